@@ -8,6 +8,8 @@ package pluginLoader
 import (
 	"errors"
 	"plugin"
+	"reflect"
+	"sync/atomic"
 
 	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	"github.com/rs/zerolog"
@@ -22,6 +24,31 @@ type ActionPlugin interface {
 	Close() error
 }
 
+// The plugin directory of the running configuration, for actions that pass
+// traps on to another action (eg aggregate)
+var currentPluginPath atomic.Value
+
+// SetPluginPath sets the plugin directory used by LoadConfiguredAction
+//
+func SetPluginPath(pluginPath string) {
+	currentPluginPath.Store(pluginPath)
+}
+
+// LoadConfiguredAction loads an action plugin from the plugin directory of
+// the running configuration, and configures it
+//
+func LoadConfiguredAction(pluginLog *zerolog.Logger, plugin_name string, actionArgs map[string]string) (ActionPlugin, error) {
+	pluginPath, _ := currentPluginPath.Load().(string)
+	action, err := LoadActionPlugin(pluginPath, plugin_name)
+	if err != nil {
+		return nil, err
+	}
+	if err = action.Configure(pluginLog, actionArgs); err != nil {
+		return nil, err
+	}
+	return action, nil
+}
+
 func LoadActionPlugin(pluginPath string, plugin_name string) (ActionPlugin, error) {
 	plugin_filename := pluginPath + "/actions/" + plugin_name + ".so"
 
@@ -36,13 +63,17 @@ func LoadActionPlugin(pluginPath string, plugin_name string) (ActionPlugin, erro
 		return nil, err
 	}
 
-	var initializer ActionPlugin
-	// Instantiate the class from the plugin
-	initializer, ok := symAction.(ActionPlugin)
+	// Instantiate the class from the plugin.  The exported symbol is shared
+	// by every filter using the plugin (and by the old and new configurations
+	// during a SIGHUP reload), so each filter gets its own zeroed copy.
+	symType := reflect.TypeOf(symAction)
+	if symType.Kind() != reflect.Ptr {
+		return nil, errors.New("Unable to load plugin " + plugin_name)
+	}
+	initializer, ok := reflect.New(symType.Elem()).Interface().(ActionPlugin)
 	if !ok {
 		return nil, errors.New("Unable to load plugin " + plugin_name)
 	}
 
 	return initializer, nil
 }
-
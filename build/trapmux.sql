@@ -19,3 +19,10 @@ PARTITION BY toYYYYMM(TrapDate)
 ORDER BY (TrapTimestamp, TrapHost, TrapAgentAddress, TrapEnterpriseOID, TrapGenericType)
 TTL TrapDate + toIntervalYear(3)
 SETTINGS index_granularity = 8192
+
+# The metadata argument of the clickhouse action also writes the device name
+# and the trap metadata after the varbinds, which need these columns:
+#
+#   ALTER TABLE snmp_traps
+#       ADD COLUMN `TrapDeviceName` LowCardinality(String),
+#       ADD COLUMN `TrapMetadata` Map(String, String)
@@ -0,0 +1,319 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// The admin HTTP server, if one is configured
+var adminServer *http.Server
+
+var startTime = time.Now()
+
+// Set from the admin API
+var paused int32
+var debugOverride int32
+
+// listenerPaused checks if incoming traps are being ignored
+//
+func listenerPaused() bool {
+	return atomic.LoadInt32(&paused) == 1
+}
+
+// debugEnabled checks if traps are logged for debugging, either from the
+// configuration or from the admin API
+//
+func debugEnabled() bool {
+	return atomic.LoadInt32(&debugOverride) == 1 || currentConfig().Logging.Level == "debug"
+}
+
+// setDebug turns debug logging on or off without a reload.  Turning it off
+// goes back to the configured log level.
+//
+func setDebug(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&debugOverride, 1)
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		atomic.StoreInt32(&debugOverride, 0)
+		zerolog.SetGlobalLevel(configuredLevel())
+	}
+}
+
+// configuredLevel is the log level from the configuration, or info if it
+// isn't set
+//
+func configuredLevel() zerolog.Level {
+	level, err := zerolog.ParseLevel(currentConfig().Logging.Level)
+	if err != nil || level == zerolog.NoLevel {
+		return zerolog.InfoLevel
+	}
+	return level
+}
+
+// addAdminToken reads the admin API token, which can be a secret
+// (filename: or env:)
+//
+func addAdminToken(newConfig *trapmuxConfig) error {
+	if newConfig.Admin.Token == "" {
+		return nil
+	}
+	token, err := pluginMeta.GetSecret(newConfig.Admin.Token)
+	if err != nil {
+		return err
+	}
+	newConfig.adminToken = token
+	return nil
+}
+
+// switchAdminServer starts or stops the admin API when its address
+// changes.  The old server is shut down in the background, as the reload
+// may have come from one of its own requests, and then closed to end any
+// tail streams.
+//
+func switchAdminServer(newConfig *trapmuxConfig) {
+	address := newConfig.Admin.ListenAddress
+	if address != "" && newConfig.adminToken == "" {
+		mainLog.Warn().Str("listen_address", address).Msg("The admin API has no token, so anyone who can connect to it can control trapmux")
+	}
+	if adminServer != nil && adminServer.Addr == address {
+		return
+	}
+	if adminServer != nil {
+		go func(server *http.Server) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		}(adminServer)
+		adminServer = nil
+	}
+	if address != "" {
+		startAdminServer(address)
+	}
+}
+
+func startAdminServer(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		mainLog.Error().Err(err).Str("listen_address", address).Msg("Unable to start the admin API")
+		return
+	}
+	adminServer = &http.Server{Addr: address, Handler: adminHandler(), ReadHeaderTimeout: 10 * time.Second}
+	mainLog.Info().Str("listen_address", address).Msg("Serving the admin API")
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			mainLog.Error().Err(err).Msg("Admin API stopped")
+		}
+	}(adminServer)
+}
+
+// adminHandler routes the admin API requests
+//
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", adminGet(adminStatus))
+	mux.HandleFunc("/counters", adminGet(adminCounters))
+	mux.HandleFunc("/filters", adminGet(adminFilters))
+	mux.HandleFunc("/plugins", adminGet(adminPlugins))
+	mux.HandleFunc("/tail", adminTail)
+	mux.HandleFunc("/alarms", adminAlarms)
+	mux.HandleFunc("/reload", adminPost(func(r *http.Request) error {
+		return reloadConfig()
+	}))
+	mux.HandleFunc("/rotate", adminPost(func(r *http.Request) error {
+		mainLog.Info().Msg("Rotating logs for the admin API")
+		rotateLogs()
+		return nil
+	}))
+	mux.HandleFunc("/pause", adminPost(func(r *http.Request) error {
+		mainLog.Info().Msg("Pausing the trap listener for the admin API")
+		atomic.StoreInt32(&paused, 1)
+		return nil
+	}))
+	mux.HandleFunc("/resume", adminPost(func(r *http.Request) error {
+		mainLog.Info().Msg("Resuming the trap listener for the admin API")
+		atomic.StoreInt32(&paused, 0)
+		return nil
+	}))
+	mux.HandleFunc("/debug", adminPost(func(r *http.Request) error {
+		enabled := true
+		if value := r.URL.Query().Get("enabled"); value != "" {
+			var err error
+			if enabled, err = strconv.ParseBool(value); err != nil {
+				return err
+			}
+		}
+		mainLog.Info().Bool("enabled", enabled).Msg("Setting debug logging for the admin API")
+		setDebug(enabled)
+		return nil
+	}))
+	return mux
+}
+
+// adminAuthorized checks the bearer token of a request.  The token is
+// looked up for each request, so that reloads are picked up.
+//
+func adminAuthorized(r *http.Request) bool {
+	token := currentConfig().adminToken
+	if token == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// adminGet wraps a handler for the state of trapmux
+//
+func adminGet(handler func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, handler())
+	}
+}
+
+// adminPost wraps a handler that changes the running state
+//
+func adminPost(handler func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := handler(r); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJSON(w, map[string]string{"status": "error", "error": err.Error()})
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
+	}
+}
+
+type adminStatusInfo struct {
+	Version       string    `json:"version"`
+	Started       time.Time `json:"started"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	ConfigSource  string    `json:"config_source"`
+	ConfigSHA256  string    `json:"config_sha256"`
+	ConfigLoaded  time.Time `json:"config_loaded"`
+	Listener      string    `json:"listen_address"`
+	Paused        bool      `json:"paused"`
+	Debug         bool      `json:"debug"`
+	TrapsReceived uint64    `json:"traps_received"`
+}
+
+func adminStatus() interface{} {
+	config := currentConfig()
+	return adminStatusInfo{
+		Version:       myVersion,
+		Started:       startTime,
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		ConfigSource:  teCmdLine.configFile,
+		ConfigSHA256:  config.configHash,
+		ConfigLoaded:  config.loadedAt,
+		Listener:      listenAddress(),
+		Paused:        listenerPaused(),
+		Debug:         debugEnabled(),
+		TrapsReceived: atomic.LoadUint64(&counterTotals[TrapCount]),
+	}
+}
+
+// adminCounters returns the counter totals since startup, by metric name
+//
+func adminCounters() interface{} {
+	totals := make(map[string]uint64)
+	for i, def := range createMetricDefs() {
+		totals[def.Name] = atomic.LoadUint64(&counterTotals[i])
+	}
+	return totals
+}
+
+// filterInfo is a filter as configured, with only the names of its plugin
+// arguments as they can hold secrets
+//
+type filterInfo struct {
+	trapmuxFilter
+	ActionArgs []string `json:"plugin_args"`
+}
+
+func makeFilterInfo(filters []trapmuxFilter) []filterInfo {
+	info := make([]filterInfo, len(filters))
+	for i, filter := range filters {
+		info[i].trapmuxFilter = filter
+		info[i].ActionArgs = make([]string, 0, len(filter.ActionArgs))
+		for name := range filter.ActionArgs {
+			info[i].ActionArgs = append(info[i].ActionArgs, name)
+		}
+		sort.Strings(info[i].ActionArgs)
+	}
+	return info
+}
+
+func adminFilters() interface{} {
+	config := currentConfig()
+	return map[string][]filterInfo{
+		"filters":              makeFilterInfo(config.Filters),
+		"plugin_error_actions": makeFilterInfo(config.PluginErrorActions),
+		"throttled_actions":    makeFilterInfo(config.ThrottledActions),
+	}
+}
+
+// adminPlugins lists the loaded action plugins, with the number of filters
+// using each of them, and the metric reporting plugins
+//
+func adminPlugins() interface{} {
+	config := currentConfig()
+	actions := make(map[string]int)
+	for _, filters := range [][]trapmuxFilter{config.Filters, config.PluginErrorActions, config.ThrottledActions} {
+		for _, filter := range filters {
+			if filter.actionType == actionPlugin {
+				actions[filter.ActionName]++
+			}
+		}
+	}
+	reporting := make([]string, 0, len(config.Reporting))
+	for _, reporter := range config.Reporting {
+		reporting = append(reporting, reporter.PluginName)
+	}
+	return map[string]interface{}{
+		"plugin_path":      config.General.PluginPath,
+		"actions":          actions,
+		"metric_reporting": reporting,
+	}
+}
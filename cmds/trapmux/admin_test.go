@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+	"github.com/rs/zerolog"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// setAdminConfig runs a test against a configuration with the given admin
+// token and log level
+//
+func setAdminConfig(t *testing.T, token string, level string) {
+	old := teConfig
+	teConfig = &trapmuxConfig{adminToken: token}
+	teConfig.Logging.Level = level
+	t.Cleanup(func() { teConfig = old })
+}
+
+func TestAdminAuthorized(t *testing.T) {
+	tests := []struct {
+		token  string
+		header string
+		want   bool
+	}{
+		{"", "", true},
+		{"", "Bearer anything", true},
+		{"s3cret", "Bearer s3cret", true},
+		{"s3cret", "", false},
+		{"s3cret", "Bearer wrong", false},
+		{"s3cret", "Bearer s3cre", false},
+		{"s3cret", "Basic s3cret", false},
+	}
+	for _, test := range tests {
+		setAdminConfig(t, test.token, "")
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := adminAuthorized(r); got != test.want {
+			t.Errorf("token %q with header %q: expected %v, got %v", test.token, test.header, test.want, got)
+		}
+	}
+}
+
+func TestAdminMethods(t *testing.T) {
+	setAdminConfig(t, "s3cret", "")
+	posted := 0
+	get := adminGet(func() interface{} { return map[string]string{"status": "up"} })
+	post := adminPost(func(r *http.Request) error {
+		posted++
+		return nil
+	})
+	failed := adminPost(func(r *http.Request) error { return errors.New("it broke") })
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		token   string
+		code    int
+		body    string
+	}{
+		{"get", get, http.MethodGet, "s3cret", http.StatusOK, `"status": "up"`},
+		{"get without token", get, http.MethodGet, "", http.StatusUnauthorized, "Unauthorized"},
+		{"get with POST", get, http.MethodPost, "s3cret", http.StatusMethodNotAllowed, "Only GET"},
+		{"post", post, http.MethodPost, "s3cret", http.StatusOK, `"status": "ok"`},
+		{"post without token", post, http.MethodPost, "wrong", http.StatusUnauthorized, "Unauthorized"},
+		{"post with GET", post, http.MethodGet, "s3cret", http.StatusMethodNotAllowed, "Only POST"},
+		{"post error", failed, http.MethodPost, "s3cret", http.StatusInternalServerError, `"error": "it broke"`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		test.handler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.code, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s: expected %q in the response, got %q", test.name, test.body, w.Body.String())
+		}
+	}
+	if posted != 1 {
+		t.Errorf("Expected the POST handler to run once, ran %d times", posted)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	setAdminConfig(t, "", "")
+	server := httptest.NewServer(adminHandler())
+	defer server.Close()
+	defer atomic.StoreInt32(&paused, 0)
+
+	for _, step := range []struct {
+		path   string
+		paused bool
+	}{
+		{"/pause", true},
+		{"/pause", true},
+		{"/resume", false},
+	} {
+		resp, err := http.Post(server.URL+step.path, "", nil)
+		if err != nil {
+			t.Fatalf("POST %s failed: %s", step.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("POST %s: expected status 200, got %d", step.path, resp.StatusCode)
+		}
+		if listenerPaused() != step.paused {
+			t.Errorf("After %s expected paused to be %v", step.path, step.paused)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/pause")
+	if err != nil {
+		t.Fatalf("GET /pause failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || listenerPaused() {
+		t.Errorf("GET /pause should be refused, got status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAlarms(t *testing.T) {
+	setAdminConfig(t, "s3cret", "")
+	server := httptest.NewServer(adminHandler())
+	defer server.Close()
+
+	get := func() (int, string) {
+		r, _ := http.NewRequest(http.MethodGet, server.URL+"/alarms", nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("GET /alarms failed: %s", err)
+		}
+		defer resp.Body.Close()
+		var body strings.Builder
+		io.Copy(&body, resp.Body)
+		return resp.StatusCode, body.String()
+	}
+
+	if code, _ := get(); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without alarm correlation, got %d", code)
+	}
+
+	correlator, err := pluginMeta.NewCorrelator(pluginMeta.CorrelationSettings{Rules: []pluginMeta.CorrelationRule{
+		{Name: "link", Raise: []string{"IF-MIB::linkDown"}, Clear: []string{"IF-MIB::linkUp"}, Key: []string{"source_ip"}},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to make correlator: %s", err)
+	}
+	teConfig.correlator = correlator
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("10.1.2.3"), SnmpVersion: g.Version2c}
+	trap.Data.Variables = []g.SnmpPDU{{Name: pluginMeta.SnmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"}}
+	correlator.Process(&trap)
+
+	if code, body := get(); code != http.StatusOK || !strings.Contains(body, `"key":"10.1.2.3"`) {
+		t.Errorf("Expected the open alarm, got status %d: %s", code, body)
+	}
+	resp, err := http.Get(server.URL + "/alarms")
+	if err != nil {
+		t.Fatalf("GET /alarms failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without the token, got %d", resp.StatusCode)
+	}
+}
+
+func TestSetDebug(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	defer atomic.StoreInt32(&debugOverride, 0)
+
+	tests := []struct {
+		configured string
+		want       zerolog.Level
+	}{
+		{"", zerolog.InfoLevel},
+		{"warn", zerolog.WarnLevel},
+		{"error", zerolog.ErrorLevel},
+		{"debug", zerolog.DebugLevel},
+		{"bogus", zerolog.InfoLevel},
+	}
+	for _, test := range tests {
+		setAdminConfig(t, "", test.configured)
+		setDebug(true)
+		if zerolog.GlobalLevel() != zerolog.DebugLevel || !debugEnabled() {
+			t.Errorf("%q: debug logging was not turned on", test.configured)
+		}
+		setDebug(false)
+		if zerolog.GlobalLevel() != test.want {
+			t.Errorf("%q: expected level %s after turning debug off, got %s", test.configured, test.want, zerolog.GlobalLevel())
+		}
+	}
+}
+
+func TestFilterInfoRedaction(t *testing.T) {
+	filters := []trapmuxFilter{
+		{ActionName: "forward", ActionArgs: map[string]string{"password": "hunter2", "destination": "10.0.0.1:162"}},
+		{ActionName: "noop"},
+	}
+	info := makeFilterInfo(filters)
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("Unable to encode filters: %s", err)
+	}
+	for _, secret := range []string{"hunter2", "10.0.0.1"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Argument value %q was shown: %s", secret, data)
+		}
+	}
+
+	var decoded []map[string]interface{}
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unable to decode filters: %s", err)
+	}
+	args, _ := json.Marshal(decoded[0]["plugin_args"])
+	if string(args) != `["destination","password"]` {
+		t.Errorf("Expected the sorted argument names, got %s", args)
+	}
+	args, _ = json.Marshal(decoded[1]["plugin_args"])
+	if string(args) != `[]` {
+		t.Errorf("Expected no argument names, got %s", args)
+	}
+	if decoded[0]["action"] != "forward" {
+		t.Errorf("Expected the action name, got %v", decoded[0]["action"])
+	}
+	if filters[0].ActionArgs["password"] != "hunter2" {
+		t.Errorf("The configured arguments were changed")
+	}
+}
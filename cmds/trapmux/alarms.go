@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// Stops the flap checks of the running correlator
+var stopFlapChecks chan struct{}
+
+// addCorrelator sets up the raise/clear correlation rules.  The running
+// correlator is kept across reloads if its settings haven't changed.
+//
+func addCorrelator(newConfig *trapmuxConfig) error {
+	settings := newConfig.Correlation
+	if len(settings.Rules) == 0 {
+		return nil
+	}
+	if teConfig != nil && teConfig.correlator != nil && reflect.DeepEqual(teConfig.Correlation, settings) {
+		newConfig.correlator = teConfig.correlator
+		return nil
+	}
+	correlator, err := pluginMeta.NewCorrelator(settings)
+	if err != nil {
+		return err
+	}
+	mainLog.Info().Int("num_rules", len(settings.Rules)).Str("state_file", settings.StateFile).Msg("Configured alarm correlation")
+	newConfig.correlator = correlator
+	return nil
+}
+
+// switchCorrelator moves the open alarms and the flap checks over to the
+// new configuration's correlator.  It is called with pipelineMutex held.
+//
+func switchCorrelator(newConfig *trapmuxConfig) {
+	var old *pluginMeta.Correlator
+	if teConfig != nil {
+		old = teConfig.correlator
+	}
+	if old == newConfig.correlator {
+		return
+	}
+	if stopFlapChecks != nil {
+		close(stopFlapChecks)
+		stopFlapChecks = nil
+	}
+	if old != nil {
+		if newConfig.correlator != nil {
+			newConfig.correlator.Adopt(old)
+		}
+		if err := old.Close(); err != nil {
+			mainLog.Warn().Err(err).Msg("Unable to save alarm state")
+		}
+	}
+	if newConfig.correlator != nil {
+		newConfig.correlator.SaveEvery(func(err error) {
+			mainLog.Warn().Err(err).Msg("Unable to save alarm state")
+		})
+		stopFlapChecks = make(chan struct{})
+		go checkFlapping(newConfig.correlator, stopFlapChecks)
+	}
+}
+
+// adminAlarms lists the open alarms.  The correlator is looked up for each
+// request, so that reloads are picked up.
+//
+func adminAlarms(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	correlator := currentConfig().correlator
+	if correlator == nil {
+		http.Error(w, "Alarm correlation is not configured", http.StatusNotFound)
+		return
+	}
+	correlator.ServeHTTP(w, r)
+}
+
+// checkFlapping sends the flap_stop events of alarms that have stopped
+// flapping through the filters, and on to the tail clients, until the
+// correlator is replaced by a reload
+//
+func checkFlapping(correlator *pluginMeta.Correlator, done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		pipelineMutex.Lock()
+		// The correlator may have been replaced while waiting for the lock
+		select {
+		case <-done:
+			pipelineMutex.Unlock()
+			return
+		default:
+		}
+		events := correlator.CheckFlapping()
+		for i := range events {
+			processTrap(&events[i])
+			publishTrap(&events[i])
+		}
+		pipelineMutex.Unlock()
+	}
+}
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,8 +14,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	pluginLoader "github.com/keruzu/trapmux/api"
 	pluginMeta "github.com/keruzu/trapmux/txPlugins"
@@ -40,6 +45,7 @@ type trapmuxCommandLine struct {
 	bindAddr     string
 	listenPort   string
 	debugMode    bool
+	mibIndex     string
 }
 
 // Global vars
@@ -48,16 +54,32 @@ var teConfig *trapmuxConfig
 var teCmdLine trapmuxCommandLine
 var ipRe = regexp.MustCompile(`^(?:\d{1,3}\.){3}\d{1,3}$`)
 
+// teConfig is replaced with both pipelineMutex and configMutex held, so the
+// pipeline and reloads can use it directly.  Everything else (the admin
+// API, the listener) goes through currentConfig.
+var configMutex sync.RWMutex
+
+// currentConfig returns the running configuration
+//
+func currentConfig() *trapmuxConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return teConfig
+}
+
 func showUsage() {
 	usageText := `
 Usage: trapmux [-h] [-c <config_file>] [-b <bind_ip>] [-p <listen_port>]
-              [-d] [-v]
+              [-d] [-v] [-m <index_file>]
+       trapmux tail [-h] [-c <config_file>] [-a <admin_address>] [-t <token>] [-j] [<filter>...]
   -h  - Show this help message and exit.
   -c  - Override the location of the trapmux configuration file.
   -b  - Override the bind IP address on which to listen for incoming traps.
   -p  - Override the UDP port on which to listen for incoming traps.
   -d  - Enable debug mode (note: produces very verbose runtime output).
   -v  - Print the version of trapmux and exit.
+  -m  - Compile the configured MIB directories into an index file and exit.
+  tail - Print the traps going through a running trapmux (see trapmux tail -h).
 `
 	fmt.Println(usageText)
 }
@@ -69,6 +91,7 @@ func processCommandLine() {
 	p := flag.String("p", "", "")
 	f := flag.String("f", "", "")
 	d := flag.Bool("d", false, "")
+	m := flag.String("m", "", "")
 	showVersion := flag.Bool("v", false, "")
 
 	flag.Parse()
@@ -88,6 +111,7 @@ func processCommandLine() {
 	teCmdLine.bindAddr = *b
 	teCmdLine.listenPort = *p
 	teCmdLine.debugMode = *d
+	teCmdLine.mibIndex = *m
 }
 
 // loadConfig
@@ -130,6 +154,8 @@ func loadConfig(config_file string, newConfig *trapmuxConfig) error {
 	if err != nil {
 		return err
 	}
+	newConfig.configHash = fmt.Sprintf("%x", sha256.Sum256(configData))
+	newConfig.loadedAt = time.Now()
 
 	return nil
 }
@@ -191,9 +217,43 @@ func getConfig() error {
 	if err = validateSnmpV3Args(&newConfig.TrapReceiverSettings); err != nil {
 		return err
 	}
+	if err = loadMibs(&newConfig); err != nil {
+		return err
+	}
+	// Filters and plugins look up MIB names as they are configured, so
+	// switch back to the running MIBs if the new configuration fails
+	pluginMeta.SetMibDatabase(newConfig.mibs)
+	defer func() {
+		if err != nil && teConfig != nil {
+			pluginMeta.SetMibDatabase(teConfig.mibs)
+		}
+	}()
+	if err = addResolver(&newConfig); err != nil {
+		return err
+	}
+	if err = addCorrelator(&newConfig); err != nil {
+		return err
+	}
 	if err = addIpSets(&newConfig); err != nil {
 		return err
 	}
+	if err = addAdminToken(&newConfig); err != nil {
+		return err
+	}
+	if err = addRateLimits(&newConfig); err != nil {
+		return err
+	}
+	// Close the new plugins and go back to the running plugin directory
+	// if anything fails from here on
+	pluginLoader.SetPluginPath(newConfig.General.PluginPath)
+	defer func() {
+		if err != nil {
+			closeHandles(&newConfig)
+			if teConfig != nil {
+				pluginLoader.SetPluginPath(teConfig.General.PluginPath)
+			}
+		}
+	}()
 	if err = addFilters(&newConfig); err != nil {
 		return err
 	}
@@ -202,22 +262,97 @@ func getConfig() error {
 	if err = addPluginErrorActions(&newConfig); err != nil {
 		return err
 	}
+	if err = addThrottledActions(&newConfig); err != nil {
+		return err
+	}
 
 	if err = addReportingPlugins(&newConfig); err != nil {
 		return err
 	}
 
+	// Traps in the pipeline are still using the old filters, so wait for
+	// them before closing the old handles
+	pipelineMutex.Lock()
+	defer pipelineMutex.Unlock()
 	// If this is a reconfigure, close the old handles here
 	if teConfig != nil && teConfig.teConfigured {
-		closeHandles()
+		closeHandles(teConfig)
 	}
+	switchCorrelator(&newConfig)
+	switchAdminServer(&newConfig)
 	// Set our global config pointer to this configuration
 	newConfig.teConfigured = true
+	configMutex.Lock()
 	teConfig = &newConfig
+	configMutex.Unlock()
+
+	return nil
+}
+
+// loadMibs reads the precompiled MIB index and then the MIB directories,
+// so that local MIBs can add to (or override) the index.
+//
+func loadMibs(newConfig *trapmuxConfig) error {
+	settings := newConfig.Mibs
+	if settings.IndexFile == "" && len(settings.Directories) == 0 {
+		return nil
+	}
+
+	db := pluginMeta.NewMibDatabase()
+	if settings.IndexFile != "" {
+		var err error
+		if db, err = pluginMeta.LoadMibIndex(settings.IndexFile); err != nil {
+			return err
+		}
+	}
+	if err := pluginMeta.LoadMibs(db, settings.Directories, &mainLog); err != nil {
+		return err
+	}
+	mainLog.Info().Int("mib_nodes", db.Len()).Msg("Loaded MIBs")
+	newConfig.mibs = db
+	return nil
+}
 
+// addResolver sets up the device name lookups.  The running resolver is
+// kept across reloads if its settings haven't changed, so that its cache
+// isn't lost.
+//
+func addResolver(newConfig *trapmuxConfig) error {
+	settings := newConfig.Resolver
+	if !settings.Enabled() {
+		return nil
+	}
+	if teConfig != nil && teConfig.resolver != nil && reflect.DeepEqual(teConfig.Resolver, settings) {
+		newConfig.resolver = teConfig.resolver
+		return nil
+	}
+	resolver, err := pluginMeta.NewDeviceResolver(settings)
+	if err != nil {
+		return err
+	}
+	mainLog.Info().Bool("reverse_dns", settings.ReverseDNS).Bool("sysname", settings.SysName).Str("address", settings.Address).Msg("Resolving device names")
+	newConfig.resolver = resolver
 	return nil
 }
 
+// compileMibIndex writes the MIBs from the configuration file to an index
+// file, which can then be used as the index_file of the mibs configuration.
+//
+func compileMibIndex(indexFile string) error {
+	var newConfig trapmuxConfig
+	if err := loadConfig(teCmdLine.configFile, &newConfig); err != nil {
+		return err
+	}
+	if len(newConfig.Mibs.Directories) == 0 {
+		return fmt.Errorf("No MIB directories in the configuration file %s", teCmdLine.configFile)
+	}
+	newConfig.Mibs.IndexFile = ""
+	if err := loadMibs(&newConfig); err != nil {
+		return err
+	}
+	return newConfig.mibs.SaveIndex(indexFile)
+}
+
 func validateIgnoreVersions(newConfig *trapmuxConfig) error {
 	var ignorev1, ignorev2c, ignorev3 bool = false, false, false
 	for _, candidate := range newConfig.TrapReceiverSettings.IgnoreVersions_str {
@@ -326,7 +461,7 @@ func addIpSets(newConfig *trapmuxConfig) error {
 func addFilters(newConfig *trapmuxConfig) error {
 	var err error
 	for i, _ := range newConfig.Filters {
-		if err = addFilterObjs(&newConfig.Filters[i], newConfig.IpSets, i); err != nil {
+		if err = addFilterObjs(&newConfig.Filters[i], newConfig.IpSets, newConfig.mibs, i); err != nil {
 			return err
 		}
 		if err = setAction(&newConfig.Filters[i], newConfig.General.PluginPath, i); err != nil {
@@ -340,7 +475,7 @@ func addFilters(newConfig *trapmuxConfig) error {
 func addPluginErrorActions(newConfig *trapmuxConfig) error {
 	var err error
 	for i, _ := range newConfig.PluginErrorActions {
-		if err = addFilterObjs(&newConfig.PluginErrorActions[i], newConfig.IpSets, i); err != nil {
+		if err = addFilterObjs(&newConfig.PluginErrorActions[i], newConfig.IpSets, newConfig.mibs, i); err != nil {
 			return err
 		}
 		if err = setAction(&newConfig.PluginErrorActions[i], newConfig.General.PluginPath, i); err != nil {
@@ -354,7 +489,7 @@ func addPluginErrorActions(newConfig *trapmuxConfig) error {
 // addFilterObjs parses a "filter" line and sets
 // the appropriate values in a corresponding trapmuxFilter struct.
 //
-func addFilterObjs(filter *trapmuxFilter, ipSets map[string]IpSet, lineNumber int) error {
+func addFilterObjs(filter *trapmuxFilter, ipSets map[string]IpSet, mibs *pluginMeta.MibDatabase, lineNumber int) error {
 	var err error
 
 	// If we find something that is specifies a condition, then reset
@@ -380,6 +515,22 @@ func addFilterObjs(filter *trapmuxFilter, ipSets map[string]IpSet, lineNumber in
 	if err = addOidFilterObj(filter, filter.EnterpriseOid, lineNumber); err != nil {
 		return err
 	}
+	if err = addTrapOidFilterObj(filter, filter.TrapOid, mibs, lineNumber); err != nil {
+		return err
+	}
+
+	if err = addStringFilterObj(filter, filterByCommunity, filter.Community, lineNumber); err != nil {
+		return err
+	}
+	if err = addStringFilterObj(filter, filterBySecurityName, filter.SecurityName, lineNumber); err != nil {
+		return err
+	}
+	if err = addStringFilterObj(filter, filterByDeviceName, filter.DeviceName, lineNumber); err != nil {
+		return err
+	}
+	if err = addMetadataFilterObjs(filter, lineNumber); err != nil {
+		return err
+	}
 	return err
 }
 
@@ -498,12 +649,103 @@ func addOidFilterObj(filter *trapmuxFilter, oid string, lineNumber int) error {
 	return nil
 }
 
-func closeHandles() {
-	for _, f := range teConfig.Filters {
-		if f.actionType == actionPlugin {
-			err := f.plugin.Close()
-			if err != nil {
-				mainLog.Warn().Err(err).Str("plugin_name", f.ActionName).Msg("Unable to perform close operation")
+// addTrapOidFilterObj adds a filter on the trap (notification) OID, given as
+// a numeric OID or a MIB name such as IF-MIB::linkDown
+// If starts with a "/", it's a regex matched against both the numeric OID
+// and the MIB name
+func addTrapOidFilterObj(filter *trapmuxFilter, entry string, mibs *pluginMeta.MibDatabase, lineNumber int) error {
+	var err error
+
+	if entry == "" {
+		return nil
+	}
+	filter.matchAll = false
+
+	fObj := filterObj{filterItem: filterByTrapOid}
+	if strings.HasPrefix(entry, "/") {
+		fObj.filterType = parseTypeRegex
+		fObj.filterValue, err = regexp.Compile(entry[1:])
+		if err != nil {
+			return fmt.Errorf("unable to compile regular expression at line %v for trap OID: %s: %s", lineNumber, entry, err)
+		}
+	} else {
+		oid, ok := mibs.Lookup(entry)
+		if !ok {
+			return fmt.Errorf("unknown trap OID or MIB name at line %v: %s", lineNumber, entry)
+		}
+		fObj.filterType = parseTypeString
+		fObj.filterValue = oid
+	}
+	filter.matchers = append(filter.matchers, fObj)
+	return nil
+}
+
+// addStringFilterObj adds a filter for a plain string value
+// If starts with a "/", it's a regex
+func addStringFilterObj(filter *trapmuxFilter, source int, entry string, lineNumber int) error {
+	if entry == "" {
+		return nil
+	}
+	fObj, err := makeStringFilterObj(source, entry, lineNumber)
+	if err != nil {
+		return err
+	}
+	filter.matchAll = false
+	filter.matchers = append(filter.matchers, fObj)
+	return nil
+}
+
+func makeStringFilterObj(source int, entry string, lineNumber int) (filterObj, error) {
+	var err error
+
+	fObj := filterObj{filterItem: source}
+	if strings.HasPrefix(entry, "/") {
+		fObj.filterType = parseTypeRegex
+		fObj.filterValue, err = regexp.Compile(entry[1:])
+		if err != nil {
+			return fObj, fmt.Errorf("unable to compile regular expression for %v on line %v: %s: %s", source, lineNumber, entry, err)
+		}
+	} else {
+		fObj.filterType = parseTypeString
+		fObj.filterValue = entry
+	}
+	return fObj, nil
+}
+
+// addMetadataFilterObjs matches trap metadata added by earlier actions.
+// Each value is a string or a regex (if it starts with a "/"), and a
+// missing key has an empty value.
+//
+func addMetadataFilterObjs(filter *trapmuxFilter, lineNumber int) error {
+	keys := make([]string, 0, len(filter.Metadata))
+	for key := range filter.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		match, err := makeStringFilterObj(filterByMetadata, filter.Metadata[key], lineNumber)
+		if err != nil {
+			return err
+		}
+		filter.matchAll = false
+		filter.matchers = append(filter.matchers, filterObj{filterItem: filterByMetadata,
+			filterValue: metadataFilter{key: key, match: match}})
+	}
+	return nil
+}
+
+// closeHandles closes the action plugins of a configuration's filters
+//
+func closeHandles(config *trapmuxConfig) {
+	for _, filters := range [][]trapmuxFilter{config.Filters, config.PluginErrorActions, config.ThrottledActions} {
+		for _, f := range filters {
+			// Filters after a failed one haven't had their plugin loaded
+			if f.actionType == actionPlugin && f.plugin != nil {
+				err := f.plugin.Close()
+				if err != nil {
+					mainLog.Warn().Err(err).Str("plugin_name", f.ActionName).Msg("Unable to perform close operation")
+				}
 			}
 		}
 	}
@@ -6,8 +6,11 @@
 package main
 
 import (
+	"time"
+
 	g "github.com/gosnmp/gosnmp"
 	pluginLoader "github.com/keruzu/trapmux/api"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 )
 
 type trapListenerConfig struct {
@@ -38,9 +41,21 @@ type trapListenerConfig struct {
 
 type IpSet map[string]bool
 
+// rateLimitConfig holds the token bucket limits on the traps handed over by
+// the listener, before any other processing.  The ip_sets limits are shared
+// by all the members of the set.  Traps over a limit are dropped, or with
+// the "chain" action go through the throttled_actions filters instead.
+//
+type rateLimitConfig struct {
+	Global    pluginMeta.RateLimit            `json:"global"`
+	PerSource pluginMeta.RateLimit            `json:"per_source"`
+	IpSets    map[string]pluginMeta.RateLimit `default:"{}" json:"ip_sets"`
+	Action    string                          `default:"drop" json:"action"`
+}
+
 // filterObj represents one of the filterable items in a filter line from
 // the config file (i.e. Src IP, AgentAddress, GenericType, SpecificType,
-// and Enterprise OID).
+// Enterprise OID, trap OID, community and v3 security name).
 //
 type filterObj struct {
 	filterItem  int
@@ -48,6 +63,14 @@ type filterObj struct {
 	filterValue interface{} // string, *regex.Regexp, *network, int
 }
 
+// metadataFilter matches one trap metadata value (eg added by the enrich
+// action) against a string or regex filter object
+//
+type metadataFilter struct {
+	key   string
+	match filterObj
+}
+
 // Get in a set of action arg pairs, convert to a map to pass into plugins
 
 // trapmuxFilter holds the filter data and action for a specfic
@@ -64,16 +87,28 @@ type trapmuxFilter struct {
 	SpecificType int `default:"-1" json:"snmp_specific_type"`
 
 	EnterpriseOid string            `default:"" json:"enterprise_oid"`
+	TrapOid       string            `default:"" json:"trap_oid"`
+	Community     string            `default:"" json:"community"`
+	SecurityName  string            `default:"" json:"security_name"`
+	DeviceName    string            `default:"" json:"device_name"`
+	Metadata      map[string]string `default:"{}" json:"metadata"`
 	ActionName    string            `default:"" json:"action"`
 	ActionArg     string            `default:"" json:"action_arg"`
 	BreakAfter    bool              `default:"false" json:"break_after"`
 	ActionArgs    map[string]string `default:"{}" json:"plugin_args"`
 
+	// Token bucket limit on the traps handled by the action, per source
+	// IP if PerSource is set.  Traps over the limit are handled as set by
+	// the rate_limits action.
+	RateLimit pluginMeta.RateLimit `json:"rate_limit"`
+	PerSource bool                 `default:"false" json:"rate_limit_per_source"`
+
 	// Compiled definition of above
 	matchAll   bool
 	matchers   []filterObj
 	actionType int
 	plugin     pluginLoader.ActionPlugin
+	limiter    *pluginMeta.RateLimiter
 }
 
 type MetricConfig struct {
@@ -101,6 +136,36 @@ type trapmuxConfig struct {
 
 	TrapReceiverSettings trapListenerConfig `json:"listener"`
 
+	// MIBs used to translate OIDs to names
+	Mibs struct {
+		Directories []string `default:"[]" json:"directories"`
+		IndexFile   string   `default:"" json:"index_file"`
+	} `json:"mibs"`
+	mibs *pluginMeta.MibDatabase
+
+	// Device name lookups for the sender of each trap
+	Resolver pluginMeta.ResolverSettings `json:"resolver"`
+	resolver *pluginMeta.DeviceResolver
+
+	// Raise/clear correlation of traps into open alarms
+	Correlation pluginMeta.CorrelationSettings `json:"correlation"`
+	correlator  *pluginMeta.Correlator
+
+	// Admin HTTP API for status and runtime control
+	Admin struct {
+		ListenAddress string `default:"" json:"listen_address"`
+		Token         string `default:"" json:"token"`
+	} `json:"admin"`
+	adminToken string
+
+	// Where and when the configuration was loaded from
+	configHash string
+	loadedAt   time.Time
+
+	// Token bucket limits on incoming traps
+	RateLimits rateLimitConfig `json:"rate_limits"`
+	limiters   *rateLimiters
+
 	IpSets_str []map[string][]string `default:"{}" json:"ip_sets"`
 	IpSets     map[string]IpSet      `default:"{}"`
 
@@ -108,4 +173,7 @@ type trapmuxConfig struct {
 
 	// Bad things happen to good plugins. How do you want to handle exceptions?
 	PluginErrorActions []trapmuxFilter `default:"[]" json:"plugin_error_actions"`
+
+	// Where traps over a rate limit go with the "chain" rate limit action
+	ThrottledActions []trapmuxFilter `default:"[]" json:"throttled_actions"`
 }
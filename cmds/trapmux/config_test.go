@@ -9,6 +9,8 @@ import (
 	"testing"
 
 	"github.com/rs/zerolog"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 )
 
 func init() {
@@ -163,3 +165,34 @@ func TestFiltersMissingIpSet(t *testing.T) {
     }
 }
 */
+
+// closeCounter is an action that counts the times it is closed
+//
+type closeCounter struct {
+	closed int
+}
+
+func (a *closeCounter) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	return nil
+}
+func (a *closeCounter) ProcessTrap(trap *pluginMeta.Trap) error { return nil }
+func (a *closeCounter) SigUsr1() error                          { return nil }
+func (a *closeCounter) SigUsr2() error                          { return nil }
+func (a *closeCounter) Close() error {
+	a.closed++
+	return nil
+}
+
+func TestCloseHandles(t *testing.T) {
+	action := &closeCounter{}
+	loaded := trapmuxFilter{actionType: actionPlugin, plugin: action}
+	config := trapmuxConfig{
+		Filters:            []trapmuxFilter{loaded, {actionType: actionPlugin}, {actionType: actionBreak}},
+		PluginErrorActions: []trapmuxFilter{loaded},
+		ThrottledActions:   []trapmuxFilter{loaded},
+	}
+	closeHandles(&config)
+	if action.closed != 3 {
+		t.Errorf("Expected the filters, plugin error and throttled actions to be closed, closed %d", action.closed)
+	}
+}
@@ -33,6 +33,11 @@ const (
 	filterByGenericType
 	filterBySpecificType
 	filterByOid
+	filterByCommunity
+	filterBySecurityName
+	filterByTrapOid
+	filterByMetadata
+	filterByDeviceName
 )
 
 // Supported action types
@@ -90,6 +95,33 @@ func (f *trapmuxFilter) isFilterMatch(sgt *pluginMeta.Trap) bool {
 			} else if fo.filterType == parseTypeString && fval.(string) != strings.TrimLeft(trap.Enterprise, ".") {
 				return false
 			}
+		case filterByTrapOid:
+			oid := sgt.TrapOID()
+			if fo.filterType == parseTypeRegex {
+				re := fval.(*regexp.Regexp)
+				if !re.MatchString(oid) && !re.MatchString(sgt.TrapName()) {
+					return false
+				}
+			} else if fval.(string) != oid {
+				return false
+			}
+		case filterByCommunity:
+			if !isStringMatch(fo, sgt.Community) {
+				return false
+			}
+		case filterBySecurityName:
+			if !isStringMatch(fo, sgt.SecurityName) {
+				return false
+			}
+		case filterByDeviceName:
+			if !isStringMatch(fo, sgt.DeviceName) {
+				return false
+			}
+		case filterByMetadata:
+			mf := fval.(metadataFilter)
+			if !isStringMatch(mf.match, sgt.Metadata[mf.key]) {
+				return false
+			}
 		case filterByGenericType:
 			if fo.filterType == parseTypeInt && fval.(int) != trap.GenericTrap {
 				return false
@@ -103,6 +135,18 @@ func (f *trapmuxFilter) isFilterMatch(sgt *pluginMeta.Trap) bool {
 	return true
 }
 
+// isStringMatch compares a trap field against a string or regex filter object
+//
+func isStringMatch(fo filterObj, value string) bool {
+	switch fo.filterType {
+	case parseTypeString:
+		return fo.filterValue.(string) == value
+	case parseTypeRegex:
+		return fo.filterValue.(*regexp.Regexp).MatchString(value)
+	}
+	return true
+}
+
 // processAction handles the execution of the action for the
 // trapmuxFilter instance on the the given trap data.
 //
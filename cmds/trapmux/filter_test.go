@@ -7,7 +7,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"testing"
+
+	pluginLoader "github.com/keruzu/trapmux/api"
 )
 
 func TestPluginInterfacess(t *testing.T) {
@@ -15,11 +18,14 @@ func TestPluginInterfacess(t *testing.T) {
 	plugins := []string{"noop", "logfile", "forward", "clickhouse"}
 
 	for _, plugin_name := range plugins {
+		if _, err = os.Stat("../../txPlugins/actions/" + plugin_name + ".so"); err != nil {
+			t.Skipf("Plugin %s has not been built", plugin_name)
+		}
 		fmt.Printf("Verifying plugin interface: %s\n", plugin_name)
-		_, err = loadActionPlugin("txPlugins/actions/plugins/%s.so", plugin_name)
+		_, err = pluginLoader.LoadActionPlugin("../../txPlugins", plugin_name)
 
 		if err != nil {
-			t.Errorf("Unable to load plugin %s", plugin_name)
+			t.Errorf("Unable to load plugin %s: %s", plugin_name, err)
 		}
 	}
 	/*
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// usmStatsUnknownEngineIDs is reported to v3 senders using the wrong engine ID
+const usmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+
+// Largest possible UDP payload
+const maxPacketSize = 65535
+
+// rawTrapHandlerFunc receives each decoded trap along with the packet bytes
+type rawTrapHandlerFunc func(p *g.SnmpPacket, addr *net.UDPAddr, raw []byte)
+
+// trapReceiver does the same job as gosnmp's TrapListener, but keeps a copy
+// of the received packet so that it can be re-emitted unchanged.
+//
+type trapReceiver struct {
+	params    *g.GoSNMP
+	conn      *net.UDPConn
+	onNewTrap rawTrapHandlerFunc
+
+	unknownEngineIDs uint32
+}
+
+func newTrapReceiver(params *g.GoSNMP, handler rawTrapHandlerFunc) *trapReceiver {
+	return &trapReceiver{params: params, onNewTrap: handler}
+}
+
+// listen reads traps from the UDP address until the socket is closed
+//
+func (r *trapReceiver) listen(listenAddr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	if r.conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		rlen, remote, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			mainLog.Warn().Err(err).Msg("Error reading from trap listener socket")
+			continue
+		}
+		// v3 traps are decrypted in place, so keep the packet first
+		raw := make([]byte, rlen)
+		copy(raw, buf[:rlen])
+		r.handlePacket(buf[:rlen], raw, remote)
+	}
+}
+
+func (r *trapReceiver) handlePacket(packet []byte, raw []byte, remote *net.UDPAddr) {
+	trap, err := r.params.UnmarshalTrap(packet, false)
+	if err != nil {
+		mainLog.Debug().Err(err).Str("source", remote.String()).Msg("Unable to decode trap")
+		return
+	}
+
+	// RFC 3414 3.2.3b: report our engine ID rather than processing the trap
+	if trap.Version == g.Version3 && trap.SecurityModel == g.UserSecurityModel && r.params.SecurityModel == g.UserSecurityModel {
+		ours, ok1 := r.params.SecurityParameters.(*g.UsmSecurityParameters)
+		theirs, ok2 := trap.SecurityParameters.(*g.UsmSecurityParameters)
+		if ok1 && ok2 && theirs.AuthoritativeEngineID != ours.AuthoritativeEngineID {
+			if len(theirs.AuthoritativeEngineID) < 5 || len(theirs.AuthoritativeEngineID) > 32 {
+				atomic.AddUint32(&r.unknownEngineIDs, 1)
+				if err := r.reportEngineID(trap, ours.AuthoritativeEngineID, remote); err != nil {
+					mainLog.Warn().Err(err).Str("source", remote.String()).Msg("Unable to report engine ID")
+				}
+				return
+			}
+		}
+	}
+
+	r.onNewTrap(trap, remote, raw)
+
+	// Informs are acknowledged with the same variables
+	if trap.PDUType == g.InformRequest {
+		trap.PDUType = g.GetResponse
+		trap.Error = g.NoError
+		trap.ErrorIndex = 0
+		if err := r.send(trap, remote); err != nil {
+			mainLog.Warn().Err(err).Str("source", remote.String()).Msg("Unable to acknowledge inform")
+		}
+	}
+}
+
+func (r *trapReceiver) reportEngineID(trap *g.SnmpPacket, engineID string, remote *net.UDPAddr) error {
+	securityParams, ok := trap.SecurityParameters.Copy().(*g.UsmSecurityParameters)
+	if !ok {
+		return fmt.Errorf("unable to copy USM security parameters")
+	}
+	securityParams.AuthoritativeEngineID = engineID
+	trap.PDUType = g.Report
+	trap.MsgFlags &= g.AuthPriv
+	trap.SecurityParameters = securityParams
+	trap.Variables = []g.SnmpPDU{
+		{Name: usmStatsUnknownEngineIDs, Type: g.Integer, Value: int(atomic.LoadUint32(&r.unknownEngineIDs))},
+	}
+	return r.send(trap, remote)
+}
+
+func (r *trapReceiver) send(packet *g.SnmpPacket, remote *net.UDPAddr) error {
+	out, err := packet.MarshalMsg()
+	if err != nil {
+		return fmt.Errorf("error marshaling SnmpPacket: %w", err)
+	}
+	_, err = r.conn.WriteToUDP(out, remote)
+	return err
+}
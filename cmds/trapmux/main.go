@@ -12,6 +12,9 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	g "github.com/gosnmp/gosnmp"
 
@@ -31,9 +34,21 @@ func main() {
 		flag.PrintDefaults()
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		os.Exit(runTail(os.Args[2:]))
+	}
+
 	// Process the command-line and get the configuration.
 	processCommandLine()
 
+	if teCmdLine.mibIndex != "" {
+		if err := compileMibIndex(teCmdLine.mibIndex); err != nil {
+			mainLog.Fatal().Err(err).Msg("Unable to compile MIB index")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if err := getConfig(); err != nil {
 		mainLog.Fatal().Err(err).Msg("Unable to load configuration")
 		os.Exit(1)
@@ -49,33 +64,28 @@ func main() {
 // is configured correctly, SNMP v3 traps.
 //
 func startTrapListener() {
-	trapListener := g.NewTrapListener()
-
-	// Callback: trapHandler
-	trapListener.OnNewTrap = trapHandler
+	params := g.Default
+	params.Community = teConfig.TrapReceiverSettings.Community
 
 	if teConfig.TrapReceiverSettings.GoSnmpDebug {
 		mainLog.Info().Msg("gosnmp debug mode enabled")
 		if teConfig.TrapReceiverSettings.GoSnmpDebugLogName == "" {
-			trapListener.Params.Logger = g.NewLogger(log.New(os.Stdout, "", 0))
+			params.Logger = g.NewLogger(log.New(os.Stdout, "", 0))
 		} else {
 			fd, err := os.Open(teConfig.TrapReceiverSettings.GoSnmpDebugLogName)
 			if err != nil {
 				mainLog.Fatal().Err(err).Str("filename", teConfig.TrapReceiverSettings.GoSnmpDebugLogName).Msg("Unable to open up debug log")
 				os.Exit(1)
 			}
-			trapListener.Params.Logger = g.NewLogger(log.New(fd, "", 0))
+			params.Logger = g.NewLogger(log.New(fd, "", 0))
 		}
 	}
 
-	trapListener.Params = g.Default
-	trapListener.Params.Community = teConfig.TrapReceiverSettings.Community
-
 	// SNMP v3 stuff
-	trapListener.Params.SecurityModel = g.UserSecurityModel
-	trapListener.Params.MsgFlags = teConfig.TrapReceiverSettings.MsgFlags
-	trapListener.Params.Version = g.Version3
-	trapListener.Params.SecurityParameters = &g.UsmSecurityParameters{
+	params.SecurityModel = g.UserSecurityModel
+	params.MsgFlags = teConfig.TrapReceiverSettings.MsgFlags
+	params.Version = g.Version3
+	params.SecurityParameters = &g.UsmSecurityParameters{
 		UserName:                 teConfig.TrapReceiverSettings.Username,
 		AuthenticationProtocol:   teConfig.TrapReceiverSettings.AuthProto,
 		AuthenticationPassphrase: teConfig.TrapReceiverSettings.AuthPassword,
@@ -83,18 +93,29 @@ func startTrapListener() {
 		PrivacyPassphrase:        teConfig.TrapReceiverSettings.PrivacyPassword,
 	}
 
-	listenAddr := fmt.Sprintf("%s:%s", teConfig.TrapReceiverSettings.ListenAddr, teConfig.TrapReceiverSettings.ListenPort)
+	// Callback: trapHandler
+	receiver := newTrapReceiver(params, trapHandler)
+
+	listenAddr := listenAddress()
 	mainLog.Info().Str("listen_address", listenAddr).Msg("Start trapmux listener")
-	err := trapListener.Listen(listenAddr)
+	err := receiver.listen(listenAddr)
 	if err != nil {
 		log.Panicf("error in listen on %s: %s", listenAddr, err)
 	}
 }
 
+// listenAddress is the address:port of the trap listener
+//
+func listenAddress() string {
+	settings := currentConfig().TrapReceiverSettings
+	return fmt.Sprintf("%s:%s", settings.ListenAddr, settings.ListenPort)
+}
+
 // counterInc increment the specified counter (reference to counter defintions)
 //
 func counterInc(counter int) {
-	for _, reporter := range teConfig.Reporting {
+	atomic.AddUint64(&counterTotals[counter], 1)
+	for _, reporter := range currentConfig().Reporting {
 		reporter.plugin.(pluginLoader.MetricPlugin).Inc(counter)
 	}
 }
@@ -102,9 +123,17 @@ func counterInc(counter int) {
 // Keep track of total number of traps received
 var totalTraps int
 
+// Counter totals since startup, for the admin API
+var counterTotals [numCounters]uint64
+
+// Traps go through the filters one at a time, including the events made by
+// the correlator in the background
+var pipelineMutex sync.Mutex
+
 // trapHandler is the callback for handling traps received by the listener.
+// raw is the packet as received, which is kept with the trap.
 //
-func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
+func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr, raw []byte) {
 	// Count every trap received
 	counterInc(TrapCount)
 	totalTraps++
@@ -118,14 +147,16 @@ func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
 		counterInc(V3Traps)
 	}
 
-	// First thing to do is check for ignored versions
-	if isIgnoredVersion(p.Version) {
+	// First thing to do is check for ignored versions, or a listener
+	// paused from the admin API
+	if isIgnoredVersion(p.Version) || listenerPaused() {
 		counterInc(IgnoredTraps)
 		return
 	}
 
 	// Also keep track of traps we handle
 	counterInc(HandledTraps)
+	config := currentConfig()
 
 	// Make the trap
 	trap := pluginMeta.Trap{
@@ -138,25 +169,72 @@ func trapHandler(p *g.SnmpPacket, addr *net.UDPAddr) {
 			Timestamp:    p.Timestamp,
 		},
 		SrcIP:       addr.IP,
+		SrcPort:     addr.Port,
 		SnmpVersion: p.Version,
-		Hostname:    teConfig.TrapReceiverSettings.Hostname,
+		Raw:         raw,
+		ReceivedAt:  time.Now(),
+		Listener:    listenAddress(),
+		Community:   p.Community,
+		Hostname:    config.TrapReceiverSettings.Hostname,
 		TrapNumber:  uint(totalTraps),
 	}
 
-	if teConfig.Logging.Level == "debug" {
+	if usm, ok := p.SecurityParameters.(*g.UsmSecurityParameters); ok && p.Version == g.Version3 {
+		trap.SecurityName = usm.UserName
+	}
+
+	// Keep a flood from one device out of the pipeline
+	if limit := throttledBy(&trap); limit != "" {
+		pipelineMutex.Lock()
+		throttleTrap(&trap, limit, true)
+		pipelineMutex.Unlock()
+		return
+	}
+
+	if config.resolver != nil {
+		config.resolver.Resolve(&trap)
+	}
+
+	pipelineMutex.Lock()
+	defer pipelineMutex.Unlock()
+	var events []pluginMeta.Trap
+	if teConfig.correlator != nil {
+		events = teConfig.correlator.Process(&trap)
+	}
+
+	if debugEnabled() {
 		var info string
 		info = makeTrapLogEntry(&trap)
 		mainLog.Debug().Str("trap", info).Msg("Raw trap info")
 	}
 
-	processTrap(&trap)
+	if trap.Dropped {
+		counterInc(SuppressedTraps)
+	} else {
+		processTrap(&trap)
+	}
+	// Tail clients see the trap as the actions left it, eg with the
+	// metadata added by enrich
+	publishTrap(&trap)
+	for i := range events {
+		processTrap(&events[i])
+		publishTrap(&events[i])
+	}
 }
 
 // processTrap is the entry point to code that checks the incoming trap
 // against the filter list and processes the trap accordingly.
 //
 func processTrap(trap *pluginMeta.Trap) {
-	for _, filterDef := range teConfig.Filters {
+	processFilters(trap, teConfig.Filters, true)
+}
+
+// processFilters runs the trap through a list of filters.  Traps over the
+// rate limit of a filter go to the throttled_actions filters if chain is
+// set, otherwise they are dropped.
+//
+func processFilters(trap *pluginMeta.Trap, filters []trapmuxFilter, chain bool) {
+	for i, filterDef := range filters {
 		if trap.Dropped {
 			continue
 		}
@@ -167,8 +245,17 @@ func processTrap(trap *pluginMeta.Trap) {
 				counterInc(DroppedTraps)
 				continue
 			}
+			if !filterDef.allowTrap(trap) {
+				throttleTrap(trap, fmt.Sprintf("filter:%d", i), chain)
+				continue
+			}
 
+			// The throttle action marks the traps that it drops
+			throttled := trap.Metadata[pluginMeta.ThrottledKey]
 			err := filterDef.processAction(trap)
+			if trap.Dropped && trap.Metadata[pluginMeta.ThrottledKey] != throttled {
+				counterInc(ThrottledTraps)
+			}
 			if err != nil {
 				for _, pluginErrorFilters := range teConfig.PluginErrorActions {
 					go pluginErrorFilters.processAction(trap)
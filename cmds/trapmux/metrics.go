@@ -18,6 +18,10 @@ const (
 	V1Traps
 	V2cTraps
 	V3Traps
+	SuppressedTraps
+	ThrottledTraps
+
+	numCounters
 )
 
 func createMetricDefs() []pluginMeta.MetricDef {
@@ -44,6 +48,12 @@ func createMetricDefs() []pluginMeta.MetricDef {
 		pluginMeta.MetricDef{Name: "v3_traps_total",
 			Help: "The total number of SNMPv3 traps received",
 		},
+		pluginMeta.MetricDef{Name: "suppressed_traps_total",
+			Help: "The total number of traps suppressed while their alarm was flapping",
+		},
+		pluginMeta.MetricDef{Name: "throttled_traps_total",
+			Help: "The total number of traps over a rate limit",
+		},
 	}
 
 	return mymetrics
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// rateLimiters are the token buckets of the rate_limits settings
+//
+type rateLimiters struct {
+	global    *pluginMeta.RateLimiter
+	perSource *pluginMeta.RateLimiter
+	ipSets    map[string]*pluginMeta.RateLimiter
+}
+
+// addRateLimits checks the rate limits and makes their token buckets.  The
+// running buckets are kept across reloads if their limits haven't changed,
+// so that a reload doesn't let a burst through.
+//
+func addRateLimits(newConfig *trapmuxConfig) error {
+	settings := newConfig.RateLimits
+	switch settings.Action {
+	case "", "drop", "chain":
+	default:
+		return fmt.Errorf("unknown rate_limits action (%s): must be drop or chain", settings.Action)
+	}
+	if err := settings.Global.Validate("global"); err != nil {
+		return err
+	}
+	if err := settings.PerSource.Validate("per_source"); err != nil {
+		return err
+	}
+	for name, limit := range settings.IpSets {
+		if _, ok := newConfig.IpSets[name]; !ok {
+			return fmt.Errorf("unknown IP set in rate_limits: %s", name)
+		}
+		if err := limit.Validate("ip set " + name); err != nil {
+			return err
+		}
+	}
+
+	var filters, throttledActions []trapmuxFilter
+	if teConfig != nil {
+		filters, throttledActions = teConfig.Filters, teConfig.ThrottledActions
+	}
+	for i := range newConfig.Filters {
+		if err := addFilterLimit(&newConfig.Filters[i], filters, i); err != nil {
+			return err
+		}
+	}
+	for i := range newConfig.ThrottledActions {
+		if err := addFilterLimit(&newConfig.ThrottledActions[i], throttledActions, i); err != nil {
+			return err
+		}
+	}
+
+	if teConfig != nil && teConfig.limiters != nil && reflect.DeepEqual(teConfig.RateLimits, settings) {
+		newConfig.limiters = teConfig.limiters
+		return nil
+	}
+	limiters := rateLimiters{ipSets: make(map[string]*pluginMeta.RateLimiter)}
+	enabled := false
+	if settings.Global.Enabled() {
+		limiters.global = pluginMeta.NewRateLimiter(settings.Global)
+		enabled = true
+	}
+	if settings.PerSource.Enabled() {
+		limiters.perSource = pluginMeta.NewRateLimiter(settings.PerSource)
+		enabled = true
+	}
+	for name, limit := range settings.IpSets {
+		if limit.Enabled() {
+			limiters.ipSets[name] = pluginMeta.NewRateLimiter(limit)
+			enabled = true
+		}
+	}
+	if enabled {
+		mainLog.Info().Float64("global", settings.Global.Rate).Float64("per_source", settings.PerSource.Rate).Int("ip_sets", len(limiters.ipSets)).Msg("Configured rate limits")
+		newConfig.limiters = &limiters
+	}
+	return nil
+}
+
+// addFilterLimit makes the token bucket of a filter's rate limit, or keeps
+// the running one of the filter in the same place in the old configuration
+// if it has the same limit.
+//
+func addFilterLimit(filter *trapmuxFilter, oldFilters []trapmuxFilter, lineNumber int) error {
+	if err := filter.RateLimit.Validate(fmt.Sprintf("filter at line %v", lineNumber)); err != nil {
+		return err
+	}
+	if !filter.RateLimit.Enabled() {
+		return nil
+	}
+	if lineNumber < len(oldFilters) {
+		old := &oldFilters[lineNumber]
+		if old.limiter != nil && old.RateLimit == filter.RateLimit && old.PerSource == filter.PerSource {
+			filter.limiter = old.limiter
+			return nil
+		}
+	}
+	filter.limiter = pluginMeta.NewRateLimiter(filter.RateLimit)
+	return nil
+}
+
+func addThrottledActions(newConfig *trapmuxConfig) error {
+	var err error
+	for i, _ := range newConfig.ThrottledActions {
+		if err = addFilterObjs(&newConfig.ThrottledActions[i], newConfig.IpSets, newConfig.mibs, i); err != nil {
+			return err
+		}
+		if err = setAction(&newConfig.ThrottledActions[i], newConfig.General.PluginPath, i); err != nil {
+			return err
+		}
+	}
+	mainLog.Info().Int("num_filters", len(newConfig.ThrottledActions)).Msg("Configured throttled trap conditions")
+	return nil
+}
+
+// throttledBy checks the trap against the ingest rate limits, returning the
+// name of the limit that it is over.  A token is taken from each bucket
+// that applies, most specific first.
+//
+func throttledBy(trap *pluginMeta.Trap) string {
+	config := currentConfig()
+	limiters := config.limiters
+	if limiters == nil {
+		return ""
+	}
+	now := trap.Time()
+	srcIP := trap.SrcIP.String()
+	for name, limiter := range limiters.ipSets {
+		if config.IpSets[name][srcIP] && !limiter.Allow(name, now) {
+			return "ip_set:" + name
+		}
+	}
+	if limiters.perSource != nil && !limiters.perSource.Allow(srcIP, now) {
+		return "per_source"
+	}
+	if limiters.global != nil && !limiters.global.Allow("", now) {
+		return "global"
+	}
+	return ""
+}
+
+// allowTrap takes a token from the filter's rate limit
+//
+func (f *trapmuxFilter) allowTrap(trap *pluginMeta.Trap) bool {
+	if f.limiter == nil {
+		return true
+	}
+	key := ""
+	if f.PerSource {
+		key = trap.SrcIP.String()
+	}
+	return f.limiter.Allow(key, trap.Time())
+}
+
+// throttleTrap handles a trap over a rate limit: it is dropped, after going
+// through the throttled_actions filters with the "chain" action.
+//
+func throttleTrap(trap *pluginMeta.Trap, limit string, chain bool) {
+	counterInc(ThrottledTraps)
+	trap.SetMetadata(pluginMeta.ThrottledKey, limit)
+	if debugEnabled() {
+		mainLog.Debug().Str("source_ip", trap.SrcIP.String()).Str("limit", limit).Msg("Throttled trap")
+	}
+	if chain && teConfig.RateLimits.Action == "chain" {
+		processFilters(trap, teConfig.ThrottledActions, false)
+	}
+	trap.Dropped = true
+}
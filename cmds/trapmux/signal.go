@@ -8,10 +8,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	pluginLoader "github.com/keruzu/trapmux/api"
 )
 
+// Reloads from SIGHUP and the admin API are done one at a time
+var reloadMutex sync.Mutex
+
 // On SIGHUP we reload the configuration.
 //
 func handleSIGHUP(sigCh chan os.Signal) {
@@ -19,9 +23,20 @@ func handleSIGHUP(sigCh chan os.Signal) {
 		select {
 		case <-sigCh:
 			fmt.Printf("Got SIGHUP - Reloading configuration.\n")
-			if err := getConfig(); err != nil {
-				mainLog.Info().Err(err).Msg("Error parsing configuration\nConfiguration was not changed")
-			}
+			reloadConfig()
+		}
+	}
+}
+
+// Use SIGUSR1 to have actions reload their data files (eg the enrich
+// inventory) without reloading the configuration.
+//
+func handleSIGUSR1(sigCh chan os.Signal) {
+	for {
+		select {
+		case <-sigCh:
+			mainLog.Info().Msg("Got SIGUSR1")
+			reloadActionData()
 		}
 	}
 }
@@ -33,13 +48,51 @@ func handleSIGUSR2(sigCh chan os.Signal) {
 		select {
 		case <-sigCh:
 			mainLog.Info().Msg("Got SIGUSR2")
-			for _, f := range teConfig.Filters {
-				if f.actionType == actionPlugin {
-					err := f.plugin.(pluginLoader.ActionPlugin).SigUsr2()
-					if err != nil {
-						mainLog.Warn().Err(err).Msg("Issue handling action")
-					}
-				}
+			rotateLogs()
+		}
+	}
+}
+
+// reloadConfig loads the configuration again, keeping the running one if
+// there are any problems with it
+//
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	err := getConfig()
+	if err != nil {
+		mainLog.Info().Err(err).Msg("Error parsing configuration\nConfiguration was not changed")
+	}
+	return err
+}
+
+// reloadActionData has the actions reload their data files.  This waits
+// for any reload, so that the plugins aren't closed underneath it.
+//
+func reloadActionData() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	for _, f := range teConfig.Filters {
+		if f.actionType == actionPlugin {
+			err := f.plugin.(pluginLoader.ActionPlugin).SigUsr1()
+			if err != nil {
+				mainLog.Warn().Err(err).Msg("Issue handling action")
+			}
+		}
+	}
+}
+
+// rotateLogs has the actions rotate their log files, waiting for any
+// reload
+//
+func rotateLogs() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	for _, f := range teConfig.Filters {
+		if f.actionType == actionPlugin {
+			err := f.plugin.(pluginLoader.ActionPlugin).SigUsr2()
+			if err != nil {
+				mainLog.Warn().Err(err).Msg("Issue handling action")
 			}
 		}
 	}
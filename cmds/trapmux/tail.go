@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// Traps queued for each tail client before they are missed
+const tailQueueSize = 256
+
+// How often an idle tail stream gets a comment, to keep proxies from
+// closing it
+const tailKeepAlive = 15 * time.Second
+
+// tailClient is one connection to the /tail stream
+//
+type tailClient struct {
+	filter *trapmuxFilter
+	traps  chan []byte
+	missed uint64
+}
+
+// The connected tail clients
+var tailClients = struct {
+	sync.Mutex
+	clients map[*tailClient]bool
+}{clients: make(map[*tailClient]bool)}
+
+var tailCount int32
+
+// parseTailFilter makes a filter from an expression of space-separated
+// name=value terms, which must all match.  The names and values are the
+// same as for the filters in the configuration file, eg
+// "source_ip=10.0.0.0/8 trap_oid=/linkDown metadata.site=lon1".  The
+// filter is matched after the trap has been through the filters, so
+// metadata terms can match metadata added by actions such as enrich.
+//
+func parseTailFilter(expression string) (*trapmuxFilter, error) {
+	filter := trapmuxFilter{GenericType: -1, SpecificType: -1, Metadata: make(map[string]string)}
+	for _, term := range strings.Fields(expression) {
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("filter terms should be name=value: %s", term)
+		}
+		name, value := parts[0], parts[1]
+		var err error
+		switch name {
+		case "snmp_versions":
+			filter.SnmpVersions = strings.Split(value, ",")
+		case "source_ip":
+			filter.SourceIp = value
+		case "agent_address":
+			filter.AgentAddress = value
+		case "snmp_generic_type":
+			filter.GenericType, err = strconv.Atoi(value)
+		case "snmp_specific_type":
+			filter.SpecificType, err = strconv.Atoi(value)
+		case "enterprise_oid":
+			filter.EnterpriseOid = value
+		case "trap_oid":
+			filter.TrapOid = value
+		case "community":
+			filter.Community = value
+		case "security_name":
+			filter.SecurityName = value
+		case "device_name":
+			filter.DeviceName = value
+		default:
+			if !strings.HasPrefix(name, "metadata.") || name == "metadata." {
+				return nil, fmt.Errorf("unknown filter term: %s", name)
+			}
+			filter.Metadata[strings.TrimPrefix(name, "metadata.")] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid number in filter term: %s", term)
+		}
+	}
+
+	config := currentConfig()
+	if err := addFilterObjs(&filter, config.IpSets, config.mibs, 0); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
+// publishTrap sends the trap to the tail clients whose filter it matches,
+// once it has been through the filters.  Slow clients miss traps rather
+// than holding up the pipeline.
+//
+func publishTrap(trap *pluginMeta.Trap) {
+	if atomic.LoadInt32(&tailCount) == 0 {
+		return
+	}
+	tailClients.Lock()
+	defer tailClients.Unlock()
+
+	var data []byte
+	for client := range tailClients.clients {
+		if !client.filter.isFilterMatch(trap) {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(trap); err != nil {
+				mainLog.Warn().Err(err).Msg("Unable to encode trap for tail clients")
+				return
+			}
+		}
+		select {
+		case client.traps <- data:
+		default:
+			atomic.AddUint64(&client.missed, 1)
+		}
+	}
+}
+
+func addTailClient(client *tailClient) {
+	tailClients.Lock()
+	tailClients.clients[client] = true
+	atomic.StoreInt32(&tailCount, int32(len(tailClients.clients)))
+	tailClients.Unlock()
+}
+
+func removeTailClient(client *tailClient) {
+	tailClients.Lock()
+	delete(tailClients.clients, client)
+	atomic.StoreInt32(&tailCount, int32(len(tailClients.clients)))
+	tailClients.Unlock()
+}
+
+// adminTail streams the traps matching the filter parameter as
+// Server-Sent Events.  Each trap is a "trap" event with the JSON form of
+// the trap as the actions left it (including any metadata they added, and
+// traps that were dropped or suppressed), and traps missed by a slow
+// client are counted in a "missed" event.
+//
+func adminTail(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := parseTailFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := &tailClient{filter: filter, traps: make(chan []byte, tailQueueSize)}
+	addTailClient(client)
+	defer removeTailClient(client)
+	mainLog.Info().Str("remote", r.RemoteAddr).Str("filter", r.URL.Query().Get("filter")).Msg("Tail client connected")
+	defer mainLog.Info().Str("remote", r.RemoteAddr).Msg("Tail client disconnected")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case data := <-client.traps:
+			if missed := atomic.SwapUint64(&client.missed, 0); missed > 0 {
+				fmt.Fprintf(w, "event: missed\ndata: %d\n\n", missed)
+			}
+			if _, err := fmt.Fprintf(w, "event: trap\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
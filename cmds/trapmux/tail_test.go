@@ -0,0 +1,153 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// setTailConfig runs a test against an empty configuration with the given
+// filters
+//
+func setTailConfig(t *testing.T, filters []trapmuxFilter) {
+	old := teConfig
+	teConfig = &trapmuxConfig{Filters: filters}
+	t.Cleanup(func() { teConfig = old })
+}
+
+func TestParseTailFilter(t *testing.T) {
+	setTailConfig(t, nil)
+	trap := pluginMeta.Trap{
+		SrcIP:       net.ParseIP("10.1.2.3"),
+		SnmpVersion: g.Version2c,
+		Community:   "public",
+		DeviceName:  "router1",
+		Metadata:    map[string]string{"site": "lon1"},
+	}
+
+	tests := []struct {
+		expression string
+		valid      bool
+		match      bool
+	}{
+		{"", true, true},
+		{"   ", true, true},
+		{"source_ip=10.0.0.0/8", true, true},
+		{"source_ip=192.168.0.0/16", true, false},
+		{"community=public device_name=router1", true, true},
+		{"community=public device_name=router2", true, false},
+		{"snmp_versions=2c", true, true},
+		{"snmp_versions=1,3", true, false},
+		{"metadata.site=lon1", true, true},
+		{"metadata.site=nyc1", true, false},
+		{"metadata.rack=a1", true, false},
+		{"snmp_generic_type=6 snmp_specific_type=1", true, false},
+		{"trap_oid=/linkDown", true, false},
+		{"source_ip", false, false},
+		{"source_ip=", false, false},
+		{"colour=red", false, false},
+		{"metadata.=lon1", false, false},
+		{"snmp_generic_type=six", false, false},
+	}
+	for _, test := range tests {
+		filter, err := parseTailFilter(test.expression)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.expression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.expression, err)
+			continue
+		}
+		if got := filter.isFilterMatch(&trap); got != test.match {
+			t.Errorf("%q: expected match %v, got %v", test.expression, test.match, got)
+		}
+	}
+}
+
+func TestPublishAfterFilters(t *testing.T) {
+	nat := trapmuxFilter{GenericType: -1, SpecificType: -1, ActionName: "nat",
+		ActionArgs: map[string]string{"natIp": "10.9.9.9"}}
+	if err := addFilterObjs(&nat, nil, nil, 0); err != nil {
+		t.Fatalf("Unable to make filter: %s", err)
+	}
+	if err := setAction(&nat, "", 0); err != nil {
+		t.Fatalf("Unable to set action: %s", err)
+	}
+	setTailConfig(t, []trapmuxFilter{nat})
+
+	filter, err := parseTailFilter("agent_address=10.9.9.9")
+	if err != nil {
+		t.Fatalf("Unable to parse tail filter: %s", err)
+	}
+	client := &tailClient{filter: filter, traps: make(chan []byte, 1)}
+	addTailClient(client)
+	defer removeTailClient(client)
+
+	packet := &g.SnmpPacket{Version: g.Version2c, Community: "public"}
+	trapHandler(packet, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 162}, nil)
+
+	select {
+	case data := <-client.traps:
+		var trap tailTrap
+		if err = json.Unmarshal(data, &trap); err != nil {
+			t.Fatalf("Unable to decode trap: %s", err)
+		}
+		if trap.AgentAddress != "10.9.9.9" {
+			t.Errorf("Expected the agent address set by the filters, got %s", trap.AgentAddress)
+		}
+	default:
+		t.Errorf("The tail client didn't get the trap changed by the filters")
+	}
+}
+
+func TestPublishCorrelatorEvents(t *testing.T) {
+	correlator, err := pluginMeta.NewCorrelator(pluginMeta.CorrelationSettings{Rules: []pluginMeta.CorrelationRule{
+		{Name: "link", Raise: []string{"IF-MIB::linkDown"}, Clear: []string{"IF-MIB::linkUp"},
+			Key: []string{"source_ip"}, FlapThreshold: 2},
+	}})
+	if err != nil {
+		t.Fatalf("Unable to make correlator: %s", err)
+	}
+	setTailConfig(t, nil)
+	teConfig.correlator = correlator
+
+	filter, err := parseTailFilter("")
+	if err != nil {
+		t.Fatalf("Unable to parse tail filter: %s", err)
+	}
+	client := &tailClient{filter: filter, traps: make(chan []byte, 3)}
+	addTailClient(client)
+	defer removeTailClient(client)
+
+	// linkDown then linkUp is enough to start the flapping
+	for _, trapOID := range []string{".1.3.6.1.6.3.1.1.5.3", ".1.3.6.1.6.3.1.1.5.4"} {
+		packet := &g.SnmpPacket{Version: g.Version2c, Community: "public", Variables: []g.SnmpPDU{
+			{Name: pluginMeta.SnmpTrapOID, Type: g.ObjectIdentifier, Value: trapOID},
+		}}
+		trapHandler(packet, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 162}, nil)
+	}
+
+	var states []string
+	for len(client.traps) > 0 {
+		var trap tailTrap
+		if err = json.Unmarshal(<-client.traps, &trap); err != nil {
+			t.Fatalf("Unable to decode trap: %s", err)
+		}
+		states = append(states, trap.Metadata[pluginMeta.AlarmStateKey])
+	}
+	if len(states) != 3 || states[2] != pluginMeta.AlarmFlapStart {
+		t.Errorf("The tail client didn't get the flap_start event, got alarm states %v", states)
+	}
+}
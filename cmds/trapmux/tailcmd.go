@@ -0,0 +1,248 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+)
+
+// Longest SSE line accepted from the admin API (a trap with large varbinds)
+const maxTailLine = 4 * 1024 * 1024
+
+// tailTrap is the part of the JSON form of a trap shown by trapmux tail
+//
+type tailTrap struct {
+	TrapNumber   uint              `json:"trap_number"`
+	SnmpVersion  string            `json:"snmp_version"`
+	ReceivedAt   time.Time         `json:"received_at"`
+	SrcIP        string            `json:"source_ip"`
+	DeviceName   string            `json:"device_name"`
+	AgentAddress string            `json:"agent_address"`
+	Community    string            `json:"community"`
+	SecurityName string            `json:"security_name"`
+	TrapOID      string            `json:"trap_oid"`
+	TrapName     string            `json:"trap_name"`
+	Metadata     map[string]string `json:"metadata"`
+	Varbinds     []struct {
+		Oid     string          `json:"oid"`
+		Name    string          `json:"name"`
+		Type    string          `json:"type"`
+		Value   json.RawMessage `json:"value"`
+		Display string          `json:"display"`
+	} `json:"varbinds"`
+}
+
+func showTailUsage() {
+	usageText := `
+Usage: trapmux tail [-c <config_file>] [-a <admin_address>] [-t <token>] [-j]
+                    [<filter>...]
+  -c  - The trapmux configuration file, for the admin API address and token.
+  -a  - The admin API address (host:port or URL), instead of the configuration.
+  -t  - The admin API token (default: the TRAPMUX_ADMIN_TOKEN variable).
+  -j  - Print each trap as a line of JSON.
+
+  The filter is space-separated name=value terms, which must all match, with
+  the names and values of the filters in the configuration file, eg:
+      trapmux tail source_ip=10.0.0.0/8 trap_oid=/linkDown metadata.site=lon1
+
+  Traps are shown after they have been through the filters, with any
+  metadata added by actions such as enrich, and including dropped traps.
+`
+	fmt.Println(usageText)
+}
+
+// runTail connects to the admin API of a running trapmux and prints the
+// traps that match the filter as they arrive
+//
+func runTail(args []string) int {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	flags.Usage = showTailUsage
+	configFile := flags.String("c", "/opt/trapmux/etc/trapmux.yml", "")
+	address := flags.String("a", "", "")
+	token := flags.String("t", os.Getenv("TRAPMUX_ADMIN_TOKEN"), "")
+	asJSON := flags.Bool("j", false, "")
+	flags.Parse(args)
+
+	if *address == "" {
+		if uri := os.Getenv("TRAPMUX_CONFIG_URI"); uri != "" {
+			*configFile = uri
+		}
+		var config trapmuxConfig
+		if err := loadConfig(*configFile, &config); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load configuration %s: %s\n", *configFile, err)
+			return 1
+		}
+		if *address = config.Admin.ListenAddress; *address == "" {
+			fmt.Fprintf(os.Stderr, "The admin API isn't configured in %s\n", *configFile)
+			return 1
+		}
+		if *token == "" && config.Admin.Token != "" {
+			secret, err := pluginMeta.GetSecret(config.Admin.Token)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read the admin API token: %s\n", err)
+				return 1
+			}
+			*token = secret
+		}
+	}
+
+	tailURL, err := makeTailURL(*address, strings.Join(flags.Args(), " "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid admin API address %s: %s\n", *address, err)
+		return 1
+	}
+	request, err := http.NewRequest(http.MethodGet, tailURL, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to trapmux: %s\n", err)
+		return 1
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if *token != "" {
+		request.Header.Set("Authorization", "Bearer "+*token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to trapmux: %s\n", err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		fmt.Fprintf(os.Stderr, "trapmux refused the tail: %s: %s\n", response.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+
+	if err = readTailEvents(response.Body, os.Stdout, *asJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "Lost connection to trapmux: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "trapmux closed the connection\n")
+	return 0
+}
+
+// makeTailURL makes the /tail URL from the admin API address.  A listen
+// address for all interfaces is connected to on the loopback address.
+//
+func makeTailURL(address string, filter string) (string, error) {
+	if !strings.Contains(address, "://") {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", err
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		address = "http://" + net.JoinHostPort(host, port)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/tail"
+	u.RawQuery = url.Values{"filter": []string{filter}}.Encode()
+	return u.String(), nil
+}
+
+// readTailEvents prints the events of the /tail stream until it ends
+//
+func readTailEvents(stream io.Reader, out io.Writer, asJSON bool) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), maxTailLine)
+	event := ""
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				printTailEvent(out, event, strings.Join(data, "\n"), asJSON)
+			}
+			event = ""
+			data = nil
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+func printTailEvent(out io.Writer, event string, data string, asJSON bool) {
+	switch event {
+	case "missed":
+		fmt.Fprintf(os.Stderr, "(missed %s traps)\n", data)
+	case "trap":
+		if asJSON {
+			fmt.Fprintln(out, data)
+			return
+		}
+		var trap tailTrap
+		if err := json.Unmarshal([]byte(data), &trap); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to decode trap: %s\n", err)
+			return
+		}
+		fmt.Fprint(out, formatTailTrap(&trap))
+	}
+}
+
+// formatTailTrap is a trap as printed by trapmux tail: a header line, and
+// then the varbinds and metadata indented
+//
+func formatTailTrap(trap *tailTrap) string {
+	var b strings.Builder
+	source := trap.SrcIP
+	if trap.DeviceName != "" {
+		source += " (" + trap.DeviceName + ")"
+	}
+	name := trap.TrapOID
+	if trap.TrapName != "" {
+		name = trap.TrapName + " (" + trap.TrapOID + ")"
+	}
+	fmt.Fprintf(&b, "%s #%d %s %s %s\n", trap.ReceivedAt.Local().Format("2006-01-02 15:04:05.000"), trap.TrapNumber, trap.SnmpVersion, source, name)
+	if trap.AgentAddress != "" && trap.AgentAddress != "0.0.0.0" && trap.AgentAddress != trap.SrcIP {
+		fmt.Fprintf(&b, "    agent address: %s\n", trap.AgentAddress)
+	}
+	for _, v := range trap.Varbinds {
+		oid := v.Oid
+		if v.Name != "" {
+			oid = v.Name
+		}
+		value := v.Display
+		if value == "" {
+			value = strings.Trim(string(v.Value), `"`)
+		}
+		fmt.Fprintf(&b, "    %s = %s: %s\n", oid, v.Type, value)
+	}
+	keys := make([]string, 0, len(trap.Metadata))
+	for key := range trap.Metadata {
+		keys = append(keys, key)
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		metadata := make([]string, len(keys))
+		for i, key := range keys {
+			metadata[i] = key + "=" + trap.Metadata[key]
+		}
+		fmt.Fprintf(&b, "    metadata: %s\n", strings.Join(metadata, " "))
+	}
+	return b.String()
+}
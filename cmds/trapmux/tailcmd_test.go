@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeTailURL(t *testing.T) {
+	tests := []struct {
+		address string
+		filter  string
+		want    string
+		valid   bool
+	}{
+		{"127.0.0.1:9090", "", "http://127.0.0.1:9090/tail?filter=", true},
+		{":9090", "", "http://127.0.0.1:9090/tail?filter=", true},
+		{"0.0.0.0:9090", "", "http://127.0.0.1:9090/tail?filter=", true},
+		{"[::]:9090", "", "http://127.0.0.1:9090/tail?filter=", true},
+		{"[::1]:9090", "", "http://[::1]:9090/tail?filter=", true},
+		{"trapmux.example.com:9090", "source_ip=10.0.0.0/8 metadata.site=lon1",
+			"http://trapmux.example.com:9090/tail?filter=source_ip%3D10.0.0.0%2F8+metadata.site%3Dlon1", true},
+		{"https://trapmux.example.com/admin/", "community=public",
+			"https://trapmux.example.com/admin/tail?filter=community%3Dpublic", true},
+		{"https://trapmux.example.com", "", "https://trapmux.example.com/tail?filter=", true},
+		{"trapmux.example.com", "", "", false},
+		{"http://%zz", "", "", false},
+	}
+	for _, test := range tests {
+		got, err := makeTailURL(test.address, test.filter)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.address, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.address, err)
+		} else if got != test.want {
+			t.Errorf("%q: expected %s, got %s", test.address, test.want, got)
+		}
+	}
+}
+
+func TestReadTailEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		asJSON bool
+		want   string
+	}{
+		{"empty", "", true, ""},
+		{"comments", ": connected\n\n: keepalive\n\n", true, ""},
+		{"trap", "event: trap\ndata: {\"trap_number\":1}\n\n", true, "{\"trap_number\":1}\n"},
+		{"no space", "event:trap\ndata:{\"trap_number\":2}\n\n", true, "{\"trap_number\":2}\n"},
+		{"multiple data lines", "event: trap\ndata: {\"trap_number\":\ndata: 3}\n\n", true, "{\"trap_number\":\n3}\n"},
+		{"missed", "event: missed\ndata: 5\n\nevent: trap\ndata: {}\n\n", true, "{}\n"},
+		{"unknown event", "event: other\ndata: x\n\n", true, ""},
+		{"unfinished event", "event: trap\ndata: {}\n", true, ""},
+		{"bad trap", "event: trap\ndata: {\n\n", false, ""},
+		{"formatted", "event: trap\ndata: {\"source_ip\":\"10.1.2.3\",\"trap_oid\":\"1.3.6.1.6.3.1.1.5.3\"}\n\n", false,
+			"1.3.6.1.6.3.1.1.5.3\n"},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		if err := readTailEvents(strings.NewReader(test.stream), &out, test.asJSON); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !strings.HasSuffix(out.String(), test.want) || (test.want == "" && out.Len() > 0) {
+			t.Errorf("%s: expected output ending %q, got %q", test.name, test.want, out.String())
+		}
+	}
+
+	long := "event: trap\ndata: " + strings.Repeat("x", maxTailLine) + "\n\n"
+	if err := readTailEvents(strings.NewReader(long), &strings.Builder{}, true); err == nil {
+		t.Errorf("Expected an error for a line over %d bytes", maxTailLine)
+	}
+}
+
+func TestFormatTailTrap(t *testing.T) {
+	receivedAt := time.Date(2022, 3, 4, 5, 6, 7, 890000000, time.Local)
+	header := "2022-03-04 05:06:07.890 #42 2c 10.1.2.3"
+
+	tests := []struct {
+		name string
+		trap string
+		want string
+	}{
+		{"numeric", `{"source_ip":"10.1.2.3","trap_oid":"1.3.6.1.6.3.1.1.5.3"}`,
+			header + " 1.3.6.1.6.3.1.1.5.3\n"},
+		{"names", `{"source_ip":"10.1.2.3","device_name":"router1","trap_oid":"1.3.6.1.6.3.1.1.5.3","trap_name":"IF-MIB::linkDown"}`,
+			header + " (router1) IF-MIB::linkDown (1.3.6.1.6.3.1.1.5.3)\n"},
+		{"agent address", `{"source_ip":"10.1.2.3","agent_address":"10.9.9.9","trap_oid":"1.2.3"}`,
+			header + " 1.2.3\n    agent address: 10.9.9.9\n"},
+		{"same agent address", `{"source_ip":"10.1.2.3","agent_address":"10.1.2.3","trap_oid":"1.2.3"}`,
+			header + " 1.2.3\n"},
+		{"empty agent address", `{"source_ip":"10.1.2.3","agent_address":"0.0.0.0","trap_oid":"1.2.3"}`,
+			header + " 1.2.3\n"},
+		{"varbinds", `{"source_ip":"10.1.2.3","trap_oid":"1.2.3","varbinds":[
+			{"oid":"1.3.6.1.2.1.2.2.1.1.3","name":"IF-MIB::ifIndex.3","type":"Integer","value":3},
+			{"oid":"1.3.6.1.2.1.2.2.1.8.3","name":"IF-MIB::ifOperStatus.3","type":"Integer","value":2,"display":"down(2)"},
+			{"oid":"1.3.6.1.4.1.9.1","type":"OctetString","value":"hello"}]}`,
+			header + " 1.2.3\n" +
+				"    IF-MIB::ifIndex.3 = Integer: 3\n" +
+				"    IF-MIB::ifOperStatus.3 = Integer: down(2)\n" +
+				"    1.3.6.1.4.1.9.1 = OctetString: hello\n"},
+		{"metadata", `{"source_ip":"10.1.2.3","trap_oid":"1.2.3","metadata":{"site":"lon1","rack":"a1"}}`,
+			header + " 1.2.3\n    metadata: rack=a1 site=lon1\n"},
+	}
+	for _, test := range tests {
+		var trap tailTrap
+		if err := json.Unmarshal([]byte(test.trap), &trap); err != nil {
+			t.Fatalf("%s: unable to decode trap: %s", test.name, err)
+		}
+		trap.TrapNumber = 42
+		trap.SnmpVersion = "2c"
+		trap.ReceivedAt = receivedAt
+		if got := formatTailTrap(&trap); got != test.want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.want, got)
+		}
+	}
+}
@@ -42,13 +42,14 @@ func (n *network) contains(ip net.IP) bool {
 	return n.net.Contains(ip)
 }
 
-// makeTrapLogEntry creates a log entry string for the given trap data.
-// Note that this particulare implementation expects to be dealing with
-// only v1 traps.
+// makeTrapLogEntry creates a log entry string for the given trap data,
+// using the canonical JSON form of the trap.
 //
 func makeTrapLogEntry(trap *pluginMeta.Trap) string {
-	trapMap := trap.Trap2Map()
-	jsonBytes, _ := json.Marshal(trapMap)
+	jsonBytes, err := json.Marshal(trap)
+	if err != nil {
+		return err.Error()
+	}
 	return string(jsonBytes[:])
 }
 
@@ -56,7 +57,7 @@ func makeTrapLogEntry(trap *pluginMeta.Trap) string {
 // SnmpVersion value is being ignored.
 //
 func isIgnoredVersion(ver g.SnmpVersion) bool {
-	for _, v := range teConfig.TrapReceiverSettings.IgnoreVersions {
+	for _, v := range currentConfig().TrapReceiverSettings.IgnoreVersions {
 		if ver == v {
 			return true
 		}
@@ -4,9 +4,11 @@ go 1.16
 
 require (
 	github.com/BurntSushi/toml v0.4.1 // indirect
+	github.com/aws/aws-sdk-go v1.44.200
 	github.com/creasty/defaults v1.7.0
 	github.com/gosnmp/gosnmp v1.37.0
 	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/prometheus/client_golang v1.18.0
 	github.com/prometheus/common v0.46.0 // indirect
@@ -0,0 +1,296 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin rolls up low-value traps (eg authenticationFailure) into
+ * counts.  Traps are grouped by a key over a tumbling window, and at the
+ * end of each window one summary trap per group is sent to the downstream
+ * action.  The original traps are dropped, so the filters that follow don't
+ * see them.
+ *
+ * The summary is the first trap of the group (with its varbinds as a
+ * sample), received at the time of the last one, with this metadata:
+ *   aggregate_key        - the key of the group
+ *   aggregate_count      - number of traps in the window
+ *   aggregate_first_seen - receive time of the first trap (RFC 3339)
+ *   aggregate_last_seen  - receive time of the last trap (RFC 3339)
+ *   aggregate_window     - length of the window in seconds
+ *
+ * Arguments:
+ *   key       - comma-separated fields to group by, from agent_address,
+ *               source_ip, device_name, community, enterprise, trap_oid,
+ *               oid:<varbind OID> and meta:<metadata key>
+ *               (default: agent_address,trap_oid)
+ *   window    - seconds in each window (default 60)
+ *   max_keys  - groups kept in a window, after which new groups are sent
+ *               straight on (default 10000, 0 for no limit)
+ *   action    - downstream action plugin for the summaries (required)
+ *   action.*  - arguments for the downstream action, eg action.filename
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pluginLoader "github.com/keruzu/trapmux/api"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "aggregate"
+
+const (
+	defaultKey     = "agent_address,trap_oid"
+	defaultWindow  = 60
+	defaultMaxKeys = 10000
+
+	actionArgPrefix = "action."
+)
+
+// Trap metadata of the summaries
+const (
+	aggregateKeyKey   = "aggregate_key"
+	aggregateCountKey = "aggregate_count"
+	aggregateFirstKey = "aggregate_first_seen"
+	aggregateLastKey  = "aggregate_last_seen"
+	aggregateWindow   = "aggregate_window"
+)
+
+// Replaced by the tests
+var loadAction = pluginLoader.LoadConfiguredAction
+
+// aggregateGroup counts the traps of one key in the current window
+//
+type aggregateGroup struct {
+	key       string
+	count     int
+	firstSeen time.Time
+	lastSeen  time.Time
+	sample    pluginMeta.Trap
+}
+
+type aggregateAction struct {
+	key     []string
+	window  time.Duration
+	maxKeys int
+
+	actionName string
+	action     pluginLoader.ActionPlugin
+
+	// The downstream action is called from the flush ticker as well as the
+	// pipeline, but actions expect one trap at a time
+	actionMutex sync.Mutex
+
+	mutex  sync.Mutex
+	groups map[string]*aggregateGroup
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	pluginLog *zerolog.Logger
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"key": true, "window": true, "max_keys": true, "action": true}
+
+	for key, _ := range actionArgs {
+		if _, ok := validArgs[key]; !ok && !strings.HasPrefix(key, actionArgPrefix) {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	return nil
+}
+
+func (a *aggregateAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	var err error
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err = validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	key := actionArgs["key"]
+	if key == "" {
+		key = defaultKey
+	}
+	for _, field := range strings.Split(key, ",") {
+		field = strings.TrimSpace(field)
+		if !pluginMeta.IsKeyField(field) {
+			return fmt.Errorf("Unknown key field for %s plugin: %s", pluginName, field)
+		}
+		a.key = append(a.key, field)
+	}
+
+	window, err := pluginMeta.GetIntArg(actionArgs, "window", defaultWindow, pluginName)
+	if err != nil {
+		return err
+	}
+	if window == 0 {
+		return fmt.Errorf("The window argument to %s plugin can't be 0", pluginName)
+	}
+	a.window = time.Duration(window) * time.Second
+	if a.maxKeys, err = pluginMeta.GetIntArg(actionArgs, "max_keys", defaultMaxKeys, pluginName); err != nil {
+		return err
+	}
+
+	a.actionName = actionArgs["action"]
+	if a.actionName == "" {
+		return fmt.Errorf("Missing the action argument to %s plugin", pluginName)
+	}
+	if a.actionName == pluginName {
+		return fmt.Errorf("The %s plugin can't send its summaries to itself", pluginName)
+	}
+	downstreamArgs := make(map[string]string)
+	for name, value := range actionArgs {
+		if strings.HasPrefix(name, actionArgPrefix) {
+			downstreamArgs[strings.TrimPrefix(name, actionArgPrefix)] = value
+		}
+	}
+	if a.action, err = loadAction(pluginLog, a.actionName, downstreamArgs); err != nil {
+		return fmt.Errorf("Unable to load the %s action for %s plugin: %s", a.actionName, pluginName, err)
+	}
+
+	a.groups = make(map[string]*aggregateGroup)
+	a.done = make(chan struct{})
+	a.wg.Add(1)
+	go a.flushEvery(a.done)
+	return nil
+}
+
+// flushEvery sends the summaries at the end of each window
+//
+func (a *aggregateAction) flushEvery(done chan struct{}) {
+	defer a.wg.Done()
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+// flush starts a new window, and sends the summaries of the old one in
+// the order that their groups were first seen
+//
+func (a *aggregateAction) flush() {
+	a.mutex.Lock()
+	groups := a.groups
+	a.groups = make(map[string]*aggregateGroup)
+	a.mutex.Unlock()
+
+	summaries := make([]*aggregateGroup, 0, len(groups))
+	for _, group := range groups {
+		summaries = append(summaries, group)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].firstSeen.Equal(summaries[j].firstSeen) {
+			return summaries[i].key < summaries[j].key
+		}
+		return summaries[i].firstSeen.Before(summaries[j].firstSeen)
+	})
+	for _, group := range summaries {
+		summary := a.summarize(group)
+		a.send(&summary)
+	}
+}
+
+// summarize makes the summary trap of a group
+//
+func (a *aggregateAction) summarize(group *aggregateGroup) pluginMeta.Trap {
+	summary := group.sample
+	summary.ReceivedAt = group.lastSeen
+	summary.SetMetadata(aggregateKeyKey, group.key)
+	summary.SetMetadata(aggregateCountKey, strconv.Itoa(group.count))
+	summary.SetMetadata(aggregateFirstKey, group.firstSeen.Format(time.RFC3339))
+	summary.SetMetadata(aggregateLastKey, group.lastSeen.Format(time.RFC3339))
+	summary.SetMetadata(aggregateWindow, strconv.Itoa(int(a.window.Seconds())))
+	return summary
+}
+
+func (a *aggregateAction) send(trap *pluginMeta.Trap) {
+	a.actionMutex.Lock()
+	err := a.action.ProcessTrap(trap)
+	a.actionMutex.Unlock()
+	if err != nil {
+		a.pluginLog.Warn().Str("plugin", pluginName).Str("action", a.actionName).Err(err).Msg("Unable to send trap summary")
+	}
+}
+
+func (a *aggregateAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	data := pluginMeta.NewTemplateData(trap)
+	values := make([]string, len(a.key))
+	for i, field := range a.key {
+		values[i] = pluginMeta.KeyField(trap, &data, field)
+	}
+	key := strings.Join(values, ",")
+	now := trap.Time()
+	trap.Dropped = true
+
+	a.mutex.Lock()
+	group, ok := a.groups[key]
+	if !ok && a.maxKeys > 0 && len(a.groups) >= a.maxKeys {
+		a.mutex.Unlock()
+		summary := a.summarize(&aggregateGroup{key: key, count: 1, firstSeen: now, lastSeen: now, sample: a.sample(trap)})
+		a.send(&summary)
+		return nil
+	}
+	if !ok {
+		group = &aggregateGroup{key: key, firstSeen: now, sample: a.sample(trap)}
+		a.groups[key] = group
+	}
+	group.count++
+	group.lastSeen = now
+	a.mutex.Unlock()
+	return nil
+}
+
+// sample keeps a copy of the first trap of a group for its summary
+//
+func (a *aggregateAction) sample(trap *pluginMeta.Trap) pluginMeta.Trap {
+	sample := trap.Copy()
+	sample.Dropped = false
+	return sample
+}
+
+func (a *aggregateAction) SigUsr1() error {
+	a.actionMutex.Lock()
+	defer a.actionMutex.Unlock()
+	return a.action.SigUsr1()
+}
+
+func (a *aggregateAction) SigUsr2() error {
+	a.actionMutex.Lock()
+	defer a.actionMutex.Unlock()
+	return a.action.SigUsr2()
+}
+
+// Close sends the summaries of the current window before closing the
+// downstream action
+//
+func (a *aggregateAction) Close() error {
+	if a.done == nil {
+		return nil
+	}
+	close(a.done)
+	a.done = nil
+	a.wg.Wait()
+	a.flush()
+	a.actionMutex.Lock()
+	defer a.actionMutex.Unlock()
+	return a.action.Close()
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin aggregateAction
@@ -0,0 +1,203 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginLoader "github.com/keruzu/trapmux/api"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+// testAction records the traps sent to it as the downstream action
+type testAction struct {
+	args   map[string]string
+	traps  []pluginMeta.Trap
+	closed bool
+}
+
+func (t *testAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	t.args = actionArgs
+	return nil
+}
+
+func (t *testAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	t.traps = append(t.traps, trap.Copy())
+	return nil
+}
+
+func (t *testAction) SigUsr1() error { return nil }
+func (t *testAction) SigUsr2() error { return nil }
+
+func (t *testAction) Close() error {
+	t.closed = true
+	return nil
+}
+
+func configureTestAction(t *testing.T, args map[string]string) (*aggregateAction, *testAction) {
+	downstream := &testAction{}
+	loadAction = func(pluginLog *zerolog.Logger, name string, actionArgs map[string]string) (pluginLoader.ActionPlugin, error) {
+		if name != "logfile" {
+			return nil, errors.New("no such plugin")
+		}
+		return downstream, downstream.Configure(pluginLog, actionArgs)
+	}
+
+	var a aggregateAction
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	return &a, downstream
+}
+
+func makeTestTrap(srcIP string, trapOID string, received time.Time) *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP(srcIP), SnmpVersion: g.Version2c, ReceivedAt: received, Raw: []byte{0x30}}
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(100)},
+		{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: g.ObjectIdentifier, Value: trapOID},
+	}
+	return &trap
+}
+
+func TestAggregate(t *testing.T) {
+	a, downstream := configureTestAction(t, map[string]string{"window": "3600",
+		"action": "logfile", "action.filename": "/tmp/summary.log"})
+	if downstream.args["filename"] != "/tmp/summary.log" || len(downstream.args) != 1 {
+		t.Errorf("Unexpected downstream arguments: %v", downstream.args)
+	}
+
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	traps := []*pluginMeta.Trap{
+		makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.5", start),
+		makeTestTrap("192.0.2.2", ".1.3.6.1.6.3.1.1.5.5", start.Add(time.Second)),
+		makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.5", start.Add(5*time.Second)),
+		makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.3", start.Add(6*time.Second)),
+		makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.5", start.Add(9*time.Second)),
+	}
+	for _, trap := range traps {
+		if err := a.ProcessTrap(trap); err != nil {
+			t.Fatalf("Unable to process trap: %s", err)
+		}
+		if !trap.Dropped {
+			t.Errorf("The original trap was not dropped")
+		}
+	}
+	if len(downstream.traps) != 0 {
+		t.Fatalf("Summaries were sent before the end of the window")
+	}
+
+	a.flush()
+	if len(downstream.traps) != 3 {
+		t.Fatalf("Expected 3 summaries, got %d", len(downstream.traps))
+	}
+	summary := downstream.traps[0]
+	expected := map[string]string{
+		"aggregate_key":        "192.0.2.1,1.3.6.1.6.3.1.1.5.5",
+		"aggregate_count":      "3",
+		"aggregate_first_seen": "2022-03-01T12:00:00Z",
+		"aggregate_last_seen":  "2022-03-01T12:00:09Z",
+		"aggregate_window":     "3600",
+	}
+	for key, value := range expected {
+		if summary.Metadata[key] != value {
+			t.Errorf("Unexpected %s metadata: %s (expected %s)", key, summary.Metadata[key], value)
+		}
+	}
+	if summary.Dropped || len(summary.Data.Variables) != 2 || !summary.ReceivedAt.Equal(start.Add(9*time.Second)) {
+		t.Errorf("Unexpected summary trap: %+v", summary)
+	}
+	if downstream.traps[1].Metadata["aggregate_key"] != "192.0.2.2,1.3.6.1.6.3.1.1.5.5" ||
+		downstream.traps[2].Metadata["aggregate_count"] != "1" {
+		t.Errorf("Unexpected summaries: %v, %v", downstream.traps[1].Metadata, downstream.traps[2].Metadata)
+	}
+
+	// The next window starts empty, and the last one is sent on close
+	a.ProcessTrap(makeTestTrap("192.0.2.3", ".1.3.6.1.6.3.1.1.5.5", start.Add(time.Hour)))
+	if err := a.Close(); err != nil {
+		t.Fatalf("Unable to close plugin: %s", err)
+	}
+	if len(downstream.traps) != 4 || downstream.traps[3].Metadata["aggregate_count"] != "1" || !downstream.closed {
+		t.Errorf("The last window was not sent on close")
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	a, downstream := configureTestAction(t, map[string]string{"key": "source_ip", "max_keys": "1", "action": "logfile"})
+	defer a.Close()
+
+	now := time.Now()
+	a.ProcessTrap(makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.5", now))
+	a.ProcessTrap(makeTestTrap("192.0.2.2", ".1.3.6.1.6.3.1.1.5.5", now))
+	a.ProcessTrap(makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.5", now))
+	if len(downstream.traps) != 1 || downstream.traps[0].Metadata["aggregate_key"] != "192.0.2.2" {
+		t.Errorf("A group over the limit was not sent straight on: %v", downstream.traps)
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	invalid := []map[string]string{
+		{"window": "60"},
+		{"action": "logfile", "windows": "60"},
+		{"action": "logfile", "window": "0"},
+		{"action": "logfile", "window": "-1"},
+		{"action": "logfile", "key": "source_ip,hostname"},
+		{"action": "logfile", "key": "oid:"},
+		{"action": "aggregate"},
+		{"action": "nosuchplugin"},
+	}
+	a, _ := configureTestAction(t, map[string]string{"action": "logfile"})
+	a.Close()
+	for _, args := range invalid {
+		var b aggregateAction
+		if err := b.Configure(&testLog, args); err == nil {
+			t.Errorf("Invalid arguments were accepted: %v", args)
+			b.Close()
+		}
+	}
+}
+
+func TestConcurrentSends(t *testing.T) {
+	a, downstream := configureTestAction(t, map[string]string{"key": "source_ip", "max_keys": "1", "action": "logfile"})
+
+	// Summaries from the flush ticker and from the pipeline, at the same
+	// time, must reach the downstream action one at a time (go test -race)
+	now := time.Now()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			a.flush()
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		a.ProcessTrap(makeTestTrap("192.0.2.1", ".1.3.6.1.6.3.1.1.5.5", now))
+		a.ProcessTrap(makeTestTrap("192.0.2.2", ".1.3.6.1.6.3.1.1.5.5", now))
+	}
+	<-done
+	a.Close()
+	count := 0
+	for _, trap := range downstream.traps {
+		n, _ := strconv.Atoi(trap.Metadata["aggregate_count"])
+		count += n
+	}
+	if count != 200 {
+		t.Errorf("Expected summaries of 200 traps, got %d", count)
+	}
+}
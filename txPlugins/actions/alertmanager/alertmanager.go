@@ -0,0 +1,440 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin turns SNMP traps into Prometheus Alertmanager alerts
+ *
+ * Labels and annotations are Go templates (see pluginMeta.TemplateData for
+ * the fields and helpers), given as plugin arguments with a 'label.' or
+ * 'annotation.' prefix, eg:
+ *
+ *   label.alertname: "LinkDown"
+ *   label.instance: "{{ .SrcIP }}"
+ *   annotation.summary: "Interface {{ .Varbind \"1.3.6.1.2.1.2.2.1.2\" }} is down"
+ *
+ * clear_trap_oids pairs the trap OIDs that raise alerts with the trap OIDs
+ * that resolve them, eg IF-MIB::linkDown=IF-MIB::linkUp.  A clearing trap
+ * resolves the alerts raised earlier by its raising traps with the same
+ * correlation key (eg linkUp resolves linkDown for the same agent and
+ * ifIndex), and no others.  The key has to be given with clear_trap_oids,
+ * as only the trap knows which of its varbinds identify what is alerting.
+ * Resolved alerts are only forgotten once Alertmanager has accepted them,
+ * so a clearing trap that fails to be sent can be retried.
+ *
+ * Arguments:
+ *   url             - Alertmanager base URL, eg http://localhost:9093 (required)
+ *   ttl             - seconds until an alert expires if not raised again (default 3600)
+ *   key             - correlation key template, eg {{ .SrcIP }}/{{ .Varbind "1.3.6.1.2.1.2.2.1.1" }}
+ *                     (required with clear_trap_oids, default: "{{ .SrcIP }}")
+ *   clear_trap_oids - comma-separated raise=clear pairs of trap OIDs (or MIB names)
+ *   generator_url   - optional generatorURL sent with the alerts
+ *   username, password, bearer_token
+ *   timeout         - seconds to wait for Alertmanager (default 5)
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "alertmanager"
+
+const (
+	alertsEndpoint = "/api/v2/alerts"
+	defaultTTL     = 3600
+	defaultTimeout = 5
+	defaultKey     = "{{ .SrcIP }}"
+)
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Labels used when none are configured
+var defaultLabels = map[string]string{
+	"alertname": "SNMPTrap",
+	"instance":  "{{ .SrcIP }}",
+	"trap_oid":  "{{ .TrapOID }}",
+}
+
+var defaultAnnotations = map[string]string{
+	"summary": "SNMP trap {{ .TrapOID }} from {{ .SrcIP }}",
+}
+
+// activeKey picks out the alerts that a clearing trap resolves: the trap
+// OID that raised them and their correlation key
+//
+type activeKey struct {
+	raiseOid string
+	key      string
+}
+
+// alert is the Alertmanager v2 API representation of an alert
+type alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+type alertmanagerForwarder struct {
+	url          string
+	ttl          time.Duration
+	generatorURL string
+	username     string
+	password     string
+	bearerToken  string
+	client       *http.Client
+
+	labels      map[string]*template.Template
+	annotations map[string]*template.Template
+	key         *template.Template
+	clearOids   map[string][]string // Clearing trap OID to the OIDs it resolves
+
+	// Alerts that have been raised and not yet resolved.  Traps with the
+	// same key can raise alerts with different labels.
+	lock   sync.Mutex
+	active map[activeKey][]alert
+
+	pluginLog *zerolog.Logger
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"url": true, "ttl": true, "key": true, "clear_trap_oids": true, "generator_url": true,
+		"username": true, "password": true, "bearer_token": true, "timeout": true}
+
+	for key, _ := range actionArgs {
+		if strings.HasPrefix(key, "label.") || strings.HasPrefix(key, "annotation.") {
+			name := key[strings.Index(key, ".")+1:]
+			if !labelNameRe.MatchString(name) {
+				return fmt.Errorf("Invalid label or annotation name for %s plugin: %s", pluginName, name)
+			}
+			continue
+		}
+		if _, ok := validArgs[key]; !ok {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	if actionArgs["url"] == "" {
+		return fmt.Errorf("Missing the required 'url' argument to the %s plugin", pluginName)
+	}
+	if strings.TrimSpace(actionArgs["clear_trap_oids"]) != "" && actionArgs["key"] == "" {
+		return fmt.Errorf("The 'key' argument is required with clear_trap_oids for the %s plugin", pluginName)
+	}
+	return nil
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := pluginMeta.ParseTemplate(name, text)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template for %s in %s plugin: %s", name, pluginName, err)
+	}
+	return tmpl, nil
+}
+
+// parseTemplates compiles the arguments with the given prefix, or the
+// defaults if there are none.
+//
+func parseTemplates(actionArgs map[string]string, prefix string, defaults map[string]string) (map[string]*template.Template, error) {
+	texts := make(map[string]string)
+	for key, value := range actionArgs {
+		if strings.HasPrefix(key, prefix) {
+			texts[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	if len(texts) == 0 {
+		texts = defaults
+	}
+
+	templates := make(map[string]*template.Template)
+	for name, text := range texts {
+		tmpl, err := parseTemplate(name, text)
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+func (a *alertmanagerForwarder) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err := validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	var err error
+	a.url = strings.TrimSuffix(actionArgs["url"], "/")
+	a.generatorURL = actionArgs["generator_url"]
+	var seconds int
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "ttl", defaultTTL, pluginName); err != nil {
+		return err
+	}
+	a.ttl = time.Duration(seconds) * time.Second
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "timeout", defaultTimeout, pluginName); err != nil {
+		return err
+	}
+	a.client = &http.Client{Timeout: time.Duration(seconds) * time.Second}
+
+	a.username = actionArgs["username"]
+	if a.password, err = pluginMeta.GetSecret(actionArgs["password"]); err != nil {
+		return err
+	}
+	if a.bearerToken, err = pluginMeta.GetSecret(actionArgs["bearer_token"]); err != nil {
+		return err
+	}
+
+	if a.labels, err = parseTemplates(actionArgs, "label.", defaultLabels); err != nil {
+		return err
+	}
+	if a.annotations, err = parseTemplates(actionArgs, "annotation.", defaultAnnotations); err != nil {
+		return err
+	}
+	key := actionArgs["key"]
+	if key == "" {
+		key = defaultKey
+	}
+	if a.key, err = parseTemplate("key", key); err != nil {
+		return err
+	}
+
+	if a.clearOids, err = parseClearOids(actionArgs["clear_trap_oids"]); err != nil {
+		return err
+	}
+	a.active = make(map[activeKey][]alert)
+
+	a.pluginLog.Info().Str("url", a.url).Int("clear_trap_oids", len(a.clearOids)).Msg("Added Alertmanager destination")
+	return nil
+}
+
+// parseClearOids converts the raise=clear pairs of trap OIDs into a lookup
+// of the raising trap OIDs for each clearing trap OID
+//
+func parseClearOids(pairs string) (map[string][]string, error) {
+	clearOids := make(map[string][]string)
+	for _, pair := range strings.Split(pairs, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		oids := strings.SplitN(pair, "=", 2)
+		if len(oids) != 2 {
+			return nil, fmt.Errorf("clear_trap_oids for %s plugin should be raise=clear pairs: %s", pluginName, pair)
+		}
+		var numeric [2]string
+		for i, oid := range oids {
+			var ok bool
+			oid = strings.Trim(strings.TrimSpace(oid), ".")
+			if numeric[i], ok = pluginMeta.Mibs().Lookup(oid); !ok || oid == "" {
+				return nil, fmt.Errorf("Unknown trap OID in clear_trap_oids for %s plugin: %s", pluginName, oid)
+			}
+		}
+		clearOids[numeric[1]] = append(clearOids[numeric[1]], numeric[0])
+	}
+	return clearOids, nil
+}
+
+func expand(tmpl *template.Template, data pluginMeta.TemplateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func expandAll(templates map[string]*template.Template, data pluginMeta.TemplateData) (map[string]string, error) {
+	result := make(map[string]string, len(templates))
+	for name, tmpl := range templates {
+		value, err := expand(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		// Alertmanager treats empty labels as missing
+		if value != "" {
+			result[name] = value
+		}
+	}
+	return result, nil
+}
+
+func (a *alertmanagerForwarder) ProcessTrap(trap *pluginMeta.Trap) error {
+	data := pluginMeta.NewTemplateData(trap)
+	key, err := expand(a.key, data)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	a.lock.Lock()
+	a.expireAlerts(now)
+	if raiseOids, ok := a.clearOids[data.TrapOID]; ok {
+		var resolved []alert
+		for _, raiseOid := range raiseOids {
+			resolved = append(resolved, a.active[activeKey{raiseOid: raiseOid, key: key}]...)
+		}
+		a.lock.Unlock()
+		if len(resolved) == 0 {
+			a.pluginLog.Debug().Str("plugin", pluginName).Str("key", key).Msg("No active alert to resolve")
+			return nil
+		}
+		for i := range resolved {
+			resolved[i].EndsAt = now
+		}
+		if err = a.postAlerts(resolved); err != nil {
+			return err
+		}
+
+		a.lock.Lock()
+		for _, raiseOid := range raiseOids {
+			a.forgetAlerts(activeKey{raiseOid: raiseOid, key: key}, resolved)
+		}
+		a.lock.Unlock()
+		return nil
+	}
+	a.lock.Unlock()
+
+	labels, err := expandAll(a.labels, data)
+	if err != nil {
+		return err
+	}
+	annotations, err := expandAll(a.annotations, data)
+	if err != nil {
+		return err
+	}
+	raised := alert{
+		Labels:       labels,
+		Annotations:  annotations,
+		StartsAt:     now,
+		EndsAt:       now.Add(a.ttl),
+		GeneratorURL: a.generatorURL,
+	}
+
+	a.lock.Lock()
+	active := activeKey{raiseOid: data.TrapOID, key: key}
+	alerts := a.active[active]
+	i := 0
+	for i < len(alerts) && !sameLabels(alerts[i].Labels, labels) {
+		i++
+	}
+	if i < len(alerts) {
+		// Keep the original start time if the alert is raised again
+		raised.StartsAt = alerts[i].StartsAt
+		alerts[i] = raised
+	} else {
+		a.active[active] = append(alerts, raised)
+	}
+	a.lock.Unlock()
+
+	return a.postAlerts([]alert{raised})
+}
+
+// expireAlerts forgets alerts that Alertmanager will already have resolved
+// on its own.  Must be called with the lock held.
+//
+func (a *alertmanagerForwarder) expireAlerts(now time.Time) {
+	for key, alerts := range a.active {
+		current := alerts[:0]
+		for _, raised := range alerts {
+			if !now.After(raised.EndsAt) {
+				current = append(current, raised)
+			}
+		}
+		if len(current) == 0 {
+			delete(a.active, key)
+		} else {
+			a.active[key] = current
+		}
+	}
+}
+
+// forgetAlerts stops tracking the alerts that have been resolved.  Must be
+// called with the lock held.
+//
+func (a *alertmanagerForwarder) forgetAlerts(key activeKey, resolved []alert) {
+	current := a.active[key][:0]
+	for _, raised := range a.active[key] {
+		found := false
+		for _, r := range resolved {
+			found = found || sameLabels(raised.Labels, r.Labels)
+		}
+		if !found {
+			current = append(current, raised)
+		}
+	}
+	if len(current) == 0 {
+		delete(a.active, key)
+	} else {
+		a.active[key] = current
+	}
+}
+
+func sameLabels(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if b[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *alertmanagerForwarder) postAlerts(alerts []alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", a.url+alertsEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.bearerToken)
+	} else if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Alertmanager returned HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (a *alertmanagerForwarder) SigUsr1() error {
+	return nil
+}
+
+func (a *alertmanagerForwarder) SigUsr2() error {
+	return nil
+}
+
+func (a *alertmanagerForwarder) Close() error {
+	return nil
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin alertmanagerForwarder
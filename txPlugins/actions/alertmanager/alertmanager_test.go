@@ -0,0 +1,219 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+// makeLinkTrap creates a v1 linkDown (generic 2) or linkUp (generic 3) trap
+func makeLinkTrap(generic int, ifIndex int) *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	trap.Data.Enterprise = ".1.3.6.1.6.3.1.1.5"
+	trap.Data.GenericTrap = generic
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1." + strconv.Itoa(ifIndex), Type: g.Integer, Value: ifIndex},
+	}
+	return &trap
+}
+
+func TestRaiseAndResolve(t *testing.T) {
+	var received [][]alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != alertsEndpoint {
+			t.Errorf("Unexpected Alertmanager path: %s", r.URL.Path)
+		}
+		var alerts []alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Errorf("Unable to decode alerts: %s", err)
+		}
+		received = append(received, alerts)
+	}))
+	defer server.Close()
+
+	var a alertmanagerForwarder
+	args := map[string]string{
+		"url":                server.URL,
+		"ttl":                "600",
+		"key":                `{{ .SrcIP }}/{{ .Varbind "1.3.6.1.2.1.2.2.1.1" }}`,
+		"clear_trap_oids":    "1.3.6.1.6.3.1.1.5.3=1.3.6.1.6.3.1.1.5.4",
+		"label.alertname":    "LinkDown",
+		"label.instance":     "{{ .SrcIP }}",
+		"label.ifIndex":      `{{ .Varbind "1.3.6.1.2.1.2.2.1.1" }}`,
+		"annotation.summary": "Interface down on {{ .AgentAddress }}",
+	}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	start := time.Now()
+	if err := a.ProcessTrap(makeLinkTrap(2, 3)); err != nil {
+		t.Fatalf("Unable to raise alert: %s", err)
+	}
+	if len(received) != 1 || received[0][0].Labels["ifIndex"] != "3" || received[0][0].Labels["alertname"] != "LinkDown" {
+		t.Fatalf("Unexpected raised alert: %v", received)
+	}
+	if received[0][0].EndsAt.Before(start.Add(590 * time.Second)) {
+		t.Errorf("endsAt does not honour the TTL: %v", received[0][0].EndsAt)
+	}
+
+	// linkUp on another interface has nothing to resolve
+	a.ProcessTrap(makeLinkTrap(3, 4))
+	if len(received) != 1 {
+		t.Errorf("linkUp for a different ifIndex should not send an alert")
+	}
+
+	a.ProcessTrap(makeLinkTrap(3, 3))
+	if len(received) != 2 {
+		t.Fatalf("linkUp did not resolve the alert")
+	}
+	resolved := received[1][0]
+	if !sameLabels(resolved.Labels, received[0][0].Labels) {
+		t.Errorf("Resolved alert labels differ from raised alert: %v", resolved.Labels)
+	}
+	if resolved.EndsAt.After(time.Now()) {
+		t.Errorf("Resolved alert endsAt is in the future: %v", resolved.EndsAt)
+	}
+	if len(a.active) != 0 {
+		t.Errorf("Resolved alert is still tracked as active")
+	}
+}
+
+func TestClearPairs(t *testing.T) {
+	var received [][]alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alerts []alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Errorf("Unable to decode alerts: %s", err)
+		}
+		received = append(received, alerts)
+	}))
+	defer server.Close()
+
+	var a alertmanagerForwarder
+	args := map[string]string{
+		"url":             server.URL,
+		"key":             "{{ .SrcIP }}",
+		"clear_trap_oids": "1.3.6.1.6.3.1.1.5.3=1.3.6.1.6.3.1.1.5.4",
+		"label.trap_oid":  "{{ .TrapOID }}",
+		"label.ifIndex":   `{{ .Varbind "1.3.6.1.2.1.2.2.1.1" }}`,
+	}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	// Two linkDowns with the same key but different labels, and a coldStart
+	a.ProcessTrap(makeLinkTrap(2, 3))
+	a.ProcessTrap(makeLinkTrap(2, 4))
+	a.ProcessTrap(makeLinkTrap(0, 1))
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 raised alerts, got %d", len(received))
+	}
+
+	a.ProcessTrap(makeLinkTrap(3, 3))
+	if len(received) != 4 || len(received[3]) != 2 {
+		t.Fatalf("linkUp should resolve both linkDown alerts: %v", received)
+	}
+	for _, resolved := range received[3] {
+		if resolved.Labels["trap_oid"] != "1.3.6.1.6.3.1.1.5.3" {
+			t.Errorf("linkUp resolved an unrelated alert: %v", resolved.Labels)
+		}
+	}
+	if len(a.active) != 1 {
+		t.Errorf("The coldStart alert should still be active: %v", a.active)
+	}
+
+	for _, pairs := range []string{"1.3.6.1.6.3.1.1.5.4", "1.3.6.1.6.3.1.1.5.3=", "NO-SUCH-MIB::x=1.3.6.1.6.3.1.1.5.4"} {
+		if _, err := parseClearOids(pairs); err == nil {
+			t.Errorf("Invalid clear_trap_oids was accepted: %s", pairs)
+		}
+	}
+}
+
+func TestServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad alert", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	var a alertmanagerForwarder
+	if err := a.Configure(&testLog, map[string]string{"url": server.URL}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if err := a.ProcessTrap(makeLinkTrap(2, 1)); err == nil {
+		t.Errorf("HTTP error status was not reported")
+	}
+	if err := validateArguments(map[string]string{"url": "http://x", "label.bad-name": "x"}); err == nil {
+		t.Errorf("Invalid label name was not detected")
+	}
+	if err := validateArguments(map[string]string{"url": "http://x", "clear_trap_oids": "1.3.6.1.6.3.1.1.5.3=1.3.6.1.6.3.1.1.5.4"}); err == nil {
+		t.Errorf("Missing key with clear_trap_oids was not detected")
+	}
+}
+
+func TestFailedResolve(t *testing.T) {
+	failing := false
+	var received [][]alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var alerts []alert
+		json.NewDecoder(r.Body).Decode(&alerts)
+		received = append(received, alerts)
+	}))
+	defer server.Close()
+
+	var a alertmanagerForwarder
+	args := map[string]string{
+		"url":             server.URL,
+		"key":             `{{ .SrcIP }}/{{ .Varbind "1.3.6.1.2.1.2.2.1.1" }}`,
+		"clear_trap_oids": "1.3.6.1.6.3.1.1.5.3=1.3.6.1.6.3.1.1.5.4",
+	}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	a.ProcessTrap(makeLinkTrap(2, 3))
+
+	// The alert is kept while Alertmanager can't take the resolve
+	failing = true
+	if err := a.ProcessTrap(makeLinkTrap(3, 3)); err == nil {
+		t.Errorf("Failed resolve was not reported")
+	}
+	if len(a.active) != 1 {
+		t.Fatalf("Alert was forgotten before it was resolved")
+	}
+
+	failing = false
+	if err := a.ProcessTrap(makeLinkTrap(3, 3)); err != nil {
+		t.Fatalf("Unable to resolve alert: %s", err)
+	}
+	if len(received) != 2 || len(received[1]) != 1 || received[1][0].EndsAt.After(time.Now()) {
+		t.Errorf("Alert was not resolved after the retry: %v", received)
+	}
+	if len(a.active) != 0 {
+		t.Errorf("Resolved alert is still tracked as active")
+	}
+}
@@ -6,23 +6,89 @@
 package main
 
 /*
- * This plugin streams traps to AWS Kinesis
+ * This plugin streams traps to an AWS Kinesis Data Stream
+ *
+ * Traps are converted to JSON (or the output of the template) and buffered until either batch_size records
+ * have been collected or flush_interval seconds have passed, and are then
+ * sent with a single PutRecords call.  Records that Kinesis rejects (eg
+ * because the shard throughput was exceeded) are retried with an exponential
+ * backoff.
+ *
+ * Arguments:
+ *   stream_name       - name of the Kinesis stream (required)
+ *   region            - AWS region (default: AWS_REGION or us-east-1)
+ *   endpoint          - override the service endpoint (eg a local emulator)
+ *   partition_key     - source_ip (default), agent_address, enterprise, hostname or random
+ *   access_key_id     - static credentials, otherwise the default AWS credential chain is used
+ *   secret_access_key
+ *   session_token
+ *   batch_size        - records per PutRecords call (default 100, max 500)
+ *   flush_interval    - seconds between flushes of a partial batch (default 5)
+ *   max_retries       - retries for throttled or failed records (default 5)
+ *   template          - Go template for the record data, instead of the JSON trap
+ *   template_file     - file containing the template
  */
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+
 	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	"github.com/rs/zerolog"
 )
 
 type kinesisConfig struct {
 	pluginLog *zerolog.Logger
+
+	streamName    string
+	partitionKey  string
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	template      *template.Template
+
+	client kinesisiface.KinesisAPI
+
+	lock      sync.Mutex
+	pending   []*kinesis.PutRecordsRequestEntry
+	stopFlush chan struct{}
+	flushDone chan struct{}
 }
 
 const pluginName = "AWS Kinesis"
 
+// Kinesis limits a PutRecords call to 500 records
+const maxBatchSize = 500
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 5
+	defaultMaxRetries    = 5
+	defaultRegion        = "us-east-1"
+)
+
+// Starting and maximum delay between retries of throttled records
+var retryBaseDelay = 100 * time.Millisecond
+var retryMaxDelay = 5 * time.Second
+
 func validateArguments(actionArgs map[string]string) error {
-	validArgs := map[string]bool{"traphost": true, "port": true, "snmp_version": true, "community": true}
+	validArgs := map[string]bool{"stream_name": true, "region": true, "endpoint": true, "partition_key": true,
+		"access_key_id": true, "secret_access_key": true, "session_token": true,
+		"batch_size": true, "flush_interval": true, "max_retries": true, "template": true, "template_file": true}
 
 	for key, _ := range actionArgs {
 		if _, ok := validArgs[key]; !ok {
@@ -30,9 +96,71 @@ func validateArguments(actionArgs map[string]string) error {
 		}
 	}
 
+	if actionArgs["stream_name"] == "" {
+		return fmt.Errorf("Missing the required 'stream_name' argument to the %s plugin", pluginName)
+	}
+
+	switch actionArgs["partition_key"] {
+	case "", "source_ip", "agent_address", "enterprise", "hostname", "random":
+	default:
+		return fmt.Errorf("Unsupported partition_key value for %s plugin: %s", pluginName, actionArgs["partition_key"])
+	}
+
 	return nil
 }
 
+// makeCredentials returns static credentials if an access key was configured,
+// or nil to let the SDK use its default credential chain (environment, shared
+// config, instance role).
+//
+func makeCredentials(actionArgs map[string]string) (*credentials.Credentials, error) {
+	if actionArgs["access_key_id"] == "" {
+		return nil, nil
+	}
+	var secrets [3]string
+	for i, key := range []string{"access_key_id", "secret_access_key", "session_token"} {
+		plaintext, err := pluginMeta.GetSecret(actionArgs[key])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode secret for %s: %s", key, err)
+		}
+		secrets[i] = plaintext
+	}
+	return credentials.NewStaticCredentials(secrets[0], secrets[1], secrets[2]), nil
+}
+
+func makeClient(actionArgs map[string]string) (kinesisiface.KinesisAPI, error) {
+	region := actionArgs["region"]
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = defaultRegion
+	}
+
+	// Retries are handled by putRecords so that throttled records inside a
+	// successful response are dealt with in the same way as throttled calls.
+	config := aws.NewConfig().WithRegion(region).WithMaxRetries(0)
+	if endpoint := actionArgs["endpoint"]; endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+		if strings.HasPrefix(endpoint, "http://") {
+			config = config.WithDisableSSL(true)
+		}
+	}
+	creds, err := makeCredentials(actionArgs)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		config = config.WithCredentials(creds)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return kinesis.New(sess), nil
+}
+
 func (p *kinesisConfig) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
 	pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
 	p.pluginLog = pluginLog
@@ -40,23 +168,213 @@ func (p *kinesisConfig) Configure(pluginLog *zerolog.Logger, actionArgs map[stri
 		return err
 	}
 
+	var err error
+	p.streamName = actionArgs["stream_name"]
+	p.partitionKey = actionArgs["partition_key"]
+	if p.partitionKey == "" {
+		p.partitionKey = "source_ip"
+	}
+	if p.batchSize, err = pluginMeta.GetIntArg(actionArgs, "batch_size", defaultBatchSize, pluginName); err != nil {
+		return err
+	}
+	if p.batchSize == 0 || p.batchSize > maxBatchSize {
+		return fmt.Errorf("batch_size argument to %s plugin must be between 1 and %d", pluginName, maxBatchSize)
+	}
+	var interval int
+	if interval, err = pluginMeta.GetIntArg(actionArgs, "flush_interval", defaultFlushInterval, pluginName); err != nil {
+		return err
+	}
+	p.flushInterval = time.Duration(interval) * time.Second
+	if p.maxRetries, err = pluginMeta.GetIntArg(actionArgs, "max_retries", defaultMaxRetries, pluginName); err != nil {
+		return err
+	}
+	if p.template, err = pluginMeta.GetTemplateArg(actionArgs, pluginName); err != nil {
+		return err
+	}
+
+	if p.client, err = makeClient(actionArgs); err != nil {
+		return err
+	}
+
+	if p.flushInterval > 0 {
+		p.stopFlush = make(chan struct{})
+		p.flushDone = make(chan struct{})
+		go p.flushTicker()
+	}
+
+	p.pluginLog.Info().Str("stream_name", p.streamName).Str("partition_key", p.partitionKey).Int("batch_size", p.batchSize).Msg("Added Kinesis stream destination")
 	return nil
 }
 
-func (p kinesisConfig) ProcessTrap(trap *pluginMeta.Trap) error {
-	p.pluginLog.Info().Str("plugin", pluginName).Msg("Noop processing trap")
-	return nil
+// makePartitionKey picks the trap field used by Kinesis to assign the record
+// to a shard.  Records with the same key keep their relative ordering.
+//
+func makePartitionKey(keyType string, trap *pluginMeta.Trap) string {
+	var key string
+	switch keyType {
+	case "agent_address":
+		key = trap.Data.AgentAddress
+	case "enterprise":
+		key = strings.Trim(trap.Data.Enterprise, ".")
+	case "hostname":
+		key = trap.Hostname
+	case "random":
+		key = strconv.FormatInt(rand.Int63(), 10) // #nosec G404 -- only used for shard distribution
+	default:
+		key = trap.SrcIP.String()
+	}
+	// Kinesis rejects empty partition keys
+	if key == "" {
+		key = "unknown"
+	}
+	return key
 }
 
-func (p kinesisConfig) Close() error {
-	return nil
+// makeRecordData returns the record sent to Kinesis for the trap
+//
+func (p *kinesisConfig) makeRecordData(trap *pluginMeta.Trap) ([]byte, error) {
+	if p.template != nil {
+		data, err := pluginMeta.ExecuteTemplate(p.template, trap)
+		return []byte(data), err
+	}
+	return json.Marshal(trap)
+}
+
+func (p *kinesisConfig) ProcessTrap(trap *pluginMeta.Trap) error {
+	data, err := p.makeRecordData(trap)
+	if err != nil {
+		return err
+	}
+	record := &kinesis.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(makePartitionKey(p.partitionKey, trap)),
+	}
+
+	var batch []*kinesis.PutRecordsRequestEntry
+	p.lock.Lock()
+	p.pending = append(p.pending, record)
+	if len(p.pending) >= p.batchSize {
+		batch = p.pending
+		p.pending = nil
+	}
+	p.lock.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+	return p.putRecords(batch)
+}
+
+// flush sends any buffered records, regardless of the batch size
+//
+func (p *kinesisConfig) flush() error {
+	p.lock.Lock()
+	batch := p.pending
+	p.pending = nil
+	p.lock.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return p.putRecords(batch)
+}
+
+// flushTicker periodically sends partial batches so that traps don't sit in
+// the buffer during quiet periods.
+//
+func (p *kinesisConfig) flushTicker() {
+	ticker := time.NewTicker(p.flushInterval)
+	defer close(p.flushDone)
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.flush(); err != nil {
+				p.pluginLog.Error().Err(err).Str("plugin", pluginName).Str("stream_name", p.streamName).Msg("Unable to send records to Kinesis")
+			}
+		case <-p.stopFlush:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// isThrottled returns true if the error from a Kinesis call is transient and
+// the request should be retried.
+//
+func isThrottled(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case kinesis.ErrCodeProvisionedThroughputExceededException,
+			kinesis.ErrCodeLimitExceededException,
+			kinesis.ErrCodeKMSThrottlingException,
+			"ThrottlingException", "InternalFailure", "ServiceUnavailable":
+			return true
+		}
+	}
+	return false
+}
+
+// putRecords sends a batch of records to the stream, retrying the whole call
+// when it is throttled and re-sending only the rejected records when the
+// call partially succeeds.
+//
+func (p *kinesisConfig) putRecords(records []*kinesis.PutRecordsRequestEntry) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		output, err := p.client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(p.streamName),
+			Records:    records,
+		})
+		if err != nil {
+			if !isThrottled(err) || attempt >= p.maxRetries {
+				return err
+			}
+		} else {
+			if aws.Int64Value(output.FailedRecordCount) == 0 {
+				return nil
+			}
+			records = failedRecords(records, output.Records)
+			if attempt >= p.maxRetries {
+				return fmt.Errorf("%d records were not accepted by Kinesis stream %s after %d retries", len(records), p.streamName, attempt)
+			}
+		}
+
+		p.pluginLog.Debug().Str("plugin", pluginName).Int("attempt", attempt+1).Int("records", len(records)).Msg("Retrying throttled Kinesis records")
+		time.Sleep(delay)
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// failedRecords returns the subset of the request entries that Kinesis
+// reported as failed.  The results are in the same order as the request.
+//
+func failedRecords(records []*kinesis.PutRecordsRequestEntry, results []*kinesis.PutRecordsResultEntry) []*kinesis.PutRecordsRequestEntry {
+	var failed []*kinesis.PutRecordsRequestEntry
+	for i, result := range results {
+		if i < len(records) && aws.StringValue(result.ErrorCode) != "" {
+			failed = append(failed, records[i])
+		}
+	}
+	return failed
+}
+
+func (p *kinesisConfig) Close() error {
+	if p.stopFlush != nil {
+		close(p.stopFlush)
+		<-p.flushDone
+		p.stopFlush = nil
+	}
+	return p.flush()
 }
 
-func (p kinesisConfig) SigUsr1() error {
+func (p *kinesisConfig) SigUsr1() error {
 	return nil
 }
 
-func (p kinesisConfig) SigUsr2() error {
+func (p *kinesisConfig) SigUsr2() error {
 	return nil
 }
 
@@ -0,0 +1,149 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	retryBaseDelay = 0
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+// fakeKinesis rejects the first record of each call until rejectCalls is
+// exhausted, and throttles the whole call throttleCalls times.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+	throttleCalls int
+	rejectCalls   int
+	calls         int
+	accepted      []string
+}
+
+func (f *fakeKinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	f.calls++
+	if f.throttleCalls > 0 {
+		f.throttleCalls--
+		return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	}
+	output := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for i, record := range input.Records {
+		result := &kinesis.PutRecordsResultEntry{}
+		if i == 0 && f.rejectCalls > 0 {
+			f.rejectCalls--
+			result.ErrorCode = aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)
+			output.FailedRecordCount = aws.Int64(1)
+		} else {
+			f.accepted = append(f.accepted, aws.StringValue(record.PartitionKey))
+		}
+		output.Records = append(output.Records, result)
+	}
+	return output, nil
+}
+
+func makeTestPlugin(client *fakeKinesis) *kinesisConfig {
+	return &kinesisConfig{
+		pluginLog:    &testLog,
+		streamName:   "traps",
+		partitionKey: "source_ip",
+		batchSize:    2,
+		maxRetries:   3,
+		client:       client,
+	}
+}
+
+func TestBatchAndRetry(t *testing.T) {
+	client := &fakeKinesis{throttleCalls: 1, rejectCalls: 1}
+	p := makeTestPlugin(client)
+
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1")}
+	if err := p.ProcessTrap(&trap); err != nil {
+		t.Errorf("Unexpected error buffering trap: %s", err)
+	}
+	if client.calls != 0 {
+		t.Errorf("Trap was sent before the batch was full")
+	}
+
+	trap.SrcIP = net.ParseIP("192.0.2.2")
+	if err := p.ProcessTrap(&trap); err != nil {
+		t.Errorf("Unable to send batch: %s", err)
+	}
+	// throttled call, partial failure, retry of the single failed record
+	if client.calls != 3 {
+		t.Errorf("Expected 3 PutRecords calls, got %d", client.calls)
+	}
+	if len(client.accepted) != 2 || client.accepted[1] != "192.0.2.1" {
+		t.Errorf("Rejected record was not retried: %v", client.accepted)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	client := &fakeKinesis{rejectCalls: 10}
+	p := makeTestPlugin(client)
+	p.batchSize = 1
+
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1")}
+	if err := p.ProcessTrap(&trap); err == nil {
+		t.Errorf("Expected an error once retries were exhausted")
+	}
+	if client.calls != p.maxRetries+1 {
+		t.Errorf("Expected %d PutRecords calls, got %d", p.maxRetries+1, client.calls)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), Hostname: "trapmux1"}
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.Data.Enterprise = ".1.3.6.1.4.1.9"
+
+	expected := map[string]string{
+		"source_ip":     "192.0.2.1",
+		"agent_address": "10.1.1.1",
+		"enterprise":    "1.3.6.1.4.1.9",
+		"hostname":      "trapmux1",
+	}
+	for keyType, value := range expected {
+		if key := makePartitionKey(keyType, &trap); key != value {
+			t.Errorf("Partition key %s: %s != %s", keyType, key, value)
+		}
+	}
+	if err := validateArguments(map[string]string{"stream_name": "traps", "partition_key": "bogus"}); err == nil {
+		t.Errorf("Invalid partition_key was not detected")
+	}
+	if err := validateArguments(map[string]string{"traphost": "localhost"}); err == nil {
+		t.Errorf("Forwarder arguments should not be accepted")
+	}
+}
+
+func TestRecordTemplate(t *testing.T) {
+	p := makeTestPlugin(&fakeKinesis{})
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1")}
+	if data, err := p.makeRecordData(&trap); err != nil || data[0] != '{' {
+		t.Errorf("Expected the JSON trap without a template: %s (%v)", data, err)
+	}
+
+	var err error
+	if p.template, err = pluginMeta.GetTemplateArg(map[string]string{"template": "trap from {{ .SrcIP }}"}, pluginName); err != nil {
+		t.Fatalf("Unable to parse template: %s", err)
+	}
+	if data, err := p.makeRecordData(&trap); err != nil || string(data) != "trap from 192.0.2.1" {
+		t.Errorf("Unexpected record from template: %s (%v)", data, err)
+	}
+}
@@ -7,11 +7,17 @@ package main
 
 /*
  * This plugin saves raw SNMP traps to disk, in a fashion that can be replayed
+ *
+ * Formats:
+ *   gob  - Go binary encoding (default)
+ *   json - the canonical JSON form of the trap, which can be read by other tools,
+ *          along with the packet as received
  */
 
 import (
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -25,12 +31,11 @@ type trapCapture struct {
 	fileExpr   string
 	fileFormat string
 	counter    int
-	main_log *zerolog.Logger
+	main_log   *zerolog.Logger
 }
 
 const pluginName = "trap capture"
 
-// currently only support gob format
 func validateArguments(actionArgs map[string]string) error {
 	validArgs := map[string]bool{"dir": true, "file_expr": true, "format": true}
 
@@ -61,8 +66,12 @@ func (a *trapCapture) Configure(pluginLog *zerolog.Logger, actionArgs map[string
 	}
 
 	a.fileFormat = actionArgs["format"]
-	if a.fileFormat == "" {
+	switch a.fileFormat {
+	case "":
 		a.fileFormat = "gob"
+	case "gob", "json":
+	default:
+		return fmt.Errorf("Unknown file format '%s'", a.fileFormat)
 	}
 	a.main_log.Info().Str("file_expr", a.fileExpr).Str("dir", a.dir).Msg("Added capture destination")
 
@@ -79,6 +88,8 @@ func (a *trapCapture) ProcessTrap(trap *pluginMeta.Trap) error {
 		switch a.fileFormat {
 		case "gob", "":
 			err = saveCaptureGob(a.main_log, filename, trap)
+		case "json":
+			err = saveCaptureJSON(a.main_log, filename, trap)
 		default:
 			return fmt.Errorf("Unknown file format '%s'", a.fileFormat)
 		}
@@ -101,17 +112,24 @@ func saveCaptureGob(pluginLog *zerolog.Logger, filename string, trap *pluginMeta
 		return err
 	}
 
-defer func() {
-    if err := fd.Close(); err != nil {
-                pluginLog.Error().Err(err).Str("capture_file", filename).Msg("Unable to load capture file")
-    }
-}()
-
+	defer func() {
+		if err := fd.Close(); err != nil {
+			pluginLog.Error().Err(err).Str("capture_file", filename).Msg("Unable to load capture file")
+		}
+	}()
 
 	encoder := gob.NewEncoder(fd)
 	return encoder.Encode(trap)
 }
 
+func saveCaptureJSON(pluginLog *zerolog.Logger, filename string, trap *pluginMeta.Trap) error {
+	data, err := trap.MarshalCaptureJSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Clean(filename), append(data, '\n'), 0600)
+}
+
 func (p trapCapture) SigUsr1() error {
 	return nil
 }
@@ -7,14 +7,45 @@
 package main
 
 /*
- * Dump data out in Clickhouse CSV data format, for adding to a Clickhouse database
+ * Send trap data to a Clickhouse database, either by inserting batches
+ * directly over the Clickhouse HTTP interface, or by dumping the data out in
+ * Clickhouse CSV data format to be loaded by build/process_csv_data.sh
+ *
+ * Arguments:
+ *   filename              - CSV file to write to (also the fallback when the server is unreachable)
+ *   size_mb               - rotate the CSV file after it reaches this size
+ *   backups_max           - number of rotated CSV files to keep
+ *   compress_after_rotate - gzip rotated CSV files
+ *   url                   - Clickhouse HTTP interface (eg http://localhost:8123)
+ *   database              - database containing the table (default: server default)
+ *   table                 - table to insert into (default: snmp_traps)
+ *   columns               - comma-separated Field=column renames (eg TrapHost=host)
+ *   username
+ *   password
+ *   batch_size            - rows per INSERT (default 1000)
+ *   flush_interval        - seconds between inserts of a partial batch (default 10)
+ *   timeout               - seconds to wait for the server (default 10)
+ *   metadata              - also write the TrapDeviceName and TrapMetadata columns (default false)
+ *   template              - Go template for the lines of the CSV file, instead of the snmp_traps columns
+ *   template_file         - file containing the template
  */
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"os"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	"github.com/rs/zerolog"
@@ -24,37 +55,138 @@ import (
 
 const pluginName = "Clickhouse"
 
+const (
+	defaultTable         = "snmp_traps"
+	defaultBatchSize     = 1000
+	defaultFlushInterval = 10
+	defaultTimeout       = 10
+)
+
+// trapFields are the columns of the snmp_traps table in build/trapmux.sql,
+// in the order used by the CSV output.
+//
+var trapFields = []string{
+	"TrapDate",
+	"TrapTimestamp",
+	"TrapHost",
+	"TrapNumber",
+	"TrapSourceIP",
+	"TrapAgentAddress",
+	"TrapGenericType",
+	"TrapSpecificType",
+	"TrapEnterpriseOID",
+	"TrapVarBinds.ObjID",
+	"TrapVarBinds.Value",
+}
+
+// metadataFields are the optional columns after the varbinds for the device
+// name and trap metadata, written with the metadata argument
+//
+var metadataFields = []string{
+	"TrapDeviceName",
+	"TrapMetadata",
+}
+
 type ClickhouseExport struct {
 	logFile   string
-	fd        *os.File
-	logger    lumberjack.Logger
+	logger    *lumberjack.Logger
 	logHandle *log.Logger
-	isBroken  bool
+	template  *template.Template
+	metadata  bool
+	fields    []string
+
+	// Direct insertion settings
+	url           string
+	database      string
+	table         string
+	columns       map[string]string
+	username      string
+	password      string
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+
+	lock      sync.Mutex
+	pending   []pendingRow
+	stopFlush chan struct{}
+	flushDone chan struct{}
 
 	main_log *zerolog.Logger
 }
 
+// pendingRow is a trap waiting to be inserted, with its line for the CSV
+// file if it has to fall back to that
+//
+type pendingRow struct {
+	row  map[string]interface{}
+	line string
+}
+
 // makeCsvLogger initializes and returns a lumberjack.Logger (logger with
 // built-in log rotation management).
 //
-func makeCsvLogger(logfile string) *lumberjack.Logger {
+func makeCsvLogger(logfile string, actionArgs map[string]string) (*lumberjack.Logger, error) {
+	var err error
 	l := lumberjack.Logger{
 		Filename: logfile,
 	}
-	return &l
+	if l.MaxSize, err = pluginMeta.GetIntArg(actionArgs, "size_mb", 0, pluginName); err != nil {
+		return nil, err
+	}
+	if l.MaxBackups, err = pluginMeta.GetIntArg(actionArgs, "backups_max", 0, pluginName); err != nil {
+		return nil, err
+	}
+	if value, ok := actionArgs["compress_after_rotate"]; ok {
+		if l.Compress, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Invalid value for compress_after_rotate argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	return &l, nil
 }
 
 func validateArguments(actionArgs map[string]string) error {
-	validArgs := map[string]bool{"filename": true, "size_mb": true, "backups_max": true, "compress_after_rotate": true}
+	validArgs := map[string]bool{"filename": true, "size_mb": true, "backups_max": true, "compress_after_rotate": true,
+		"url": true, "database": true, "table": true, "columns": true, "username": true, "password": true,
+		"batch_size": true, "flush_interval": true, "timeout": true, "template": true, "template_file": true, "metadata": true}
 
 	for key, _ := range actionArgs {
 		if _, ok := validArgs[key]; !ok {
 			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
 		}
 	}
+	if actionArgs["filename"] == "" && actionArgs["url"] == "" {
+		return fmt.Errorf("The %s plugin requires a 'filename' or 'url' argument", pluginName)
+	}
 	return nil
 }
 
+// parseColumns converts the 'columns' argument (Field=column,...) into a
+// lookup of trap field to table column name.
+//
+func parseColumns(mapping string) (map[string]string, error) {
+	columns := make(map[string]string)
+	for _, field := range trapFields {
+		columns[field] = field
+	}
+	for _, field := range metadataFields {
+		columns[field] = field
+	}
+	if mapping == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid column mapping for %s plugin: %s", pluginName, pair)
+		}
+		if _, ok := columns[kv[0]]; !ok {
+			return nil, fmt.Errorf("Unknown trap field in column mapping for %s plugin: %s", pluginName, kv[0])
+		}
+		columns[kv[0]] = kv[1]
+	}
+	return columns, nil
+}
+
 func (a *ClickhouseExport) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
 	if err := validateArguments(actionArgs); err != nil {
 		return err
@@ -62,86 +194,347 @@ func (a *ClickhouseExport) Configure(pluginLog *zerolog.Logger, actionArgs map[s
 
 	a.main_log = pluginLog
 
-	a.logFile = actionArgs["filename"]
-        // gosec complains if perms are less than 600
-	fd, err := os.OpenFile(a.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
+	var err error
+	if a.template, err = pluginMeta.GetTemplateArg(actionArgs, pluginName); err != nil {
 		return err
 	}
-	a.fd = fd
-	a.logHandle = log.New(fd, "", 0)
-	a.logger = lumberjack.Logger{
-		Filename: a.logFile,
+	a.metadata = false
+	if value := actionArgs["metadata"]; value != "" {
+		if a.metadata, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid value for metadata argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	a.fields = trapFields
+	if a.metadata {
+		a.fields = append(append([]string{}, trapFields...), metadataFields...)
+	}
+	a.logFile = actionArgs["filename"]
+	if a.logFile != "" {
+		if a.logger, err = makeCsvLogger(a.logFile, actionArgs); err != nil {
+			return err
+		}
+		a.logHandle = log.New(a.logger, "", 0)
+		a.main_log.Info().Str("logfile", a.logFile).Msg("Added Clickhouse CSV log destination")
 	}
-	a.logHandle.SetOutput(&a.logger)
-	a.main_log.Info().Str("logfile", a.logFile).Msg("Added Clickhouse CSV log destination")
 
+	a.url = actionArgs["url"]
+	if a.url == "" {
+		return nil
+	}
+	if err = a.configureInsert(actionArgs); err != nil {
+		return err
+	}
+	a.main_log.Info().Str("url", a.url).Str("table", a.table).Int("batch_size", a.batchSize).Msg("Added Clickhouse database destination")
 	return nil
 }
 
-func (a ClickhouseExport) ProcessTrap(trap *pluginMeta.Trap) error {
-	logCsvTrap(trap, a.logHandle)
+// configureInsert sets up direct insertion over the Clickhouse HTTP interface
+//
+func (a *ClickhouseExport) configureInsert(actionArgs map[string]string) error {
+	var err error
+
+	a.database = actionArgs["database"]
+	a.table = actionArgs["table"]
+	if a.table == "" {
+		a.table = defaultTable
+	}
+	if a.columns, err = parseColumns(actionArgs["columns"]); err != nil {
+		return err
+	}
+	a.username = actionArgs["username"]
+	if a.password, err = pluginMeta.GetSecret(actionArgs["password"]); err != nil {
+		return err
+	}
+	if a.batchSize, err = pluginMeta.GetIntArg(actionArgs, "batch_size", defaultBatchSize, pluginName); err != nil {
+		return err
+	}
+	if a.batchSize == 0 {
+		a.batchSize = 1
+	}
+	var seconds int
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "timeout", defaultTimeout, pluginName); err != nil {
+		return err
+	}
+	a.client = &http.Client{Timeout: time.Duration(seconds) * time.Second}
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "flush_interval", defaultFlushInterval, pluginName); err != nil {
+		return err
+	}
+	a.flushInterval = time.Duration(seconds) * time.Second
+
+	if a.flushInterval > 0 {
+		a.stopFlush = make(chan struct{})
+		a.flushDone = make(chan struct{})
+		go a.flushTicker()
+	}
 	return nil
 }
 
-func (a ClickhouseExport) SigUsr1() error {
-	fmt.Println("SigUsr1")
-	return nil
+func (a *ClickhouseExport) ProcessTrap(trap *pluginMeta.Trap) error {
+	line := ""
+	if a.template != nil {
+		var err error
+		if line, err = pluginMeta.ExecuteTemplate(a.template, trap); err != nil {
+			return err
+		}
+	}
+	row := makeTrapRow(trap)
+	if a.url == "" {
+		a.logRow(pendingRow{row: row, line: line})
+		return nil
+	}
+
+	var batch []pendingRow
+	a.lock.Lock()
+	a.pending = append(a.pending, pendingRow{row: row, line: line})
+	if len(a.pending) >= a.batchSize {
+		batch = a.pending
+		a.pending = nil
+	}
+	a.lock.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+	return a.sendBatch(batch)
+}
+
+// flush inserts any buffered rows, regardless of the batch size
+//
+func (a *ClickhouseExport) flush() error {
+	a.lock.Lock()
+	batch := a.pending
+	a.pending = nil
+	a.lock.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return a.sendBatch(batch)
 }
 
-func (a ClickhouseExport) Close() error {
-	return a.fd.Close()
+// flushTicker periodically inserts partial batches so that traps don't sit in
+// the buffer during quiet periods.
+//
+func (a *ClickhouseExport) flushTicker() {
+	ticker := time.NewTicker(a.flushInterval)
+	defer close(a.flushDone)
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.flush(); err != nil {
+				a.main_log.Error().Err(err).Str("plugin", pluginName).Str("url", a.url).Msg("Unable to insert traps")
+			}
+		case <-a.stopFlush:
+			ticker.Stop()
+			return
+		}
+	}
 }
 
-func (a ClickhouseExport) SigUsr2() error {
-	a.main_log.Info().Str("logfile", a.logFile).Msg("Rotating Clickhouse CSV file")
-	return a.logger.Rotate()
+// sendBatch inserts the rows into the database, and falls back to writing
+// them to the CSV file if the insert fails.
+//
+func (a *ClickhouseExport) sendBatch(batch []pendingRow) error {
+	err := a.insertRows(batch)
+	if err == nil {
+		return nil
+	}
+	if a.logHandle == nil {
+		return err
+	}
+	a.main_log.Warn().Err(err).Str("url", a.url).Str("logfile", a.logFile).Int("rows", len(batch)).Msg("Clickhouse insert failed -- writing traps to CSV file")
+	for _, pending := range batch {
+		a.logRow(pending)
+	}
+	return nil
+}
+
+// logRow writes a trap to the CSV file, as the template line if there is
+// one or else in the column order of the table
+//
+func (a *ClickhouseExport) logRow(pending pendingRow) {
+	if a.template != nil {
+		a.logHandle.Print(pending.line)
+	} else {
+		a.logHandle.Print(makeCsvLine(pending.row, a.fields))
+	}
 }
 
-// logCsvTrap takes care of logging the given trap to the given ClickhouseExport
-// destination.
+// insertQuery returns the INSERT statement for the configured table and
+// column mapping.
 //
-func logCsvTrap(trap *pluginMeta.Trap, l *log.Logger) {
-	l.Printf(makeTrapLogCsvEntry(trap))
+func (a *ClickhouseExport) insertQuery() string {
+	var names []string
+	for _, field := range a.fields {
+		names = append(names, "`"+a.columns[field]+"`")
+	}
+	table := "`" + a.table + "`"
+	if a.database != "" {
+		table = "`" + a.database + "`." + table
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) FORMAT JSONEachRow", table, strings.Join(names, ", "))
 }
 
-// makeTrapLogEntry creates a log entry string for the given trap data.
-// Note that this particular implementation expects to be dealing with
-// only v1 traps.
+// insertRows posts the rows to the Clickhouse HTTP interface as JSONEachRow
 //
-func makeTrapLogCsvEntry(trap *pluginMeta.Trap) string {
-	var csv [11]string
-	trapMap := trap.Trap2Map()
+func (a *ClickhouseExport) insertRows(batch []pendingRow) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, pending := range batch {
+		mapped := make(map[string]interface{}, len(a.fields))
+		for _, field := range a.fields {
+			mapped[a.columns[field]] = pending.row[field]
+		}
+		if err := encoder.Encode(mapped); err != nil {
+			return err
+		}
+	}
 
-	csv[0] = trapMap["TrapDate"]
-	csv[1] = trapMap["TrapTimestamp"]
-	csv[2] = trapMap["TrapHost"]
-	csv[3] = trapMap["TrapNumber"]
-	csv[4] = trapMap["TrapSourceIP"]
-	csv[5] = trapMap["TrapAgentAddress"]
-	csv[6] = trapMap["TrapGenericType"]
-	csv[7] = trapMap["TrapSpecificType"]
-	csv[8] = trapMap["TrapEnterpriseOID"]
+	params := url.Values{}
+	params.Set("query", a.insertQuery())
+	req, err := http.NewRequest("POST", a.url+"/?"+params.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	if a.username != "" {
+		req.Header.Set("X-ClickHouse-User", a.username)
+		req.Header.Set("X-ClickHouse-Key", a.password)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Clickhouse returned HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (a *ClickhouseExport) SigUsr1() error {
+	return nil
+}
+
+func (a *ClickhouseExport) Close() error {
+	var err error
+	if a.stopFlush != nil {
+		close(a.stopFlush)
+		<-a.flushDone
+		a.stopFlush = nil
+	}
+	if a.url != "" {
+		err = a.flush()
+	}
+	if a.logger != nil {
+		if cerr := a.logger.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (a *ClickhouseExport) SigUsr2() error {
+	if a.logger == nil {
+		return nil
+	}
+	a.main_log.Info().Str("logfile", a.logFile).Msg("Rotating Clickhouse CSV file")
+	return a.logger.Rotate()
+}
+
+// makeTrapRow converts a trap into typed column values for the snmp_traps
+// table, keyed by the trap field name.
+//
+func makeTrapRow(trap *pluginMeta.Trap) map[string]interface{} {
+	now := trap.Time()
+	raw := trap.Data
 
-	// Varbinds are split to separate arrays - one for the ObjectIDs,
-	// and the other for Values
 	var vbObj []string
 	var vbVal []string
+	for _, v := range raw.Variables {
+		vbObj = append(vbObj, strings.Trim(v.Name, "."))
+		vbVal = append(vbVal, pluginMeta.VarbindString(v))
+	}
+	// Copied as the row may be buffered while later actions change the trap
+	metadata := make(map[string]string, len(trap.Metadata))
+	for key, value := range trap.Metadata {
+		metadata[key] = value
+	}
 
-	for key, value := range trapMap {
-		if strings.HasPrefix(key, "Trap") {
-			continue
+	return map[string]interface{}{
+		"TrapDate":           now.Format("2006-01-02"),
+		"TrapTimestamp":      now.Format("2006-01-02 15:04:05"),
+		"TrapHost":           trap.Hostname,
+		"TrapNumber":         trap.TrapNumber,
+		"TrapSourceIP":       trap.SrcIP.String(),
+		"TrapAgentAddress":   agentAddress(trap),
+		"TrapGenericType":    raw.GenericTrap,
+		"TrapSpecificType":   raw.SpecificTrap,
+		"TrapEnterpriseOID":  strings.Trim(raw.Enterprise, "."),
+		"TrapVarBinds.ObjID": vbObj,
+		"TrapVarBinds.Value": vbVal,
+		"TrapDeviceName":     trap.DeviceName,
+		"TrapMetadata":       metadata,
+	}
+}
+
+// agentAddress is the v1 agent address of the trap, or the source address
+// for v2c/v3 traps which have none, as the column can't be empty
+//
+func agentAddress(trap *pluginMeta.Trap) string {
+	if address := trap.Data.AgentAddress; address != "" {
+		return address
+	}
+	return trap.SrcIP.String()
+}
+
+// makeCsvLine renders a row from makeTrapRow as a line of the CSV file
+// loaded by build/process_csv_data.sh.  Arrays and maps are written as
+// Clickhouse literals, eg ['1.3.6.1.2.1.2.2.1.1.3','1.3.6.1.2.1.2.2.1.2.3']
+//
+func makeCsvLine(row map[string]interface{}, fields []string) string {
+	record := make([]string, len(fields))
+	for i, field := range fields {
+		switch value := row[field].(type) {
+		case string:
+			record[i] = value
+		case []string:
+			quoted := make([]string, len(value))
+			for j, s := range value {
+				quoted[j] = quoteLiteral(s)
+			}
+			record[i] = "[" + strings.Join(quoted, ",") + "]"
+		case map[string]string:
+			keys := make([]string, 0, len(value))
+			for key := range value {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			pairs := make([]string, len(keys))
+			for j, key := range keys {
+				pairs[j] = quoteLiteral(key) + ":" + quoteLiteral(value[key])
+			}
+			record[i] = "{" + strings.Join(pairs, ",") + "}"
+		default:
+			record[i] = fmt.Sprint(value)
 		}
-		vbObj = append(vbObj, key)
-		vbVal = append(vbVal, value)
 	}
 
-	// Now we create the CS-escaped string representation of our varbind arrays
-	// and add them to the CSV array.
-	csv[9] = fmt.Sprintf("\"['%v']\"", strings.Join(vbObj, "','"))
-	csv[10] = fmt.Sprintf("\"['%v']\"", strings.Join(vbVal, "','"))
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(record)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// literalEscaper escapes the strings inside Clickhouse array and map literals
+var literalEscaper = strings.NewReplacer("\\", "\\\\", "'", "\\'")
 
-	return strings.Join(csv[:], ",")
+// quoteLiteral makes a Clickhouse string literal
+//
+func quoteLiteral(s string) string {
+	return "'" + literalEscaper.Replace(s) + "'"
 }
 
 var ActionPlugin ClickhouseExport
@@ -0,0 +1,262 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+func makeTestTrap() *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), Hostname: "trapmux1", TrapNumber: 7}
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.Data.Enterprise = ".1.3.6.1.4.1.9"
+	trap.Data.SpecificTrap = 3
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0")},
+	}
+	return &trap
+}
+
+func TestDirectInsert(t *testing.T) {
+	var query string
+	var rows []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			row := make(map[string]interface{})
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Errorf("Unable to decode inserted row: %s", err)
+			}
+			rows = append(rows, row)
+		}
+	}))
+	defer server.Close()
+
+	var a ClickhouseExport
+	args := map[string]string{"url": server.URL, "database": "traps", "batch_size": "2",
+		"flush_interval": "0", "columns": "TrapHost=host"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	a.ProcessTrap(makeTestTrap())
+	if rows != nil {
+		t.Errorf("Rows were inserted before the batch was full")
+	}
+	a.ProcessTrap(makeTestTrap())
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 inserted rows, got %d", len(rows))
+	}
+	if !strings.HasPrefix(query, "INSERT INTO `traps`.`snmp_traps` (") || !strings.Contains(query, "`host`") {
+		t.Errorf("Unexpected insert query: %s", query)
+	}
+	if rows[0]["host"] != "trapmux1" || rows[0]["TrapSpecificType"] != float64(3) {
+		t.Errorf("Unexpected row contents: %v", rows[0])
+	}
+	values := rows[0]["TrapVarBinds.Value"].([]interface{})
+	if len(values) != 2 || values[1] != "eth0" {
+		t.Errorf("Unexpected varbind values: %v", values)
+	}
+	a.Close()
+}
+
+func TestCsvFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Grab a port that nothing is listening on
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	unreachable := "http://" + listener.Addr().String()
+	listener.Close()
+
+	var a ClickhouseExport
+	csvFile := filepath.Join(dir, "traps.csv")
+	args := map[string]string{"url": unreachable, "filename": csvFile, "batch_size": "1", "flush_interval": "0"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if err := a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Errorf("Fallback to CSV should not report an error: %s", err)
+	}
+	a.Close()
+
+	data, err := ioutil.ReadFile(csvFile)
+	if err != nil {
+		t.Fatalf("CSV fallback file was not written: %s", err)
+	}
+	fields, err := csv.NewReader(strings.NewReader(string(data))).Read()
+	if err != nil || len(fields) != 11 || fields[2] != "trapmux1" || fields[7] != "3" {
+		t.Errorf("Unexpected CSV fallback line: %s", data)
+	}
+}
+
+func TestCsvLine(t *testing.T) {
+	trap := makeTestTrap()
+	trap.Hostname = `it's "trap\mux"`
+	trap.Data.Variables[1].Value = []byte(`it's a\b, "c"`)
+	trap.ReceivedAt = time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	line := makeCsvLine(makeTrapRow(trap), trapFields)
+	want := `2022-03-04,2022-03-04 05:06:07,"it's ""trap\mux""",7,192.0.2.1,10.1.1.1,0,3,1.3.6.1.4.1.9,` +
+		`"['1.3.6.1.2.1.2.2.1.1.3','1.3.6.1.2.1.2.2.1.2.3']","['3','it\'s a\\b, ""c""']"`
+	if line != want {
+		t.Errorf("Unexpected CSV line:\n%s\nexpected:\n%s", line, want)
+	}
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil || fields[2] != trap.Hostname {
+		t.Errorf("Host name was not kept in the CSV line: %q", fields)
+	}
+
+	// The file has the same layout without a url as in the fallback
+	dir, err := ioutil.TempDir("", "clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvFile := filepath.Join(dir, "traps.csv")
+	var a ClickhouseExport
+	if err := a.Configure(&testLog, map[string]string{"filename": csvFile}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	trap.Hostname = "100%s"
+	a.ProcessTrap(trap)
+	a.Close()
+	data, err := ioutil.ReadFile(csvFile)
+	if err != nil {
+		t.Fatalf("CSV file was not written: %s", err)
+	}
+	if string(data) != makeCsvLine(makeTrapRow(trap), trapFields)+"\n" {
+		t.Errorf("Unexpected CSV file: %s", data)
+	}
+}
+
+func TestColumnMapping(t *testing.T) {
+	if _, err := parseColumns("NotAField=x"); err == nil {
+		t.Errorf("Unknown trap field was not detected")
+	}
+	if _, err := parseColumns("TrapHost"); err == nil {
+		t.Errorf("Missing column name was not detected")
+	}
+	if err := validateArguments(map[string]string{"size_mb": "10"}); err == nil {
+		t.Errorf("Missing filename and url was not detected")
+	}
+}
+
+func TestV2cAgentAddress(t *testing.T) {
+	trap := makeTestTrap()
+	trap.Data.AgentAddress = ""
+	if address := makeTrapRow(trap)["TrapAgentAddress"]; address != "192.0.2.1" {
+		t.Errorf("Expected the source address for a v2c trap, got %v", address)
+	}
+	if fields := strings.Split(makeCsvLine(makeTrapRow(trap), trapFields), ","); fields[5] != "192.0.2.1" {
+		t.Errorf("Expected the source address in the CSV entry, got %s", fields[5])
+	}
+}
+
+func TestCsvTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	unreachable := "http://" + listener.Addr().String()
+	listener.Close()
+
+	// The template is used for the CSV file, and for the fallback to it
+	csvFile := filepath.Join(dir, "traps.csv")
+	for _, args := range []map[string]string{
+		{"filename": csvFile, "template": "{{ .SrcIP }},{{ .AgentAddress }}"},
+		{"filename": csvFile, "template": "{{ .SrcIP }},{{ .AgentAddress }}", "url": unreachable, "batch_size": "1", "flush_interval": "0"},
+	} {
+		var a ClickhouseExport
+		if err := a.Configure(&testLog, args); err != nil {
+			t.Fatalf("Unable to configure plugin: %s", err)
+		}
+		if err := a.ProcessTrap(makeTestTrap()); err != nil {
+			t.Errorf("Unable to write trap: %s", err)
+		}
+		a.Close()
+	}
+
+	data, err := ioutil.ReadFile(csvFile)
+	if err != nil {
+		t.Fatalf("CSV file was not written: %s", err)
+	}
+	if string(data) != "192.0.2.1,10.1.1.1\n192.0.2.1,10.1.1.1\n" {
+		t.Errorf("Unexpected CSV file from template: %q", data)
+	}
+}
+
+func TestMetadataColumns(t *testing.T) {
+	var query string
+	var row map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		json.NewDecoder(r.Body).Decode(&row)
+	}))
+	defer server.Close()
+
+	var a ClickhouseExport
+	args := map[string]string{"url": server.URL, "batch_size": "1", "flush_interval": "0", "metadata": "true"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	trap := makeTestTrap()
+	trap.DeviceName = "core1"
+	trap.SetMetadata("site", "lon1")
+	a.ProcessTrap(trap)
+	a.Close()
+	if !strings.Contains(query, "`TrapDeviceName`, `TrapMetadata`") {
+		t.Errorf("Metadata columns are missing from the insert: %s", query)
+	}
+	if metadata, _ := row["TrapMetadata"].(map[string]interface{}); row["TrapDeviceName"] != "core1" || metadata["site"] != "lon1" {
+		t.Errorf("Unexpected metadata columns: %v", row)
+	}
+
+	line := makeCsvLine(makeTrapRow(trap), metadataFields)
+	if line != `core1,{'site':'lon1'}` {
+		t.Errorf("Unexpected metadata in CSV line: %s", line)
+	}
+
+	// Without the argument the table is unchanged
+	var b ClickhouseExport
+	delete(args, "metadata")
+	if err := b.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if strings.Contains(b.insertQuery(), "TrapMetadata") {
+		t.Errorf("Metadata columns were inserted without the metadata argument")
+	}
+	b.Close()
+}
@@ -0,0 +1,511 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin looks up the device that sent a trap in an inventory, and
+ * adds the inventory columns (eg site, owner, role) to the trap metadata.
+ * Filters after this one can match on the metadata, and it is included in
+ * the JSON form of the trap, in templates ({{ .Metadata.site }}) and in the
+ * other outputs.
+ *
+ * The inventory is a CSV file with a header line, a JSON file (a list of
+ * objects, or an object of objects keyed by address) or an SQLite database.
+ * Addresses can be IP addresses, networks in CIDR form (the most specific
+ * network wins) or device names, for match_on device_name.
+ *
+ * Arguments:
+ *   source          - inventory file (required)
+ *   format          - csv, json or sqlite (default: from the file extension)
+ *   query           - SQL query for an sqlite inventory (default: SELECT * FROM inventory)
+ *   key_column      - column holding the device address (default: ip)
+ *   match_on        - trap fields to look up, in order, from agent_address,
+ *                     source_ip and device_name (default: agent_address,source_ip)
+ *   fields          - comma-separated columns to add (default: all of them)
+ *   prefix          - prefix for the metadata keys (default: none)
+ *   overwrite       - replace metadata added by earlier actions (default: true)
+ *   reload_interval - seconds between checks for a changed inventory (default 60,
+ *                     0 to only load it at startup, SIGHUP or SIGUSR1)
+ */
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "enrich"
+
+const (
+	defaultQuery          = "SELECT * FROM inventory"
+	defaultKeyColumn      = "ip"
+	defaultMatchOn        = "agent_address,source_ip"
+	defaultReloadInterval = 60
+)
+
+// inventory is the loaded source, indexed by address
+//
+type inventory struct {
+	hosts    map[string]map[string]string
+	networks []inventoryNetwork
+}
+
+type inventoryNetwork struct {
+	network *net.IPNet
+	prefix  int
+	fields  map[string]string
+}
+
+type enrichAction struct {
+	source    string
+	format    string
+	query     string
+	keyColumn string
+	matchOn   []string
+	fields    []string
+	prefix    string
+	overwrite bool
+
+	// The current *inventory, swapped on reload
+	devices atomic.Value
+
+	reloadLock sync.Mutex
+	modTime    time.Time
+	size       int64
+	done       chan struct{}
+
+	pluginLog *zerolog.Logger
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"source": true, "format": true, "query": true, "key_column": true,
+		"match_on": true, "fields": true, "prefix": true, "overwrite": true, "reload_interval": true}
+
+	for key, _ := range actionArgs {
+		if _, ok := validArgs[key]; !ok {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	if actionArgs["source"] == "" {
+		return fmt.Errorf("Missing the required 'source' argument to the %s plugin", pluginName)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated argument, dropping empty entries
+//
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// sourceFormat works out the inventory format from the file extension
+//
+func sourceFormat(source string) (string, error) {
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".csv":
+		return "csv", nil
+	case ".json":
+		return "json", nil
+	case ".db", ".sqlite", ".sqlite3":
+		return "sqlite", nil
+	}
+	return "", fmt.Errorf("Unable to tell the format of %s for the %s plugin, use the format argument", source, pluginName)
+}
+
+func (a *enrichAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	var err error
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err = validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	a.source = actionArgs["source"]
+	if a.format = actionArgs["format"]; a.format == "" {
+		if a.format, err = sourceFormat(a.source); err != nil {
+			return err
+		}
+	}
+	switch a.format {
+	case "csv", "json", "sqlite":
+	default:
+		return fmt.Errorf("Unknown format for %s plugin: %s", pluginName, a.format)
+	}
+	if a.query = actionArgs["query"]; a.query == "" {
+		a.query = defaultQuery
+	}
+	if a.keyColumn = actionArgs["key_column"]; a.keyColumn == "" {
+		a.keyColumn = defaultKeyColumn
+	}
+
+	matchOn := actionArgs["match_on"]
+	if matchOn == "" {
+		matchOn = defaultMatchOn
+	}
+	for _, field := range splitList(matchOn) {
+		switch field {
+		case "agent_address", "source_ip", "device_name":
+			a.matchOn = append(a.matchOn, field)
+		default:
+			return fmt.Errorf("Unknown trap field in match_on argument to %s plugin: %s", pluginName, field)
+		}
+	}
+	a.fields = splitList(actionArgs["fields"])
+	a.prefix = actionArgs["prefix"]
+
+	a.overwrite = true
+	if value := actionArgs["overwrite"]; value != "" {
+		if a.overwrite, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid value for overwrite argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	reloadInterval, err := pluginMeta.GetIntArg(actionArgs, "reload_interval", defaultReloadInterval, pluginName)
+	if err != nil {
+		return err
+	}
+
+	if err = a.reload(true); err != nil {
+		return err
+	}
+	a.done = make(chan struct{})
+	if reloadInterval > 0 {
+		go a.reloadEvery(time.Duration(reloadInterval)*time.Second, a.done)
+	}
+	return nil
+}
+
+// reloadEvery checks for a changed inventory until the plugin is closed
+//
+func (a *enrichAction) reloadEvery(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := a.reload(false); err != nil {
+				a.pluginLog.Warn().Err(err).Str("source", a.source).Msg("Unable to reload inventory, keeping the previous one")
+			}
+		}
+	}
+}
+
+// reload reads the inventory if it has changed since it was last read (or
+// if forced).  SQLite databases are always read, as the database file isn't
+// always updated by a write.
+//
+func (a *enrichAction) reload(force bool) error {
+	a.reloadLock.Lock()
+	defer a.reloadLock.Unlock()
+
+	info, err := os.Stat(a.source)
+	if err != nil {
+		return fmt.Errorf("Unable to read inventory for %s plugin: %s", pluginName, err)
+	}
+	if !force && a.format != "sqlite" && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return nil
+	}
+
+	var records []map[string]string
+	switch a.format {
+	case "csv":
+		records, err = loadCsv(a.source)
+	case "json":
+		records, err = loadJSON(a.source)
+	case "sqlite":
+		records, err = loadSqlite(a.source, a.query)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to load inventory %s for %s plugin: %s", a.source, pluginName, err)
+	}
+	devices, err := makeInventory(records, a.keyColumn)
+	if err != nil {
+		return fmt.Errorf("Unable to load inventory %s for %s plugin: %s", a.source, pluginName, err)
+	}
+
+	a.devices.Store(devices)
+	a.modTime, a.size = info.ModTime(), info.Size()
+	a.pluginLog.Info().Str("source", a.source).Int("devices", len(devices.hosts)).Int("networks", len(devices.networks)).Msg("Loaded inventory")
+	return nil
+}
+
+// loadCsv reads a CSV inventory, with the column names in the first line
+//
+func loadCsv(filename string) ([]map[string]string, error) {
+	fd, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	reader := csv.NewReader(fd)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var records []map[string]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		record := make(map[string]string, len(header))
+		for i, value := range row {
+			record[header[i]] = strings.TrimSpace(value)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// loadJSON reads a JSON inventory, either a list of objects or an object of
+// objects keyed by address.  Values that aren't strings are kept in their
+// JSON form.
+//
+func loadJSON(filename string) ([]map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	var list []map[string]json.RawMessage
+	if err = json.Unmarshal(data, &list); err != nil {
+		var keyed map[string]map[string]json.RawMessage
+		if json.Unmarshal(data, &keyed) != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(keyed))
+		for key := range keyed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if keyed[key] == nil {
+				keyed[key] = make(map[string]json.RawMessage)
+			}
+			keyed[key][""] = json.RawMessage(strconv.Quote(key))
+			list = append(list, keyed[key])
+		}
+	}
+
+	var records []map[string]string
+	for _, object := range list {
+		record := make(map[string]string, len(object))
+		for column, raw := range object {
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				record[column] = s
+			} else if string(raw) != "null" {
+				record[column] = string(raw)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// loadSqlite runs the inventory query against an SQLite database
+//
+func loadSqlite(filename string, query string) ([]map[string]string, error) {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []map[string]string
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		record := make(map[string]string, len(columns))
+		for i, column := range columns {
+			switch value := values[i].(type) {
+			case nil:
+			case []byte:
+				record[column] = string(value)
+			default:
+				record[column] = fmt.Sprintf("%v", value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// normalizeAddress puts IP addresses in their standard form, so that eg
+// IPv6 addresses match however they are written
+//
+func normalizeAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(address)
+}
+
+// makeInventory indexes the records by the key column.  For a JSON object
+// keyed by address, the key is in the "" column.
+//
+func makeInventory(records []map[string]string, keyColumn string) (*inventory, error) {
+	devices := inventory{hosts: make(map[string]map[string]string)}
+	for i, record := range records {
+		key, ok := record[keyColumn]
+		if !ok {
+			key, ok = record[""]
+		}
+		delete(record, "")
+		delete(record, keyColumn)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("record %d has no %s column", i+1, keyColumn)
+		}
+
+		if strings.Contains(key, "/") {
+			_, network, err := net.ParseCIDR(key)
+			if err != nil {
+				return nil, fmt.Errorf("record %d has an invalid network: %s", i+1, key)
+			}
+			prefix, _ := network.Mask.Size()
+			devices.networks = append(devices.networks, inventoryNetwork{network: network, prefix: prefix, fields: record})
+			continue
+		}
+		devices.hosts[normalizeAddress(key)] = record
+	}
+
+	// Most specific networks first
+	sort.SliceStable(devices.networks, func(i, j int) bool {
+		return devices.networks[i].prefix > devices.networks[j].prefix
+	})
+	return &devices, nil
+}
+
+// lookup finds the inventory record for an address
+//
+func (devices *inventory) lookup(address string) (map[string]string, bool) {
+	if address == "" {
+		return nil, false
+	}
+	if record, ok := devices.hosts[normalizeAddress(address)]; ok {
+		return record, true
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		for _, n := range devices.networks {
+			if n.network.Contains(ip) {
+				return n.fields, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (a *enrichAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	devices := a.devices.Load().(*inventory)
+
+	for _, field := range a.matchOn {
+		var address string
+		switch field {
+		case "agent_address":
+			address = trap.Data.AgentAddress
+		case "source_ip":
+			if trap.SrcIP != nil {
+				address = trap.SrcIP.String()
+			}
+		case "device_name":
+			address = trap.DeviceName
+		}
+		record, ok := devices.lookup(address)
+		if !ok {
+			continue
+		}
+
+		columns := a.fields
+		if len(columns) == 0 {
+			for column := range record {
+				columns = append(columns, column)
+			}
+		}
+		for _, column := range columns {
+			value, ok := record[column]
+			if !ok || value == "" {
+				continue
+			}
+			key := a.prefix + column
+			if _, exists := trap.Metadata[key]; exists && !a.overwrite {
+				continue
+			}
+			trap.SetMetadata(key, value)
+		}
+		return nil
+	}
+	return nil
+}
+
+// SigUsr1 reloads the inventory
+//
+func (a *enrichAction) SigUsr1() error {
+	return a.reload(true)
+}
+
+func (a *enrichAction) SigUsr2() error {
+	return nil
+}
+
+func (a *enrichAction) Close() error {
+	if a.done != nil {
+		close(a.done)
+		a.done = nil
+	}
+	return nil
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin enrichAction
@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+const testCsv = `ip,site,owner,role
+# Core routers
+10.1.1.1, lon1, netops, core
+192.0.2.0/24, nyc1, netops,
+192.0.2.128/25, nyc2, facilities, ups
+2001:db8::1, ams1, netops, edge
+`
+
+const testJSON = `{
+  "10.1.1.1": {"site": "lon1", "owner": "netops", "role": "core", "rack": 12},
+  "192.0.2.0/24": {"site": "nyc1", "owner": "netops", "role": null}
+}`
+
+func makeTestTrap(srcIP string, agent string) *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP(srcIP), SnmpVersion: g.Version1}
+	trap.Data.AgentAddress = agent
+	return &trap
+}
+
+func writeTestFile(t *testing.T, dir string, name string, data string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func configureTestAction(t *testing.T, args map[string]string) *enrichAction {
+	var a enrichAction
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	return &a
+}
+
+// checkMetadata runs a trap through the action and compares its metadata
+//
+func checkMetadata(t *testing.T, a *enrichAction, trap *pluginMeta.Trap, expected map[string]string) {
+	if err := a.ProcessTrap(trap); err != nil {
+		t.Fatalf("Unable to process trap: %s", err)
+	}
+	if len(trap.Metadata) != len(expected) {
+		t.Errorf("Expected metadata %v, found %v", expected, trap.Metadata)
+		return
+	}
+	for key, value := range expected {
+		if trap.Metadata[key] != value {
+			t.Errorf("Expected metadata %v, found %v", expected, trap.Metadata)
+			return
+		}
+	}
+}
+
+func TestCsvInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := writeTestFile(t, dir, "inventory.csv", testCsv)
+
+	a := configureTestAction(t, map[string]string{"source": source})
+	defer a.Close()
+
+	// The agent address is looked up first
+	checkMetadata(t, a, makeTestTrap("192.0.2.1", "10.1.1.1"), map[string]string{"site": "lon1", "owner": "netops", "role": "core"})
+	// Networks, with the most specific first, and empty columns are left out
+	checkMetadata(t, a, makeTestTrap("192.0.2.1", ""), map[string]string{"site": "nyc1", "owner": "netops"})
+	checkMetadata(t, a, makeTestTrap("192.0.2.200", "203.0.113.1"), map[string]string{"site": "nyc2", "owner": "facilities", "role": "ups"})
+	checkMetadata(t, a, makeTestTrap("2001:db8:0::1", ""), map[string]string{"site": "ams1", "owner": "netops", "role": "edge"})
+	checkMetadata(t, a, makeTestTrap("203.0.113.1", ""), map[string]string{})
+}
+
+func TestFieldsAndPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := writeTestFile(t, dir, "inventory.csv", testCsv)
+
+	a := configureTestAction(t, map[string]string{"source": source, "fields": "site", "prefix": "inv_",
+		"match_on": "source_ip", "overwrite": "false"})
+	defer a.Close()
+
+	trap := makeTestTrap("10.1.1.1", "192.0.2.1")
+	checkMetadata(t, a, trap, map[string]string{"inv_site": "lon1"})
+
+	trap = makeTestTrap("10.1.1.1", "")
+	trap.SetMetadata("inv_site", "manual")
+	checkMetadata(t, a, trap, map[string]string{"inv_site": "manual"})
+}
+
+func TestJSONInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := writeTestFile(t, dir, "inventory.json", testJSON)
+
+	a := configureTestAction(t, map[string]string{"source": source})
+	defer a.Close()
+	checkMetadata(t, a, makeTestTrap("10.1.1.1", ""), map[string]string{"site": "lon1", "owner": "netops", "role": "core", "rack": "12"})
+	checkMetadata(t, a, makeTestTrap("192.0.2.9", ""), map[string]string{"site": "nyc1", "owner": "netops"})
+
+	list := writeTestFile(t, dir, "list.json", `[{"address": "10.1.1.1", "site": "lon1"}]`)
+	b := configureTestAction(t, map[string]string{"source": list, "key_column": "address"})
+	defer b.Close()
+	checkMetadata(t, b, makeTestTrap("10.1.1.1", ""), map[string]string{"site": "lon1"})
+}
+
+func TestSqliteInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "inventory.db")
+
+	db, err := sql.Open("sqlite3", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"CREATE TABLE devices (address TEXT, site TEXT, rack INTEGER, retired INTEGER)",
+		"INSERT INTO devices VALUES ('10.1.1.1', 'lon1', 12, 0), ('10.1.1.2', 'lon1', NULL, 1)",
+	} {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	a := configureTestAction(t, map[string]string{"source": source,
+		"query": "SELECT address AS ip, site, rack FROM devices WHERE retired = 0"})
+	defer a.Close()
+	checkMetadata(t, a, makeTestTrap("10.1.1.1", ""), map[string]string{"site": "lon1", "rack": "12"})
+	checkMetadata(t, a, makeTestTrap("10.1.1.2", ""), map[string]string{})
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := writeTestFile(t, dir, "inventory.csv", testCsv)
+
+	a := configureTestAction(t, map[string]string{"source": source, "reload_interval": "0"})
+	defer a.Close()
+
+	writeTestFile(t, dir, "inventory.csv", "ip,site\n10.1.1.1,lon2\n")
+	if err = a.SigUsr1(); err != nil {
+		t.Fatalf("Unable to reload inventory: %s", err)
+	}
+	checkMetadata(t, a, makeTestTrap("10.1.1.1", ""), map[string]string{"site": "lon2"})
+
+	// A broken inventory keeps the previous one
+	writeTestFile(t, dir, "inventory.csv", "site\nlon3\n")
+	if err = a.SigUsr1(); err == nil {
+		t.Errorf("Inventory without addresses was loaded")
+	}
+	checkMetadata(t, a, makeTestTrap("10.1.1.1", ""), map[string]string{"site": "lon2"})
+}
+
+func TestConfigureErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := writeTestFile(t, dir, "inventory.csv", testCsv)
+
+	invalid := []map[string]string{
+		{},
+		{"source": writeTestFile(t, dir, "inventory.txt", testCsv)},
+		{"source": source, "format": "xml"},
+		{"source": filepath.Join(dir, "missing.csv")},
+		{"source": source, "match_on": "community"},
+		{"source": source, "match_on": "hostname"},
+		{"source": source, "key_column": "address"},
+		{"source": source, "overwrite": "sometimes"},
+		{"source": source, "bogus": "1"},
+	}
+	for _, args := range invalid {
+		var a enrichAction
+		if err := a.Configure(&testLog, args); err == nil {
+			a.Close()
+			t.Errorf("Invalid arguments were accepted: %v", args)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin runs an external command for each trap.  The trap is written
+ * to the command's stdin in the canonical JSON form (see pluginMeta.Trap
+ * MarshalJSON) and the key fields are available in TRAPMUX_* environment
+ * variables, with the trap metadata in TRAPMUX_META_<KEY> variables.
+ *
+ * The exit status and output of each command are logged, and a non-zero
+ * exit status or a timeout is returned as a plugin error, so that the
+ * plugin_error_actions filters run.  At most max_concurrent commands run at
+ * once.
+ *
+ * With async set, traps are queued by ProcessTrap and the commands are run
+ * by max_concurrent workers, so a slow command doesn't hold up the trap
+ * listener.  If the queue is full the trap is dropped and reported as a
+ * plugin error.  Commands that fail in the background are reported as a
+ * plugin error by the next ProcessTrap.
+ *
+ * Arguments:
+ *   command        - command line to run (required)
+ *   shell          - run the command with /bin/sh -c (default: false)
+ *   timeout        - seconds before the command is killed (default 30)
+ *   max_concurrent - number of commands that may run at once (default 4)
+ *   async          - queue the traps and run the commands in the background (default: false)
+ *   queue_size     - with async, traps waiting for a command before new ones are dropped (default 100)
+ *   output_max     - bytes of stdout/stderr to keep for the log (default 4096)
+ *   template       - Go template for stdin, instead of the JSON trap
+ *   template_file  - file containing the template
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "exec"
+
+const (
+	defaultTimeout       = 30
+	defaultMaxConcurrent = 4
+	defaultQueueSize     = 100
+	defaultOutputMax     = 4096
+)
+
+type execAction struct {
+	command   []string
+	timeout   time.Duration
+	outputMax int
+	template  *template.Template
+
+	// Commands that are running, when they are run from ProcessTrap
+	slots chan struct{}
+
+	// Traps waiting for the workers, with async
+	async       bool
+	queue       chan execJob
+	workersDone sync.WaitGroup
+	closeMutex  sync.RWMutex
+	closed      bool
+
+	// Background commands that failed since the last ProcessTrap, and the
+	// last of the errors
+	failed    uint64
+	lastError atomic.Value
+
+	pluginLog *zerolog.Logger
+}
+
+// execJob is what a worker needs to run the command for a trap, taken from
+// the trap when it was queued
+//
+type execJob struct {
+	input []byte
+	env   []string
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - b.Len()
+	if room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"command": true, "shell": true, "timeout": true, "max_concurrent": true, "async": true, "queue_size": true, "output_max": true,
+		"template": true, "template_file": true}
+
+	for key, _ := range actionArgs {
+		if _, ok := validArgs[key]; !ok {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	if strings.TrimSpace(actionArgs["command"]) == "" {
+		return fmt.Errorf("Missing the required 'command' argument to the %s plugin", pluginName)
+	}
+	return nil
+}
+
+func (a *execAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err := validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	useShell, err := getBoolArg(actionArgs, "shell")
+	if err != nil {
+		return err
+	}
+	if a.async, err = getBoolArg(actionArgs, "async"); err != nil {
+		return err
+	}
+	if useShell {
+		a.command = []string{"/bin/sh", "-c", actionArgs["command"]}
+	} else {
+		a.command = strings.Fields(actionArgs["command"])
+	}
+
+	seconds, err := pluginMeta.GetIntArg(actionArgs, "timeout", defaultTimeout, pluginName)
+	if err != nil {
+		return err
+	}
+	a.timeout = time.Duration(seconds) * time.Second
+	maxConcurrent, err := pluginMeta.GetIntArg(actionArgs, "max_concurrent", defaultMaxConcurrent, pluginName)
+	if err != nil {
+		return err
+	}
+	if maxConcurrent == 0 {
+		maxConcurrent = 1
+	}
+	queueSize, err := pluginMeta.GetIntArg(actionArgs, "queue_size", defaultQueueSize, pluginName)
+	if err != nil {
+		return err
+	}
+	if a.outputMax, err = pluginMeta.GetIntArg(actionArgs, "output_max", defaultOutputMax, pluginName); err != nil {
+		return err
+	}
+	if a.template, err = pluginMeta.GetTemplateArg(actionArgs, pluginName); err != nil {
+		return err
+	}
+
+	a.closed = false
+	a.slots = make(chan struct{}, maxConcurrent)
+	if a.async {
+		a.queue = make(chan execJob, queueSize)
+		for i := 0; i < maxConcurrent; i++ {
+			a.workersDone.Add(1)
+			go a.worker()
+		}
+	}
+
+	a.pluginLog.Info().Str("command", actionArgs["command"]).Int("max_concurrent", maxConcurrent).Bool("async", a.async).Msg("Added exec action")
+	return nil
+}
+
+// getBoolArg converts an optional true/false argument, which is false if
+// not specified
+//
+func getBoolArg(actionArgs map[string]string, key string) (bool, error) {
+	value := actionArgs[key]
+	if value == "" {
+		return false, nil
+	}
+	converted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for %s argument to %s plugin: %s", key, pluginName, value)
+	}
+	return converted, nil
+}
+
+// makeEnvironment adds the key trap fields to the daemon's environment
+//
+func makeEnvironment(trap *pluginMeta.Trap) []string {
+	env := append(os.Environ(),
+		"TRAPMUX_TRAP_NUMBER="+strconv.FormatUint(uint64(trap.TrapNumber), 10),
+		"TRAPMUX_SNMP_VERSION="+trap.SnmpVersion.String(),
+		"TRAPMUX_SRC_IP="+trap.SrcIP.String(),
+		"TRAPMUX_AGENT_ADDRESS="+trap.Data.AgentAddress,
+		"TRAPMUX_ENTERPRISE="+strings.Trim(trap.Data.Enterprise, "."),
+		"TRAPMUX_GENERIC_TYPE="+strconv.Itoa(trap.Data.GenericTrap),
+		"TRAPMUX_SPECIFIC_TYPE="+strconv.Itoa(trap.Data.SpecificTrap),
+		"TRAPMUX_TRAP_OID="+trap.TrapOID(),
+		"TRAPMUX_TRAP_NAME="+trap.TrapName(),
+		"TRAPMUX_HOSTNAME="+trap.Hostname,
+		"TRAPMUX_DEVICE_NAME="+trap.DeviceName,
+	)
+	for _, key := range trap.MetadataKeys() {
+		env = append(env, "TRAPMUX_META_"+envName(key)+"="+trap.Metadata[key])
+	}
+	return env
+}
+
+// envName converts a metadata key to an environment variable name
+//
+func envName(key string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+			return c
+		}
+		return '_'
+	}, key)
+}
+
+// makeInput returns what is written to the command's stdin
+//
+func (a *execAction) makeInput(trap *pluginMeta.Trap) ([]byte, error) {
+	if a.template != nil {
+		input, err := pluginMeta.ExecuteTemplate(a.template, trap)
+		return []byte(input), err
+	}
+	input, err := json.Marshal(trap)
+	return append(input, '\n'), err
+}
+
+// ProcessTrap runs the command for the trap, returning an error if it
+// fails.  With async, the trap is queued for the workers instead, and is
+// dropped if the queue is full rather than blocking the listener.
+//
+func (a *execAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	input, err := a.makeInput(trap)
+	if err != nil {
+		return err
+	}
+	job := execJob{input: input, env: makeEnvironment(trap)}
+	if !a.async {
+		return a.run(job)
+	}
+	if err = a.enqueue(job); err != nil {
+		return err
+	}
+	return a.backgroundErrors()
+}
+
+// enqueue passes a job to the workers without waiting
+//
+func (a *execAction) enqueue(job execJob) error {
+	a.closeMutex.RLock()
+	defer a.closeMutex.RUnlock()
+	if a.closed {
+		return fmt.Errorf("The %s plugin has been closed", pluginName)
+	}
+	select {
+	case a.queue <- job:
+		return nil
+	default:
+		return fmt.Errorf("Queue for %s is full (%d traps), dropping trap", a.command[0], cap(a.queue))
+	}
+}
+
+func (a *execAction) worker() {
+	defer a.workersDone.Done()
+	for job := range a.queue {
+		if err := a.run(job); err != nil {
+			atomic.AddUint64(&a.failed, 1)
+			a.lastError.Store(err)
+		}
+	}
+}
+
+// backgroundErrors reports the commands run by the workers that failed
+// since it was last called
+//
+func (a *execAction) backgroundErrors() error {
+	failed := atomic.SwapUint64(&a.failed, 0)
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d queued commands failed, most recently: %s", failed, a.lastError.Load())
+}
+
+// run runs the command for a trap and logs how it went
+//
+func (a *execAction) run(job execJob) error {
+	ctx := context.Background()
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	a.slots <- struct{}{}
+	defer func() { <-a.slots }()
+
+	// #nosec G204 -- the command comes from the trapmux configuration
+	cmd := exec.CommandContext(ctx, a.command[0], a.command[1:]...)
+	cmd.Stdin = bytes.NewReader(job.input)
+	cmd.Env = job.env
+	stdout := &limitedBuffer{max: a.outputMax}
+	stderr := &limitedBuffer{max: a.outputMax}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Command %s timed out after %v", a.command[0], a.timeout)
+	} else if err != nil {
+		err = fmt.Errorf("Command %s failed: %s", a.command[0], err)
+	}
+	a.logOutput(stdout, stderr, time.Since(start), err)
+	return err
+}
+
+func (a *execAction) logOutput(stdout *limitedBuffer, stderr *limitedBuffer, duration time.Duration, err error) {
+	event := a.pluginLog.Info()
+	if err != nil {
+		event = a.pluginLog.Warn().Err(err)
+	}
+	event = event.Str("plugin", pluginName).Str("command", a.command[0]).Dur("duration", duration)
+	if stdout.Len() > 0 {
+		event = event.Str("stdout", strings.TrimSpace(stdout.String())).Bool("stdout_truncated", stdout.truncated)
+	}
+	if stderr.Len() > 0 {
+		event = event.Str("stderr", strings.TrimSpace(stderr.String())).Bool("stderr_truncated", stderr.truncated)
+	}
+	event.Msg("Command completed")
+}
+
+func (a *execAction) SigUsr1() error {
+	return nil
+}
+
+func (a *execAction) SigUsr2() error {
+	return nil
+}
+
+// Close stops accepting traps and waits for the queued commands to run
+//
+func (a *execAction) Close() error {
+	a.closeMutex.Lock()
+	if !a.closed && a.queue != nil {
+		a.closed = true
+		close(a.queue)
+	}
+	a.closeMutex.Unlock()
+	a.workersDone.Wait()
+	return nil
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin execAction
@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+func makeTestTrap() *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.Data.Enterprise = ".1.3.6.1.6.3.1.1.5"
+	trap.Data.GenericTrap = 2
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+	}
+	return &trap
+}
+
+func TestStdinAndEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outFile := filepath.Join(dir, "trap.json")
+
+	var a execAction
+	args := map[string]string{"command": "cat > " + outFile + "; echo $TRAPMUX_SRC_IP $TRAPMUX_TRAP_OID $TRAPMUX_META_SITE_NAME >> " + outFile, "shell": "true"}
+	if err = a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	trap := makeTestTrap()
+	trap.SetMetadata("site-name", "lon1")
+	if err = a.ProcessTrap(trap); err != nil {
+		t.Fatalf("Unable to run command: %s", err)
+	}
+	a.Close()
+
+	data, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		t.Fatalf("Command output not found: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected command output: %s", data)
+	}
+	var decoded pluginMeta.Trap
+	if err = json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatalf("Unable to decode trap from stdin: %s", err)
+	}
+	if decoded.Data.AgentAddress != "10.1.1.1" || len(decoded.Data.Variables) != 1 || decoded.Data.Variables[0].Value != 3 || decoded.Metadata["site-name"] != "lon1" {
+		t.Errorf("Unexpected trap from stdin: %+v", decoded)
+	}
+	if lines[1] != "192.0.2.1 1.3.6.1.6.3.1.1.5.3 lon1" {
+		t.Errorf("Unexpected environment variables: %s", lines[1])
+	}
+}
+
+func TestExitStatusAndTimeout(t *testing.T) {
+	var a execAction
+	if err := a.Configure(&testLog, map[string]string{"command": "false"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+	if err := a.ProcessTrap(makeTestTrap()); err == nil {
+		t.Errorf("Non-zero exit status was not reported")
+	}
+
+	var b execAction
+	if err := b.Configure(&testLog, map[string]string{"command": "sleep 5", "timeout": "1"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer b.Close()
+	err := b.ProcessTrap(makeTestTrap())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Timeout was not reported: %v", err)
+	}
+}
+
+func TestQueueing(t *testing.T) {
+	var a execAction
+	if err := a.Configure(&testLog, map[string]string{"command": "sleep 1", "async": "true", "max_concurrent": "2", "queue_size": "2"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	// Queueing doesn't wait for the commands, and two run at once
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := a.ProcessTrap(makeTestTrap()); err != nil {
+			t.Errorf("Unable to queue trap: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("ProcessTrap waited for the command: %v", elapsed)
+	}
+	a.Close()
+	if elapsed := time.Since(start); elapsed > 1800*time.Millisecond {
+		t.Errorf("Commands did not run concurrently: %v", elapsed)
+	}
+
+	// Traps are dropped once the workers are busy and the queue is full
+	var b execAction
+	if err := b.Configure(&testLog, map[string]string{"command": "sleep 1", "async": "true", "max_concurrent": "1", "queue_size": "1"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	dropped := 0
+	for i := 0; i < 3; i++ {
+		if err := b.ProcessTrap(makeTestTrap()); err != nil {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("No traps were dropped from a full queue")
+	}
+	b.Close()
+	if err := b.ProcessTrap(makeTestTrap()); err == nil {
+		t.Errorf("Trap was queued after Close")
+	}
+}
+
+func TestAsyncErrors(t *testing.T) {
+	var a execAction
+	if err := a.Configure(&testLog, map[string]string{"command": "false", "async": "true", "max_concurrent": "1"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+	if err := a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Fatalf("Unable to queue trap: %s", err)
+	}
+
+	// The failure of the first command is reported with a later trap
+	deadline := time.Now().Add(5 * time.Second)
+	var err error
+	for err == nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		err = a.ProcessTrap(makeTestTrap())
+	}
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("Failed background command was not reported: %v", err)
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := limitedBuffer{max: 4}
+	b.Write([]byte("abc"))
+	b.Write([]byte("def"))
+	if b.String() != "abcd" || !b.truncated {
+		t.Errorf("Output was not truncated correctly: %s", b.String())
+	}
+}
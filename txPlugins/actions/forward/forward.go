@@ -7,46 +7,206 @@ package main
 
 /*
  * This plugin sends SNMP traps to a new destination
+ *
+ * Arguments:
+ *   traphost         - destination host, or a comma-separated group of host[:port] (required)
+ *   port             - destination port for hosts without one (default 162)
+ *   snmp_version     - v1, v2c, v3 or inform (v2c inform) (default v1)
+ *   community        - community string for v1 and v2c
+ *   inform           - send informs and wait for the acknowledgement (default false)
+ *   timeout          - seconds to wait for an inform acknowledgement (default 2)
+ *   retries          - number of inform retries (default 3)
+ *
+ * Destination group arguments:
+ *   mode             - failover (first healthy host), round_robin, or hash (by
+ *                      source IP, so an agent sticks to one host) (default failover)
+ *   retry_interval   - seconds before a failed host is tried again (default 30)
+ *   probe_interval   - seconds between inform probes of each host, 0 to only use
+ *                      send errors for health (default 0)
+ *   probe_oid        - snmpTrapOID of the probe inform
+ *                      (default NET-SNMP-EXAMPLES-MIB::netSnmpExampleHeartbeatNotification)
+ *
+ * Plain traps are unacknowledged, so a failed host is usually only noticed
+ * from send errors when using informs or probes.
+ *
+ * Queueing arguments:
+ *   queue_size       - traps waiting to be sent before new ones are dropped (default 1000)
+ *   workers          - number of goroutines sending traps (default 4)
+ *
+ * Traps are queued by ProcessTrap and sent by the workers, so a slow or
+ * unreachable destination doesn't hold up the trap listener.  Each worker
+ * has its own share of the queue, and the traps from a source IP always go
+ * to the same worker, so that they are forwarded in the order received (eg
+ * a linkDown before the linkUp).  Queued, sent, failed and dropped traps are
+ * counted per group member in the forward_* Prometheus metrics.
+ *
+ * Source address preserving arguments:
+ *   spoof_source      - re-emit the received packet unchanged, with the agent's
+ *                       source IP, over a raw socket (IPv4 only, requires
+ *                       CAP_NET_RAW) (default false)
+ *   spoof_source_port - UDP source port of the re-emitted packet (default: the
+ *                       agent's source port, or 162 if it isn't known)
+ *
+ * Legacy managers that identify devices by the UDP source address otherwise
+ * see every forwarded trap as coming from trapmux.  With spoof_source the
+ * snmp_version and inform arguments don't apply, as the packet isn't changed.
+ *
+ * SNMP v3 arguments:
+ *   username         - USM user name (required)
+ *   msg_flags        - noauthnopriv, authnopriv or authpriv (default: from the protocols)
+ *   engine_id        - authoritative engine ID in hex (required for traps)
+ *   context_name     - context name
+ *   auth_protocol    - noauth, md5, sha, sha224, sha256, sha384 or sha512
+ *   auth_password    - authentication passphrase (supports filename: and env: secrets)
+ *   privacy_protocol - nopriv, des, aes, aes192, aes256, aes192c or aes256c
+ *   privacy_password - privacy passphrase (supports filename: and env: secrets)
  */
 
-/*
- TOOD:
-    - create a channel-based forwarding architecture to increase concurrency
-*/
-
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
+// destination is one member of the forwarding group
+type destination struct {
+	address string
+	snmp    *g.GoSNMP
+	probe   *g.GoSNMP
+
+	// Resolved address for spoof_source mode
+	rawAddr *net.UDPAddr
+
+	// gosnmp connections are not safe for concurrent use
+	sendMutex sync.Mutex
+
+	stateMutex sync.Mutex
+	healthy    bool
+	retryAt    time.Time
+}
+
 type trapForwarder struct {
-	destination *g.GoSNMP
-	main_log  *zerolog.Logger
+	destinations  []*destination
+	mode          string
+	inform        bool
+	retryInterval time.Duration
+	probeInterval time.Duration
+	probeOID      string
+
+	// Round-robin position
+	next uint32
+
+	stopProbe chan struct{}
+	probeDone chan struct{}
+
+	// Raw socket for spoof_source mode, and the source port (0 to use the
+	// agent's port)
+	spoof     *rawSender
+	spoofPort uint16
+
+	// Translated traps waiting for the workers, one queue for each
+	queues      []chan queuedTrap
+	group       string
+	workersDone sync.WaitGroup
+	closeMutex  sync.RWMutex
+	closed      bool
+
+	main_log *zerolog.Logger
 }
 
 const pluginName = "trap forwarder"
 
+const (
+	modeFailover   = "failover"
+	modeRoundRobin = "round_robin"
+	modeHash       = "hash"
+)
+
+const (
+	defaultTimeout       = 2
+	defaultRetries       = 3
+	defaultRetryInterval = 30
+	defaultProbeOID      = ".1.3.6.1.4.1.8072.2.3.0.1"
+	defaultQueueSize     = 1000
+	defaultWorkers       = 4
+)
+
+// Per-destination metrics, exposed through the default Prometheus registry.
+// The destination label is the traphost argument and target is the group
+// member.  Queued and dropped traps are counted against the member picked
+// for the trap when it was queued, and sent and failed traps against the
+// member that it was sent to.
+var (
+	queuedTraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forward_queued_traps_total",
+		Help: "The total number of traps queued for forwarding",
+	}, []string{"destination", "target"})
+	sentTraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forward_sent_traps_total",
+		Help: "The total number of traps forwarded",
+	}, []string{"destination", "target"})
+	failedTraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forward_failed_traps_total",
+		Help: "The total number of traps that could not be sent to a destination",
+	}, []string{"destination", "target"})
+	droppedTraps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forward_dropped_traps_total",
+		Help: "The total number of traps dropped because the queue was full or no destination accepted them",
+	}, []string{"destination", "target"})
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "forward_queue_length",
+		Help: "The number of traps waiting to be forwarded",
+	}, []string{"destination", "target"})
+
+	registerMetrics sync.Once
+)
+
 func validateArguments(snmpVersion g.SnmpVersion, actionArgs map[string]string) error {
-	validArgs := map[string]bool{"traphost": true, "port": true, "snmp_version": true, "community": true}
-	validV3Args := map[string]bool{"engine_id": true, "auth_password": true, "auth_protocol": true, "privacy_protocol": true, "privacy_password": true}
+	validArgs := map[string]bool{"traphost": true, "port": true, "snmp_version": true, "community": true, "inform": true,
+		"timeout": true, "retries": true, "mode": true, "retry_interval": true, "probe_interval": true, "probe_oid": true,
+		"queue_size": true, "workers": true, "spoof_source": true, "spoof_source_port": true}
+	validV3Args := map[string]bool{"username": true, "msg_flags": true, "engine_id": true, "context_name": true,
+		"auth_password": true, "auth_protocol": true, "privacy_protocol": true, "privacy_password": true}
 
 	for key, _ := range actionArgs {
-		if _, ok := validArgs[key]; !ok {
-			if snmpVersion == g.Version3 {
-				if _, ok := validV3Args[key]; !ok {
-					return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
-				}
-			}
+		if _, ok := validArgs[key]; ok {
+			continue
+		}
+		if _, ok := validV3Args[key]; !ok {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+		if snmpVersion != g.Version3 {
+			return fmt.Errorf("Option %s to %s plugin is only valid with snmp_version v3", key, pluginName)
 		}
 	}
 
+	if strings.TrimSpace(actionArgs["traphost"]) == "" {
+		return fmt.Errorf("Missing the required 'traphost' argument to the %s plugin", pluginName)
+	}
+	switch actionArgs["mode"] {
+	case "", modeFailover, modeRoundRobin, modeHash:
+	default:
+		return fmt.Errorf("Invalid mode argument to %s plugin: %s", pluginName, actionArgs["mode"])
+	}
+	if snmpVersion == g.Version3 && actionArgs["username"] == "" {
+		return fmt.Errorf("Missing the required 'username' argument to the %s plugin for SNMP v3", pluginName)
+	}
+
 	return nil
 }
 
@@ -58,6 +218,8 @@ func getVersion(snmpVersion string) (g.SnmpVersion, error) {
 		return g.Version2c, nil
 	case "v3", "3":
 		return g.Version3, nil
+	case "inform":
+		return g.Version2c, nil
 	default:
 		return g.Version1, fmt.Errorf("Unsupported or invalid value (%s) for SNMP version", snmpVersion)
 	}
@@ -68,96 +230,315 @@ func (a *trapForwarder) Configure(pluginLog *zerolog.Logger, actionArgs map[stri
 
 	a.main_log.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
 
-	snmpVersion, err := getVersion(actionArgs["version"])
+	snmpVersion, err := getVersion(actionArgs["snmp_version"])
 	if err != nil {
 		return err
 	}
+	// Informs are a v2c/v3 feature
+	a.inform = strings.ToLower(actionArgs["snmp_version"]) == "inform"
+	if value, ok := actionArgs["inform"]; ok {
+		if a.inform, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid value for inform argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	if a.inform && snmpVersion == g.Version1 {
+		return fmt.Errorf("SNMP v1 does not support informs")
+	}
 
 	if err := validateArguments(snmpVersion, actionArgs); err != nil {
 		return err
 	}
 
-	hostname := actionArgs["traphost"]
-	port_str := actionArgs["port"]
-	port, err := strconv.Atoi(port_str)
+	a.mode = actionArgs["mode"]
+	if a.mode == "" {
+		a.mode = modeFailover
+	}
+	seconds, err := pluginMeta.GetIntArg(actionArgs, "retry_interval", defaultRetryInterval, pluginName)
+	if err != nil {
+		return err
+	}
+	a.retryInterval = time.Duration(seconds) * time.Second
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "probe_interval", 0, pluginName); err != nil {
+		return err
+	}
+	a.probeInterval = time.Duration(seconds) * time.Second
+	if a.probeInterval > 0 && snmpVersion == g.Version1 {
+		return fmt.Errorf("Inform probes are not supported with SNMP v1 destinations")
+	}
+	a.probeOID = actionArgs["probe_oid"]
+	if a.probeOID == "" {
+		a.probeOID = defaultProbeOID
+	}
+
+	spoof := false
+	if value := actionArgs["spoof_source"]; value != "" {
+		if spoof, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid value for spoof_source argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	if spoof && a.inform {
+		return fmt.Errorf("Informs can't be acknowledged when spoofing the source address")
+	}
+	spoofPort, err := pluginMeta.GetIntArg(actionArgs, "spoof_source_port", 0, pluginName)
+	if err != nil || spoofPort > 65535 {
+		return fmt.Errorf("Invalid value for spoof_source_port argument to %s plugin: %s", pluginName, actionArgs["spoof_source_port"])
+	}
+	a.spoofPort = uint16(spoofPort)
+
+	queueSize, err := pluginMeta.GetIntArg(actionArgs, "queue_size", defaultQueueSize, pluginName)
+	if err != nil {
+		return err
+	}
+	workers, err := pluginMeta.GetIntArg(actionArgs, "workers", defaultWorkers, pluginName)
+	if err != nil {
+		return err
+	}
+	if workers == 0 {
+		workers = 1
+	}
+
+	a.destinations = nil
+	for _, address := range strings.Split(actionArgs["traphost"], ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		d, err := a.newDestination(address, snmpVersion, actionArgs)
+		if err != nil {
+			for _, built := range a.destinations {
+				built.close()
+			}
+			return err
+		}
+		if spoof {
+			if d.rawAddr, err = net.ResolveUDPAddr("udp4", d.address); err != nil {
+				d.close()
+				for _, built := range a.destinations {
+					built.close()
+				}
+				return fmt.Errorf("Unable to resolve %s to an IPv4 address for spoof_source: %s", d.address, err)
+			}
+		}
+		a.destinations = append(a.destinations, d)
+		a.main_log.Info().Str("target", d.address).Str("snmp_version", snmpVersion.String()).Bool("inform", a.inform).Str("mode", a.mode).Msg("Added trap destination")
+	}
+
+	a.spoof = nil
+	if spoof {
+		if a.spoof, err = newRawSender(); err != nil {
+			for _, built := range a.destinations {
+				built.close()
+			}
+			return err
+		}
+	}
+
+	registerMetrics.Do(func() {
+		for _, collector := range []prometheus.Collector{queuedTraps, sentTraps, failedTraps, droppedTraps, queueLength} {
+			if err := prometheus.Register(collector); err != nil {
+				a.main_log.Warn().Str("plugin", pluginName).Err(err).Msg("Unable to register metrics")
+			}
+		}
+	})
+	a.group = strings.TrimSpace(actionArgs["traphost"])
+	a.closed = false
+	a.queues = make([]chan queuedTrap, workers)
+	for i := range a.queues {
+		a.queues[i] = make(chan queuedTrap, (queueSize+workers-1)/workers)
+		a.workersDone.Add(1)
+		go a.worker(a.queues[i])
+	}
+
+	if a.probeInterval > 0 {
+		a.stopProbe = make(chan struct{})
+		a.probeDone = make(chan struct{})
+		go a.probeLoop()
+	}
+
+	return nil
+}
+
+// newSnmpTarget creates a connected gosnmp session for one host
+//
+func newSnmpTarget(host string, port uint16, snmpVersion g.SnmpVersion, actionArgs map[string]string, inform bool) (*g.GoSNMP, error) {
+	timeout, err := pluginMeta.GetIntArg(actionArgs, "timeout", defaultTimeout, pluginName)
 	if err != nil {
-		panic("Invalid destination port: " + port_str)
+		return nil, err
 	}
-	var community string
-	community, _ = actionArgs["community"]
-	a.destination = &g.GoSNMP{
-		Target:             hostname,
-		Port:               uint16(port),
+	retries, err := pluginMeta.GetIntArg(actionArgs, "retries", defaultRetries, pluginName)
+	if err != nil {
+		return nil, err
+	}
+	target := &g.GoSNMP{
+		Target:             host,
+		Port:               port,
 		Transport:          "udp",
-		Community:          community,
+		Community:          actionArgs["community"],
 		Version:            snmpVersion,
-		Timeout:            time.Duration(2) * time.Second,
-		Retries:            3,
+		Timeout:            time.Duration(timeout) * time.Second,
+		Retries:            retries,
 		ExponentialTimeout: true,
 		MaxOids:            g.MaxOids,
 	}
-	err = a.destination.Connect()
+	if err = setSnmpV3Args(target, actionArgs, inform); err != nil {
+		return nil, err
+	}
+	if err = target.Connect(); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// newDestination parses a host[:port] group member and connects to it.  When
+// probes are enabled, a second session is kept for the informs so that a v3
+// trap destination can still discover the receiver's engine ID.
+//
+func (a *trapForwarder) newDestination(address string, snmpVersion g.SnmpVersion, actionArgs map[string]string) (*destination, error) {
+	host := address
+	portStr := actionArgs["port"]
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		host, portStr = h, p
+	}
+	if portStr == "" {
+		portStr = "162"
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Invalid destination port to %s plugin: %s", pluginName, portStr)
 	}
-	a.main_log.Info().Str("target", hostname).Str("port", port_str).Msg("Added trap destination")
 
-	return nil
+	d := destination{address: net.JoinHostPort(host, portStr), healthy: true}
+	if d.snmp, err = newSnmpTarget(host, uint16(port), snmpVersion, actionArgs, a.inform); err != nil {
+		return nil, err
+	}
+	if a.probeInterval > 0 {
+		probeArgs := make(map[string]string, len(actionArgs))
+		for key, value := range actionArgs {
+			probeArgs[key] = value
+		}
+		delete(probeArgs, "engine_id")
+		if d.probe, err = newSnmpTarget(host, uint16(port), snmpVersion, probeArgs, true); err != nil {
+			d.snmp.Conn.Close()
+			return nil, err
+		}
+	}
+	return &d, nil
 }
 
-func setSnmpV3Args(destination *g.GoSNMP, params map[string]string) error {
+// decodeEngineID converts an engine ID given in hex (eg 0x80001f8880...) to
+// the raw octets that gosnmp expects.  Anything which isn't valid hex is used
+// as-is.
+//
+func decodeEngineID(engineID string) string {
+	trimmed := strings.TrimPrefix(strings.ToLower(engineID), "0x")
+	if decoded, err := hex.DecodeString(trimmed); err == nil && len(decoded) > 0 {
+		return string(decoded)
+	}
+	return engineID
+}
+
+// setSnmpV3Args adds the USM settings to a v3 destination.  For traps,
+// trapmux is the authoritative engine and engine_id is required so that the
+// receiver can localize the keys.  For informs the receiver is authoritative,
+// so its engine ID is discovered unless engine_id is given.
+//
+func setSnmpV3Args(destination *g.GoSNMP, params map[string]string, inform bool) error {
 	if destination.Version != g.Version3 {
 		return nil
 	}
 
 	destination.SecurityModel = g.UserSecurityModel
-
-	switch strings.ToLower(params["msg_flags"]) {
-	case "noauthnopriv":
-		destination.MsgFlags = g.NoAuthNoPriv
-	case "authnopriv":
-		destination.MsgFlags = g.AuthNoPriv
-	case "authpriv":
-		destination.MsgFlags = g.AuthPriv
-	default:
-		return fmt.Errorf("unsupported or invalid value (%s) for snmpv3:msg_flags", strings.ToLower(params["msg_flags"]))
-	}
+	destination.ContextName = params["context_name"]
 
 	var securityParams g.UsmSecurityParameters
-
-	securityParams.AuthoritativeEngineID = params["engine_id"]
+	securityParams.UserName = params["username"]
+	securityParams.AuthoritativeEngineID = decodeEngineID(params["engine_id"])
+	securityParams.AuthoritativeEngineBoots = 1
 
 	switch strings.ToLower(params["auth_protocol"]) {
-	case "noauth":
+	case "noauth", "":
 		securityParams.AuthenticationProtocol = g.NoAuth
-	case "sha":
-		securityParams.AuthenticationProtocol = g.SHA
 	case "md5":
 		securityParams.AuthenticationProtocol = g.MD5
+	case "sha":
+		securityParams.AuthenticationProtocol = g.SHA
+	case "sha224":
+		securityParams.AuthenticationProtocol = g.SHA224
+	case "sha256":
+		securityParams.AuthenticationProtocol = g.SHA256
+	case "sha384":
+		securityParams.AuthenticationProtocol = g.SHA384
+	case "sha512":
+		securityParams.AuthenticationProtocol = g.SHA512
 	default:
 		return fmt.Errorf("invalid value for snmpv3:auth_protocol: %s", params["auth_protocol"])
 	}
 
-	securityParams.AuthenticationPassphrase = params["auth_password"]
-
 	switch strings.ToLower(params["privacy_protocol"]) {
-	case "nopriv":
+	case "nopriv", "":
 		securityParams.PrivacyProtocol = g.NoPriv
-	case "aes":
-		securityParams.PrivacyProtocol = g.AES
 	case "des":
 		securityParams.PrivacyProtocol = g.DES
+	case "aes":
+		securityParams.PrivacyProtocol = g.AES
+	case "aes192":
+		securityParams.PrivacyProtocol = g.AES192
+	case "aes256":
+		securityParams.PrivacyProtocol = g.AES256
+	case "aes192c":
+		securityParams.PrivacyProtocol = g.AES192C
+	case "aes256c":
+		securityParams.PrivacyProtocol = g.AES256C
 	default:
 		return fmt.Errorf("invalid value for snmpv3:privacy_protocol: %s", params["privacy_protocol"])
 	}
 
-	securityParams.PrivacyPassphrase = params["privacy_password"]
+	var err error
+	if securityParams.AuthenticationPassphrase, err = pluginMeta.GetSecret(params["auth_password"]); err != nil {
+		return fmt.Errorf("unable to decode secret for auth password: %s", err)
+	}
+	if securityParams.PrivacyPassphrase, err = pluginMeta.GetSecret(params["privacy_password"]); err != nil {
+		return fmt.Errorf("unable to decode secret for privacy password: %s", err)
+	}
+
+	// Without an explicit msg_flags, use the strongest mode the protocols allow
+	switch strings.ToLower(params["msg_flags"]) {
+	case "":
+		destination.MsgFlags = g.NoAuthNoPriv
+		if securityParams.AuthenticationProtocol > g.NoAuth {
+			destination.MsgFlags = g.AuthNoPriv
+			if securityParams.PrivacyProtocol > g.NoPriv {
+				destination.MsgFlags = g.AuthPriv
+			}
+		}
+	case "noauthnopriv":
+		destination.MsgFlags = g.NoAuthNoPriv
+	case "authnopriv":
+		destination.MsgFlags = g.AuthNoPriv
+	case "authpriv":
+		destination.MsgFlags = g.AuthPriv
+	default:
+		return fmt.Errorf("unsupported or invalid value (%s) for snmpv3:msg_flags", params["msg_flags"])
+	}
 
-	if (destination.MsgFlags&g.AuthPriv) == 1 && securityParams.AuthenticationProtocol < 2 {
-		return fmt.Errorf("v3 config error: no auth protocol set when snmpv3:msg_flags specifies an Auth mode")
+	if destination.MsgFlags&g.AuthNoPriv != 0 {
+		if securityParams.AuthenticationProtocol <= g.NoAuth {
+			return fmt.Errorf("v3 config error: no auth protocol set when snmpv3:msg_flags specifies an Auth mode")
+		}
+		if securityParams.AuthenticationPassphrase == "" {
+			return fmt.Errorf("v3 config error: no auth password set when snmpv3:msg_flags specifies an Auth mode")
+		}
+	}
+	if destination.MsgFlags == g.AuthPriv {
+		if securityParams.PrivacyProtocol <= g.NoPriv {
+			return fmt.Errorf("v3 config error: no privacy protocol mode set when snmpv3:msg_flags specifies an AuthPriv mode")
+		}
+		if securityParams.PrivacyPassphrase == "" {
+			return fmt.Errorf("v3 config error: no privacy password set when snmpv3:msg_flags specifies an AuthPriv mode")
+		}
 	}
-	if destination.MsgFlags == g.AuthPriv && securityParams.AuthenticationProtocol < 2 {
-		return fmt.Errorf("v3 config error: no privacy protocol mode set when snmpv3:msg_flags specifies an AuthPriv mode")
+	if securityParams.AuthoritativeEngineID == "" && !inform {
+		return fmt.Errorf("v3 config error: engine_id is required to send v3 traps")
 	}
 
 	destination.SecurityParameters = &securityParams
@@ -165,30 +546,367 @@ func setSnmpV3Args(destination *g.GoSNMP, params map[string]string) error {
 	return nil
 }
 
-func (a trapForwarder) ProcessTrap(trap *pluginMeta.Trap) error {
-	// Translate to v1 if needed
-	if trap.SnmpVersion > g.Version1 {
-		err := pluginMeta.TranslateToV1(trap)
-		if err != nil {
-			return err
+func (d *destination) close() error {
+	if d.probe != nil {
+		d.probe.Conn.Close()
+	}
+	return d.snmp.Conn.Close()
+}
+
+// available reports whether the destination is healthy, or has been down for
+// long enough to try again.  With probes enabled, only a probe brings a
+// destination back.
+//
+func (a *trapForwarder) available(d *destination, now time.Time) bool {
+	d.stateMutex.Lock()
+	defer d.stateMutex.Unlock()
+	return d.healthy || (a.probeInterval == 0 && !now.Before(d.retryAt))
+}
+
+func (a *trapForwarder) setHealth(d *destination, healthy bool, err error) {
+	d.stateMutex.Lock()
+	defer d.stateMutex.Unlock()
+	if !healthy {
+		d.retryAt = time.Now().Add(a.retryInterval)
+	}
+	if d.healthy == healthy {
+		return
+	}
+	d.healthy = healthy
+	if healthy {
+		a.main_log.Info().Str("plugin", pluginName).Str("target", d.address).Msg("Trap destination is back up")
+	} else {
+		a.main_log.Warn().Str("plugin", pluginName).Str("target", d.address).Err(err).Msg("Trap destination is down")
+	}
+}
+
+// hashScore ranks a destination for a source IP.  Picking the highest score
+// (rendezvous hashing) keeps an agent on the same destination, and only the
+// agents of a failed destination move elsewhere.
+//
+func hashScore(srcIP string, d *destination) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(srcIP))
+	h.Write([]byte{0})
+	h.Write([]byte(d.address))
+	return h.Sum64()
+}
+
+// candidates returns the destinations in the order to try them for a trap
+// from srcIP.  Unavailable destinations are only used as a last resort.
+//
+func (a *trapForwarder) candidates(srcIP net.IP) []*destination {
+	ordered := make([]*destination, len(a.destinations))
+	switch a.mode {
+	case modeRoundRobin:
+		start := int(atomic.AddUint32(&a.next, 1)-1) % len(a.destinations)
+		for i := range a.destinations {
+			ordered[i] = a.destinations[(start+i)%len(a.destinations)]
+		}
+	case modeHash:
+		copy(ordered, a.destinations)
+		source := srcIP.String()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return hashScore(source, ordered[i]) > hashScore(source, ordered[j])
+		})
+	default:
+		copy(ordered, a.destinations)
+	}
+
+	now := time.Now()
+	var up, down []*destination
+	for _, d := range ordered {
+		if a.available(d, now) {
+			up = append(up, d)
+		} else {
+			down = append(down, d)
 		}
 	}
+	return append(up, down...)
+}
 
-	a.main_log.Info().Str("plugin", pluginName).Msg("Processing trap")
-	_, err := a.destination.SendTrap(trap.Data)
+func (a *trapForwarder) send(d *destination, item queuedTrap) error {
+	var err error
+	if a.spoof != nil {
+		err = a.spoof.send(item.srcIP, item.srcPort, d.rawAddr, item.raw)
+	} else {
+		d.sendMutex.Lock()
+		_, err = d.snmp.SendTrap(item.data)
+		d.sendMutex.Unlock()
+	}
+	a.setHealth(d, err == nil, err)
 	return err
 }
 
-func (p trapForwarder) SigUsr1() error {
+// forward sends the trap to the first destination of the group that
+// accepts it, in the order picked when it was queued.
+//
+func (a *trapForwarder) forward(item queuedTrap) error {
+	var err error
+	for _, d := range item.candidates {
+		if err = a.send(d, item); err == nil {
+			sentTraps.WithLabelValues(a.group, d.address).Inc()
+			return nil
+		}
+		failedTraps.WithLabelValues(a.group, d.address).Inc()
+	}
+	droppedTraps.WithLabelValues(a.group, item.target().address).Inc()
+	return fmt.Errorf("Unable to forward trap to any destination: %s", err)
+}
+
+// queuedTrap keeps the source address with the trap for hash mode, and the
+// received packet for spoof_source mode
+type queuedTrap struct {
+	data    g.SnmpTrap
+	srcIP   net.IP
+	srcPort uint16
+	raw     []byte
+
+	// The destinations to try, as picked when the trap was queued
+	candidates []*destination
+}
+
+// target is the destination that the trap was queued for
+//
+func (item *queuedTrap) target() *destination {
+	return item.candidates[0]
+}
+
+func (a *trapForwarder) worker(queue chan queuedTrap) {
+	defer a.workersDone.Done()
+	for item := range queue {
+		queueLength.WithLabelValues(a.group, item.target().address).Dec()
+		if err := a.forward(item); err != nil {
+			a.main_log.Warn().Str("plugin", pluginName).Str("destination", a.group).Err(err).Msg("Dropped trap")
+		}
+	}
+}
+
+// sourceQueue picks the worker queue for a source IP, so that the traps
+// from an agent are sent in order by one worker
+//
+func (a *trapForwarder) sourceQueue(srcIP net.IP) chan queuedTrap {
+	h := fnv.New32a()
+	h.Write(srcIP)
+	return a.queues[h.Sum32()%uint32(len(a.queues))]
+}
+
+// ProcessTrap translates the trap to the configured outbound SNMP version
+// and queues it for the workers.  Translation is done on a copy, so later
+// filters still see the trap as it was received.  If the queue is full the
+// trap is dropped rather than blocking the listener.
+//
+func (a *trapForwarder) ProcessTrap(trap *pluginMeta.Trap) error {
+	if len(a.destinations) == 0 {
+		return fmt.Errorf("No destinations configured for the %s plugin", pluginName)
+	}
+	outbound := trap.Copy()
+	var err error
+	if a.spoof != nil {
+		if len(outbound.Raw) == 0 || outbound.SrcIP.To4() == nil {
+			return fmt.Errorf("Unable to spoof the source of a trap without the received IPv4 packet")
+		}
+	} else if a.destinations[0].snmp.Version == g.Version1 {
+		err = pluginMeta.TranslateToV1(&outbound)
+	} else {
+		err = pluginMeta.TranslateToV2c(&outbound)
+		pluginMeta.AddTrapAddress(&outbound)
+	}
+	if err != nil {
+		return err
+	}
+	outbound.Data.IsInform = a.inform
+
+	a.closeMutex.RLock()
+	defer a.closeMutex.RUnlock()
+	if a.closed {
+		return fmt.Errorf("The %s plugin has been closed", pluginName)
+	}
+	item := queuedTrap{data: outbound.Data, srcIP: outbound.SrcIP, srcPort: a.sourcePort(trap), raw: outbound.Raw,
+		candidates: a.candidates(outbound.SrcIP)}
+	target := item.target().address
+	queue := a.sourceQueue(outbound.SrcIP)
+	select {
+	case queue <- item:
+		queuedTraps.WithLabelValues(a.group, target).Inc()
+		queueLength.WithLabelValues(a.group, target).Inc()
+		return nil
+	default:
+		droppedTraps.WithLabelValues(a.group, target).Inc()
+		return fmt.Errorf("Forwarding queue to %s is full (%d traps), dropping trap", a.group, cap(queue))
+	}
+}
+
+// sourcePort picks the UDP source port for spoof_source mode
+//
+func (a *trapForwarder) sourcePort(trap *pluginMeta.Trap) uint16 {
+	switch {
+	case a.spoofPort != 0:
+		return a.spoofPort
+	case trap.SrcPort > 0 && trap.SrcPort <= 65535:
+		return uint16(trap.SrcPort)
+	}
+	return 162
+}
+
+// rawSender writes complete IPv4/UDP packets, so that the source address
+// can be set to the original agent's.
+//
+type rawSender struct {
+	fd int
+}
+
+func newRawSender() (*rawSender, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open a raw socket for spoof_source (requires CAP_NET_RAW): %s", err)
+	}
+	return &rawSender{fd: fd}, nil
+}
+
+func (r *rawSender) send(srcIP net.IP, srcPort uint16, dst *net.UDPAddr, payload []byte) error {
+	packet, err := buildUDPPacket(srcIP, srcPort, dst.IP, uint16(dst.Port), payload)
+	if err != nil {
+		return err
+	}
+	var addr syscall.SockaddrInet4
+	copy(addr.Addr[:], dst.IP.To4())
+	return syscall.Sendto(r.fd, packet, 0, &addr)
+}
+
+func (r *rawSender) close() error {
+	return syscall.Close(r.fd)
+}
+
+// checksum is the Internet checksum (RFC 1071) of the data, with an
+// optional starting sum.
+//
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// buildUDPPacket creates an IPv4 packet containing a UDP datagram
+//
+func buildUDPPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, payload []byte) ([]byte, error) {
+	src, dst := srcIP.To4(), dstIP.To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("Only IPv4 addresses can be used with spoof_source")
+	}
+	const ipHeaderLen, udpHeaderLen = 20, 8
+	total := ipHeaderLen + udpHeaderLen + len(payload)
+	if total > 65535 {
+		return nil, fmt.Errorf("Packet of %d bytes is too large to forward", len(payload))
+	}
+	packet := make([]byte, total)
+
+	ip := packet[:ipHeaderLen]
+	ip[0] = 0x45 // IPv4, 5 word header
+	binary.BigEndian.PutUint16(ip[2:], uint16(total))
+	ip[8] = 64 // TTL
+	ip[9] = syscall.IPPROTO_UDP
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	udp := packet[ipHeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+len(payload)))
+	copy(udp[udpHeaderLen:], payload)
+
+	// The UDP checksum includes a pseudo-header of the addresses and length
+	var pseudo uint32
+	for i := 0; i < 4; i += 2 {
+		pseudo += uint32(src[i])<<8 | uint32(src[i+1])
+		pseudo += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	pseudo += syscall.IPPROTO_UDP + uint32(len(udp))
+	sum := checksum(udp, pseudo)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+
+	return packet, nil
+}
+
+// probe sends a heartbeat inform to each destination and updates its health
+//
+func (a *trapForwarder) probe() {
+	for _, d := range a.destinations {
+		heartbeat := g.SnmpTrap{
+			Variables: []g.SnmpPDU{
+				{Name: pluginMeta.SysUpTime, Type: g.TimeTicks, Value: uint32(time.Now().Unix())},
+				{Name: pluginMeta.SnmpTrapOID, Type: g.ObjectIdentifier, Value: a.probeOID},
+			},
+			IsInform: true,
+		}
+		d.sendMutex.Lock()
+		_, err := d.probe.SendTrap(heartbeat)
+		d.sendMutex.Unlock()
+		a.setHealth(d, err == nil, err)
+	}
+}
+
+func (a *trapForwarder) probeLoop() {
+	defer close(a.probeDone)
+	ticker := time.NewTicker(a.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.probe()
+		case <-a.stopProbe:
+			return
+		}
+	}
+}
+
+func (p *trapForwarder) SigUsr1() error {
 	return nil
 }
 
-func (p trapForwarder) SigUsr2() error {
+func (p *trapForwarder) SigUsr2() error {
 	return nil
 }
 
-func (a trapForwarder) Close() error {
-	return a.destination.Conn.Close()
+// Close stops accepting traps and waits for the queued traps to be sent
+//
+func (a *trapForwarder) Close() error {
+	a.closeMutex.Lock()
+	if !a.closed {
+		a.closed = true
+		for _, queue := range a.queues {
+			close(queue)
+		}
+	}
+	a.closeMutex.Unlock()
+	a.workersDone.Wait()
+
+	if a.stopProbe != nil {
+		close(a.stopProbe)
+		<-a.probeDone
+		a.stopProbe = nil
+	}
+	var err error
+	for _, d := range a.destinations {
+		if closeErr := d.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if a.spoof != nil {
+		a.spoof.close()
+	}
+	return err
 }
 
 // Exported symbol which supports filter.go's FilterAction type
@@ -0,0 +1,593 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+const snmpTrapAddressOid = ".1.3.6.1.6.3.18.1.3.0"
+
+// startReceiver starts a trap listener on a free local port, and returns the
+// port and a channel that receives every packet.
+func startReceiver(t *testing.T, params *g.GoSNMP) (int, chan *g.SnmpPacket) {
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	received := make(chan *g.SnmpPacket, 10)
+	listener := g.NewTrapListener()
+	listener.Params = params
+	listener.OnNewTrap = func(p *g.SnmpPacket, addr *net.UDPAddr) {
+		// The listener reuses the packet to acknowledge informs
+		copied := *p
+		received <- &copied
+	}
+	go listener.Listen("127.0.0.1:" + strconv.Itoa(port))
+	t.Cleanup(listener.Close)
+
+	select {
+	case <-listener.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Trap receiver did not start")
+	}
+	return port, received
+}
+
+func waitForTrap(t *testing.T, received chan *g.SnmpPacket) *g.SnmpPacket {
+	select {
+	case p := <-received:
+		return p
+	case <-time.After(3 * time.Second):
+		t.Fatal("Forwarded trap was not received")
+	}
+	return nil
+}
+
+// waitForSent waits for the workers to have sent count traps to the
+// destination on the port
+//
+func waitForSent(a *trapForwarder, port int, count float64) bool {
+	sent := sentTraps.WithLabelValues(a.group, "127.0.0.1:"+strconv.Itoa(port))
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		if testutil.ToFloat64(sent) >= count {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func makeV1Trap() *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	trap.Data.Enterprise = ".1.3.6.1.6.3.1.1.5"
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.Data.GenericTrap = 2
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+	}
+	return &trap
+}
+
+func findVarbind(p *g.SnmpPacket, oid string) *g.SnmpPDU {
+	for i := range p.Variables {
+		if p.Variables[i].Name == oid {
+			return &p.Variables[i]
+		}
+	}
+	return nil
+}
+
+func TestForwardV1AsV2c(t *testing.T) {
+	params := *g.Default
+	port, received := startReceiver(t, &params)
+
+	var a trapForwarder
+	args := map[string]string{"traphost": "127.0.0.1", "port": strconv.Itoa(port), "snmp_version": "v2c", "community": "public"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	trap := makeV1Trap()
+	if err := a.ProcessTrap(trap); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	p := waitForTrap(t, received)
+	if p.Version != g.Version2c {
+		t.Errorf("Trap was forwarded as %v", p.Version)
+	}
+	if vb := findVarbind(p, ".1.3.6.1.6.3.1.1.4.1.0"); vb == nil || vb.Value != ".1.3.6.1.6.3.1.1.5.3" {
+		t.Errorf("Missing or invalid snmpTrapOID varbind: %v", p.Variables)
+	}
+	if vb := findVarbind(p, snmpTrapAddressOid); vb == nil || vb.Value != "10.1.1.1" {
+		t.Errorf("Missing or invalid snmpTrapAddress varbind: %v", p.Variables)
+	}
+	if trap.SnmpVersion != g.Version1 || len(trap.Data.Variables) != 1 || trap.Translated {
+		t.Errorf("Forwarding modified the original trap: %+v", trap)
+	}
+}
+
+func TestForwardV2cAsV1(t *testing.T) {
+	params := *g.Default
+	port, received := startReceiver(t, &params)
+
+	var a trapForwarder
+	args := map[string]string{"traphost": "127.0.0.1", "port": strconv.Itoa(port), "snmp_version": "v1"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	trap := makeV1Trap()
+	pluginMeta.TranslateToV2c(trap)
+	trap.Translated = false
+	if err := a.ProcessTrap(trap); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	p := waitForTrap(t, received)
+	if p.Version != g.Version1 || p.GenericTrap != 2 || p.AgentAddress != "10.1.1.1" {
+		t.Errorf("Unexpected v1 trap: version %v generic %d agent %s", p.Version, p.GenericTrap, p.AgentAddress)
+	}
+	if trap.SnmpVersion != g.Version2c || len(trap.Data.Variables) != 5 {
+		t.Errorf("Forwarding modified the original trap: %+v", trap)
+	}
+}
+
+func TestForwardInform(t *testing.T) {
+	params := *g.Default
+	port, received := startReceiver(t, &params)
+
+	var a trapForwarder
+	args := map[string]string{"traphost": "127.0.0.1", "port": strconv.Itoa(port), "snmp_version": "inform"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	// An inform waits for the acknowledgement, so a sent trap means it was received
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	if !waitForSent(&a, port, 1) {
+		t.Errorf("Inform was not acknowledged")
+	}
+	if p := waitForTrap(t, received); p.PDUType != g.InformRequest {
+		t.Errorf("Expected an InformRequest, got %v", p.PDUType)
+	}
+
+	if err := a.Configure(&testLog, map[string]string{"traphost": "127.0.0.1", "port": "162", "snmp_version": "v1", "inform": "true"}); err == nil {
+		t.Errorf("v1 informs were not rejected")
+	}
+}
+
+// v3ReceiverParams returns listener settings for a SHA-256/AES-256 USM user
+func v3ReceiverParams(engineID string) *g.GoSNMP {
+	params := *g.Default
+	params.Version = g.Version3
+	params.SecurityModel = g.UserSecurityModel
+	params.MsgFlags = g.AuthPriv
+	params.SecurityParameters = &g.UsmSecurityParameters{
+		UserName:                 "trapmux",
+		AuthoritativeEngineID:    engineID,
+		AuthenticationProtocol:   g.SHA256,
+		AuthenticationPassphrase: "authpassword",
+		PrivacyProtocol:          g.AES256,
+		PrivacyPassphrase:        "privpassword",
+	}
+	return &params
+}
+
+func v3Args(port int) map[string]string {
+	return map[string]string{
+		"traphost":         "127.0.0.1",
+		"port":             strconv.Itoa(port),
+		"snmp_version":     "v3",
+		"username":         "trapmux",
+		"auth_protocol":    "sha256",
+		"auth_password":    "authpassword",
+		"privacy_protocol": "aes256",
+		"privacy_password": "env:TRAPMUX_TEST_PRIV_PASSWORD",
+	}
+}
+
+func TestForwardV3Trap(t *testing.T) {
+	engineID := "80001f8880e9bd0c1d12667a5100000000"
+	rawEngineID, _ := hex.DecodeString(engineID)
+	port, received := startReceiver(t, v3ReceiverParams(string(rawEngineID)))
+	os.Setenv("TRAPMUX_TEST_PRIV_PASSWORD", "privpassword")
+	defer os.Unsetenv("TRAPMUX_TEST_PRIV_PASSWORD")
+
+	var a trapForwarder
+	args := v3Args(port)
+	if err := a.Configure(&testLog, args); err == nil {
+		t.Errorf("v3 traps without an engine_id were not rejected")
+	}
+	args["engine_id"] = "0x" + engineID
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+	if a.destinations[0].snmp.MsgFlags&g.AuthPriv != g.AuthPriv {
+		t.Errorf("msg_flags was not derived from the protocols: %v", a.destinations[0].snmp.MsgFlags)
+	}
+
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	p := waitForTrap(t, received)
+	if p.Version != g.Version3 {
+		t.Errorf("Trap was forwarded as %v", p.Version)
+	}
+	if vb := findVarbind(p, ".1.3.6.1.6.3.1.1.4.1.0"); vb == nil || vb.Value != ".1.3.6.1.6.3.1.1.5.3" {
+		t.Errorf("Trap was not decrypted by the receiver: %v", p.Variables)
+	}
+}
+
+func TestForwardV3Inform(t *testing.T) {
+	// The receiver is authoritative for informs, so its engine ID is discovered
+	port, received := startReceiver(t, v3ReceiverParams("\x80\x00\x1f\x88\x80receiver"))
+	os.Setenv("TRAPMUX_TEST_PRIV_PASSWORD", "privpassword")
+	defer os.Unsetenv("TRAPMUX_TEST_PRIV_PASSWORD")
+
+	var a trapForwarder
+	args := v3Args(port)
+	args["inform"] = "true"
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	if p := waitForTrap(t, received); p.PDUType != g.InformRequest {
+		t.Errorf("Expected an InformRequest, got %v", p.PDUType)
+	}
+}
+
+func TestV3Arguments(t *testing.T) {
+	if err := validateArguments(g.Version2c, map[string]string{"traphost": "x", "username": "trapmux"}); err == nil {
+		t.Errorf("v3 options were accepted for a v2c destination")
+	}
+	if err := validateArguments(g.Version2c, map[string]string{"traphost": "x", "bogus": "1"}); err == nil {
+		t.Errorf("Unknown options were accepted")
+	}
+	if err := validateArguments(g.Version3, map[string]string{"traphost": "x"}); err == nil {
+		t.Errorf("v3 destination without a username was accepted")
+	}
+
+	args := v3Args(162)
+	args["engine_id"] = "8000000001020304"
+	args["privacy_protocol"] = ""
+	args["msg_flags"] = "authpriv"
+	var a trapForwarder
+	if err := a.Configure(&testLog, args); err == nil {
+		a.Close()
+		t.Errorf("authPriv without a privacy protocol was accepted")
+	}
+}
+
+// closedPort returns a local port with nothing listening on it
+func closedPort(t *testing.T) int {
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	return port
+}
+
+func groupArgs(mode string, ports ...int) map[string]string {
+	var hosts []string
+	for _, port := range ports {
+		hosts = append(hosts, "127.0.0.1:"+strconv.Itoa(port))
+	}
+	return map[string]string{"traphost": strings.Join(hosts, ","), "snmp_version": "inform", "mode": mode, "timeout": "1", "retries": "0"}
+}
+
+func countReceived(received chan *g.SnmpPacket) int {
+	count := 0
+	for {
+		select {
+		case <-received:
+			count++
+		case <-time.After(200 * time.Millisecond):
+			return count
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	params1, params2 := *g.Default, *g.Default
+	port1, received1 := startReceiver(t, &params1)
+	port2, received2 := startReceiver(t, &params2)
+
+	var a trapForwarder
+	if err := a.Configure(&testLog, groupArgs("round_robin", port1, port2)); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := a.ProcessTrap(makeV1Trap()); err != nil {
+			t.Fatalf("Unable to forward trap: %s", err)
+		}
+	}
+	if n1, n2 := countReceived(received1), countReceived(received2); n1 != 2 || n2 != 2 {
+		t.Errorf("Traps were not shared between destinations: %d and %d", n1, n2)
+	}
+}
+
+func TestHashBySource(t *testing.T) {
+	params1, params2 := *g.Default, *g.Default
+	port1, received1 := startReceiver(t, &params1)
+	port2, received2 := startReceiver(t, &params2)
+
+	var a trapForwarder
+	if err := a.Configure(&testLog, groupArgs("hash", port1, port2)); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := a.ProcessTrap(makeV1Trap()); err != nil {
+			t.Fatalf("Unable to forward trap: %s", err)
+		}
+	}
+	n1, n2 := countReceived(received1), countReceived(received2)
+	if !(n1 == 3 && n2 == 0) && !(n1 == 0 && n2 == 3) {
+		t.Errorf("Traps from one agent were split between destinations: %d and %d", n1, n2)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	params := *g.Default
+	standbyPort, received := startReceiver(t, &params)
+	activePort := closedPort(t)
+
+	var a trapForwarder
+	if err := a.Configure(&testLog, groupArgs("failover", activePort, standbyPort)); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	waitForTrap(t, received)
+	if !waitForSent(&a, standbyPort, 1) {
+		t.Fatalf("Trap was not sent to the standby destination")
+	}
+	if a.destinations[0].healthy || !a.destinations[1].healthy {
+		t.Errorf("Failed destination was not marked down")
+	}
+	if a.available(a.destinations[0], time.Now()) {
+		t.Errorf("Failed destination is available before retry_interval")
+	}
+
+	// With probes, health comes from the heartbeat informs
+	a.probeInterval = time.Hour
+	a.destinations[0].probe = a.destinations[0].snmp
+	a.destinations[1].probe = a.destinations[1].snmp
+	a.destinations[1].healthy = false
+	a.probe()
+	if a.destinations[0].healthy || !a.destinations[1].healthy {
+		t.Errorf("Probe did not update destination health")
+	}
+	if p := waitForTrap(t, received); findVarbind(p, ".1.3.6.1.6.3.1.1.4.1.0").Value != defaultProbeOID {
+		t.Errorf("Unexpected probe inform: %v", p.Variables)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	params := *g.Default
+	port, received := startReceiver(t, &params)
+
+	var a trapForwarder
+	args := map[string]string{"traphost": "127.0.0.1:" + strconv.Itoa(port), "snmp_version": "v2c", "queue_size": "1", "workers": "1"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	// Hold up the worker so that the queue fills
+	a.destinations[0].sendMutex.Lock()
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to queue trap: %s", err)
+	}
+	for len(a.queues[0]) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to queue trap: %s", err)
+	}
+	if err := a.ProcessTrap(makeV1Trap()); err == nil {
+		t.Errorf("Trap was queued beyond queue_size")
+	}
+	a.destinations[0].sendMutex.Unlock()
+
+	// Close sends whatever is still queued
+	a.Close()
+	if n := countReceived(received); n != 2 {
+		t.Errorf("Expected 2 forwarded traps, received %d", n)
+	}
+	target := a.destinations[0].address
+	if dropped := testutil.ToFloat64(droppedTraps.WithLabelValues(a.group, target)); dropped != 1 {
+		t.Errorf("Dropped trap was not counted: %v", dropped)
+	}
+	if queued := testutil.ToFloat64(queuedTraps.WithLabelValues(a.group, target)); queued != 2 {
+		t.Errorf("Queued traps were not counted: %v", queued)
+	}
+	if queued := testutil.ToFloat64(queueLength.WithLabelValues(a.group, target)); queued != 0 {
+		t.Errorf("Queue length was not updated: %v", queued)
+	}
+	if err := a.ProcessTrap(makeV1Trap()); err == nil {
+		t.Errorf("Trap was accepted after Close")
+	}
+}
+
+func TestSourceOrder(t *testing.T) {
+	params := *g.Default
+	port, received := startReceiver(t, &params)
+
+	var a trapForwarder
+	args := map[string]string{"traphost": "127.0.0.1:" + strconv.Itoa(port), "snmp_version": "v2c", "workers": "4"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	// The traps from an agent are sent in order, even with several workers
+	const count = 50
+	for i := 0; i < count; i++ {
+		trap := makeV1Trap()
+		trap.Data.Variables[0].Value = i
+		if err := a.ProcessTrap(trap); err != nil {
+			t.Fatalf("Unable to queue trap: %s", err)
+		}
+	}
+	a.Close()
+	for i := 0; i < count; i++ {
+		p := waitForTrap(t, received)
+		if value := findVarbind(p, ".1.3.6.1.2.1.2.2.1.1.3").Value; value != i {
+			t.Fatalf("Trap %d was forwarded out of order: %v", i, value)
+		}
+	}
+}
+
+func TestFailedMetric(t *testing.T) {
+	params := *g.Default
+	port, _ := startReceiver(t, &params)
+	downPort := closedPort(t)
+
+	var a trapForwarder
+	if err := a.Configure(&testLog, groupArgs("failover", downPort, port)); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if err := a.ProcessTrap(makeV1Trap()); err != nil {
+		t.Fatalf("Unable to queue trap: %s", err)
+	}
+	a.Close()
+
+	down, up := a.destinations[0].address, a.destinations[1].address
+	if n := testutil.ToFloat64(queuedTraps.WithLabelValues(a.group, down)); n != 1 {
+		t.Errorf("Trap was not queued for the first destination: %v", n)
+	}
+	if n := testutil.ToFloat64(failedTraps.WithLabelValues(a.group, down)); n != 1 {
+		t.Errorf("Failed send was not counted: %v", n)
+	}
+	if n := testutil.ToFloat64(sentTraps.WithLabelValues(a.group, up)); n != 1 {
+		t.Errorf("Trap was not sent to the second destination: %v", n)
+	}
+}
+
+func TestBuildUDPPacket(t *testing.T) {
+	payload := []byte("trap")
+	packet, err := buildUDPPacket(net.ParseIP("192.0.2.1"), 1024, net.ParseIP("198.51.100.7"), 162, payload)
+	if err != nil {
+		t.Fatalf("Unable to build packet: %s", err)
+	}
+	if len(packet) != 32 || packet[0] != 0x45 || packet[9] != 17 {
+		t.Fatalf("Invalid IPv4 header: %x", packet[:20])
+	}
+	if !net.IP(packet[12:16]).Equal(net.ParseIP("192.0.2.1")) || !net.IP(packet[16:20]).Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("Invalid addresses in IPv4 header: %x", packet[12:20])
+	}
+	// A valid checksum sums to zero
+	if sum := checksum(packet[:20], 0); sum != 0 {
+		t.Errorf("Invalid IPv4 header checksum: %x", sum)
+	}
+	pseudo := uint32(0xc000+0x0201+0xc633+0x6407) + 17 + 12
+	if sum := checksum(packet[20:], pseudo); sum != 0 {
+		t.Errorf("Invalid UDP checksum: %x", sum)
+	}
+	if string(packet[28:]) != "trap" {
+		t.Errorf("Payload was not copied: %x", packet[28:])
+	}
+
+	if _, err = buildUDPPacket(net.ParseIP("2001:db8::1"), 162, net.ParseIP("198.51.100.7"), 162, payload); err == nil {
+		t.Errorf("IPv6 source address was accepted")
+	}
+}
+
+func TestSpoofSource(t *testing.T) {
+	if sender, err := newRawSender(); err != nil {
+		t.Skipf("Raw sockets are not available: %s", err)
+	} else {
+		sender.close()
+	}
+
+	var sources []*net.UDPAddr
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	received := make(chan *g.SnmpPacket, 1)
+	listener := g.NewTrapListener()
+	params := *g.Default
+	listener.Params = &params
+	listener.OnNewTrap = func(p *g.SnmpPacket, addr *net.UDPAddr) {
+		sources = append(sources, addr)
+		copied := *p
+		received <- &copied
+	}
+	go listener.Listen("127.0.0.1:" + strconv.Itoa(port))
+	defer listener.Close()
+	<-listener.Listening()
+
+	var a trapForwarder
+	args := map[string]string{"traphost": "127.0.0.1:" + strconv.Itoa(port), "snmp_version": "v2c", "spoof_source": "true"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	packet := g.SnmpPacket{Version: g.Version2c, Community: "public", PDUType: g.SNMPv2Trap,
+		Variables: []g.SnmpPDU{
+			{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(10)},
+			{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		},
+	}
+	raw, err := packet.MarshalMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("127.0.0.2"), SrcPort: 1162, SnmpVersion: g.Version2c, Raw: raw}
+	if err := a.ProcessTrap(&trap); err != nil {
+		t.Fatalf("Unable to forward trap: %s", err)
+	}
+	waitForTrap(t, received)
+	if !sources[0].IP.Equal(net.ParseIP("127.0.0.2")) || sources[0].Port != 1162 {
+		t.Errorf("Source address was not preserved: %s", sources[0])
+	}
+
+	if err := a.ProcessTrap(makeV1Trap()); err == nil {
+		t.Errorf("Trap without the received packet was accepted")
+	}
+}
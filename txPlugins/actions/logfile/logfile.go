@@ -7,19 +7,61 @@ package main
 
 /*
 This plugin logs SNMP trap data to a log file
+
+Arguments:
+  filename              - file to write to (required)
+  format                - text (default), jsonl (one canonical JSON trap per line),
+                          cef (ArcSight) or leef (QRadar LEEF 1.0)
+  template              - Go template for each log entry, instead of a format
+  template_file         - file containing the template
+  size_mb               - size at which the file is rotated (default 100)
+  backups_max           - number of rotated files to keep (default all)
+  max_age_days          - remove rotated files older than this (default never)
+  compress_after_rotate - gzip rotated files (default false)
+  rotate_interval       - also rotate on this interval (eg 1h or 24h), counted from
+                          midnight or rotate_at
+  rotate_at             - also rotate daily at this local time of day (HH:MM)
+
+The filename can contain the date and time, as %Y (year), %m (month), %d (day),
+%H (hour), %M (minute) and %j (day of year), eg /var/log/trapmux/traps-%Y%m%d.log
+starts a new file each day.  The rotation settings apply to each of the files,
+and SIGUSR2 rotates the current file.
+
+CEF and LEEF arguments:
+  vendor                - device vendor in the header (default: trapmux)
+  product               - device product in the header (default: trapmux)
+  product_version       - device version in the header (default: 1.0)
+  severity              - event severity, 0-10 (default 5)
+  field_map             - comma-separated key=field pairs for the extension, in order
+                          (defaults below).  A field is one of the trap fields
+                          time, source_ip, source_port, agent_address, hostname,
+                          device_name (from the resolver), listener, community,
+                          security_name, snmp_version,
+                          enterprise, generic_type, specific_type, trap_oid,
+                          trap_name, uptime, trap_number, severity or varbinds,
+                          oid:<varbind OID or MIB name> for a varbind value,
+                          meta:<key> for trap metadata (eg from the enrich action),
+                          or literal:<text>.  Empty values are left out.
+
+The CEF signature ID is the trap OID, and the name is the MIB name of the
+trap (if known).  The LEEF event ID is the MIB name or trap OID.
 */
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
-	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	"github.com/natefinch/lumberjack"
 	"github.com/rs/zerolog"
 )
@@ -37,57 +79,299 @@ var trapType = [...]string{
 	"Vendor Specific",
 }
 
+// Default extension fields for the CEF and LEEF formats
+const (
+	defaultCefFieldMap = "rt=time,src=source_ip,spt=source_port,dvc=agent_address,dvchost=device_name," +
+		"cs1Label=literal:trapOID,cs1=trap_oid,cs2Label=literal:community,cs2=community,msg=varbinds"
+	defaultLeefFieldMap = "devTime=time,sev=severity,src=source_ip,srcPort=source_port,identSrc=agent_address," +
+		"identHostName=device_name,trapOID=trap_oid,trapName=trap_name,community=community,varbinds=varbinds"
+)
+
+// siemField is one key=field pair of the field_map argument
+//
+type siemField struct {
+	key   string
+	field string
+}
+
+// The trap fields that can be used in a field_map
+var siemFieldNames = map[string]bool{
+	"time": true, "source_ip": true, "source_port": true, "agent_address": true, "hostname": true, "device_name": true,
+	"listener": true, "community": true, "security_name": true, "snmp_version": true, "enterprise": true,
+	"generic_type": true, "specific_type": true, "trap_oid": true, "trap_name": true, "uptime": true,
+	"trap_number": true, "severity": true, "varbinds": true,
+}
+
+// Header and extension escaping (CEF implementation standard, section "Character encoding")
+var cefHeaderEscaper = strings.NewReplacer("\\", "\\\\", "|", "\\|", "\n", " ", "\r", " ")
+var cefValueEscaper = strings.NewReplacer("\\", "\\\\", "=", "\\=", "\n", "\\n", "\r", "\\r")
+
+// LEEF attributes are tab separated, so keep tabs and newlines out of values
+var leefHeaderEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ", "|", "\\|")
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
 type trapLogger struct {
 	logFile   string
-	fd        *os.File
+	logWriter *rotatingLog
 	logHandle *log.Logger
 	isBroken  bool
+	format    string
+	template  *template.Template
+
+	// CEF and LEEF settings
+	vendor         string
+	product        string
+	productVersion string
+	severity       int
+	fieldMap       []siemField
 
 	pluginLog *zerolog.Logger
 }
 
 const pluginName = "trap logger"
 
-func makeLogger(logfile string, actionArgs map[string]string) *lumberjack.Logger {
-	var ok bool
+// rotatingLog is the log file writer.  The rotation itself is done by
+// lumberjack, which only knows about size, so this adds the time of day
+// rotation and the dated filenames.
+//
+type rotatingLog struct {
+	mutex sync.Mutex
 
-	l := lumberjack.Logger{Filename: logfile}
-	var value string
-	value, ok = actionArgs["size_mb"]
-	if ok {
-		converted, err := strconv.Atoi(value)
-		if err != nil {
-			l.MaxSize = converted
+	filenameExpr   string
+	maxSize        int
+	maxBackups     int
+	maxAge         int
+	compress       bool
+	rotateAt       time.Duration
+	rotateInterval time.Duration
+
+	current     *lumberjack.Logger
+	currentName string
+	nextRotate  time.Time
+	now         func() time.Time
+}
+
+// expandFilename fills in the date and time in a filename
+//
+func expandFilename(expr string, now time.Time) string {
+	if !strings.Contains(expr, "%") {
+		return expr
+	}
+	return strings.NewReplacer(
+		"%Y", now.Format("2006"),
+		"%m", now.Format("01"),
+		"%d", now.Format("02"),
+		"%H", now.Format("15"),
+		"%M", now.Format("04"),
+		"%j", fmt.Sprintf("%03d", now.YearDay()),
+		"%%", "%",
+	).Replace(expr)
+}
+
+func makeLogger(logfile string, actionArgs map[string]string) (*rotatingLog, error) {
+	var err error
+	l := rotatingLog{filenameExpr: logfile, now: time.Now}
+
+	if l.maxSize, err = pluginMeta.GetIntArg(actionArgs, "size_mb", 0, pluginName); err != nil {
+		return nil, err
+	}
+	if l.maxBackups, err = pluginMeta.GetIntArg(actionArgs, "backups_max", 0, pluginName); err != nil {
+		return nil, err
+	}
+	if l.maxAge, err = pluginMeta.GetIntArg(actionArgs, "max_age_days", 0, pluginName); err != nil {
+		return nil, err
+	}
+	if value, ok := actionArgs["compress_after_rotate"]; ok {
+		if l.compress, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Invalid value for compress_after_rotate argument to %s plugin: %s", pluginName, value)
 		}
 	}
-	value, ok = actionArgs["backups_max"]
-	if ok {
-		converted, err := strconv.Atoi(value)
+
+	if value, ok := actionArgs["rotate_at"]; ok {
+		at, err := time.Parse("15:04", value)
 		if err != nil {
-			l.MaxBackups = converted
+			return nil, fmt.Errorf("Invalid value for rotate_at argument to %s plugin: %s", pluginName, value)
 		}
+		l.rotateAt = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+		l.rotateInterval = 24 * time.Hour
 	}
-	value, ok = actionArgs["compress_after_rotate"]
-	if ok {
-		converted, err := strconv.ParseBool(value)
-		if err != nil {
-			l.Compress = converted
+	if value, ok := actionArgs["rotate_interval"]; ok {
+		if l.rotateInterval, err = time.ParseDuration(value); err != nil || l.rotateInterval < time.Minute {
+			return nil, fmt.Errorf("Invalid value for rotate_interval argument to %s plugin: %s", pluginName, value)
 		}
 	}
-	return &l
+
+	// Report problems with the file now rather than on the first trap
+	name := expandFilename(logfile, l.now())
+	fd, err := os.OpenFile(filepath.Clean(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = fd.Close(); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// nextRotation returns the first rotation time after the given time
+//
+func (l *rotatingLog) nextRotation(after time.Time) time.Time {
+	next := time.Date(after.Year(), after.Month(), after.Day(), 0, 0, 0, 0, after.Location()).Add(l.rotateAt)
+	for next.Add(-l.rotateInterval).After(after) {
+		next = next.Add(-l.rotateInterval)
+	}
+	for !next.After(after) {
+		next = next.Add(l.rotateInterval)
+	}
+	return next
+}
+
+// open switches to the named file.  A file that was last written before
+// a rotation time that has passed is rotated on the next write.
+//
+func (l *rotatingLog) open(name string, now time.Time) error {
+	if l.current != nil {
+		if err := l.current.Close(); err != nil {
+			return err
+		}
+	}
+	l.current = &lumberjack.Logger{Filename: name, MaxSize: l.maxSize, MaxBackups: l.maxBackups,
+		MaxAge: l.maxAge, Compress: l.compress}
+	l.currentName = name
+
+	if l.rotateInterval > 0 {
+		last := now
+		if info, err := os.Stat(name); err == nil && info.Size() > 0 {
+			last = info.ModTime()
+		}
+		l.nextRotate = l.nextRotation(last)
+	}
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if name := expandFilename(l.filenameExpr, now); l.current == nil || name != l.currentName {
+		if err := l.open(name, now); err != nil {
+			return 0, err
+		}
+	}
+	if l.rotateInterval > 0 && !now.Before(l.nextRotate) {
+		if err := l.current.Rotate(); err != nil {
+			return 0, err
+		}
+		l.nextRotate = l.nextRotation(now)
+	}
+	return l.current.Write(p)
+}
+
+// Rotate starts a new file, keeping the old one as a backup
+//
+func (l *rotatingLog) Rotate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.current == nil {
+		return nil
+	}
+	return l.current.Rotate()
+}
+
+func (l *rotatingLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.current == nil {
+		return nil
+	}
+	err := l.current.Close()
+	l.current = nil
+	return err
 }
 
 func validateArguments(actionArgs map[string]string) error {
-	validArgs := map[string]bool{"filename": true, "size_mb": true, "backups_max": true, "compress_after_rotate": true}
+	validArgs := map[string]bool{"filename": true, "format": true, "template": true, "template_file": true,
+		"size_mb": true, "backups_max": true, "max_age_days": true, "compress_after_rotate": true,
+		"rotate_interval": true, "rotate_at": true,
+		"vendor": true, "product": true, "product_version": true, "severity": true, "field_map": true}
 
 	for key, _ := range actionArgs {
 		if _, ok := validArgs[key]; !ok {
 			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
 		}
 	}
+	switch actionArgs["format"] {
+	case "", "text", "jsonl", "cef", "leef":
+	default:
+		return fmt.Errorf("Unknown format for %s plugin: %s", pluginName, actionArgs["format"])
+	}
 	return nil
 }
 
+// parseFieldMap converts the 'field_map' argument (key=field,...) into the
+// ordered list of extension fields
+//
+func parseFieldMap(mapping string) ([]siemField, error) {
+	var fields []siemField
+	for _, pair := range strings.Split(mapping, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid field_map entry for %s plugin: %s", pluginName, pair)
+		}
+		field := siemField{key: strings.TrimSpace(kv[0]), field: strings.TrimSpace(kv[1])}
+		switch {
+		case strings.HasPrefix(field.field, "literal:"), strings.HasPrefix(field.field, "meta:"):
+		case strings.HasPrefix(field.field, "oid:"):
+			if _, ok := pluginMeta.Mibs().Lookup(strings.TrimPrefix(field.field, "oid:")); !ok {
+				return nil, fmt.Errorf("Unknown varbind OID in field_map for %s plugin: %s", pluginName, field.field)
+			}
+		case !siemFieldNames[field.field]:
+			return nil, fmt.Errorf("Unknown trap field in field_map for %s plugin: %s", pluginName, field.field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// configureSiem sets up the CEF and LEEF header values and field mapping
+//
+func (a *trapLogger) configureSiem(actionArgs map[string]string) error {
+	a.vendor = actionArgs["vendor"]
+	if a.vendor == "" {
+		a.vendor = "trapmux"
+	}
+	a.product = actionArgs["product"]
+	if a.product == "" {
+		a.product = "trapmux"
+	}
+	a.productVersion = actionArgs["product_version"]
+	if a.productVersion == "" {
+		a.productVersion = "1.0"
+	}
+
+	a.severity = 5
+	if value := actionArgs["severity"]; value != "" {
+		var err error
+		if a.severity, err = strconv.Atoi(value); err != nil || a.severity < 0 || a.severity > 10 {
+			return fmt.Errorf("Invalid value for severity argument to %s plugin: %s", pluginName, value)
+		}
+	}
+
+	mapping := actionArgs["field_map"]
+	if mapping == "" && a.format == "cef" {
+		mapping = defaultCefFieldMap
+	} else if mapping == "" {
+		mapping = defaultLeefFieldMap
+	}
+	var err error
+	a.fieldMap, err = parseFieldMap(mapping)
+	return err
+}
+
 func (a *trapLogger) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
 	var ok bool
 	a.pluginLog = pluginLog
@@ -101,19 +385,58 @@ func (a *trapLogger) Configure(pluginLog *zerolog.Logger, actionArgs map[string]
 	if !ok {
 		return fmt.Errorf("Missing the required 'filename' argument to the logfile action")
 	}
-	fd, err := os.OpenFile(a.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
+	a.format = actionArgs["format"]
+	if a.format == "" {
+		a.format = "text"
+	}
+	var err error
+	if a.template, err = pluginMeta.GetTemplateArg(actionArgs, pluginName); err != nil {
+		return err
+	}
+	if a.template != nil {
+		if actionArgs["format"] != "" {
+			return fmt.Errorf("The format and template arguments to the %s plugin can't be used together", pluginName)
+		}
+		a.format = "template"
+	}
+	if a.format == "cef" || a.format == "leef" {
+		if err = a.configureSiem(actionArgs); err != nil {
+			return err
+		}
+	}
+	if a.logWriter, err = makeLogger(a.logFile, actionArgs); err != nil {
 		return err
 	}
-	a.fd = fd
-	a.logHandle = log.New(fd, "", 0)
-	a.logHandle.SetOutput(makeLogger(a.logFile, actionArgs))
-	a.pluginLog.Info().Str("logfile", a.logFile).Msg("Added log destination")
+	a.logHandle = log.New(a.logWriter, "", 0)
+	a.pluginLog.Info().Str("logfile", a.logFile).Str("format", a.format).Msg("Added log destination")
 	return nil
 }
 
 func (a trapLogger) ProcessTrap(trap *pluginMeta.Trap) error {
-	a.logHandle.Printf(makeTrapLogEntry(trap))
+	if a.template != nil {
+		entry, err := pluginMeta.ExecuteTemplate(a.template, trap)
+		if err != nil {
+			return err
+		}
+		a.logHandle.Print(entry)
+		return nil
+	}
+	if a.format == "jsonl" {
+		jsonBytes, err := json.Marshal(trap)
+		if err != nil {
+			return err
+		}
+		a.logHandle.Println(string(jsonBytes))
+		return nil
+	}
+	switch a.format {
+	case "cef":
+		a.logHandle.Println(a.makeCefEntry(trap))
+	case "leef":
+		a.logHandle.Println(a.makeLeefEntry(trap))
+	default:
+		a.logHandle.Print(makeTrapLogEntry(trap))
+	}
 	return nil
 }
 
@@ -121,12 +444,124 @@ func (a trapLogger) SigUsr1() error {
 	return nil
 }
 
+// SigUsr2 rotates the log file
+//
 func (a trapLogger) SigUsr2() error {
-	return nil
+	a.pluginLog.Info().Str("logfile", a.logFile).Msg("Rotating log file")
+	return a.logWriter.Rotate()
 }
 
 func (a trapLogger) Close() error {
-	return a.fd.Close()
+	return a.logWriter.Close()
+}
+
+// trapField returns the value of a field_map field for the trap
+//
+func (a *trapLogger) trapField(trap *pluginMeta.Trap, field string) string {
+	switch {
+	case strings.HasPrefix(field, "literal:"):
+		return strings.TrimPrefix(field, "literal:")
+	case strings.HasPrefix(field, "meta:"):
+		return trap.Metadata[strings.TrimPrefix(field, "meta:")]
+	case strings.HasPrefix(field, "oid:"):
+		// Table columns match without the index
+		return pluginMeta.NewTemplateData(trap).VarbindDisplay(strings.TrimPrefix(field, "oid:"))
+	}
+
+	switch field {
+	case "time":
+		return strconv.FormatInt(trap.Time().UnixNano()/int64(time.Millisecond), 10)
+	case "source_ip":
+		if trap.SrcIP == nil {
+			return ""
+		}
+		return trap.SrcIP.String()
+	case "source_port":
+		if trap.SrcPort == 0 {
+			return ""
+		}
+		return strconv.Itoa(trap.SrcPort)
+	case "agent_address":
+		return trap.Data.AgentAddress
+	case "hostname":
+		return trap.Hostname
+	case "device_name":
+		return trap.DeviceName
+	case "listener":
+		return trap.Listener
+	case "community":
+		return trap.Community
+	case "security_name":
+		return trap.SecurityName
+	case "snmp_version":
+		return trap.SnmpVersion.String()
+	case "enterprise":
+		return strings.Trim(trap.Data.Enterprise, ".")
+	case "generic_type":
+		return strconv.Itoa(trap.Data.GenericTrap)
+	case "specific_type":
+		return strconv.Itoa(trap.Data.SpecificTrap)
+	case "trap_oid":
+		return trap.TrapOID()
+	case "trap_name":
+		return trap.TrapName()
+	case "uptime":
+		return strconv.FormatUint(uint64(trap.Data.Timestamp), 10)
+	case "trap_number":
+		return strconv.FormatUint(uint64(trap.TrapNumber), 10)
+	case "severity":
+		return strconv.Itoa(a.severity)
+	case "varbinds":
+		var vbs []string
+		for _, v := range trap.Data.Variables {
+			vbs = append(vbs, pluginMeta.VarbindName(v)+"="+pluginMeta.VarbindDisplay(v))
+		}
+		return strings.Join(vbs, " ")
+	}
+	return ""
+}
+
+// makeCefEntry formats the trap as an ArcSight Common Event Format line
+//
+func (a *trapLogger) makeCefEntry(trap *pluginMeta.Trap) string {
+	name := trap.TrapName()
+	if name == "" {
+		name = "SNMP trap " + trap.TrapOID()
+	}
+	header := []string{"CEF:0", a.vendor, a.product, a.productVersion, trap.TrapOID(), name, strconv.Itoa(a.severity)}
+	for i := range header[1:] {
+		header[i+1] = cefHeaderEscaper.Replace(header[i+1])
+	}
+
+	var ext []string
+	for _, f := range a.fieldMap {
+		if value := a.trapField(trap, f.field); value != "" {
+			ext = append(ext, f.key+"="+cefValueEscaper.Replace(value))
+		}
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// makeLeefEntry formats the trap as a QRadar Log Event Extended Format 1.0
+// line, with tab separated attributes
+//
+func (a *trapLogger) makeLeefEntry(trap *pluginMeta.Trap) string {
+	eventID := trap.TrapName()
+	if eventID == "" {
+		eventID = trap.TrapOID()
+	}
+	header := []string{"LEEF:1.0", a.vendor, a.product, a.productVersion, eventID}
+	for i := range header[1:] {
+		header[i+1] = leefHeaderEscaper.Replace(header[i+1])
+	}
+
+	var attrs []string
+	for _, f := range a.fieldMap {
+		if value := a.trapField(trap, f.field); value != "" {
+			attrs = append(attrs, f.key+"="+leefValueEscaper.Replace(value))
+		}
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(attrs, "\t")
 }
 
 // makeTrapLogEntry creates a log entry string for the given trap data.
@@ -145,19 +580,32 @@ func makeTrapLogEntry(sgt *pluginMeta.Trap) string {
 	}
 	b.WriteString(fmt.Sprintf("\nTrap: %v", sgt.TrapNumber))
 	b.WriteString(fmt.Sprintf("\nSNMP Version%s", sgt.SnmpVersion.String()))
-	b.WriteString(fmt.Sprintf("\n\t%s\n", time.Now().Format(time.ANSIC)))
+	b.WriteString(fmt.Sprintf("\n\t%s\n", sgt.Time().Format(time.ANSIC)))
 	b.WriteString(fmt.Sprintf("\tSrc IP: %s\n", sgt.SrcIP))
 	b.WriteString(fmt.Sprintf("\tAgent: %s\n", trap.AgentAddress))
+	if sgt.DeviceName != "" {
+		b.WriteString(fmt.Sprintf("\tDevice Name: %s\n", sgt.DeviceName))
+	}
 	b.WriteString(fmt.Sprintf("\tTrap Type: %s\n", genTrapType))
 	b.WriteString(fmt.Sprintf("\tSpecific Type: %v\n", trap.SpecificTrap))
 	b.WriteString(fmt.Sprintf("\tEnterprise: %s\n", strings.Trim(trap.Enterprise, ".")))
 	b.WriteString(fmt.Sprintf("\tTimestamp: %v\n", trap.Timestamp))
+	if name := sgt.TrapName(); name != "" {
+		b.WriteString(fmt.Sprintf("\tTrap Name: %s\n", name))
+	}
+	for _, key := range sgt.MetadataKeys() {
+		b.WriteString(fmt.Sprintf("\tMetadata: %s=%s\n", key, strings.ReplaceAll(sgt.Metadata[key], "%", "%%")))
+	}
 
 	replacer := strings.NewReplacer("\n", " - ", "%", "%%")
 
 	// Process the Varbinds for this trap.
 	for _, v := range trap.Variables {
-		vbName := strings.Trim(v.Name, ".")
+		vbName := pluginMeta.VarbindName(v)
+		if display, ok := pluginMeta.Mibs().FormatValue(v); ok {
+			b.WriteString(fmt.Sprintf("\tObject:%s Value:%s\n", vbName, replacer.Replace(display)))
+			continue
+		}
 		switch v.Type {
 		case g.OctetString:
 			var nonASCII bool
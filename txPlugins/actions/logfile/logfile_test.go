@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+func makeTestTrap() *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SrcPort: 161, SnmpVersion: g.Version1,
+		Community: "pub|lic", ReceivedAt: time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)}
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.SetMetadata("site", "lon1")
+	trap.Data.Enterprise = ".1.3.6.1.6.3.1.1.5"
+	trap.Data.GenericTrap = 2
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0=up\n")},
+	}
+	return &trap
+}
+
+// logTestTrap configures a logfile action with the arguments, logs the test
+// trap and returns what was written
+//
+func logTestTrap(t *testing.T, args map[string]string) string {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args["filename"] = filepath.Join(dir, "traps.log")
+
+	var a trapLogger
+	if err = a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+	if err = a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Fatalf("Unable to log trap: %s", err)
+	}
+	data, err := ioutil.ReadFile(args["filename"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCefFormat(t *testing.T) {
+	line := logTestTrap(t, map[string]string{"format": "cef", "vendor": "Acme|Corp", "severity": "7"})
+	expected := "CEF:0|Acme\\|Corp|trapmux|1.0|1.3.6.1.6.3.1.1.5.3|SNMP trap 1.3.6.1.6.3.1.1.5.3|7|" +
+		"rt=1646370367000 src=192.0.2.1 spt=161 dvc=10.1.1.1 cs1Label=trapOID cs1=1.3.6.1.6.3.1.1.5.3 " +
+		"cs2Label=community cs2=pub|lic msg=1.3.6.1.2.1.2.2.1.1.3\\=3 1.3.6.1.2.1.2.2.1.2.3\\=eth0\\=up\\n\n"
+	if line != expected {
+		t.Errorf("Unexpected CEF output:\n%q\nexpected:\n%q", line, expected)
+	}
+}
+
+func TestLeefFormat(t *testing.T) {
+	line := logTestTrap(t, map[string]string{"format": "leef",
+		"field_map": "devTime=time, src=source_ip, ifDescr=oid:1.3.6.1.2.1.2.2.1.2, cat=literal:snmp, site=meta:site, role=meta:role"})
+	expected := "LEEF:1.0|trapmux|trapmux|1.0|1.3.6.1.6.3.1.1.5.3|" +
+		"devTime=1646370367000\tsrc=192.0.2.1\tifDescr=eth0=up \tcat=snmp\tsite=lon1\n"
+	if line != expected {
+		t.Errorf("Unexpected LEEF output:\n%q\nexpected:\n%q", line, expected)
+	}
+}
+
+func TestJsonlFormat(t *testing.T) {
+	line := logTestTrap(t, map[string]string{"format": "jsonl"})
+	if strings.Count(line, "\n") != 1 || !strings.Contains(line, `"agent_address":"10.1.1.1"`) {
+		t.Errorf("Unexpected JSON Lines output: %s", line)
+	}
+}
+
+func TestFieldMapErrors(t *testing.T) {
+	invalid := []map[string]string{
+		{"format": "cef", "field_map": "src=no_such_field"},
+		{"format": "cef", "field_map": "src"},
+		{"format": "leef", "field_map": "x=oid:NO-SUCH-MIB::thing"},
+		{"format": "cef", "severity": "11"},
+		{"format": "xml"},
+	}
+	for _, args := range invalid {
+		args["filename"] = filepath.Join(os.TempDir(), "logfile-not-created.log")
+		var a trapLogger
+		if err := a.Configure(&testLog, args); err == nil {
+			a.Close()
+			t.Errorf("Invalid arguments were accepted: %v", args)
+		}
+	}
+}
+
+func TestRotationSettings(t *testing.T) {
+	l, err := makeLogger(filepath.Join(os.TempDir(), "logfile-settings.log"),
+		map[string]string{"size_mb": "5", "backups_max": "3", "max_age_days": "7", "compress_after_rotate": "true"})
+	if err != nil {
+		t.Fatalf("Unable to make logger: %s", err)
+	}
+	defer os.Remove(filepath.Join(os.TempDir(), "logfile-settings.log"))
+	if l.maxSize != 5 || l.maxBackups != 3 || l.maxAge != 7 || !l.compress {
+		t.Errorf("Rotation settings were not applied: %+v", l)
+	}
+
+	invalid := []map[string]string{
+		{"size_mb": "big"},
+		{"backups_max": "-1"},
+		{"compress_after_rotate": "sometimes"},
+		{"rotate_at": "25:00"},
+		{"rotate_interval": "1s"},
+	}
+	for _, args := range invalid {
+		if _, err = makeLogger(filepath.Join(os.TempDir(), "logfile-settings.log"), args); err == nil {
+			t.Errorf("Invalid arguments were accepted: %v", args)
+		}
+	}
+}
+
+func TestNextRotation(t *testing.T) {
+	at := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		rotateAt, interval time.Duration
+		expected           time.Time
+	}{
+		{0, 24 * time.Hour, time.Date(2022, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{0, time.Hour, time.Date(2022, 3, 4, 6, 0, 0, 0, time.UTC)},
+		{23*time.Hour + 30*time.Minute, 24 * time.Hour, time.Date(2022, 3, 4, 23, 30, 0, 0, time.UTC)},
+		{23*time.Hour + 30*time.Minute, 6 * time.Hour, time.Date(2022, 3, 4, 5, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		l := rotatingLog{rotateAt: test.rotateAt, rotateInterval: test.interval}
+		if next := l.nextRotation(at); !next.Equal(test.expected) {
+			t.Errorf("Rotation at %v every %v gave %v, expected %v", test.rotateAt, test.interval, next, test.expected)
+		}
+	}
+}
+
+func TestTimeRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2022, 3, 4, 23, 59, 0, 0, time.Local)
+	l, err := makeLogger(filepath.Join(dir, "traps-%Y%m%d.log"), map[string]string{"rotate_interval": "1h"})
+	if err != nil {
+		t.Fatalf("Unable to make logger: %s", err)
+	}
+	defer l.Close()
+	l.now = func() time.Time { return now }
+
+	writes := []time.Duration{0, 30 * time.Second, 2 * time.Minute, 62 * time.Minute}
+	for _, offset := range writes {
+		now = time.Date(2022, 3, 4, 23, 59, 0, 0, time.Local).Add(offset)
+		if _, err = l.Write([]byte(now.String() + "\n")); err != nil {
+			t.Fatalf("Unable to write: %s", err)
+		}
+	}
+
+	// One file for the 4th, and on the 5th a backup from the hourly rotation
+	files, _ := filepath.Glob(filepath.Join(dir, "traps-2022*"))
+	if len(files) != 3 {
+		t.Errorf("Expected 3 log files, found %v", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "traps-20220304.log"))
+	if strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Expected two entries before midnight, found %q", data)
+	}
+}
+
+func TestSigUsr2Rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var a trapLogger
+	if err = a.Configure(&testLog, map[string]string{"filename": filepath.Join(dir, "traps.log"), "format": "jsonl"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+	if err = a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Fatalf("Unable to log trap: %s", err)
+	}
+	if err = a.SigUsr2(); err != nil {
+		t.Fatalf("Unable to rotate: %s", err)
+	}
+	if err = a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Fatalf("Unable to log trap: %s", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "traps*.log"))
+	if len(files) != 2 {
+		t.Errorf("Expected the log file and a backup, found %v", files)
+	}
+}
@@ -0,0 +1,519 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin sends SNMP traps to a syslog server (RFC 5424 or RFC 3164)
+ * over UDP, TCP or TLS.
+ *
+ * Arguments:
+ *   address            - host:port of the syslog server (required)
+ *   protocol           - udp (default), tcp or tls
+ *   format             - rfc5424 (default) or rfc3164
+ *   framing            - octet_counting (default for tcp/tls) or newline
+ *   facility           - syslog facility name (default: local0)
+ *   severity           - severity used when severity_map has no match (default: notice)
+ *   severity_field     - generic_type (default), specific_type, oid:<varbind OID>
+ *                        or meta:<trap metadata key>
+ *   severity_map       - comma-separated value=severity pairs for the severity_field
+ *   hostname_field     - source_ip (default), agent_address, hostname or device_name
+ *                        (from the resolver, falling back to the source IP)
+ *   app_name           - syslog APP-NAME/TAG (default: trapmux)
+ *   sd_id              - structured data ID for trap fields (default: snmpTrap@32473)
+ *   template           - Go template for the message text (replaces the summary and,
+ *                        for rfc3164, the varbind list)
+ *   template_file      - file containing the template
+ *   reconnect_interval - minimum seconds between reconnection attempts (default 5)
+ *   timeout            - seconds to wait when connecting or writing (default 5)
+ *   tls_ca_file, tls_cert_file, tls_key_file, tls_skip_verify
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "syslog"
+
+const (
+	defaultAppName           = "trapmux"
+	defaultSdID              = "snmpTrap@32473"
+	defaultReconnectInterval = 5
+	defaultTimeout           = 5
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var severities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3, "warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// defaultGenericSeverity maps the generic trap types (coldStart .. enterpriseSpecific)
+// to a severity when no severity_map is given.
+var defaultGenericSeverity = map[string]int{
+	"0": 5, "1": 5, "2": 4, "3": 5, "4": 4, "5": 4,
+}
+
+type syslogForwarder struct {
+	address           string
+	protocol          string
+	format            string
+	octetCounting     bool
+	facility          int
+	severity          int
+	severityField     string
+	severityMap       map[string]int
+	hostnameField     string
+	appName           string
+	sdID              string
+	template          *template.Template
+	reconnectInterval time.Duration
+	timeout           time.Duration
+	tlsConfig         *tls.Config
+
+	lock        sync.Mutex
+	conn        net.Conn
+	lastConnect time.Time
+
+	pluginLog *zerolog.Logger
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"address": true, "protocol": true, "format": true, "framing": true,
+		"facility": true, "severity": true, "severity_field": true, "severity_map": true,
+		"hostname_field": true, "app_name": true, "sd_id": true, "template": true, "template_file": true, "reconnect_interval": true, "timeout": true,
+		"tls_ca_file": true, "tls_cert_file": true, "tls_key_file": true, "tls_skip_verify": true}
+
+	for key, _ := range actionArgs {
+		if _, ok := validArgs[key]; !ok {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	if actionArgs["address"] == "" {
+		return fmt.Errorf("Missing the required 'address' argument to the %s plugin", pluginName)
+	}
+	return nil
+}
+
+func lookupSeverity(name string) (int, error) {
+	severity, ok := severities[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("Unknown syslog severity for %s plugin: %s", pluginName, name)
+	}
+	return severity, nil
+}
+
+// parseSeverityMap converts the 'severity_map' argument (value=severity,...)
+// into a lookup table.
+//
+func parseSeverityMap(mapping string) (map[string]int, error) {
+	severityMap := make(map[string]int)
+	if mapping == "" {
+		return severityMap, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid severity mapping for %s plugin: %s", pluginName, pair)
+		}
+		severity, err := lookupSeverity(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		severityMap[strings.TrimSpace(kv[0])] = severity
+	}
+	return severityMap, nil
+}
+
+func (a *syslogForwarder) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err := validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	var err error
+	a.address = actionArgs["address"]
+	a.protocol = strings.ToLower(actionArgs["protocol"])
+	switch a.protocol {
+	case "":
+		a.protocol = "udp"
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("Unsupported protocol for %s plugin: %s", pluginName, a.protocol)
+	}
+
+	a.format = strings.ToLower(actionArgs["format"])
+	switch a.format {
+	case "", "rfc5424", "5424":
+		a.format = "rfc5424"
+	case "rfc3164", "3164", "bsd":
+		a.format = "rfc3164"
+	default:
+		return fmt.Errorf("Unsupported format for %s plugin: %s", pluginName, a.format)
+	}
+
+	switch actionArgs["framing"] {
+	case "", "octet_counting":
+		a.octetCounting = a.protocol != "udp"
+	case "newline":
+		a.octetCounting = false
+	default:
+		return fmt.Errorf("Unsupported framing for %s plugin: %s", pluginName, actionArgs["framing"])
+	}
+
+	facility := actionArgs["facility"]
+	if facility == "" {
+		facility = "local0"
+	}
+	var ok bool
+	if a.facility, ok = facilities[strings.ToLower(facility)]; !ok {
+		return fmt.Errorf("Unknown syslog facility for %s plugin: %s", pluginName, facility)
+	}
+
+	severity := actionArgs["severity"]
+	if severity == "" {
+		severity = "notice"
+	}
+	if a.severity, err = lookupSeverity(severity); err != nil {
+		return err
+	}
+	a.severityField = actionArgs["severity_field"]
+	if a.severityField == "" {
+		a.severityField = "generic_type"
+	}
+	if a.severityField != "generic_type" && a.severityField != "specific_type" &&
+		!strings.HasPrefix(a.severityField, "oid:") && !strings.HasPrefix(a.severityField, "meta:") {
+		return fmt.Errorf("Unsupported severity_field for %s plugin: %s", pluginName, a.severityField)
+	}
+	if a.severityMap, err = parseSeverityMap(actionArgs["severity_map"]); err != nil {
+		return err
+	}
+	if len(a.severityMap) == 0 && a.severityField == "generic_type" {
+		a.severityMap = defaultGenericSeverity
+	}
+
+	a.hostnameField = actionArgs["hostname_field"]
+	switch a.hostnameField {
+	case "":
+		a.hostnameField = "source_ip"
+	case "source_ip", "agent_address", "hostname", "device_name":
+	default:
+		return fmt.Errorf("Unsupported hostname_field for %s plugin: %s", pluginName, a.hostnameField)
+	}
+
+	a.appName = actionArgs["app_name"]
+	if a.appName == "" {
+		a.appName = defaultAppName
+	}
+	a.sdID = actionArgs["sd_id"]
+	if a.sdID == "" {
+		a.sdID = defaultSdID
+	}
+	if a.template, err = pluginMeta.GetTemplateArg(actionArgs, pluginName); err != nil {
+		return err
+	}
+
+	var seconds int
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "reconnect_interval", defaultReconnectInterval, pluginName); err != nil {
+		return err
+	}
+	a.reconnectInterval = time.Duration(seconds) * time.Second
+	if seconds, err = pluginMeta.GetIntArg(actionArgs, "timeout", defaultTimeout, pluginName); err != nil {
+		return err
+	}
+	a.timeout = time.Duration(seconds) * time.Second
+
+	if a.protocol == "tls" {
+		if a.tlsConfig, err = makeTLSConfig(a.address, actionArgs); err != nil {
+			return err
+		}
+	}
+
+	// A server that is down at startup is not fatal: we reconnect on the next trap
+	if err = a.connect(); err != nil {
+		a.pluginLog.Warn().Err(err).Str("address", a.address).Msg("Unable to connect to syslog server")
+	}
+	a.pluginLog.Info().Str("address", a.address).Str("protocol", a.protocol).Str("format", a.format).Msg("Added syslog destination")
+	return nil
+}
+
+func makeTLSConfig(address string, actionArgs map[string]string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	if value := actionArgs["tls_skip_verify"]; value != "" {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Invalid value for tls_skip_verify argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	if caFile := actionArgs["tls_ca_file"]; caFile != "" {
+		pem, err := ioutil.ReadFile(filepath.Clean(caFile))
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+	if certFile := actionArgs["tls_cert_file"]; certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, actionArgs["tls_key_file"])
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// connect (re-)opens the connection to the syslog server.  Attempts are
+// rate-limited by reconnect_interval so that an unreachable server doesn't
+// slow down trap processing.  Must be called with the lock held, or before
+// the plugin is in use.
+//
+func (a *syslogForwarder) connect() error {
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+	}
+	if !a.lastConnect.IsZero() && time.Since(a.lastConnect) < a.reconnectInterval {
+		return fmt.Errorf("Not connected to syslog server %s -- waiting to reconnect", a.address)
+	}
+	a.lastConnect = time.Now()
+
+	var err error
+	dialer := &net.Dialer{Timeout: a.timeout}
+	switch a.protocol {
+	case "tls":
+		a.conn, err = tls.DialWithDialer(dialer, "tcp", a.address, a.tlsConfig)
+	default:
+		a.conn, err = dialer.Dial(a.protocol, a.address)
+	}
+	if err != nil {
+		a.conn = nil
+		return err
+	}
+	a.pluginLog.Debug().Str("address", a.address).Str("protocol", a.protocol).Msg("Connected to syslog server")
+	return nil
+}
+
+func (a *syslogForwarder) ProcessTrap(trap *pluginMeta.Trap) error {
+	msg, err := a.makeMessage(trap, trap.Time())
+	if err != nil {
+		return err
+	}
+	frame := a.frame(msg)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.conn == nil {
+		if err := a.connect(); err != nil {
+			return err
+		}
+	}
+	err = a.write(frame)
+	if err != nil && a.protocol != "udp" {
+		// The server may have dropped an idle stream connection: reconnect
+		// right away and try once more.
+		a.pluginLog.Info().Err(err).Str("address", a.address).Msg("Reconnecting to syslog server")
+		a.lastConnect = time.Time{}
+		if err = a.connect(); err == nil {
+			err = a.write(frame)
+		}
+	}
+	return err
+}
+
+func (a *syslogForwarder) write(frame []byte) error {
+	if a.timeout > 0 {
+		if err := a.conn.SetWriteDeadline(time.Now().Add(a.timeout)); err != nil {
+			return err
+		}
+	}
+	_, err := a.conn.Write(frame)
+	return err
+}
+
+// frame applies the transport framing from RFC 6587 for stream transports
+//
+func (a *syslogForwarder) frame(msg string) []byte {
+	if a.octetCounting {
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	}
+	if a.protocol != "udp" {
+		return []byte(msg + "\n")
+	}
+	return []byte(msg)
+}
+
+// trapSeverity looks up the severity of the trap using the configured
+// trap field and mapping.
+//
+func (a *syslogForwarder) trapSeverity(trap *pluginMeta.Trap) int {
+	var value string
+	switch {
+	case a.severityField == "generic_type":
+		value = strconv.Itoa(trap.Data.GenericTrap)
+	case a.severityField == "specific_type":
+		value = strconv.Itoa(trap.Data.SpecificTrap)
+	case strings.HasPrefix(a.severityField, "meta:"):
+		value = trap.Metadata[strings.TrimPrefix(a.severityField, "meta:")]
+	default:
+		oid := strings.Trim(strings.TrimPrefix(a.severityField, "oid:"), ".")
+		for _, v := range trap.Data.Variables {
+			if strings.Trim(v.Name, ".") == oid {
+				value = pluginMeta.VarbindString(v)
+				break
+			}
+		}
+	}
+	if severity, ok := a.severityMap[value]; ok {
+		return severity
+	}
+	return a.severity
+}
+
+func (a *syslogForwarder) trapHostname(trap *pluginMeta.Trap) string {
+	var hostname string
+	switch a.hostnameField {
+	case "agent_address":
+		hostname = trap.Data.AgentAddress
+	case "hostname":
+		hostname = trap.Hostname
+	case "device_name":
+		hostname = trap.DeviceName
+		if hostname == "" {
+			hostname = trap.SrcIP.String()
+		}
+	default:
+		hostname = trap.SrcIP.String()
+	}
+	if hostname == "" {
+		return "-"
+	}
+	return hostname
+}
+
+// makeMessage formats the trap as a syslog message (without transport framing)
+//
+func (a *syslogForwarder) makeMessage(trap *pluginMeta.Trap, now time.Time) (string, error) {
+	pri := a.facility*8 + a.trapSeverity(trap)
+	enterprise := strings.Trim(trap.Data.Enterprise, ".")
+	summary := fmt.Sprintf("SNMP trap from %s: enterprise %s generic %d specific %d",
+		trap.SrcIP, enterprise, trap.Data.GenericTrap, trap.Data.SpecificTrap)
+	trapName := trap.TrapName()
+	if trapName != "" {
+		summary = fmt.Sprintf("SNMP trap %s from %s", trapName, trap.SrcIP)
+	}
+	if a.template != nil {
+		var err error
+		if summary, err = pluginMeta.ExecuteTemplate(a.template, trap); err != nil {
+			return "", err
+		}
+	}
+
+	if a.format == "rfc3164" {
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("<%d>%s %s %s: %s", pri, now.Format(time.Stamp), a.trapHostname(trap), a.appName, summary))
+		if a.template == nil {
+			for _, v := range trap.Data.Variables {
+				b.WriteString(fmt.Sprintf(" %s=%q", pluginMeta.VarbindName(v), pluginMeta.VarbindDisplay(v)))
+			}
+		}
+		return b.String(), nil
+	}
+
+	var sd strings.Builder
+	sd.WriteString(fmt.Sprintf("[%s version=\"%s\" srcIP=\"%s\" agentAddress=\"%s\" enterprise=\"%s\" genericType=\"%d\" specificType=\"%d\"",
+		a.sdID, sdEscape(trap.SnmpVersion.String()), trap.SrcIP, sdEscape(trap.Data.AgentAddress), sdEscape(enterprise),
+		trap.Data.GenericTrap, trap.Data.SpecificTrap))
+	if trapName != "" {
+		sd.WriteString(fmt.Sprintf(" trapName=\"%s\"", sdEscape(trapName)))
+	}
+	for i, v := range trap.Data.Variables {
+		sd.WriteString(fmt.Sprintf(" oid%d=\"%s\" val%d=\"%s\"", i+1, sdEscape(strings.Trim(v.Name, ".")), i+1, sdEscape(pluginMeta.VarbindString(v))))
+		if name := pluginMeta.Mibs().Translate(v.Name); name != "" {
+			sd.WriteString(fmt.Sprintf(" name%d=\"%s\"", i+1, sdEscape(name)))
+		}
+		if display, ok := pluginMeta.Mibs().FormatValue(v); ok {
+			sd.WriteString(fmt.Sprintf(" display%d=\"%s\"", i+1, sdEscape(display)))
+		}
+	}
+	for _, key := range trap.MetadataKeys() {
+		sd.WriteString(fmt.Sprintf(" meta.%s=\"%s\"", sdParamName(key), sdEscape(trap.Metadata[key])))
+	}
+	sd.WriteString("]")
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s %s", pri, now.Format(time.RFC3339), a.trapHostname(trap), a.appName, os.Getpid(), sd.String(), summary), nil
+}
+
+// sdParamName replaces the characters that can't be used in a structured
+// data parameter name (RFC 5424 section 6.3.3)
+//
+func sdParamName(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+	if b.Len() > 27 {
+		return b.String()[:27]
+	}
+	return b.String()
+}
+
+// sdEscape escapes a structured data parameter value per RFC 5424 section 6.3.3
+//
+func sdEscape(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "]", "\\]").Replace(value)
+}
+
+func (a *syslogForwarder) SigUsr1() error {
+	return nil
+}
+
+func (a *syslogForwarder) SigUsr2() error {
+	return nil
+}
+
+func (a *syslogForwarder) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.conn == nil {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn = nil
+	return err
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin syslogForwarder
@@ -0,0 +1,181 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+func makeTestTrap() *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.Data.Enterprise = ".1.3.6.1.6.3.1.1.5"
+	trap.Data.GenericTrap = 2
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0 \"uplink]")},
+	}
+	return &trap
+}
+
+// readOctetCounted reads one RFC 6587 octet-counted frame
+func readOctetCounted(t *testing.T, r *bufio.Reader) string {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("Unable to read frame length: %s", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		t.Fatalf("Invalid frame length %q", length)
+	}
+	msg := make([]byte, n)
+	if _, err = r.Read(msg); err != nil {
+		t.Fatalf("Unable to read frame: %s", err)
+	}
+	return string(msg)
+}
+
+func TestUdpRfc5424(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var a syslogForwarder
+	args := map[string]string{"address": server.LocalAddr().String(), "facility": "local1"}
+	if err = a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+	if err = a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Fatalf("Unable to send trap: %s", err)
+	}
+
+	buf := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No syslog message received: %s", err)
+	}
+	msg := string(buf[:n])
+	// local1 (17) * 8 + warning (4) for linkDown
+	if !strings.HasPrefix(msg, "<140>1 ") {
+		t.Errorf("Unexpected PRI/version: %s", msg)
+	}
+	if !strings.Contains(msg, " 192.0.2.1 trapmux ") {
+		t.Errorf("Missing hostname or app name: %s", msg)
+	}
+	if !strings.Contains(msg, `oid2="1.3.6.1.2.1.2.2.1.2.3" val2="eth0 \"uplink\]"`) {
+		t.Errorf("Varbind structured data not escaped correctly: %s", msg)
+	}
+}
+
+func TestTcpReconnect(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var a syslogForwarder
+	args := map[string]string{"address": server.Addr().String(), "protocol": "tcp", "format": "rfc3164",
+		"severity_field": "oid:1.3.6.1.2.1.2.2.1.1.3", "severity_map": "3=crit"}
+	if err = a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	conn, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ProcessTrap(makeTestTrap()); err != nil {
+		t.Fatalf("Unable to send trap: %s", err)
+	}
+	msg := readOctetCounted(t, bufio.NewReader(conn))
+	// local0 (16) * 8 + crit (2) from the varbind mapping
+	if !strings.HasPrefix(msg, "<130>") || !strings.Contains(msg, " 192.0.2.1 trapmux: ") {
+		t.Errorf("Unexpected RFC 3164 message: %s", msg)
+	}
+
+	// Drop the connection: the plugin should reconnect on the next send
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		// The first write after the peer closes may still succeed locally
+		a.ProcessTrap(makeTestTrap())
+		time.Sleep(50 * time.Millisecond)
+	}
+	server.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	conn, err = server.Accept()
+	if err != nil {
+		t.Fatalf("Plugin did not reconnect: %s", err)
+	}
+	conn.Close()
+}
+
+func TestArguments(t *testing.T) {
+	if err := validateArguments(map[string]string{"traphost": "localhost"}); err == nil {
+		t.Errorf("Missing address was not detected")
+	}
+	if _, err := parseSeverityMap("1=loud"); err == nil {
+		t.Errorf("Invalid severity name was not detected")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	var a syslogForwarder
+	args := map[string]string{"address": "127.0.0.1:514", "severity_field": "meta:role", "severity_map": "core=crit"}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	defer a.Close()
+
+	trap := makeTestTrap()
+	trap.SetMetadata("role", "core")
+	trap.SetMetadata("site name", "lon1")
+	msg, err := a.makeMessage(trap, time.Now())
+	if err != nil {
+		t.Fatalf("Unable to make message: %s", err)
+	}
+	// local0 (16) * 8 + crit (2)
+	if !strings.HasPrefix(msg, "<130>1 ") {
+		t.Errorf("Severity was not taken from the metadata: %s", msg)
+	}
+	if !strings.Contains(msg, ` meta.role="core" meta.site_name="lon1"]`) {
+		t.Errorf("Missing metadata structured data: %s", msg)
+	}
+}
+
+func TestDeviceNameHostname(t *testing.T) {
+	a := syslogForwarder{hostnameField: "device_name"}
+	trap := makeTestTrap()
+	if hostname := a.trapHostname(trap); hostname != "192.0.2.1" {
+		t.Errorf("Unresolved device should use the source IP, found %s", hostname)
+	}
+	trap.DeviceName = "rtr1.example.com"
+	if hostname := a.trapHostname(trap); hostname != "rtr1.example.com" {
+		t.Errorf("Expected the device name, found %s", hostname)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin rate limits the traps going through the filters with a token
+ * bucket.  Traps within the limit carry on to the filters that follow, and
+ * traps over it are dropped, after being sent to the downstream action if
+ * one is given.  The dropped traps have the throttled metadata set to the
+ * name of the limit, and are counted in throttled_traps_total.
+ *
+ * Arguments:
+ *   rate      - traps per second let through on average (required)
+ *   burst     - traps let through at once (default: the rate, or 1)
+ *   key       - comma-separated fields with a bucket for each value, from
+ *               agent_address, source_ip, device_name, community,
+ *               enterprise, trap_oid, oid:<varbind OID> and meta:<metadata key>
+ *               (default: one bucket for all traps)
+ *   name      - name of the limit in the throttled metadata (default: throttle)
+ *   action    - downstream action plugin for the throttled traps
+ *   action.*  - arguments for the downstream action, eg action.filename
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pluginLoader "github.com/keruzu/trapmux/api"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "throttle"
+
+const actionArgPrefix = "action."
+
+// Replaced by the tests
+var loadAction = pluginLoader.LoadConfiguredAction
+
+type throttleAction struct {
+	limiter *pluginMeta.RateLimiter
+	key     []string
+	name    string
+
+	actionName string
+	action     pluginLoader.ActionPlugin
+
+	pluginLog *zerolog.Logger
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"rate": true, "burst": true, "key": true, "name": true, "action": true}
+
+	for key, _ := range actionArgs {
+		if _, ok := validArgs[key]; !ok && !strings.HasPrefix(key, actionArgPrefix) {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	return nil
+}
+
+func (a *throttleAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	var err error
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err = validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	var limit pluginMeta.RateLimit
+	if limit.Rate, err = strconv.ParseFloat(actionArgs["rate"], 64); err != nil || !(limit.Rate > 0) {
+		return fmt.Errorf("Missing or invalid rate argument to %s plugin: %s", pluginName, actionArgs["rate"])
+	}
+	if value := actionArgs["burst"]; value != "" {
+		if limit.Burst, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("Invalid value for burst argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	if err = limit.Validate(pluginName + " plugin"); err != nil {
+		return err
+	}
+	a.limiter = pluginMeta.NewRateLimiter(limit)
+
+	if key := actionArgs["key"]; key != "" {
+		for _, field := range strings.Split(key, ",") {
+			field = strings.TrimSpace(field)
+			if !pluginMeta.IsKeyField(field) {
+				return fmt.Errorf("Unknown key field for %s plugin: %s", pluginName, field)
+			}
+			a.key = append(a.key, field)
+		}
+	}
+	if a.name = actionArgs["name"]; a.name == "" {
+		a.name = pluginName
+	}
+
+	if a.actionName = actionArgs["action"]; a.actionName != "" {
+		downstreamArgs := make(map[string]string)
+		for name, value := range actionArgs {
+			if strings.HasPrefix(name, actionArgPrefix) {
+				downstreamArgs[strings.TrimPrefix(name, actionArgPrefix)] = value
+			}
+		}
+		if a.action, err = loadAction(pluginLog, a.actionName, downstreamArgs); err != nil {
+			return fmt.Errorf("Unable to load the %s action for %s plugin: %s", a.actionName, pluginName, err)
+		}
+	}
+	return nil
+}
+
+func (a *throttleAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	key := ""
+	if len(a.key) > 0 {
+		data := pluginMeta.NewTemplateData(trap)
+		values := make([]string, len(a.key))
+		for i, field := range a.key {
+			values[i] = pluginMeta.KeyField(trap, &data, field)
+		}
+		key = strings.Join(values, ",")
+	}
+	if a.limiter.Allow(key, trap.Time()) {
+		return nil
+	}
+
+	trap.SetMetadata(pluginMeta.ThrottledKey, a.name)
+	var err error
+	if a.action != nil {
+		if err = a.action.ProcessTrap(trap); err != nil {
+			err = fmt.Errorf("Unable to send throttled trap to %s action: %s", a.actionName, err)
+		}
+	}
+	trap.Dropped = true
+	return err
+}
+
+func (a *throttleAction) SigUsr1() error {
+	if a.action != nil {
+		return a.action.SigUsr1()
+	}
+	return nil
+}
+
+func (a *throttleAction) SigUsr2() error {
+	if a.action != nil {
+		return a.action.SigUsr2()
+	}
+	return nil
+}
+
+func (a *throttleAction) Close() error {
+	if a.action != nil {
+		return a.action.Close()
+	}
+	return nil
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin throttleAction
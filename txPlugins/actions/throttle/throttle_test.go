@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginLoader "github.com/keruzu/trapmux/api"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+// testAction records the traps sent to it as the downstream action
+type testAction struct {
+	traps []pluginMeta.Trap
+}
+
+func (t *testAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	return nil
+}
+
+func (t *testAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	t.traps = append(t.traps, trap.Copy())
+	return nil
+}
+
+func (t *testAction) SigUsr1() error { return nil }
+func (t *testAction) SigUsr2() error { return nil }
+func (t *testAction) Close() error   { return nil }
+
+func configureTestAction(t *testing.T, args map[string]string) (*throttleAction, *testAction) {
+	downstream := &testAction{}
+	loadAction = func(pluginLog *zerolog.Logger, name string, actionArgs map[string]string) (pluginLoader.ActionPlugin, error) {
+		if name != "capture" {
+			return nil, errors.New("no such plugin")
+		}
+		return downstream, nil
+	}
+
+	var a throttleAction
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	return &a, downstream
+}
+
+func makeTestTrap(srcIP string, received time.Time) *pluginMeta.Trap {
+	return &pluginMeta.Trap{SrcIP: net.ParseIP(srcIP), SnmpVersion: g.Version2c, ReceivedAt: received}
+}
+
+func TestThrottle(t *testing.T) {
+	a, downstream := configureTestAction(t, map[string]string{"rate": "1", "burst": "2", "key": "source_ip",
+		"name": "noisy", "action": "capture", "action.filename": "/tmp/throttled.cap"})
+
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	dropped := 0
+	for i := 0; i < 5; i++ {
+		trap := makeTestTrap("192.0.2.1", start)
+		if err := a.ProcessTrap(trap); err != nil {
+			t.Fatalf("Unable to process trap: %s", err)
+		}
+		if trap.Dropped {
+			dropped++
+			if trap.Metadata[pluginMeta.ThrottledKey] != "noisy" {
+				t.Errorf("Throttled trap was not marked: %v", trap.Metadata)
+			}
+		}
+	}
+	if dropped != 3 || len(downstream.traps) != 3 {
+		t.Errorf("Expected 3 throttled traps, got %d (%d sent downstream)", dropped, len(downstream.traps))
+	}
+
+	// Other sources have their own bucket, and the bucket refills
+	for _, trap := range []*pluginMeta.Trap{makeTestTrap("192.0.2.2", start), makeTestTrap("192.0.2.1", start.Add(time.Second))} {
+		a.ProcessTrap(trap)
+		if trap.Dropped {
+			t.Errorf("Trap within the limit was dropped: %s", trap.SrcIP)
+		}
+	}
+}
+
+func TestThrottleDrop(t *testing.T) {
+	a, _ := configureTestAction(t, map[string]string{"rate": "0.5"})
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := makeTestTrap("192.0.2.1", start)
+	second := makeTestTrap("192.0.2.2", start)
+	a.ProcessTrap(first)
+	a.ProcessTrap(second)
+	if first.Dropped || !second.Dropped || second.Metadata[pluginMeta.ThrottledKey] != "throttle" {
+		t.Errorf("All traps don't share one bucket without a key")
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	invalid := []map[string]string{
+		{},
+		{"rate": "0"},
+		{"rate": "-1"},
+		{"rate": "fast"},
+		{"rate": "1", "burst": "-2"},
+		{"rate": "1", "key": "hostname"},
+		{"rate": "1", "limit": "5"},
+		{"rate": "1", "action": "nosuchplugin"},
+	}
+	for _, args := range invalid {
+		var a throttleAction
+		if err := a.Configure(&testLog, args); err == nil {
+			t.Errorf("Invalid arguments were accepted: %v", args)
+		}
+	}
+}
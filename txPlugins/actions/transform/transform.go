@@ -0,0 +1,464 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+/*
+ * This plugin changes the trap as it goes through the filters, so that the
+ * actions that follow (eg forward) see the transformed trap.  Varbinds are
+ * deleted, renamed, rewritten and added in that order, and then the trap
+ * OID, enterprise and agent address are set.  Templates are expanded with
+ * the trap as it was before any changes.
+ *
+ * OIDs can be numeric or MIB names (eg IF-MIB::ifDescr), and match the OID
+ * and any instances of it.  An OID pattern starting with / is a regular
+ * expression matched against the numeric OID and the MIB name.
+ *
+ * Arguments:
+ *   delete        - comma-separated OID patterns of varbinds to remove
+ *   rename        - comma-separated old=new OID pairs, keeping any instance
+ *                   sub-identifiers (eg ifDescr=ifAlias)
+ *   rewrite       - semicolon-separated OID-pattern=s/regex/replacement/
+ *                   entries to change varbind values (any delimiter can be
+ *                   used after the s, and $1 etc refer to regex groups)
+ *   add           - semicolon-separated OID=Type:value entries, with the
+ *                   SNMP type as in the JSON form (eg OctetString, Integer,
+ *                   Counter32, ObjectIdentifier, IPAddress).  The value
+ *                   can be a Go template, eg sysLocation.0=OctetString:{{ .Metadata.site }}
+ *                   A varbind with the same OID is replaced.
+ *   trap_oid      - new trap OID (snmpTrapOID.0, or the v1 enterprise and
+ *                   generic/specific types per RFC 3584)
+ *   enterprise    - new enterprise OID
+ *   agent_address - new agent address (also snmpTrapAddress.0 for v2c/v3
+ *                   traps), an IPv4 address or a Go template such as {{ .SrcIP }}
+ *
+ * The packet as received (Trap.Raw) is dropped, as it no longer matches the
+ * trap, so a 'forward' action in spoof_source mode can't send it.
+ */
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+	"github.com/rs/zerolog"
+)
+
+const pluginName = "transform"
+
+// oidPattern matches a varbind by OID prefix or regular expression
+//
+type oidPattern struct {
+	prefix string
+	re     *regexp.Regexp
+}
+
+type varbindRename struct {
+	from string
+	to   string
+}
+
+type varbindRewrite struct {
+	match       oidPattern
+	re          *regexp.Regexp
+	replacement string
+}
+
+type varbindAddition struct {
+	oid      string
+	typeName string
+	value    string
+	template *template.Template
+}
+
+type transformAction struct {
+	deletes   []oidPattern
+	renames   []varbindRename
+	rewrites  []varbindRewrite
+	additions []varbindAddition
+
+	trapOID       string
+	enterprise    string
+	agentAddress  string
+	agentTemplate *template.Template
+
+	pluginLog *zerolog.Logger
+}
+
+func validateArguments(actionArgs map[string]string) error {
+	validArgs := map[string]bool{"delete": true, "rename": true, "rewrite": true, "add": true,
+		"trap_oid": true, "enterprise": true, "agent_address": true}
+
+	for key, _ := range actionArgs {
+		if _, ok := validArgs[key]; !ok {
+			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
+		}
+	}
+	return nil
+}
+
+// splitList splits a list argument, dropping empty entries
+//
+func splitList(value string, separator string) []string {
+	var list []string
+	for _, item := range strings.Split(value, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// lookupOID converts an OID or MIB name to a numeric OID with a leading dot
+//
+func lookupOID(name string) (string, error) {
+	oid, ok := pluginMeta.Mibs().Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("Unknown OID for %s plugin: %s", pluginName, name)
+	}
+	return "." + oid, nil
+}
+
+func parseOidPattern(entry string) (oidPattern, error) {
+	if strings.HasPrefix(entry, "/") {
+		re, err := regexp.Compile(entry[1:])
+		if err != nil {
+			return oidPattern{}, fmt.Errorf("Unable to compile OID regular expression for %s plugin: %s: %s", pluginName, entry, err)
+		}
+		return oidPattern{re: re}, nil
+	}
+	oid, err := lookupOID(entry)
+	return oidPattern{prefix: oid}, err
+}
+
+func (p oidPattern) matches(v g.SnmpPDU) bool {
+	if p.re != nil {
+		return p.re.MatchString(strings.Trim(v.Name, ".")) || p.re.MatchString(pluginMeta.VarbindName(v))
+	}
+	return v.Name == p.prefix || strings.HasPrefix(v.Name, p.prefix+".")
+}
+
+// parseSubstitution splits s/regex/replacement/, where the character after
+// the s is the delimiter
+//
+func parseSubstitution(entry string) (*regexp.Regexp, string, error) {
+	if len(entry) < 4 || entry[0] != 's' {
+		return nil, "", fmt.Errorf("Invalid rewrite for %s plugin, expected s/regex/replacement/: %s", pluginName, entry)
+	}
+	parts := strings.Split(entry[2:], entry[1:2])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, "", fmt.Errorf("Invalid rewrite for %s plugin, expected s/regex/replacement/: %s", pluginName, entry)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to compile rewrite regular expression for %s plugin: %s: %s", pluginName, parts[0], err)
+	}
+	return re, parts[1], nil
+}
+
+// parseTemplateValue compiles a value if it is a template
+//
+func parseTemplateValue(name string, value string) (*template.Template, error) {
+	if !strings.Contains(value, "{{") {
+		return nil, nil
+	}
+	tmpl, err := pluginMeta.ParseTemplate(name, value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template for %s plugin: %s", pluginName, err)
+	}
+	return tmpl, nil
+}
+
+func (a *transformAction) Configure(pluginLog *zerolog.Logger, actionArgs map[string]string) error {
+	a.pluginLog = pluginLog
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Initialization of plugin")
+
+	if err := validateArguments(actionArgs); err != nil {
+		return err
+	}
+
+	for _, entry := range splitList(actionArgs["delete"], ",") {
+		pattern, err := parseOidPattern(entry)
+		if err != nil {
+			return err
+		}
+		a.deletes = append(a.deletes, pattern)
+	}
+
+	for _, entry := range splitList(actionArgs["rename"], ",") {
+		pair := strings.SplitN(entry, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid rename for %s plugin, expected old=new: %s", pluginName, entry)
+		}
+		from, err := lookupOID(strings.TrimSpace(pair[0]))
+		if err != nil {
+			return err
+		}
+		to, err := lookupOID(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return err
+		}
+		a.renames = append(a.renames, varbindRename{from: from, to: to})
+	}
+
+	for _, entry := range splitList(actionArgs["rewrite"], ";") {
+		pair := strings.SplitN(entry, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid rewrite for %s plugin, expected OID=s/regex/replacement/: %s", pluginName, entry)
+		}
+		match, err := parseOidPattern(strings.TrimSpace(pair[0]))
+		if err != nil {
+			return err
+		}
+		re, replacement, err := parseSubstitution(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return err
+		}
+		a.rewrites = append(a.rewrites, varbindRewrite{match: match, re: re, replacement: replacement})
+	}
+
+	for _, entry := range splitList(actionArgs["add"], ";") {
+		if err := a.addAddition(entry); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if value := actionArgs["trap_oid"]; value != "" {
+		if a.trapOID, err = lookupOID(value); err != nil {
+			return err
+		}
+	}
+	if value := actionArgs["enterprise"]; value != "" {
+		if a.enterprise, err = lookupOID(value); err != nil {
+			return err
+		}
+	}
+	if value := actionArgs["agent_address"]; value != "" {
+		if a.agentTemplate, err = parseTemplateValue("agent_address", value); err != nil {
+			return err
+		}
+		if a.agentTemplate == nil && net.ParseIP(value).To4() == nil {
+			return fmt.Errorf("Invalid agent_address for %s plugin, expected an IPv4 address: %s", pluginName, value)
+		}
+		a.agentAddress = value
+	}
+	return nil
+}
+
+// addAddition parses an OID=Type:value entry of the add argument
+//
+func (a *transformAction) addAddition(entry string) error {
+	pair := strings.SplitN(entry, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("Invalid varbind to add for %s plugin, expected OID=Type:value: %s", pluginName, entry)
+	}
+	typed := strings.SplitN(pair[1], ":", 2)
+	if len(typed) != 2 {
+		return fmt.Errorf("Invalid varbind to add for %s plugin, expected OID=Type:value: %s", pluginName, entry)
+	}
+	oid, err := lookupOID(strings.TrimSpace(pair[0]))
+	if err != nil {
+		return err
+	}
+	addition := varbindAddition{oid: oid, typeName: strings.TrimSpace(typed[0]), value: typed[1]}
+	if addition.template, err = parseTemplateValue(oid, addition.value); err != nil {
+		return err
+	}
+	// Check the type, and the value if it isn't a template
+	if _, ok := pluginMeta.VarbindType(addition.typeName); !ok {
+		return fmt.Errorf("Unknown SNMP type for varbind to add in %s plugin: %s", pluginName, entry)
+	}
+	if addition.template == nil {
+		if _, err = a.makeVarbind(addition.oid, addition.typeName, addition.value); err != nil {
+			return err
+		}
+	}
+	a.additions = append(a.additions, addition)
+	return nil
+}
+
+// makeVarbind parses a varbind value, allowing MIB names for OID values
+//
+func (a *transformAction) makeVarbind(oid string, typeName string, value string) (g.SnmpPDU, error) {
+	if typeName == g.ObjectIdentifier.String() {
+		if numeric, ok := pluginMeta.Mibs().Lookup(value); ok {
+			value = numeric
+		}
+	}
+	v, err := pluginMeta.ParseVarbind(oid, typeName, value)
+	if err != nil {
+		return v, fmt.Errorf("%s (%s plugin)", err, pluginName)
+	}
+	return v, nil
+}
+
+// rewriteValue applies a regex rewrite to the varbind value, keeping its type
+//
+func (a *transformAction) rewriteValue(v g.SnmpPDU, rewrite varbindRewrite) (g.SnmpPDU, error) {
+	var value string
+	if octets, ok := v.Value.([]byte); ok {
+		value = string(octets)
+	} else {
+		value = pluginMeta.VarbindString(v)
+	}
+	changed := rewrite.re.ReplaceAllString(value, rewrite.replacement)
+	if changed == value {
+		return v, nil
+	}
+	return a.makeVarbind(v.Name, v.Type.String(), changed)
+}
+
+// setTrapOID changes the notification OID of the trap.  v1 traps get the
+// enterprise and generic/specific types that map to the OID in RFC 3584.
+//
+func (a *transformAction) setTrapOID(trap *pluginMeta.Trap, variables []g.SnmpPDU) []g.SnmpPDU {
+	data := &trap.Data
+	if trap.SnmpVersion == g.Version1 || trap.Translated {
+		lastDot := strings.LastIndex(a.trapOID, ".")
+		last, _ := strconv.Atoi(a.trapOID[lastDot+1:])
+		if strings.HasPrefix(a.trapOID, pluginMeta.SnmpTraps+".") && last >= 1 && last <= 6 {
+			data.GenericTrap = last - 1
+			data.SpecificTrap = 0
+		} else {
+			data.GenericTrap = 6
+			data.SpecificTrap = last
+			data.Enterprise = strings.TrimSuffix(a.trapOID[:lastDot], ".0")
+		}
+	}
+	if trap.SnmpVersion == g.Version1 {
+		return variables
+	}
+
+	trapOID := g.SnmpPDU{Name: pluginMeta.SnmpTrapOID, Type: g.ObjectIdentifier, Value: a.trapOID}
+	for i, v := range variables {
+		if v.Name == pluginMeta.SnmpTrapOID {
+			variables[i] = trapOID
+			return variables
+		}
+	}
+	at := 0
+	if len(variables) > 0 && variables[0].Name == pluginMeta.SysUpTime {
+		at = 1
+	}
+	variables = append(variables, g.SnmpPDU{})
+	copy(variables[at+1:], variables[at:])
+	variables[at] = trapOID
+	return variables
+}
+
+// setVarbind replaces the varbind with the same OID, or appends it
+//
+func setVarbind(variables []g.SnmpPDU, v g.SnmpPDU, appendMissing bool) []g.SnmpPDU {
+	for i := range variables {
+		if variables[i].Name == v.Name {
+			variables[i] = v
+			return variables
+		}
+	}
+	if appendMissing {
+		variables = append(variables, v)
+	}
+	return variables
+}
+
+func (a *transformAction) ProcessTrap(trap *pluginMeta.Trap) error {
+	// Expand the templates before anything is changed
+	added := make([]g.SnmpPDU, 0, len(a.additions))
+	for _, addition := range a.additions {
+		value := addition.value
+		if addition.template != nil {
+			var err error
+			if value, err = pluginMeta.ExecuteTemplate(addition.template, trap); err != nil {
+				return fmt.Errorf("Unable to expand template for %s in %s plugin: %s", addition.oid, pluginName, err)
+			}
+		}
+		v, err := a.makeVarbind(addition.oid, addition.typeName, value)
+		if err != nil {
+			return err
+		}
+		added = append(added, v)
+	}
+	agentAddress := a.agentAddress
+	if a.agentTemplate != nil {
+		var err error
+		if agentAddress, err = pluginMeta.ExecuteTemplate(a.agentTemplate, trap); err != nil {
+			return fmt.Errorf("Unable to expand agent_address template in %s plugin: %s", pluginName, err)
+		}
+		agentAddress = strings.TrimSpace(agentAddress)
+		if net.ParseIP(agentAddress).To4() == nil {
+			return fmt.Errorf("The agent_address template in %s plugin gave an invalid address: %s", pluginName, agentAddress)
+		}
+	}
+
+	// Work on a new list of varbinds, so that the trap is only changed if
+	// all of the rewrites succeed
+	variables := make([]g.SnmpPDU, 0, len(trap.Data.Variables)+len(added)+2)
+varbinds:
+	for _, v := range trap.Data.Variables {
+		for _, pattern := range a.deletes {
+			if pattern.matches(v) {
+				continue varbinds
+			}
+		}
+		for _, rename := range a.renames {
+			if v.Name == rename.from || strings.HasPrefix(v.Name, rename.from+".") {
+				v.Name = rename.to + strings.TrimPrefix(v.Name, rename.from)
+				break
+			}
+		}
+		for _, rewrite := range a.rewrites {
+			if rewrite.match.matches(v) {
+				var err error
+				if v, err = a.rewriteValue(v, rewrite); err != nil {
+					return err
+				}
+			}
+		}
+		variables = append(variables, v)
+	}
+	for _, v := range added {
+		variables = setVarbind(variables, v, true)
+	}
+
+	if a.trapOID != "" {
+		variables = a.setTrapOID(trap, variables)
+	}
+	if a.enterprise != "" {
+		trap.Data.Enterprise = a.enterprise
+		variables = setVarbind(variables, g.SnmpPDU{Name: pluginMeta.SnmpTrapEnterprise, Type: g.ObjectIdentifier, Value: a.enterprise}, false)
+	}
+	if agentAddress != "" {
+		trap.Data.AgentAddress = agentAddress
+		if trap.SnmpVersion != g.Version1 {
+			variables = setVarbind(variables, g.SnmpPDU{Name: pluginMeta.SnmpTrapAddress, Type: g.IPAddress, Value: agentAddress}, true)
+		}
+	}
+
+	trap.Data.Variables = variables
+	// The received packet no longer matches the trap
+	trap.Raw = nil
+	return nil
+}
+
+func (a *transformAction) SigUsr1() error {
+	return nil
+}
+
+func (a *transformAction) SigUsr2() error {
+	return nil
+}
+
+func (a *transformAction) Close() error {
+	return nil
+}
+
+// Exported symbol which supports filter.go's FilterAction type
+var ActionPlugin transformAction
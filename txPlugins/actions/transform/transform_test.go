@@ -0,0 +1,144 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+func makeTestTrap() *pluginMeta.Trap {
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version2c, Raw: []byte{0x30}}
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: pluginMeta.SysUpTime, Type: g.TimeTicks, Value: uint32(100)},
+		{Name: pluginMeta.SnmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0")},
+		{Name: ".1.3.6.1.2.1.2.2.1.7.3", Type: g.Integer, Value: 1},
+		{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2},
+	}
+	return &trap
+}
+
+func transformTestTrap(t *testing.T, args map[string]string, trap *pluginMeta.Trap) {
+	var a transformAction
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if err := a.ProcessTrap(trap); err != nil {
+		t.Fatalf("Unable to transform trap: %s", err)
+	}
+}
+
+func TestVarbindChanges(t *testing.T) {
+	trap := makeTestTrap()
+	transformTestTrap(t, map[string]string{
+		"delete":  "1.3.6.1.2.1.2.2.1.7, /^1\\.3\\.6\\.1\\.2\\.1\\.2\\.2\\.1\\.8\\.",
+		"rename":  "1.3.6.1.2.1.2.2.1.2=1.3.6.1.2.1.31.1.1.1.18",
+		"rewrite": "1.3.6.1.2.1.31.1.1.1.18=s|^eth([0-9]+)$|ge-0/0/$1|; 1.3.6.1.2.1.2.2.1.1=s/3/30/",
+		"add":     "1.3.6.1.4.1.99.1.0=OctetString:from {{ .SrcIP }}; 1.3.6.1.4.1.99.2.0=Gauge32:7; 1.3.6.1.2.1.2.2.1.1.3=Integer:4",
+	}, trap)
+
+	expected := []g.SnmpPDU{
+		{Name: pluginMeta.SysUpTime, Type: g.TimeTicks, Value: uint32(100)},
+		{Name: pluginMeta.SnmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 4},
+		{Name: ".1.3.6.1.2.1.31.1.1.1.18.3", Type: g.OctetString, Value: []byte("ge-0/0/0")},
+		{Name: ".1.3.6.1.4.1.99.1.0", Type: g.OctetString, Value: []byte("from 192.0.2.1")},
+		{Name: ".1.3.6.1.4.1.99.2.0", Type: g.Gauge32, Value: uint(7)},
+	}
+	if !reflect.DeepEqual(trap.Data.Variables, expected) {
+		t.Errorf("Unexpected varbinds:\n%v\nexpected:\n%v", trap.Data.Variables, expected)
+	}
+	if trap.Raw != nil {
+		t.Errorf("The received packet was kept for a changed trap")
+	}
+}
+
+func TestTrapOID(t *testing.T) {
+	// v2c traps have the snmpTrapOID.0 varbind changed, and later
+	// translation to v1 (eg by forward) uses the new OID and address
+	trap := makeTestTrap()
+	transformTestTrap(t, map[string]string{"trap_oid": "1.3.6.1.4.1.99.0.5", "agent_address": "{{ .SrcIP }}"}, trap)
+	if trap.TrapOID() != "1.3.6.1.4.1.99.0.5" {
+		t.Errorf("Trap OID was not changed: %s", trap.TrapOID())
+	}
+	outbound := trap.Copy()
+	if err := pluginMeta.TranslateToV1(&outbound); err != nil {
+		t.Fatalf("Unable to translate the trap: %s", err)
+	}
+	if outbound.Data.Enterprise != ".1.3.6.1.4.1.99" || outbound.Data.SpecificTrap != 5 || outbound.Data.AgentAddress != "192.0.2.1" {
+		t.Errorf("Unexpected v1 trap: %+v", outbound.Data)
+	}
+
+	// v1 traps have the enterprise and types changed
+	v1 := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	v1.Data.Enterprise = ".1.3.6.1.4.1.9"
+	v1.Data.GenericTrap = 6
+	v1.Data.SpecificTrap = 1
+	transformTestTrap(t, map[string]string{"trap_oid": "1.3.6.1.6.3.1.1.5.4", "agent_address": "10.1.1.1"}, &v1)
+	if v1.Data.GenericTrap != 3 || v1.Data.SpecificTrap != 0 || v1.TrapOID() != "1.3.6.1.6.3.1.1.5.4" {
+		t.Errorf("Unexpected v1 trap types: %+v", v1.Data)
+	}
+	if v1.Data.AgentAddress != "10.1.1.1" || len(v1.Data.Variables) != 0 {
+		t.Errorf("Unexpected v1 agent address or varbinds: %+v", v1.Data)
+	}
+
+	transformTestTrap(t, map[string]string{"trap_oid": "1.3.6.1.4.1.99.0.7", "enterprise": "1.3.6.1.4.1.100"}, &v1)
+	if v1.TrapOID() != "1.3.6.1.4.1.100.0.7" {
+		t.Errorf("Unexpected v1 trap OID: %s", v1.TrapOID())
+	}
+}
+
+func TestFailedTransform(t *testing.T) {
+	trap := makeTestTrap()
+	var a transformAction
+	if err := a.Configure(&testLog, map[string]string{"delete": "1.3.6.1.2.1.2.2.1.7",
+		"rewrite": "1.3.6.1.2.1.2.2.1.1=s/3/three/"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if err := a.ProcessTrap(trap); err == nil {
+		t.Errorf("Rewriting an integer to text was accepted")
+	}
+	if len(trap.Data.Variables) != 6 || trap.Raw == nil {
+		t.Errorf("Trap was changed by a failed transform")
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	invalid := []map[string]string{
+		{"remove": "1.3.6"},
+		{"delete": "NO-SUCH-MIB::thing"},
+		{"delete": "/(1.3"},
+		{"rename": "1.3.6.1"},
+		{"rewrite": "1.3.6.1=s/a/b"},
+		{"rewrite": "1.3.6.1=y/a/b/"},
+		{"add": "1.3.6.1.4.1.99.1.0=Text:x"},
+		{"add": "1.3.6.1.4.1.99.1.0=Integer:x"},
+		{"add": "1.3.6.1.4.1.99.1.0=OctetString:{{ .SrcIP "},
+		{"agent_address": "2001:db8::1"},
+		{"trap_oid": "NO-SUCH-MIB::linkDown"},
+	}
+	for _, args := range invalid {
+		var a transformAction
+		if err := a.Configure(&testLog, args); err == nil {
+			t.Errorf("Invalid arguments were accepted: %v", args)
+		}
+	}
+}
@@ -7,37 +7,57 @@ package main
 
 /*
  * This plugin sends SNMP traps as JSON to a webhook server
+ *
+ * Arguments:
+ *   url           - URL to POST each trap to (required)
+ *   timeout       - seconds to wait for the server (default 10)
+ *   template      - Go template for the request body
+ *   template_file - file containing the template
+ *   content_type  - Content-Type of the body (default application/json)
+ *
+ * Without a template, the body is the canonical JSON form of the trap (see
+ * pluginMeta.Trap MarshalJSON), which can be decoded back into a trap.
  */
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-
-	/*
-	   "net/http"
-	   "bytes"
-	*/
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 	"github.com/rs/zerolog"
 )
 
 type webhookForwarder struct {
-	url       string
-	timeout   uint
-	pluginLog *zerolog.Logger
+	url         string
+	client      *http.Client
+	template    *template.Template
+	contentType string
+	pluginLog   *zerolog.Logger
 }
 
 const pluginName = "webhook"
 
+const defaultTimeout = 10
+
 func validateArguments(actionArgs map[string]string) error {
-	validArgs := map[string]bool{"url": true, "timeout": true}
+	validArgs := map[string]bool{"url": true, "timeout": true, "template": true, "template_file": true, "content_type": true}
 
 	for key, _ := range actionArgs {
 		if _, ok := validArgs[key]; !ok {
 			return fmt.Errorf("Unrecognized option to %s plugin: %s", pluginName, key)
 		}
 	}
+	if actionArgs["url"] == "" {
+		return fmt.Errorf("Missing the required 'url' argument to the %s plugin", pluginName)
+	}
 	return nil
 }
 
@@ -49,50 +69,72 @@ func (a *webhookForwarder) Configure(pluginLog *zerolog.Logger, actionArgs map[s
 		return err
 	}
 	a.url = actionArgs["url"]
+
+	timeout := defaultTimeout
+	if value := actionArgs["timeout"]; value != "" {
+		var err error
+		if timeout, err = strconv.Atoi(value); err != nil || timeout < 0 {
+			return fmt.Errorf("Invalid value for timeout argument to %s plugin: %s", pluginName, value)
+		}
+	}
+	a.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	var err error
+	if a.template, err = pluginMeta.GetTemplateArg(actionArgs, pluginName); err != nil {
+		return err
+	}
+	a.contentType = actionArgs["content_type"]
+	if a.contentType == "" {
+		a.contentType = "application/json"
+	}
+
 	a.pluginLog.Info().Str("url", a.url).Msg("Added webhook destination")
 	return nil
 }
 
-func (a webhookForwarder) ProcessTrap(trap *pluginMeta.Trap) error {
-	a.pluginLog.Info().Str("plugin", pluginName).Msg("Processing HTTP post -- fake")
-	trapMap := trap.Trap2Map()
-	jsonBytes, err := json.Marshal(trapMap)
+func (a *webhookForwarder) ProcessTrap(trap *pluginMeta.Trap) error {
+	a.pluginLog.Info().Str("plugin", pluginName).Msg("Processing HTTP post")
+	body, err := a.makeBody(trap)
 	if err != nil {
 		return err
 	}
 
-	a.pluginLog.Info().Str("plugin", pluginName).Str("json", string(jsonBytes[:])).Msg("Converted trap to JSON")
-	/*
-	   body := new(bytes.Buffer)
-	   trap.toJson(&body)
-	   // need timeout information
-	   req, _ := http.NewRequest("POST", a.url, body)
-
-	   client := &http.Client()
-	   result, err := client.Do(req)
-	   if err != nil {
-	   return err
-	   }
-
-	   defer result.Body.Close()
-	   a.main_log.Info().Str("url", a.url).Int("http_status", result.Status).Msg("Webhook HTTP status")
-	   if result.Status == 200 {
-	   a.main_log.Info().Str("url", a.url).Str("body, result.Body).Msg("Webhook HTTP result")
-	   } else {
-	   return error.New("Unable to forward to webhook server")
-	*/
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", a.contentType)
+	result, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	a.pluginLog.Debug().Str("url", a.url).Int("http_status", result.StatusCode).Msg("Webhook HTTP status")
+	if result.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(result.Body, 512))
+		return fmt.Errorf("Unable to forward to webhook server: HTTP status %d: %s", result.StatusCode, strings.TrimSpace(string(msg)))
+	}
 	return nil
 }
 
-func (p webhookForwarder) SigUsr1() error {
+func (a *webhookForwarder) makeBody(trap *pluginMeta.Trap) ([]byte, error) {
+	if a.template != nil {
+		body, err := pluginMeta.ExecuteTemplate(a.template, trap)
+		return []byte(body), err
+	}
+	return json.Marshal(trap)
+}
+
+func (p *webhookForwarder) SigUsr1() error {
 	return nil
 }
 
-func (p webhookForwarder) SigUsr2() error {
+func (p *webhookForwarder) SigUsr2() error {
 	return nil
 }
 
-func (a webhookForwarder) Close() error {
+func (a *webhookForwarder) Close() error {
 	return nil
 }
 
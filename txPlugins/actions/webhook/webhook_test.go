@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+	pluginMeta "github.com/keruzu/trapmux/txPlugins"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var testLog = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+func TestPostTrap(t *testing.T) {
+	var received []pluginMeta.Trap
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected content type: %s", r.Header.Get("Content-Type"))
+		}
+		var trap pluginMeta.Trap
+		if err := json.NewDecoder(r.Body).Decode(&trap); err != nil {
+			t.Errorf("Unable to decode trap: %s", err)
+		}
+		received = append(received, trap)
+	}))
+	defer server.Close()
+
+	var a webhookForwarder
+	if err := a.Configure(&testLog, map[string]string{"url": server.URL}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version2c}
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(10)},
+		{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+	}
+	if err := a.ProcessTrap(&trap); err != nil {
+		t.Fatalf("Unable to post trap: %s", err)
+	}
+	if len(received) != 1 || received[0].TrapOID() != "1.3.6.1.6.3.1.1.5.3" || !received[0].SrcIP.Equal(trap.SrcIP) {
+		t.Errorf("Unexpected trap received: %+v", received)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad trap", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	var a webhookForwarder
+	if err := a.Configure(&testLog, map[string]string{"url": server.URL, "timeout": "2"}); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	if err := a.ProcessTrap(&pluginMeta.Trap{SnmpVersion: g.Version2c}); err == nil {
+		t.Errorf("HTTP error status was not reported")
+	}
+	if err := a.Configure(&testLog, map[string]string{}); err == nil {
+		t.Errorf("Missing url was not reported")
+	}
+}
+
+func TestTemplateBody(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("Unexpected content type: %s", r.Header.Get("Content-Type"))
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	var a webhookForwarder
+	args := map[string]string{"url": server.URL, "content_type": "text/plain",
+		"template": `{{ .SrcIP }} {{ .TrapOID }}{{ range .Varbinds }} {{ .Oid }}={{ .Value }}{{ end }}`}
+	if err := a.Configure(&testLog, args); err != nil {
+		t.Fatalf("Unable to configure plugin: %s", err)
+	}
+	trap := pluginMeta.Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	trap.Data.GenericTrap = 2
+	trap.Data.Variables = []g.SnmpPDU{{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3}}
+	if err := a.ProcessTrap(&trap); err != nil {
+		t.Fatalf("Unable to post trap: %s", err)
+	}
+	if body != "192.0.2.1 1.3.6.1.6.3.1.1.5.3 1.3.6.1.2.1.2.2.1.1.3=3" {
+		t.Errorf("Unexpected body: %s", body)
+	}
+
+	args["template_file"] = "/nonexistent"
+	if err := a.Configure(&testLog, args); err == nil {
+		t.Errorf("Both template and template_file were accepted")
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Trap metadata set by the correlator
+const (
+	AlarmStateKey    = "alarm_state"
+	AlarmRuleKey     = "alarm_rule"
+	AlarmKeyKey      = "alarm_key"
+	AlarmCountKey    = "alarm_count"
+	AlarmDurationKey = "alarm_duration"
+)
+
+// Values of the alarm_state metadata
+const (
+	AlarmRaise     = "raise"
+	AlarmDuplicate = "duplicate"
+	AlarmClear     = "clear"
+)
+
+// CorrelationSettings is the 'correlation' section of the configuration
+// file: the raise/clear rules and where the open alarms are saved.
+//
+type CorrelationSettings struct {
+	Rules        []CorrelationRule `default:"[]" json:"rules"`
+	StateFile    string            `default:"" json:"state_file"`
+	SaveInterval int               `default:"10" json:"save_interval"`
+}
+
+// CorrelationRule pairs the traps that raise an alarm with the traps that
+// clear it.  The key fields pick out the alarm, eg agent_address and
+// oid:IF-MIB::ifIndex for linkDown/linkUp.
+//
+type CorrelationRule struct {
+	Name     string   `json:"name"`
+	Raise    []string `json:"raise"`
+	Clear    []string `json:"clear"`
+	Key      []string `json:"key"`
+	Severity string   `json:"severity"`
+	Expire   int      `json:"expire"`
+
+	// Flap detection: flap_threshold transitions between raised and
+	// cleared within flap_window seconds
+	FlapThreshold int `json:"flap_threshold"`
+	FlapWindow    int `json:"flap_window"`
+}
+
+// Alarm is an open alarm, as listed by the HTTP API and saved in the
+// state file
+//
+type Alarm struct {
+	Rule         string            `json:"rule"`
+	Key          string            `json:"key"`
+	Fields       map[string]string `json:"fields"`
+	Severity     string            `json:"severity,omitempty"`
+	TrapOID      string            `json:"trap_oid"`
+	TrapName     string            `json:"trap_name,omitempty"`
+	SrcIP        string            `json:"source_ip"`
+	AgentAddress string            `json:"agent_address,omitempty"`
+	DeviceName   string            `json:"device_name,omitempty"`
+	FirstRaised  time.Time         `json:"first_raised"`
+	LastRaised   time.Time         `json:"last_raised"`
+	Count        int               `json:"count"`
+	Flapping     bool              `json:"flapping,omitempty"`
+}
+
+type correlationRule struct {
+	CorrelationRule
+	raise map[string]bool
+	clear map[string]bool
+}
+
+// Correlator keeps the table of open alarms
+//
+type Correlator struct {
+	settings CorrelationSettings
+	rules    []correlationRule
+
+	mutex  sync.Mutex
+	alarms map[string]*Alarm
+	flaps  map[string]*flapState
+	dirty  bool
+	done   chan struct{}
+
+	now func() time.Time
+}
+
+// NewCorrelator checks the rules and loads the open alarms from the state
+// file, if there is one
+//
+func NewCorrelator(settings CorrelationSettings) (*Correlator, error) {
+	c := Correlator{settings: settings, alarms: make(map[string]*Alarm), flaps: make(map[string]*flapState), now: time.Now}
+
+	names := make(map[string]bool)
+	for i, rule := range settings.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("Correlation rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Correlation rule %s is defined more than once", rule.Name)
+		}
+		names[rule.Name] = true
+		if len(rule.Raise) == 0 {
+			return nil, fmt.Errorf("Correlation rule %s has no raise traps", rule.Name)
+		}
+		if len(rule.Key) == 0 {
+			rule.Key = []string{"agent_address"}
+		}
+		for _, field := range rule.Key {
+			if !IsKeyField(field) {
+				return nil, fmt.Errorf("Unknown key field in correlation rule %s: %s", rule.Name, field)
+			}
+		}
+		if rule.FlapThreshold < 0 || rule.FlapThreshold == 1 || rule.FlapWindow < 0 {
+			return nil, fmt.Errorf("The flap_threshold of correlation rule %s must be at least 2, and the flap_window can't be negative", rule.Name)
+		}
+
+		compiled := correlationRule{CorrelationRule: rule, raise: make(map[string]bool), clear: make(map[string]bool)}
+		for _, name := range rule.Raise {
+			oid, ok := Mibs().Lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("Unknown raise trap in correlation rule %s: %s", rule.Name, name)
+			}
+			compiled.raise[oid] = true
+		}
+		for _, name := range rule.Clear {
+			oid, ok := Mibs().Lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("Unknown clear trap in correlation rule %s: %s", rule.Name, name)
+			}
+			compiled.clear[oid] = true
+		}
+		c.rules = append(c.rules, compiled)
+	}
+
+	if settings.StateFile != "" {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// IsKeyField checks the name of a field used to group traps, by the
+// correlation rules and the aggregate action
+//
+func IsKeyField(field string) bool {
+	switch field {
+	case "agent_address", "source_ip", "device_name", "community", "enterprise", "trap_oid":
+		return true
+	}
+	return (strings.HasPrefix(field, "oid:") || strings.HasPrefix(field, "meta:")) && strings.Index(field, ":") < len(field)-1
+}
+
+// KeyField returns the value of a key field for the trap.  The agent address
+// falls back to the source IP, as v2c traps don't have one.
+//
+func KeyField(trap *Trap, data *TemplateData, field string) string {
+	switch field {
+	case "agent_address":
+		if address := trap.Data.AgentAddress; address != "" && address != "0.0.0.0" {
+			return address
+		}
+		return data.SrcIP
+	case "source_ip":
+		return data.SrcIP
+	case "device_name":
+		return trap.DeviceName
+	case "community":
+		return trap.Community
+	case "enterprise":
+		return data.Enterprise
+	case "trap_oid":
+		return data.TrapOID
+	}
+	if strings.HasPrefix(field, "meta:") {
+		return trap.Metadata[strings.TrimPrefix(field, "meta:")]
+	}
+	return data.Varbind(strings.TrimPrefix(field, "oid:"))
+}
+
+// Process matches the trap against the rules, updates the alarm table and
+// adds the alarm_state (raise, duplicate or clear), alarm_rule and
+// alarm_key metadata to the trap.  The first rule that matches is used.
+// Traps of a flapping alarm are marked as dropped, and the flap_start
+// summary event to send in their place is returned.
+//
+func (c *Correlator) Process(trap *Trap) []Trap {
+	oid := trap.TrapOID()
+	for i := range c.rules {
+		rule := &c.rules[i]
+		raise := rule.raise[oid]
+		if !raise && !rule.clear[oid] {
+			continue
+		}
+
+		data := NewTemplateData(trap)
+		fields := make(map[string]string, len(rule.Key))
+		values := make([]string, len(rule.Key))
+		for j, field := range rule.Key {
+			values[j] = KeyField(trap, &data, field)
+			fields[field] = values[j]
+		}
+		key := strings.Join(values, ",")
+		trap.SetMetadata(AlarmRuleKey, rule.Name)
+		trap.SetMetadata(AlarmKeyKey, key)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.expire()
+		id := rule.Name + "\x00" + key
+		alarm, open := c.alarms[id]
+		switch {
+		case raise && open:
+			alarm.LastRaised = trap.Time()
+			alarm.Count++
+			trap.SetMetadata(AlarmStateKey, AlarmDuplicate)
+			trap.SetMetadata(AlarmCountKey, strconv.Itoa(alarm.Count))
+		case raise:
+			c.alarms[id] = &Alarm{Rule: rule.Name, Key: key, Fields: fields, Severity: rule.Severity,
+				TrapOID: oid, TrapName: data.TrapName, SrcIP: data.SrcIP, AgentAddress: data.AgentAddress,
+				DeviceName: trap.DeviceName, FirstRaised: trap.Time(), LastRaised: trap.Time(), Count: 1}
+			trap.SetMetadata(AlarmStateKey, AlarmRaise)
+			trap.SetMetadata(AlarmCountKey, "1")
+		default:
+			trap.SetMetadata(AlarmStateKey, AlarmClear)
+			if open {
+				delete(c.alarms, id)
+				duration := trap.Time().Sub(alarm.FirstRaised)
+				trap.SetMetadata(AlarmDurationKey, strconv.Itoa(int(duration.Seconds())))
+			}
+		}
+		c.dirty = true
+		if rule.FlapThreshold > 0 {
+			return c.checkFlap(rule, id, trap, raise != open)
+		}
+		return nil
+	}
+	return nil
+}
+
+// expire drops alarms that haven't been raised again within the expire
+// time of their rule
+//
+func (c *Correlator) expire() {
+	now := c.now()
+	for i := range c.rules {
+		rule := &c.rules[i]
+		if rule.Expire <= 0 {
+			continue
+		}
+		for id, alarm := range c.alarms {
+			if alarm.Rule == rule.Name && now.Sub(alarm.LastRaised) > time.Duration(rule.Expire)*time.Second {
+				delete(c.alarms, id)
+				c.dirty = true
+			}
+		}
+	}
+}
+
+// Alarms returns the open alarms, oldest first
+//
+func (c *Correlator) Alarms() []Alarm {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expire()
+	alarms := make([]Alarm, 0, len(c.alarms))
+	for id, alarm := range c.alarms {
+		alarms = append(alarms, *alarm)
+		if state, ok := c.flaps[id]; ok && state.flapping {
+			alarms[len(alarms)-1].Flapping = true
+		}
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].FirstRaised.Equal(alarms[j].FirstRaised) {
+			return alarms[i].Rule+alarms[i].Key < alarms[j].Rule+alarms[j].Key
+		}
+		return alarms[i].FirstRaised.Before(alarms[j].FirstRaised)
+	})
+	return alarms
+}
+
+// Adopt takes over the open alarms of the correlator being replaced (eg
+// on a configuration reload) for the rules that are still configured
+//
+func (c *Correlator) Adopt(old *Correlator) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.alarms = make(map[string]*Alarm)
+	c.addAlarms(old.alarms)
+	c.dirty = true
+}
+
+// addAlarms keeps the alarms with a configured rule
+//
+func (c *Correlator) addAlarms(alarms map[string]*Alarm) {
+	for id, alarm := range alarms {
+		for _, rule := range c.rules {
+			if rule.Name == alarm.Rule {
+				dup := *alarm
+				c.alarms[id] = &dup
+				break
+			}
+		}
+	}
+}
+
+func (c *Correlator) load() error {
+	data, err := ioutil.ReadFile(c.settings.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to read correlation state file: %s", err)
+	}
+	var saved []Alarm
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("Unable to decode correlation state file %s: %s", c.settings.StateFile, err)
+	}
+	alarms := make(map[string]*Alarm, len(saved))
+	for i := range saved {
+		alarms[saved[i].Rule+"\x00"+saved[i].Key] = &saved[i]
+	}
+	c.addAlarms(alarms)
+	return nil
+}
+
+// Save writes the open alarms to the state file, if they have changed
+//
+func (c *Correlator) Save() error {
+	if c.settings.StateFile == "" {
+		return nil
+	}
+	c.mutex.Lock()
+	if !c.dirty {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.dirty = false
+	c.mutex.Unlock()
+
+	data, err := json.MarshalIndent(c.Alarms(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write a new file and rename it, so that a crash can't leave half a file
+	temp, err := ioutil.TempFile(filepath.Dir(c.settings.StateFile), filepath.Base(c.settings.StateFile)+".*")
+	if err != nil {
+		return fmt.Errorf("Unable to save correlation state: %s", err)
+	}
+	_, err = temp.Write(append(data, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), c.settings.StateFile)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("Unable to save correlation state: %s", err)
+	}
+	return nil
+}
+
+// SaveEvery saves the state file every interval until the correlator is
+// closed.  Errors are passed to the report function.
+//
+func (c *Correlator) SaveEvery(report func(error)) {
+	if c.settings.StateFile == "" || c.done != nil {
+		return
+	}
+	interval := time.Duration(c.settings.SaveInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	c.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := c.Save(); err != nil {
+					report(err)
+				}
+			}
+		}
+	}(c.done)
+}
+
+// Close stops the background saves and saves the state one last time
+//
+func (c *Correlator) Close() error {
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	return c.Save()
+}
+
+// ServeHTTP lists the open alarms as JSON, optionally only those of one
+// rule (?rule=name) or severity (?severity=major)
+//
+func (c *Correlator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	rule := r.URL.Query().Get("rule")
+	severity := r.URL.Query().Get("severity")
+	alarms := make([]Alarm, 0)
+	for _, alarm := range c.Alarms() {
+		if (rule == "" || alarm.Rule == rule) && (severity == "" || alarm.Severity == severity) {
+			alarms = append(alarms, alarm)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alarms)
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+var testLinkRule = CorrelationRule{Name: "link", Raise: []string{"IF-MIB::linkDown"}, Clear: []string{"IF-MIB::linkUp"},
+	Key: []string{"agent_address", "oid:IF-MIB::ifIndex"}, Severity: "major"}
+
+// makeLinkTrap makes a v2c linkDown (up=false) or linkUp trap for an interface
+//
+func makeLinkTrap(srcIP string, ifIndex int, up bool, at time.Time) *Trap {
+	trapOID := ".1.3.6.1.6.3.1.1.5.3"
+	if up {
+		trapOID = ".1.3.6.1.6.3.1.1.5.4"
+	}
+	trap := &Trap{SrcIP: net.ParseIP(srcIP), SnmpVersion: g.Version2c, ReceivedAt: at}
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: SnmpTrapOID, Type: g.ObjectIdentifier, Value: trapOID},
+		{Name: ".1.3.6.1.2.1.2.2.1.1." + strconv.Itoa(ifIndex), Type: g.Integer, Value: ifIndex},
+	}
+	return trap
+}
+
+func makeTestCorrelator(t *testing.T, settings CorrelationSettings) *Correlator {
+	c, err := NewCorrelator(settings)
+	if err != nil {
+		t.Fatalf("Unable to make correlator: %s", err)
+	}
+	return c
+}
+
+func checkAlarmState(t *testing.T, c *Correlator, trap *Trap, state string, key string) {
+	c.Process(trap)
+	if trap.Metadata[AlarmStateKey] != state || trap.Metadata[AlarmKeyKey] != key {
+		t.Errorf("Expected %s of %s, found metadata %v", state, key, trap.Metadata)
+	}
+}
+
+func TestRaiseClear(t *testing.T) {
+	SetMibDatabase(loadTestMibs(t))
+	defer SetMibDatabase(nil)
+	c := makeTestCorrelator(t, CorrelationSettings{Rules: []CorrelationRule{testLinkRule}})
+
+	start := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	checkAlarmState(t, c, makeLinkTrap("192.0.2.1", 3, false, start), AlarmRaise, "192.0.2.1,3")
+	checkAlarmState(t, c, makeLinkTrap("192.0.2.1", 4, false, start), AlarmRaise, "192.0.2.1,4")
+	checkAlarmState(t, c, makeLinkTrap("192.0.2.2", 3, false, start), AlarmRaise, "192.0.2.2,3")
+	duplicate := makeLinkTrap("192.0.2.1", 3, false, start.Add(time.Minute))
+	checkAlarmState(t, c, duplicate, AlarmDuplicate, "192.0.2.1,3")
+	if duplicate.Metadata[AlarmCountKey] != "2" {
+		t.Errorf("Unexpected duplicate count: %v", duplicate.Metadata)
+	}
+
+	clear := makeLinkTrap("192.0.2.1", 3, true, start.Add(90*time.Second))
+	checkAlarmState(t, c, clear, AlarmClear, "192.0.2.1,3")
+	if clear.Metadata[AlarmDurationKey] != "90" {
+		t.Errorf("Unexpected alarm duration: %v", clear.Metadata)
+	}
+
+	alarms := c.Alarms()
+	if len(alarms) != 2 || alarms[0].Key != "192.0.2.1,4" || alarms[1].Key != "192.0.2.2,3" {
+		t.Fatalf("Unexpected open alarms: %+v", alarms)
+	}
+	if alarms[0].TrapName != "IF-MIB::linkDown" || alarms[0].Severity != "major" || alarms[0].Fields["oid:IF-MIB::ifIndex"] != "4" {
+		t.Errorf("Unexpected alarm details: %+v", alarms[0])
+	}
+
+	// Traps that don't match a rule are left alone
+	other := makeLinkTrap("192.0.2.1", 3, false, start)
+	other.Data.Variables[0].Value = ".1.3.6.1.6.3.1.1.5.1"
+	c.Process(other)
+	if len(other.Metadata) != 0 {
+		t.Errorf("Unmatched trap was annotated: %v", other.Metadata)
+	}
+}
+
+func TestAlarmExpiry(t *testing.T) {
+	rule := CorrelationRule{Name: "auth", Raise: []string{"1.3.6.1.6.3.1.1.5.5"}, Expire: 60}
+	c := makeTestCorrelator(t, CorrelationSettings{Rules: []CorrelationRule{rule}})
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	trap := makeLinkTrap("192.0.2.1", 1, false, now)
+	trap.Data.Variables[0].Value = ".1.3.6.1.6.3.1.1.5.5"
+	checkAlarmState(t, c, trap, AlarmRaise, "192.0.2.1")
+	now = now.Add(2 * time.Minute)
+	if alarms := c.Alarms(); len(alarms) != 0 {
+		t.Errorf("Alarm did not expire: %+v", alarms)
+	}
+}
+
+func TestCorrelationState(t *testing.T) {
+	SetMibDatabase(loadTestMibs(t))
+	defer SetMibDatabase(nil)
+	dir, err := ioutil.TempDir("", "correlation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	settings := CorrelationSettings{Rules: []CorrelationRule{testLinkRule}, StateFile: filepath.Join(dir, "alarms.json")}
+
+	c := makeTestCorrelator(t, settings)
+	c.Process(makeLinkTrap("192.0.2.1", 3, false, time.Now()))
+	if err = c.Close(); err != nil {
+		t.Fatalf("Unable to save state: %s", err)
+	}
+
+	restarted := makeTestCorrelator(t, settings)
+	if alarms := restarted.Alarms(); len(alarms) != 1 || alarms[0].Key != "192.0.2.1,3" {
+		t.Fatalf("Alarms were not loaded: %+v", alarms)
+	}
+	checkAlarmState(t, restarted, makeLinkTrap("192.0.2.1", 3, false, time.Now()), AlarmDuplicate, "192.0.2.1,3")
+
+	// A reload keeps the alarms of rules that are still configured
+	settings.StateFile = ""
+	settings.Rules = append(settings.Rules, CorrelationRule{Name: "cold", Raise: []string{"1.3.6.1.6.3.1.1.5.1"}})
+	reloaded := makeTestCorrelator(t, settings)
+	reloaded.Adopt(restarted)
+	if alarms := reloaded.Alarms(); len(alarms) != 1 || alarms[0].Count != 2 {
+		t.Errorf("Alarms were not adopted: %+v", alarms)
+	}
+	settings.Rules = settings.Rules[1:]
+	reloaded = makeTestCorrelator(t, settings)
+	reloaded.Adopt(restarted)
+	if alarms := reloaded.Alarms(); len(alarms) != 0 {
+		t.Errorf("Alarms of a removed rule were adopted: %+v", alarms)
+	}
+}
+
+func TestAlarmAPI(t *testing.T) {
+	SetMibDatabase(loadTestMibs(t))
+	defer SetMibDatabase(nil)
+	c := makeTestCorrelator(t, CorrelationSettings{Rules: []CorrelationRule{testLinkRule}})
+	c.Process(makeLinkTrap("192.0.2.1", 3, false, time.Now()))
+
+	for query, expected := range map[string]int{"": 1, "?rule=link": 1, "?severity=minor": 0} {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/alarms"+query, nil))
+		var alarms []Alarm
+		if err := json.Unmarshal(w.Body.Bytes(), &alarms); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Unable to list alarms: %d %s", w.Code, w.Body.String())
+		}
+		if len(alarms) != expected {
+			t.Errorf("Expected %d alarms for %q, found %+v", expected, query, alarms)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/alarms", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST was accepted: %d", w.Code)
+	}
+}
+
+func TestCorrelationRules(t *testing.T) {
+	invalid := []CorrelationRule{
+		{Raise: []string{"1.3.6.1.6.3.1.1.5.3"}},
+		{Name: "none"},
+		{Name: "mib", Raise: []string{"NO-SUCH-MIB::linkDown"}},
+		{Name: "key", Raise: []string{"1.3.6.1.6.3.1.1.5.3"}, Key: []string{"ifIndex"}},
+		{Name: "oid", Raise: []string{"1.3.6.1.6.3.1.1.5.3"}, Key: []string{"oid:"}},
+	}
+	for _, rule := range invalid {
+		if _, err := NewCorrelator(CorrelationSettings{Rules: []CorrelationRule{rule}}); err == nil {
+			t.Errorf("Invalid rule was accepted: %+v", rule)
+		}
+	}
+	twice := CorrelationRule{Name: "link", Raise: []string{"1.3.6.1.6.3.1.1.5.3"}}
+	if _, err := NewCorrelator(CorrelationSettings{Rules: []CorrelationRule{twice, twice}}); err == nil {
+		t.Errorf("Duplicate rule names were accepted")
+	}
+}
+
+func TestFlapDetection(t *testing.T) {
+	SetMibDatabase(loadTestMibs(t))
+	defer SetMibDatabase(nil)
+	rule := testLinkRule
+	rule.FlapThreshold = 4
+	rule.FlapWindow = 60
+	c := makeTestCorrelator(t, CorrelationSettings{Rules: []CorrelationRule{rule}})
+	start := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	now := start
+	c.now = func() time.Time { return now }
+
+	// Three transitions go through, and the fourth starts the flapping
+	for i := 0; i < 3; i++ {
+		trap := makeLinkTrap("192.0.2.1", 3, i%2 == 1, start.Add(time.Duration(i)*5*time.Second))
+		if events := c.Process(trap); len(events) != 0 || trap.Dropped {
+			t.Fatalf("Transition %d was treated as flapping", i+1)
+		}
+	}
+	trap := makeLinkTrap("192.0.2.1", 3, true, start.Add(15*time.Second))
+	events := c.Process(trap)
+	if !trap.Dropped || len(events) != 1 || events[0].Metadata[AlarmStateKey] != AlarmFlapStart || events[0].Metadata[AlarmTransitionsKey] != "4" {
+		t.Fatalf("Flapping did not start: %v", events)
+	}
+
+	// Transitions and duplicates are suppressed while flapping
+	for _, at := range []time.Duration{20, 21} {
+		trap = makeLinkTrap("192.0.2.1", 3, false, start.Add(at*time.Second))
+		if events = c.Process(trap); len(events) != 0 || !trap.Dropped {
+			t.Errorf("Trap at %ds was not suppressed", at)
+		}
+	}
+	if alarms := c.Alarms(); len(alarms) != 1 || !alarms[0].Flapping {
+		t.Errorf("Alarm is not shown as flapping: %+v", alarms)
+	}
+	// Other interfaces aren't affected
+	other := makeLinkTrap("192.0.2.1", 4, false, start.Add(20*time.Second))
+	if c.Process(other); other.Dropped || other.Metadata[AlarmStateKey] != AlarmRaise {
+		t.Errorf("Other interface was suppressed: %v", other.Metadata)
+	}
+
+	now = start.Add(70 * time.Second)
+	if events = c.CheckFlapping(); len(events) != 0 {
+		t.Errorf("Flapping stopped within the window: %v", events)
+	}
+	now = start.Add(81 * time.Second)
+	events = c.CheckFlapping()
+	if len(events) != 1 {
+		t.Fatalf("Flapping did not stop: %v", events)
+	}
+	expected := map[string]string{AlarmStateKey: AlarmFlapStop, AlarmTransitionsKey: "5", AlarmSuppressedKey: "3",
+		AlarmOpenKey: "true", AlarmDurationKey: "66", AlarmRuleKey: "link", AlarmKeyKey: "192.0.2.1,3"}
+	for key, value := range expected {
+		if events[0].Metadata[key] != value {
+			t.Errorf("Unexpected flap_stop metadata: %v", events[0].Metadata)
+			break
+		}
+	}
+
+	// Stable again, so the next transition goes through
+	trap = makeLinkTrap("192.0.2.1", 3, true, now)
+	if events = c.Process(trap); len(events) != 0 || trap.Dropped || trap.Metadata[AlarmStateKey] != AlarmClear {
+		t.Errorf("Trap after flapping was not processed: %v", trap.Metadata)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"strconv"
+	"time"
+)
+
+// Values of the alarm_state metadata for the flap summary events
+const (
+	AlarmFlapStart = "flap_start"
+	AlarmFlapStop  = "flap_stop"
+)
+
+// Trap metadata of the flap summary events
+const (
+	AlarmTransitionsKey = "alarm_transitions"
+	AlarmSuppressedKey  = "alarm_suppressed"
+	AlarmOpenKey        = "alarm_open"
+)
+
+const defaultFlapWindow = 60 * time.Second
+
+// flapState counts the transitions of one alarm.  While it is flapping,
+// the last trap is kept for the flap_stop summary event.
+//
+type flapState struct {
+	window      time.Duration
+	transitions []time.Time
+	flapping    bool
+	started     time.Time
+	count       int
+	suppressed  int
+	last        Trap
+}
+
+func (rule *correlationRule) flapWindow() time.Duration {
+	if rule.FlapWindow <= 0 {
+		return defaultFlapWindow
+	}
+	return time.Duration(rule.FlapWindow) * time.Second
+}
+
+// pruneTransitions drops the transitions before the start of the window
+//
+func pruneTransitions(transitions []time.Time, start time.Time) []time.Time {
+	i := 0
+	for i < len(transitions) && transitions[i].Before(start) {
+		i++
+	}
+	return transitions[i:]
+}
+
+// flapEvent makes a summary event from a trap of the flapping alarm
+//
+func flapEvent(trap *Trap, state string) Trap {
+	event := trap.Copy()
+	event.Raw = nil
+	event.Dropped = false
+	delete(event.Metadata, AlarmCountKey)
+	delete(event.Metadata, AlarmDurationKey)
+	event.SetMetadata(AlarmStateKey, state)
+	return event
+}
+
+// checkFlap counts a transition of the alarm (raised to cleared, or cleared
+// to raised) in the sliding window.  Once there are flap_threshold of them
+// the alarm is flapping, and its traps are suppressed until it is stable.
+//
+func (c *Correlator) checkFlap(rule *correlationRule, id string, trap *Trap, transition bool) []Trap {
+	state := c.flaps[id]
+	if state == nil {
+		if !transition {
+			return nil
+		}
+		state = &flapState{window: rule.flapWindow()}
+		c.flaps[id] = state
+	}
+
+	now := trap.Time()
+	if transition {
+		state.transitions = append(pruneTransitions(state.transitions, now.Add(-state.window)), now)
+	}
+	if state.flapping {
+		if transition {
+			state.count++
+		}
+		state.suppressed++
+		state.last = trap.Copy()
+		trap.Dropped = true
+		return nil
+	}
+	if len(state.transitions) < rule.FlapThreshold {
+		return nil
+	}
+
+	state.flapping = true
+	state.started = now
+	state.count = len(state.transitions)
+	state.suppressed = 1
+	state.last = trap.Copy()
+	trap.Dropped = true
+	event := flapEvent(trap, AlarmFlapStart)
+	event.SetMetadata(AlarmTransitionsKey, strconv.Itoa(state.count))
+	return []Trap{event}
+}
+
+// CheckFlapping ends the flapping of alarms that have had no transitions
+// for the flap window, returning their flap_stop summary events.  These
+// have the number of transitions and suppressed traps while flapping, and
+// whether the alarm was left open.
+//
+func (c *Correlator) CheckFlapping() []Trap {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	var events []Trap
+	for id, state := range c.flaps {
+		state.transitions = pruneTransitions(state.transitions, now.Add(-state.window))
+		if len(state.transitions) > 0 {
+			continue
+		}
+		if state.flapping {
+			_, open := c.alarms[id]
+			event := flapEvent(&state.last, AlarmFlapStop)
+			event.ReceivedAt = now
+			event.SetMetadata(AlarmTransitionsKey, strconv.Itoa(state.count))
+			event.SetMetadata(AlarmSuppressedKey, strconv.Itoa(state.suppressed))
+			event.SetMetadata(AlarmOpenKey, strconv.FormatBool(open))
+			event.SetMetadata(AlarmDurationKey, strconv.Itoa(int(now.Sub(state.started).Seconds())))
+			events = append(events, event)
+		}
+		delete(c.flaps, id)
+	}
+	return events
+}
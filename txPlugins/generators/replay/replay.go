@@ -12,6 +12,7 @@ package main
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -73,6 +74,7 @@ func (p *replayData) Configure(replayLog *zerolog.Logger, actionArgs map[string]
 	switch format {
 	case "gob", "":
 		format = "gob"
+	case "json":
 	default:
 		return fmt.Errorf("Unknown file format %s", format)
 	}
@@ -112,7 +114,12 @@ func (p *replayData) preLoadTraps(dir string, maxFiles int, suffix string) error
 		filename := fd.Name()
 		if strings.HasSuffix(filename, suffix) {
 			fullpath := dir + "/" + filename
-			trap, err := loadCaptureGob(p.replayLog, fullpath)
+			var trap pluginMeta.Trap
+			if suffix == ".json" {
+				trap, err = loadCaptureJSON(fullpath)
+			} else {
+				trap, err = loadCaptureGob(p.replayLog, fullpath)
+			}
 			if err != nil {
 				return err
 			}
@@ -144,4 +151,14 @@ defer func() {
 	return trap, err
 }
 
+func loadCaptureJSON(filename string) (pluginMeta.Trap, error) {
+	var trap pluginMeta.Trap
+	data, err := ioutil.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return trap, err
+	}
+	err = json.Unmarshal(data, &trap)
+	return trap, err
+}
+
 var GeneratorPlugin replayData
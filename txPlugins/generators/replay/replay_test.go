@@ -6,9 +6,15 @@
 package main
 
 import (
+	"encoding/gob"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	g "github.com/gosnmp/gosnmp"
 	pluginMeta "github.com/keruzu/trapmux/txPlugins"
 
 	"github.com/rs/zerolog"
@@ -47,3 +53,56 @@ func TestGenerator(t *testing.T) {
 		t.Errorf("Not able to keep generating traps")
 	}
 }
+
+func TestCaptureRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	trap := pluginMeta.Trap{
+		SrcIP:        net.ParseIP("192.0.2.1"),
+		SrcPort:      1162,
+		SnmpVersion:  g.Version2c,
+		Raw:          []byte{0x30, 0x29},
+		ReceivedAt:   time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		Listener:     "0.0.0.0:162",
+		Community:    "public",
+		SecurityName: "",
+	}
+	trap.Data.Variables = []g.SnmpPDU{{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(10)}}
+
+	fd, err := os.Create(filepath.Join(dir, "captureFile-0.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gob.NewEncoder(fd).Encode(&trap); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	encoded, err := trap.MarshalCaptureJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "captureFile-1.json"), encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suffix := range []string{".gob", ".json"} {
+		var data replayData
+		data.replayLog = &testLog
+		if err = data.preLoadTraps(dir, 10, suffix); err != nil {
+			t.Fatalf("Unable to load %s capture: %s", suffix, err)
+		}
+		loaded := data.captured[0]
+		if loaded.SrcPort != 1162 || loaded.Community != "public" || loaded.Listener != trap.Listener ||
+			!loaded.ReceivedAt.Equal(trap.ReceivedAt) || string(loaded.Raw) != string(trap.Raw) {
+			t.Errorf("Receive metadata was not carried through the %s capture: %+v", suffix, loaded)
+		}
+		if len(loaded.Data.Variables) != 1 || loaded.Data.Variables[0].Value != uint32(10) {
+			t.Errorf("Varbinds were not carried through the %s capture: %v", suffix, loaded.Data.Variables)
+		}
+	}
+}
@@ -45,6 +45,12 @@ func CreateMetricDefs() []MetricDef {
 		MetricDef{Name: "v3_traps_total",
 			Help: "The total number of SNMPv3 traps received",
 		},
+		MetricDef{Name: "suppressed_traps_total",
+			Help: "The total number of traps suppressed while their alarm was flapping",
+		},
+		MetricDef{Name: "throttled_traps_total",
+			Help: "The total number of traps over a rate limit",
+		},
 	}
 
 	return mymetrics
@@ -0,0 +1,651 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	g "github.com/gosnmp/gosnmp"
+	"github.com/rs/zerolog"
+)
+
+// MibNode is a named OID loaded from the MIBs, along with what is needed
+// to show the values of an object.
+//
+type MibNode struct {
+	Oid         string         `json:"oid"`
+	Module      string         `json:"module"`
+	Name        string         `json:"name"`
+	Kind        string         `json:"kind,omitempty"`
+	Syntax      string         `json:"syntax,omitempty"`
+	DisplayHint string         `json:"display_hint,omitempty"`
+	Enums       map[int]string `json:"enums,omitempty"`
+}
+
+// MibDatabase translates between numeric OIDs and MIB names.  A nil
+// database translates nothing, so callers don't need to check whether MIBs
+// have been loaded.
+//
+type MibDatabase struct {
+	byOid  map[string]*MibNode
+	byName map[string]*MibNode // both MODULE::name and the plain name
+}
+
+// The SMI nodes that every MIB builds on, so that OIDs can be resolved
+// even if SNMPv2-SMI and friends aren't in the MIB directories.
+//
+var builtinMibNodes = []MibNode{
+	{Module: "SNMPv2-SMI", Name: "ccitt", Oid: "0"},
+	{Module: "SNMPv2-SMI", Name: "iso", Oid: "1"},
+	{Module: "SNMPv2-SMI", Name: "joint-iso-ccitt", Oid: "2"},
+	{Module: "SNMPv2-SMI", Name: "org", Oid: "1.3"},
+	{Module: "SNMPv2-SMI", Name: "dod", Oid: "1.3.6"},
+	{Module: "SNMPv2-SMI", Name: "internet", Oid: "1.3.6.1"},
+	{Module: "SNMPv2-SMI", Name: "directory", Oid: "1.3.6.1.1"},
+	{Module: "SNMPv2-SMI", Name: "mgmt", Oid: "1.3.6.1.2"},
+	{Module: "SNMPv2-SMI", Name: "mib-2", Oid: "1.3.6.1.2.1"},
+	{Module: "SNMPv2-SMI", Name: "transmission", Oid: "1.3.6.1.2.1.10"},
+	{Module: "SNMPv2-SMI", Name: "experimental", Oid: "1.3.6.1.3"},
+	{Module: "SNMPv2-SMI", Name: "private", Oid: "1.3.6.1.4"},
+	{Module: "SNMPv2-SMI", Name: "enterprises", Oid: "1.3.6.1.4.1"},
+	{Module: "SNMPv2-SMI", Name: "security", Oid: "1.3.6.1.5"},
+	{Module: "SNMPv2-SMI", Name: "snmpV2", Oid: "1.3.6.1.6"},
+	{Module: "SNMPv2-SMI", Name: "snmpDomains", Oid: "1.3.6.1.6.1"},
+	{Module: "SNMPv2-SMI", Name: "snmpProxys", Oid: "1.3.6.1.6.2"},
+	{Module: "SNMPv2-SMI", Name: "snmpModules", Oid: "1.3.6.1.6.3"},
+	{Module: "SNMPv2-MIB", Name: "system", Oid: "1.3.6.1.2.1.1"},
+	{Module: "SNMPv2-MIB", Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Kind: "OBJECT-TYPE", Syntax: "TimeTicks"},
+	{Module: "SNMPv2-MIB", Name: "snmp", Oid: "1.3.6.1.2.1.11"},
+	{Module: "SNMPv2-MIB", Name: "snmpMIB", Oid: "1.3.6.1.6.3.1"},
+	{Module: "SNMPv2-MIB", Name: "snmpMIBObjects", Oid: "1.3.6.1.6.3.1.1"},
+	{Module: "SNMPv2-MIB", Name: "snmpTrap", Oid: "1.3.6.1.6.3.1.1.4"},
+	{Module: "SNMPv2-MIB", Name: "snmpTrapOID", Oid: "1.3.6.1.6.3.1.1.4.1", Kind: "OBJECT-TYPE", Syntax: "OBJECT IDENTIFIER"},
+	{Module: "SNMPv2-MIB", Name: "snmpTrapEnterprise", Oid: "1.3.6.1.6.3.1.1.4.3", Kind: "OBJECT-TYPE", Syntax: "OBJECT IDENTIFIER"},
+	{Module: "SNMPv2-MIB", Name: "snmpTraps", Oid: "1.3.6.1.6.3.1.1.5"},
+	{Module: "SNMPv2-MIB", Name: "coldStart", Oid: "1.3.6.1.6.3.1.1.5.1", Kind: "NOTIFICATION-TYPE"},
+	{Module: "SNMPv2-MIB", Name: "warmStart", Oid: "1.3.6.1.6.3.1.1.5.2", Kind: "NOTIFICATION-TYPE"},
+	{Module: "IF-MIB", Name: "linkDown", Oid: "1.3.6.1.6.3.1.1.5.3", Kind: "NOTIFICATION-TYPE"},
+	{Module: "IF-MIB", Name: "linkUp", Oid: "1.3.6.1.6.3.1.1.5.4", Kind: "NOTIFICATION-TYPE"},
+	{Module: "SNMPv2-MIB", Name: "authenticationFailure", Oid: "1.3.6.1.6.3.1.1.5.5", Kind: "NOTIFICATION-TYPE"},
+	{Module: "RFC1213-MIB", Name: "egpNeighborLoss", Oid: "1.3.6.1.6.3.1.1.5.6", Kind: "NOTIFICATION-TYPE"},
+}
+
+// The commonly used textual conventions from SNMPv2-TC, used when that
+// module isn't loaded.
+//
+var builtinMibTypes = map[string]*mibType{
+	"DisplayString":   {syntax: mibSyntax{base: "OCTET STRING"}, displayHint: "255a"},
+	"PhysAddress":     {syntax: mibSyntax{base: "OCTET STRING"}, displayHint: "1x:"},
+	"MacAddress":      {syntax: mibSyntax{base: "OCTET STRING"}, displayHint: "1x:"},
+	"DateAndTime":     {syntax: mibSyntax{base: "OCTET STRING"}, displayHint: "2d-1d-1d,1d:1d:1d.1d,1a1d:1d"},
+	"TruthValue":      {syntax: mibSyntax{base: "INTEGER", enums: map[int]string{1: "true", 2: "false"}}},
+	"TimeStamp":       {syntax: mibSyntax{base: "TimeTicks"}},
+	"TimeInterval":    {syntax: mibSyntax{base: "INTEGER"}},
+	"AutonomousType":  {syntax: mibSyntax{base: "OBJECT IDENTIFIER"}},
+	"VariablePointer": {syntax: mibSyntax{base: "OBJECT IDENTIFIER"}},
+	"RowStatus": {syntax: mibSyntax{base: "INTEGER", enums: map[int]string{1: "active", 2: "notInService",
+		3: "notReady", 4: "createAndGo", 5: "createAndWait", 6: "destroy"}}},
+	"StorageType": {syntax: mibSyntax{base: "INTEGER", enums: map[int]string{1: "other", 2: "volatile",
+		3: "nonVolatile", 4: "permanent", 5: "readOnly"}}},
+}
+
+// The built-in nodes, for looking up names when no MIBs are configured
+var builtinMibs = NewMibDatabase()
+
+// NewMibDatabase returns a database holding only the SMI base nodes
+//
+func NewMibDatabase() *MibDatabase {
+	db := &MibDatabase{byOid: map[string]*MibNode{}, byName: map[string]*MibNode{}}
+	for i := range builtinMibNodes {
+		node := builtinMibNodes[i]
+		db.add(&node)
+	}
+	return db
+}
+
+func (db *MibDatabase) add(node *MibNode) {
+	db.byOid[node.Oid] = node
+	db.byName[node.Module+"::"+node.Name] = node
+	if _, ok := db.byName[node.Name]; !ok {
+		db.byName[node.Name] = node
+	}
+}
+
+// Len returns the number of named OIDs in the database
+//
+func (db *MibDatabase) Len() int {
+	if db == nil {
+		return 0
+	}
+	return len(db.byOid)
+}
+
+// LoadMibs parses all of the MIB files in the given directories.  MIBs that
+// can't be parsed, or that refer to modules that aren't available, are
+// logged and skipped rather than stopping the load.
+//
+func LoadMibs(db *MibDatabase, dirs []string, log *zerolog.Logger) error {
+	modules := map[string]*mibModule{}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("Unable to read MIB directory %s: %s", dir, err)
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") || strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			filename := filepath.Join(dir, file.Name())
+			data, err := ioutil.ReadFile(filepath.Clean(filename))
+			if err != nil {
+				return fmt.Errorf("Unable to read MIB file %s: %s", filename, err)
+			}
+			parsed, err := parseMibModules(string(data))
+			if err != nil {
+				log.Warn().Err(err).Str("mib_file", filename).Msg("Unable to parse MIB file")
+			}
+			for _, module := range parsed {
+				modules[module.name] = module
+			}
+		}
+	}
+	db.resolve(modules, log)
+	return nil
+}
+
+// resolve works out the OID of each definition.  Definitions can refer to
+// names defined later or in other modules, so keep going until no more can
+// be resolved.
+//
+func (db *MibDatabase) resolve(modules map[string]*mibModule, log *zerolog.Logger) {
+	type pendingDef struct {
+		module *mibModule
+		def    *mibDefinition
+	}
+	var pending []pendingDef
+	var names []string
+	for name := range modules {
+		names = append(names, name)
+	}
+	// Keep the load order (and so name clashes) the same from run to run
+	sort.Strings(names)
+	for _, name := range names {
+		for _, def := range modules[name].definitions {
+			pending = append(pending, pendingDef{modules[name], def})
+		}
+	}
+
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		var unresolved []pendingDef
+		for _, p := range pending {
+			oid, ok := db.resolveDefinition(p.module, p.def)
+			if !ok {
+				unresolved = append(unresolved, p)
+				continue
+			}
+			progress = true
+			if oid == "" {
+				continue
+			}
+			node := &MibNode{Oid: oid, Module: p.module.name, Name: p.def.name, Kind: p.def.kind}
+			if p.def.kind == "OBJECT-TYPE" {
+				node.Syntax, node.Enums, node.DisplayHint = resolveSyntax(modules, p.module, p.def.syntax, p.def.displayHint)
+			}
+			db.add(node)
+		}
+		pending = unresolved
+	}
+
+	for _, p := range pending {
+		log.Debug().Str("module", p.module.name).Str("name", p.def.name).Msg("Unable to resolve the OID of MIB definition")
+	}
+	if len(pending) > 0 {
+		log.Warn().Int("unresolved", len(pending)).Msg("Some MIB definitions refer to modules that are not loaded")
+	}
+}
+
+// lookupRef finds the OID of a name as seen from inside a module
+//
+func (db *MibDatabase) lookupRef(module *mibModule, name string) (string, bool) {
+	if node, ok := db.byName[module.name+"::"+name]; ok {
+		return node.Oid, true
+	}
+	if from, ok := module.imports[name]; ok {
+		if node, ok := db.byName[from+"::"+name]; ok {
+			return node.Oid, true
+		}
+	}
+	if node, ok := db.byName[name]; ok {
+		return node.Oid, true
+	}
+	return "", false
+}
+
+// resolveDefinition returns the OID of the definition, or false if it
+// depends on something that hasn't been resolved yet.  An empty OID means
+// that the definition should be ignored.
+//
+func (db *MibDatabase) resolveDefinition(module *mibModule, def *mibDefinition) (string, bool) {
+	if def.kind == "TRAP-TYPE" {
+		// The RFC 1215 generic traps are mapped to snmpTraps, as per RFC 3584
+		if def.enterprise == "snmp" {
+			return "", true
+		}
+		enterprise, ok := db.lookupRef(module, def.enterprise)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%s.0.%d", enterprise, def.trapNumber), true
+	}
+
+	var oid []string
+	for i, component := range def.value {
+		if i == 0 && !component.hasNum {
+			parent, ok := db.lookupRef(module, component.name)
+			if !ok {
+				return "", false
+			}
+			oid = append(oid, parent)
+			continue
+		}
+		oid = append(oid, strconv.Itoa(component.number))
+		// Named numbers define the intermediate nodes, eg org(3)
+		if component.name != "" && i < len(def.value)-1 {
+			if _, ok := db.byOid[strings.Join(oid, ".")]; !ok {
+				db.add(&MibNode{Oid: strings.Join(oid, "."), Module: module.name, Name: component.name})
+			}
+		}
+	}
+	return strings.Join(oid, "."), true
+}
+
+// lookupType finds a type by name as seen from inside a module, along with
+// the module that defines it.
+//
+func lookupType(modules map[string]*mibModule, module *mibModule, name string) (*mibType, *mibModule) {
+	if t, ok := module.types[name]; ok {
+		return t, module
+	}
+	if from, ok := module.imports[name]; ok {
+		if m, ok := modules[from]; ok {
+			if t, ok := m.types[name]; ok {
+				return t, m
+			}
+		}
+	}
+	if t, ok := builtinMibTypes[name]; ok {
+		return t, module
+	}
+	for _, m := range modules {
+		if t, ok := m.types[name]; ok {
+			return t, m
+		}
+	}
+	return nil, nil
+}
+
+// resolveSyntax follows textual conventions down to the base SMI type,
+// keeping the first enumeration and display hint found on the way.
+//
+func resolveSyntax(modules map[string]*mibModule, module *mibModule, syntax mibSyntax, hint string) (string, map[int]string, string) {
+	enums := syntax.enums
+	// The depth limit guards against types that refer to each other
+	for depth := 0; depth < 10; depth++ {
+		t, m := lookupType(modules, module, syntax.base)
+		if t == nil || t.syntax.base == syntax.base {
+			break
+		}
+		if hint == "" {
+			hint = t.displayHint
+		}
+		if enums == nil {
+			enums = t.syntax.enums
+		}
+		syntax, module = t.syntax, m
+	}
+	return syntax.base, enums, hint
+}
+
+// LoadMibIndex reads a MIB index previously written with SaveIndex
+//
+func LoadMibIndex(filename string) (*MibDatabase, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read MIB index %s: %s", filename, err)
+	}
+	var nodes []*MibNode
+	if err = json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("Unable to decode MIB index %s: %s", filename, err)
+	}
+	db := NewMibDatabase()
+	for _, node := range nodes {
+		db.add(node)
+	}
+	return db, nil
+}
+
+// SaveIndex writes the database as a precompiled index, which loads much
+// faster than parsing the MIBs.
+//
+func (db *MibDatabase) SaveIndex(filename string) error {
+	nodes := make([]*MibNode, 0, len(db.byOid))
+	for _, node := range db.byOid {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Oid < nodes[j].Oid })
+	data, err := json.MarshalIndent(nodes, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Clean(filename), data, 0644)
+}
+
+// findNode returns the node with the longest OID that is a prefix of the
+// given OID, and the remaining sub-identifiers (eg the table index).
+//
+func (db *MibDatabase) findNode(oid string) (*MibNode, string) {
+	if db == nil {
+		return nil, ""
+	}
+	oid = strings.Trim(oid, ".")
+	for prefix := oid; prefix != ""; {
+		if node, ok := db.byOid[prefix]; ok {
+			return node, oid[len(prefix):]
+		}
+		i := strings.LastIndexByte(prefix, '.')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	return nil, ""
+}
+
+// Translate returns the symbolic name of an OID, eg IF-MIB::ifOperStatus.3,
+// or an empty string if there isn't one.
+//
+func (db *MibDatabase) Translate(oid string) string {
+	node, suffix := db.findNode(oid)
+	if node == nil {
+		return ""
+	}
+	return node.Module + "::" + node.Name + suffix
+}
+
+// Lookup returns the numeric OID (without a leading dot) of a name given as
+// MODULE::name, a plain name or a numeric OID.  Any instance sub-identifiers
+// are kept, eg ifOperStatus.3.  Without a database (no MIBs configured) the
+// built-in nodes such as IF-MIB::linkDown can still be looked up.
+//
+func (db *MibDatabase) Lookup(name string) (string, bool) {
+	name = strings.Trim(name, ".")
+	if name == "" {
+		return "", false
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		for _, s := range strings.Split(name, ".") {
+			if _, err := strconv.ParseUint(s, 10, 32); err != nil {
+				return "", false
+			}
+		}
+		return name, true
+	}
+	if db == nil {
+		db = builtinMibs
+	}
+
+	module := ""
+	if i := strings.Index(name, "::"); i >= 0 {
+		module, name = name[:i], name[i+2:]
+	}
+	suffix := ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+	key := name
+	if module != "" {
+		key = module + "::" + name
+	}
+	node, ok := db.byName[key]
+	if !ok {
+		return "", false
+	}
+	return node.Oid + suffix, true
+}
+
+// FormatValue shows a varbind value the way its MIB describes it, using
+// enumeration labels and DISPLAY-HINTs.  It returns false when the MIB
+// doesn't say anything more than the raw value.
+//
+func (db *MibDatabase) FormatValue(v g.SnmpPDU) (string, bool) {
+	node, _ := db.findNode(v.Name)
+	if node == nil || node.Kind != "OBJECT-TYPE" {
+		return "", false
+	}
+
+	switch value := v.Value.(type) {
+	case []byte:
+		if node.Syntax == "BITS" && node.Enums != nil {
+			return formatBits(value, node.Enums), true
+		}
+		if node.DisplayHint != "" {
+			return formatOctetHint(node.DisplayHint, value)
+		}
+	case int, uint, uint32, uint64:
+		n := g.ToBigInt(value)
+		if n.IsInt64() {
+			if label, ok := node.Enums[int(n.Int64())]; ok {
+				return fmt.Sprintf("%s(%s)", label, n), true
+			}
+		}
+		if node.DisplayHint != "" {
+			return formatIntHint(node.DisplayHint, n)
+		}
+	case string:
+		if node.Syntax == "OBJECT IDENTIFIER" {
+			if name := db.Translate(value); name != "" {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// formatBits lists the named bits that are set in a BITS value
+//
+func formatBits(value []byte, enums map[int]string) string {
+	var set []string
+	for i, b := range value {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>uint(bit)) == 0 {
+				continue
+			}
+			n := i*8 + bit
+			if label, ok := enums[n]; ok {
+				set = append(set, fmt.Sprintf("%s(%d)", label, n))
+			} else {
+				set = append(set, strconv.Itoa(n))
+			}
+		}
+	}
+	return strings.Join(set, " ")
+}
+
+// octetHintSpec is one part of an OCTET STRING DISPLAY-HINT (RFC 2579 3.1)
+type octetHintSpec struct {
+	repeat     bool
+	length     int
+	format     byte
+	separator  byte
+	terminator byte
+}
+
+func parseOctetHint(hint string) ([]octetHintSpec, bool) {
+	var specs []octetHintSpec
+	isSeparator := func(i int) bool {
+		return i < len(hint) && hint[i] != '*' && (hint[i] < '0' || hint[i] > '9')
+	}
+	for i := 0; i < len(hint); {
+		var spec octetHintSpec
+		if hint[i] == '*' {
+			spec.repeat = true
+			i++
+		}
+		start := i
+		for i < len(hint) && hint[i] >= '0' && hint[i] <= '9' {
+			i++
+		}
+		length, err := strconv.Atoi(hint[start:i])
+		if err != nil || i >= len(hint) || strings.IndexByte("dxoat", hint[i]) < 0 {
+			return nil, false
+		}
+		spec.length = length
+		spec.format = hint[i]
+		i++
+		if isSeparator(i) {
+			spec.separator = hint[i]
+			i++
+		}
+		if spec.repeat && isSeparator(i) {
+			spec.terminator = hint[i]
+			i++
+		}
+		specs = append(specs, spec)
+	}
+	return specs, len(specs) > 0
+}
+
+// formatOctetHint applies an OCTET STRING DISPLAY-HINT.  The last part of
+// the hint is used again until the value is used up.
+//
+func formatOctetHint(hint string, value []byte) (string, bool) {
+	specs, ok := parseOctetHint(hint)
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; len(value) > 0; i++ {
+		spec := specs[len(specs)-1]
+		if i < len(specs) {
+			spec = specs[i]
+		}
+		count := 1
+		if spec.repeat {
+			count = int(value[0])
+			value = value[1:]
+		}
+		for n := 0; n < count && len(value) > 0; n++ {
+			size := spec.length
+			if size > len(value) {
+				size = len(value)
+			}
+			chunk := value[:size]
+			value = value[size:]
+			switch spec.format {
+			case 'a', 't':
+				b.Write(chunk)
+			case 'x':
+				b.WriteString(fmt.Sprintf("%0*x", size*2, new(big.Int).SetBytes(chunk)))
+			case 'o':
+				b.WriteString(new(big.Int).SetBytes(chunk).Text(8))
+			case 'd':
+				b.WriteString(new(big.Int).SetBytes(chunk).String())
+			}
+			if len(value) == 0 {
+				break
+			}
+			if spec.repeat && n == count-1 && spec.terminator != 0 {
+				b.WriteByte(spec.terminator)
+			} else if spec.separator != 0 {
+				b.WriteByte(spec.separator)
+			}
+		}
+	}
+	return b.String(), true
+}
+
+// formatIntHint applies an INTEGER DISPLAY-HINT, eg "d-2" or "x"
+//
+func formatIntHint(hint string, n *big.Int) (string, bool) {
+	switch {
+	case hint == "x":
+		return n.Text(16), true
+	case hint == "o":
+		return n.Text(8), true
+	case hint == "b":
+		return n.Text(2), true
+	case hint == "d":
+		return n.String(), true
+	case strings.HasPrefix(hint, "d-"):
+		places, err := strconv.Atoi(hint[2:])
+		if err != nil || places <= 0 {
+			return "", false
+		}
+		digits := new(big.Int).Abs(n).String()
+		if len(digits) <= places {
+			digits = strings.Repeat("0", places-len(digits)+1) + digits
+		}
+		sign := ""
+		if n.Sign() < 0 {
+			sign = "-"
+		}
+		return sign + digits[:len(digits)-places] + "." + digits[len(digits)-places:], true
+	}
+	return "", false
+}
+
+// The MIBs used by the running configuration
+var currentMibs atomic.Value
+
+// SetMibDatabase makes the database available to filters and plugins
+//
+func SetMibDatabase(db *MibDatabase) {
+	currentMibs.Store(db)
+}
+
+// Mibs returns the MIB database for the running configuration, which is nil
+// if no MIBs were configured.
+//
+func Mibs() *MibDatabase {
+	db, _ := currentMibs.Load().(*MibDatabase)
+	return db
+}
+
+// TrapName returns the symbolic name of the trap's notification OID, or an
+// empty string if it isn't known.
+//
+func (trap *Trap) TrapName() string {
+	return Mibs().Translate(trap.TrapOID())
+}
+
+// VarbindName returns the symbolic name of a varbind OID, falling back to
+// the numeric OID
+//
+func VarbindName(v g.SnmpPDU) string {
+	if name := Mibs().Translate(v.Name); name != "" {
+		return name
+	}
+	return strings.Trim(v.Name, ".")
+}
+
+// VarbindDisplay returns the value of a varbind as described by its MIB,
+// falling back to VarbindString
+//
+func VarbindDisplay(v g.SnmpPDU) string {
+	if value, ok := Mibs().FormatValue(v); ok {
+		return value
+	}
+	return VarbindString(v)
+}
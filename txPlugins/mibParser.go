@@ -0,0 +1,491 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The MIB parser understands enough of SMIv1/SMIv2 to name OIDs and decode
+// values: OBJECT IDENTIFIER assignments, the SMI macros (OBJECT-TYPE,
+// NOTIFICATION-TYPE, TRAP-TYPE and friends), TEXTUAL-CONVENTIONs and type
+// assignments.  Anything else in a module is skipped.
+//
+
+// oidComponent is one element of an OID value, eg "internet", "org(3)" or "1"
+type oidComponent struct {
+	name   string
+	number int
+	hasNum bool
+}
+
+// mibSyntax is the SYNTAX of an object or the definition of a type
+type mibSyntax struct {
+	base  string
+	enums map[int]string
+}
+
+// mibDefinition is a named OID found in a module, before it is resolved
+type mibDefinition struct {
+	module string
+	name   string
+	kind   string
+	value  []oidComponent
+
+	// TRAP-TYPE definitions are numbered under their enterprise
+	enterprise string
+	trapNumber int
+
+	syntax      mibSyntax
+	displayHint string
+}
+
+// mibType is a TEXTUAL-CONVENTION or type assignment
+type mibType struct {
+	syntax      mibSyntax
+	displayHint string
+}
+
+// mibModule holds everything parsed from one MIB module
+type mibModule struct {
+	name        string
+	imports     map[string]string
+	definitions []*mibDefinition
+	types       map[string]*mibType
+}
+
+// tokenizeMib splits a MIB file into tokens, dropping comments.  Quoted
+// strings keep their quotes so that they can't be mistaken for names.
+//
+func tokenizeMib(data string) []string {
+	var tokens []string
+	i := 0
+	for i < len(data) {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f':
+			i++
+		case strings.HasPrefix(data[i:], "--"):
+			// Comments end at the end of the line or at the next "--"
+			end := i + 2
+			for end < len(data) && data[end] != '\n' && !strings.HasPrefix(data[end:], "--") {
+				end++
+			}
+			if strings.HasPrefix(data[end:], "--") {
+				end += 2
+			}
+			i = end
+		case c == '"':
+			end := strings.IndexByte(data[i+1:], '"')
+			if end < 0 {
+				tokens = append(tokens, data[i:])
+				return tokens
+			}
+			tokens = append(tokens, data[i:i+end+2])
+			i += end + 2
+		case c == '\'':
+			// Hex or binary strings, eg '0A'H
+			end := strings.IndexByte(data[i+1:], '\'')
+			if end < 0 {
+				end = len(data) - i - 1
+			}
+			end += i + 2
+			if end < len(data) && (data[end] == 'H' || data[end] == 'h' || data[end] == 'B' || data[end] == 'b') {
+				end++
+			}
+			if end > len(data) {
+				end = len(data)
+			}
+			tokens = append(tokens, data[i:end])
+			i = end
+		case strings.HasPrefix(data[i:], "::="):
+			tokens = append(tokens, "::=")
+			i += 3
+		case strings.HasPrefix(data[i:], ".."):
+			tokens = append(tokens, "..")
+			i += 2
+		case strings.IndexByte("{}()[],;|", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			end := i + 1
+			for end < len(data) && isMibWordChar(data[end]) && !strings.HasPrefix(data[end:], "--") &&
+				!strings.HasPrefix(data[end:], "..") {
+				end++
+			}
+			tokens = append(tokens, data[i:end])
+			i = end
+		}
+	}
+	return tokens
+}
+
+func isMibWordChar(c byte) bool {
+	return c != ' ' && c != '\t' && c != '\r' && c != '\n' && c != '\f' && c != '"' &&
+		c != ':' && c != '\'' && strings.IndexByte("{}()[],;|", c) < 0
+}
+
+// isMibName reports whether the token is an identifier (value or type name)
+//
+func isMibName(token string) bool {
+	if token == "" || !unicode.IsLetter(rune(token[0])) {
+		return false
+	}
+	for _, c := range token {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// mibParser walks the tokens of a MIB file
+type mibParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *mibParser) peek(offset int) string {
+	if p.pos+offset < len(p.tokens) {
+		return p.tokens[p.pos+offset]
+	}
+	return ""
+}
+
+func (p *mibParser) next() string {
+	token := p.peek(0)
+	p.pos++
+	return token
+}
+
+func (p *mibParser) atEnd() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *mibParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("expected %q but found %q (token %d)", token, got, p.pos)
+	}
+	return nil
+}
+
+// skipBalanced skips a bracketed group, starting at the opening bracket
+//
+func (p *mibParser) skipBalanced(open, close string) {
+	depth := 0
+	for !p.atEnd() {
+		switch p.next() {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+// parseMibModules parses all of the modules in the text of a MIB file
+//
+func parseMibModules(data string) ([]*mibModule, error) {
+	p := mibParser{tokens: tokenizeMib(data)}
+	var modules []*mibModule
+	for !p.atEnd() {
+		module, err := p.parseModule()
+		if err != nil {
+			return modules, err
+		}
+		modules = append(modules, module)
+	}
+	return modules, nil
+}
+
+func (p *mibParser) parseModule() (*mibModule, error) {
+	module := &mibModule{
+		name:    p.next(),
+		imports: map[string]string{},
+		types:   map[string]*mibType{},
+	}
+	if !isMibName(module.name) {
+		return nil, fmt.Errorf("expected a module name but found %q", module.name)
+	}
+	// Skip over any module OID, DEFINITIONS and tagging defaults
+	for !p.atEnd() && p.peek(0) != "BEGIN" {
+		p.next()
+	}
+	if err := p.expect("BEGIN"); err != nil {
+		return nil, fmt.Errorf("module %s: %s", module.name, err)
+	}
+
+	for !p.atEnd() {
+		token := p.peek(0)
+		switch {
+		case token == "END":
+			p.next()
+			return module, nil
+		case token == "IMPORTS":
+			p.next()
+			p.parseImports(module)
+		case token == "EXPORTS":
+			for !p.atEnd() && p.next() != ";" {
+			}
+		case p.peek(1) == "MACRO":
+			for !p.atEnd() && p.next() != "END" {
+			}
+		case isMibName(token) && p.peek(1) == "::=":
+			p.pos += 2
+			if err := p.parseTypeAssignment(module, token); err != nil {
+				return nil, fmt.Errorf("module %s: type %s: %s", module.name, token, err)
+			}
+		case isMibName(token) && p.peek(1) == "OBJECT" && p.peek(2) == "IDENTIFIER" && p.peek(3) == "::=":
+			p.pos += 4
+			value, err := p.parseOidValue()
+			if err != nil {
+				return nil, fmt.Errorf("module %s: %s: %s", module.name, token, err)
+			}
+			module.definitions = append(module.definitions, &mibDefinition{module: module.name, name: token, value: value})
+		case isMibName(token) && isMacroName(p.peek(1)):
+			p.pos++
+			def, err := p.parseMacro(module.name, token)
+			if err != nil {
+				return nil, fmt.Errorf("module %s: %s: %s", module.name, token, err)
+			}
+			if def != nil {
+				module.definitions = append(module.definitions, def)
+			}
+		default:
+			// Value assignments and anything else we don't need
+			p.next()
+		}
+	}
+	return nil, fmt.Errorf("module %s has no END", module.name)
+}
+
+// isMacroName reports whether the token invokes one of the SMI macros that
+// assign an OID
+//
+func isMacroName(token string) bool {
+	switch token {
+	case "OBJECT-TYPE", "NOTIFICATION-TYPE", "TRAP-TYPE", "MODULE-IDENTITY", "OBJECT-IDENTITY",
+		"OBJECT-GROUP", "NOTIFICATION-GROUP", "MODULE-COMPLIANCE", "AGENT-CAPABILITIES":
+		return true
+	}
+	return false
+}
+
+func (p *mibParser) parseImports(module *mibModule) {
+	var names []string
+	for !p.atEnd() {
+		token := p.next()
+		switch token {
+		case ";":
+			return
+		case ",":
+		case "FROM":
+			from := p.next()
+			for _, name := range names {
+				module.imports[name] = from
+			}
+			names = nil
+		default:
+			names = append(names, token)
+		}
+	}
+}
+
+func (p *mibParser) parseTypeAssignment(module *mibModule, name string) error {
+	t := &mibType{}
+	if p.peek(0) == "TEXTUAL-CONVENTION" {
+		p.next()
+		for !p.atEnd() && p.peek(0) != "SYNTAX" {
+			if p.next() == "DISPLAY-HINT" {
+				t.displayHint = unquote(p.next())
+			}
+		}
+		if err := p.expect("SYNTAX"); err != nil {
+			return err
+		}
+	}
+	syntax, err := p.parseSyntax()
+	if err != nil {
+		return err
+	}
+	t.syntax = syntax
+	module.types[name] = t
+	return nil
+}
+
+// parseSyntax parses a type, eg "INTEGER { up(1), down(2) }",
+// "OCTET STRING (SIZE (0..255))" or "DisplayString"
+//
+func (p *mibParser) parseSyntax() (mibSyntax, error) {
+	var syntax mibSyntax
+
+	// Tags from the SMI type definitions, eg [APPLICATION 1] IMPLICIT
+	if p.peek(0) == "[" {
+		p.skipBalanced("[", "]")
+	}
+	if p.peek(0) == "IMPLICIT" || p.peek(0) == "EXPLICIT" {
+		p.next()
+	}
+
+	token := p.next()
+	switch {
+	case token == "OCTET" && p.peek(0) == "STRING":
+		p.next()
+		syntax.base = "OCTET STRING"
+	case token == "OBJECT" && p.peek(0) == "IDENTIFIER":
+		p.next()
+		syntax.base = "OBJECT IDENTIFIER"
+	case token == "SEQUENCE" && p.peek(0) == "OF":
+		p.next()
+		syntax.base = "SEQUENCE OF " + p.next()
+	case token == "SEQUENCE" || token == "CHOICE":
+		syntax.base = token
+		if p.peek(0) == "{" {
+			p.skipBalanced("{", "}")
+		}
+		return syntax, nil
+	case isMibName(token):
+		syntax.base = token
+	default:
+		return syntax, fmt.Errorf("unexpected %q in SYNTAX", token)
+	}
+
+	if p.peek(0) == "{" {
+		enums, err := p.parseEnums()
+		if err != nil {
+			return syntax, err
+		}
+		syntax.enums = enums
+	}
+	if p.peek(0) == "(" {
+		p.skipBalanced("(", ")")
+	}
+	return syntax, nil
+}
+
+// parseEnums parses named numbers, eg "{ up(1), down(2) }"
+//
+func (p *mibParser) parseEnums() (map[int]string, error) {
+	enums := map[int]string{}
+	p.next()
+	for !p.atEnd() {
+		name := p.next()
+		if name == "}" {
+			return enums, nil
+		}
+		if name == "," {
+			continue
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		value, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		if err = p.expect(")"); err != nil {
+			return nil, err
+		}
+		enums[value] = name
+	}
+	return nil, fmt.Errorf("unterminated list of named numbers")
+}
+
+// parseOidValue parses an OID value, eg "{ iso org(3) dod(6) 1 }"
+//
+func (p *mibParser) parseOidValue() ([]oidComponent, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var value []oidComponent
+	for !p.atEnd() {
+		token := p.next()
+		if token == "}" {
+			if len(value) == 0 {
+				return nil, fmt.Errorf("empty OID value")
+			}
+			return value, nil
+		}
+		if n, err := strconv.Atoi(token); err == nil {
+			value = append(value, oidComponent{number: n, hasNum: true})
+			continue
+		}
+		if !isMibName(token) {
+			return nil, fmt.Errorf("unexpected %q in OID value", token)
+		}
+		component := oidComponent{name: token}
+		if p.peek(0) == "(" {
+			p.next()
+			n, err := strconv.Atoi(p.next())
+			if err != nil {
+				return nil, fmt.Errorf("invalid number for %s in OID value", token)
+			}
+			if err = p.expect(")"); err != nil {
+				return nil, err
+			}
+			component.number = n
+			component.hasNum = true
+		}
+		value = append(value, component)
+	}
+	return nil, fmt.Errorf("unterminated OID value")
+}
+
+// parseMacro parses the clauses of an SMI macro up to and including its value
+//
+func (p *mibParser) parseMacro(module string, name string) (*mibDefinition, error) {
+	def := &mibDefinition{module: module, name: name, kind: p.next()}
+	for !p.atEnd() && p.peek(0) != "::=" {
+		switch p.next() {
+		case "SYNTAX":
+			// The SYNTAX clause of MODULE-COMPLIANCE refines other objects
+			if def.kind != "OBJECT-TYPE" {
+				continue
+			}
+			syntax, err := p.parseSyntax()
+			if err != nil {
+				return nil, err
+			}
+			def.syntax = syntax
+		case "DISPLAY-HINT":
+			def.displayHint = unquote(p.next())
+		case "ENTERPRISE":
+			def.enterprise = p.next()
+		case "{":
+			// VARIABLES, OBJECTS, INDEX, DEFVAL and friends
+			p.pos--
+			p.skipBalanced("{", "}")
+		}
+	}
+	if err := p.expect("::="); err != nil {
+		return nil, err
+	}
+
+	if def.kind == "TRAP-TYPE" {
+		n, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("invalid trap number: %s", err)
+		}
+		def.trapNumber = n
+		return def, nil
+	}
+	value, err := p.parseOidValue()
+	if err != nil {
+		return nil, err
+	}
+	def.value = value
+	return def, nil
+}
+
+func unquote(token string) string {
+	return strings.Trim(token, "\"")
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+	"github.com/rs/zerolog"
+)
+
+var testMibLog = zerolog.New(ioutil.Discard)
+
+const testIfMib = `
+IF-MIB DEFINITIONS ::= BEGIN
+
+IMPORTS
+    MODULE-IDENTITY, OBJECT-TYPE, Counter32, Integer32,
+    mib-2, NOTIFICATION-TYPE                 FROM SNMPv2-SMI
+    TEXTUAL-CONVENTION, DisplayString,
+    PhysAddress, TruthValue                  FROM SNMPv2-TC;
+
+ifMIB MODULE-IDENTITY
+    LAST-UPDATED "200006140000Z"
+    ORGANIZATION "IETF Interfaces MIB Working Group"
+    CONTACT-INFO "-- not a comment"
+    DESCRIPTION
+            "The MIB module to describe generic objects for network
+            interface sub-layers.  ::= { not really }"
+    ::= { mib-2 31 }
+
+ifMIBObjects OBJECT IDENTIFIER ::= { ifMIB 1 }
+interfaces   OBJECT IDENTIFIER ::= { mib-2 2 }
+
+InterfaceIndex ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "d"
+    STATUS       current
+    DESCRIPTION  "A unique value, greater than zero, for each interface."
+    SYNTAX       Integer32 (1..2147483647)
+
+ifTable OBJECT-TYPE
+    SYNTAX      SEQUENCE OF IfEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "A list of interface entries."
+    ::= { interfaces 2 }
+
+ifEntry OBJECT-TYPE
+    SYNTAX      IfEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "An entry containing management information."
+    INDEX   { ifIndex }
+    ::= { ifTable 1 }
+
+IfEntry ::=
+    SEQUENCE {
+        ifIndex                 InterfaceIndex,
+        ifDescr                 DisplayString,
+        ifPhysAddress           PhysAddress,
+        ifOperStatus            INTEGER
+    }
+
+ifIndex OBJECT-TYPE
+    SYNTAX      InterfaceIndex
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "A unique value for each interface."
+    ::= { ifEntry 1 }
+
+ifDescr OBJECT-TYPE
+    SYNTAX      DisplayString (SIZE (0..255))
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "A textual string containing information about the interface."
+    ::= { ifEntry 2 }
+
+ifPhysAddress OBJECT-TYPE
+    SYNTAX      PhysAddress
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "The interface's address at its protocol sub-layer."
+    ::= { ifEntry 6 }
+
+ifOperStatus OBJECT-TYPE
+    SYNTAX  INTEGER {
+                up(1),        -- ready to pass packets
+                down(2),
+                testing(3),   -- in some test mode
+                unknown(4),
+                dormant(5),
+                notPresent(6),
+                lowerLayerDown(7)
+            }
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "The current operational state of the interface."
+    DEFVAL { up }
+    ::= { ifEntry 8 }
+
+ifPromiscuousMode  OBJECT-TYPE
+    SYNTAX      TruthValue
+    MAX-ACCESS  read-write
+    STATUS      current
+    DESCRIPTION "Whether the interface is in promiscuous mode."
+    ::= { ifXEntry 16 }
+
+ifXTable        OBJECT-TYPE
+    SYNTAX      SEQUENCE OF IfXEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "A list of interface entries."
+    ::= { ifMIBObjects 1 }
+
+ifXEntry        OBJECT-TYPE
+    SYNTAX      IfXEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "An entry containing additional management information."
+    AUGMENTS    { ifEntry }
+    ::= { ifXTable 1 }
+
+snmpTraps OBJECT IDENTIFIER ::= { iso(1) org(3) dod(6) internet(1) snmpV2(6) snmpModules(3) snmpMIB(1) snmpMIBObjects(1) 5 }
+
+linkDown NOTIFICATION-TYPE
+    OBJECTS { ifIndex, ifAdminStatus, ifOperStatus }
+    STATUS  current
+    DESCRIPTION "A linkDown trap signifies that the SNMP entity has
+            detected that the ifOperStatus object ..."
+    ::= { snmpTraps 3 }
+
+END
+`
+
+const testVendorMib = `
+ACME-MIB DEFINITIONS ::= BEGIN
+IMPORTS enterprises FROM RFC1155-SMI
+        TRAP-TYPE FROM RFC-1215
+        DisplayString FROM RFC1213-MIB;
+
+acme OBJECT IDENTIFIER ::= { enterprises 99999 }
+
+acmeTemperature OBJECT-TYPE
+    SYNTAX  INTEGER
+    ACCESS  read-only
+    STATUS  mandatory
+    ::= { acme 1 }
+
+acmeOverheat TRAP-TYPE
+    ENTERPRISE  acme
+    VARIABLES   { acmeTemperature }
+    DESCRIPTION "Too hot"
+    ::= 7
+
+coldStart TRAP-TYPE
+    ENTERPRISE  snmp
+    ::= 0
+END
+`
+
+func loadTestMibs(t *testing.T) *MibDatabase {
+	dir, err := ioutil.TempDir("", "mibs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "IF-MIB.txt"), []byte(testIfMib), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "ACME-MIB"), []byte(testVendorMib), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewMibDatabase()
+	if err = LoadMibs(db, []string{dir}, &testMibLog); err != nil {
+		t.Fatalf("Unable to load MIBs: %s", err)
+	}
+	return db
+}
+
+func TestMibTranslate(t *testing.T) {
+	db := loadTestMibs(t)
+
+	tests := map[string]string{
+		"1.3.6.1.6.3.1.1.5.3":       "IF-MIB::linkDown",
+		".1.3.6.1.2.1.2.2.1.8.3":    "IF-MIB::ifOperStatus.3",
+		"1.3.6.1.2.1.31.1.1.1.16.2": "IF-MIB::ifPromiscuousMode.2",
+		"1.3.6.1.4.1.99999.0.7":     "ACME-MIB::acmeOverheat",
+		"1.3.6.1.4.1.99999.1.0":     "ACME-MIB::acmeTemperature.0",
+		"1.3.6.1.4.1.12345":         "SNMPv2-SMI::enterprises.12345",
+		"1.3.6.1.6.3.1":             "SNMPv2-MIB::snmpMIB",
+	}
+	for oid, expected := range tests {
+		if name := db.Translate(oid); name != expected {
+			t.Errorf("Translate(%s) = %s, expected %s", oid, name, expected)
+		}
+	}
+
+	for _, name := range []string{"IF-MIB::ifOperStatus.3", "ifOperStatus.3", "1.3.6.1.2.1.2.2.1.8.3"} {
+		if oid, ok := db.Lookup(name); !ok || oid != "1.3.6.1.2.1.2.2.1.8.3" {
+			t.Errorf("Lookup(%s) = %s, %v", name, oid, ok)
+		}
+	}
+	if _, ok := db.Lookup("NO-SUCH-MIB::nothing"); ok {
+		t.Errorf("Lookup of an unknown name succeeded")
+	}
+
+	var none *MibDatabase
+	if none.Translate("1.3.6.1") != "" {
+		t.Errorf("A nil database should not translate")
+	}
+	if oid, ok := none.Lookup("IF-MIB::linkDown"); !ok || oid != "1.3.6.1.6.3.1.1.5.3" {
+		t.Errorf("A nil database should look up the built-in nodes: %s, %v", oid, ok)
+	}
+	if _, ok := none.Lookup("IF-MIB::ifOperStatus"); ok {
+		t.Errorf("A nil database looked up a name that isn't built in")
+	}
+}
+
+func TestMibFormatValue(t *testing.T) {
+	db := loadTestMibs(t)
+
+	tests := []struct {
+		pdu      g.SnmpPDU
+		expected string
+	}{
+		{g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2}, "down(2)"},
+		{g.SnmpPDU{Name: ".1.3.6.1.2.1.31.1.1.1.16.3", Type: g.Integer, Value: 1}, "true(1)"},
+		{g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.6.3", Type: g.OctetString, Value: []byte{0, 0x1b, 0x21, 0xa, 0xb, 0xc}}, "00:1b:21:0a:0b:0c"},
+		{g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3}, "3"},
+		{g.SnmpPDU{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"}, "IF-MIB::linkDown"},
+	}
+	for _, test := range tests {
+		value, ok := db.FormatValue(test.pdu)
+		if !ok || value != test.expected {
+			t.Errorf("FormatValue(%s) = %q, %v; expected %q", test.pdu.Name, value, ok, test.expected)
+		}
+	}
+	if _, ok := db.FormatValue(g.SnmpPDU{Name: ".1.3.6.1.4.1.99999.1.0", Type: g.Integer, Value: 40}); ok {
+		t.Errorf("Plain INTEGER objects should not be reformatted")
+	}
+}
+
+func TestDisplayHints(t *testing.T) {
+	dateAndTime := []byte{0x07, 0xe6, 3, 4, 5, 6, 7, 8, '+', 1, 0}
+	if value, _ := formatOctetHint("2d-1d-1d,1d:1d:1d.1d,1a1d:1d", dateAndTime); value != "2022-3-4,5:6:7.8,+1:0" {
+		t.Errorf("Unexpected DateAndTime: %s", value)
+	}
+	if value, _ := formatOctetHint("1d.1d.1d.1d/1d", []byte{192, 0, 2, 1, 24}); value != "192.0.2.1/24" {
+		t.Errorf("Unexpected address: %s", value)
+	}
+	if value, _ := formatOctetHint("*1x:/1x:", []byte{2, 0xaa, 0xbb, 0xcc}); value != "aa:bb/cc" {
+		t.Errorf("Unexpected repeated value: %s", value)
+	}
+	if value, _ := formatIntHint("d-2", big.NewInt(-1234)); value != "-12.34" {
+		t.Errorf("Unexpected decimal value: %s", value)
+	}
+	if value, _ := formatIntHint("d-3", big.NewInt(5)); value != "0.005" {
+		t.Errorf("Unexpected decimal value: %s", value)
+	}
+	if _, ok := formatOctetHint("1q", []byte{1}); ok {
+		t.Errorf("Invalid hints should not be used")
+	}
+}
+
+func TestMibIndex(t *testing.T) {
+	db := loadTestMibs(t)
+	dir, err := ioutil.TempDir("", "mibindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "mibs.json")
+	if err = db.SaveIndex(index); err != nil {
+		t.Fatalf("Unable to save index: %s", err)
+	}
+
+	loaded, err := LoadMibIndex(index)
+	if err != nil {
+		t.Fatalf("Unable to load index: %s", err)
+	}
+	if loaded.Len() != db.Len() || loaded.Translate("1.3.6.1.2.1.2.2.1.8.3") != "IF-MIB::ifOperStatus.3" {
+		t.Errorf("Index does not match the MIBs: %d vs %d nodes", loaded.Len(), db.Len())
+	}
+	if value, ok := loaded.FormatValue(g.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.8.1", Type: g.Integer, Value: 1}); !ok || value != "up(1)" {
+		t.Errorf("Index lost the enumerations: %s", value)
+	}
+}
+
+func TestMibTrapOutput(t *testing.T) {
+	SetMibDatabase(loadTestMibs(t))
+	defer SetMibDatabase(nil)
+
+	trap := Trap{SnmpVersion: g.Version2c}
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: SnmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2},
+	}
+	if name := trap.TrapName(); name != "IF-MIB::linkDown" {
+		t.Errorf("Unexpected trap name: %s", name)
+	}
+	if VarbindName(trap.Data.Variables[1]) != "IF-MIB::ifOperStatus.3" || VarbindDisplay(trap.Data.Variables[1]) != "down(2)" {
+		t.Errorf("Varbind was not translated")
+	}
+	if trap.Trap2Map()["TrapName"] != `"IF-MIB::linkDown"` {
+		t.Errorf("Trap2Map is missing the trap name")
+	}
+
+	encoded, err := json.Marshal(&trap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc trapJSON
+	if err = json.Unmarshal(encoded, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.TrapName != "IF-MIB::linkDown" || doc.Varbinds[1].Name != "IF-MIB::ifOperStatus.3" || doc.Varbinds[1].Display != "down(2)" {
+		t.Errorf("JSON is missing the MIB names: %s", encoded)
+	}
+	var decoded Trap
+	if err = json.Unmarshal(encoded, &decoded); err != nil || decoded.Data.Variables[1].Value != 2 {
+		t.Errorf("MIB names should not change the decoded trap: %v %v", err, decoded.Data.Variables)
+	}
+}
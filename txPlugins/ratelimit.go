@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ThrottledKey is the trap metadata set on traps over a rate limit, with
+// the name of the limit
+const ThrottledKey = "throttled"
+
+// Idle buckets are forgotten when there are more than this many, and then
+// the least recently used ones if none are idle
+const maxRateBuckets = 10000
+
+// RateLimit is a token bucket limit.  Traps are let through at rate traps
+// per second on average, with bursts of up to burst traps (by default the
+// rate, or 1).
+//
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Enabled checks if the limit is set
+//
+func (limit RateLimit) Enabled() bool {
+	return limit.Rate > 0
+}
+
+// Validate checks the limit values, with the name of the limit for errors
+//
+func (limit RateLimit) Validate(name string) error {
+	if limit.Rate < 0 || limit.Burst < 0 || math.IsNaN(limit.Rate) || math.IsInf(limit.Rate, 0) {
+		return fmt.Errorf("Invalid rate limit for %s: rate %v, burst %d", name, limit.Rate, limit.Burst)
+	}
+	return nil
+}
+
+func (limit RateLimit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, math.Ceil(limit.Rate))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket for each key (eg a source IP) of a
+// limit.  A full bucket is the same as no bucket, so idle ones are dropped.
+//
+type RateLimiter struct {
+	limit RateLimit
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimiter returns a limiter for the limit
+//
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, burst: limit.burst(), buckets: make(map[string]*tokenBucket)}
+}
+
+// Limit returns the limit being enforced
+//
+func (l *RateLimiter) Limit() RateLimit {
+	return l.limit
+}
+
+// Allow takes a token from the bucket of the key, returning false if it is
+// empty and the trap is over the limit
+//
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket := l.buckets[key]
+	if bucket == nil {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.limit.Rate)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune drops the buckets that have filled up again.  If none have, as
+// in a flood from many sources, the least recently used tenth is dropped.
+//
+func (l *RateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.limit.Rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) < maxRateBuckets {
+		return
+	}
+
+	keys := make([]string, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return l.buckets[keys[i]].last.Before(l.buckets[keys[j]].last)
+	})
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(l.buckets, key)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func countAllowed(l *RateLimiter, key string, count int, now time.Time) int {
+	allowed := 0
+	for i := 0; i < count; i++ {
+		if l.Allow(key, now) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 2, Burst: 5})
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if allowed := countAllowed(l, "192.0.2.1", 10, start); allowed != 5 {
+		t.Errorf("Expected a burst of 5 traps, got %d", allowed)
+	}
+	if allowed := countAllowed(l, "192.0.2.2", 10, start); allowed != 5 {
+		t.Errorf("Keys don't have their own buckets: %d traps let through", allowed)
+	}
+
+	// Refills at the rate, up to the burst
+	if allowed := countAllowed(l, "192.0.2.1", 10, start.Add(1500*time.Millisecond)); allowed != 3 {
+		t.Errorf("Expected 3 traps after 1.5s, got %d", allowed)
+	}
+	if allowed := countAllowed(l, "192.0.2.1", 10, start.Add(time.Hour)); allowed != 5 {
+		t.Errorf("Expected the burst after an idle hour, got %d", allowed)
+	}
+
+	// The burst defaults to the rate
+	l = NewRateLimiter(RateLimit{Rate: 0.5})
+	if allowed := countAllowed(l, "", 3, start); allowed != 1 {
+		t.Errorf("Expected a burst of 1 trap, got %d", allowed)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 1, Burst: 1})
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxRateBuckets; i++ {
+		l.Allow(fmt.Sprintf("key%d", i), start)
+	}
+	l.Allow("last", start.Add(2*time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("Idle buckets were kept: %d", len(l.buckets))
+	}
+
+	// In a flood none of the buckets fill up, so the oldest are dropped
+	l = NewRateLimiter(RateLimit{Rate: 0.01, Burst: 1})
+	for i := 0; i < maxRateBuckets; i++ {
+		l.Allow(fmt.Sprintf("key%d", i), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	l.Allow("last", start.Add(maxRateBuckets*time.Millisecond))
+	if len(l.buckets) > maxRateBuckets*9/10+1 {
+		t.Errorf("Buckets were not evicted in a flood: %d", len(l.buckets))
+	}
+	if l.buckets["key0"] != nil || l.buckets["last"] == nil || l.buckets[fmt.Sprintf("key%d", maxRateBuckets-1)] == nil {
+		t.Errorf("The least recently used buckets were not the ones evicted")
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	if err := (RateLimit{Rate: 10, Burst: 20}).Validate("global"); err != nil {
+		t.Errorf("Valid limit was rejected: %s", err)
+	}
+	if err := (RateLimit{Rate: -1}).Validate("global"); err == nil {
+		t.Errorf("Negative rate was accepted")
+	}
+	if err := (RateLimit{Rate: 1, Burst: -1}).Validate("global"); err == nil {
+		t.Errorf("Negative burst was accepted")
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// How long failed lookups are cached for, unless negative_ttl is given
+const defaultNegativeTTL = 300
+
+// sysName.0 from SNMPv2-MIB
+const sysNameOID = ".1.3.6.1.2.1.1.5.0"
+
+// ResolverSettings is the 'resolver' section of the configuration file,
+// which finds a name for the device that sent each trap.
+//
+type ResolverSettings struct {
+	ReverseDNS  bool   `default:"false" json:"reverse_dns"`
+	DNSServer   string `default:"" json:"dns_server"`
+	SysName     bool   `default:"false" json:"sysname"`
+	Community   string `default:"public" json:"snmp_community"`
+	SnmpVersion string `default:"2c" json:"snmp_version"`
+	SnmpPort    int    `default:"161" json:"snmp_port"`
+	Address     string `default:"source_ip" json:"address"`
+	CacheTTL    int    `default:"3600" json:"cache_ttl"`
+	NegativeTTL *int   `default:"300" json:"negative_ttl"`
+	CacheSize   int    `default:"10000" json:"cache_size"`
+	Timeout     int    `default:"1" json:"timeout"`
+	Async       *bool  `default:"true" json:"async"`
+}
+
+// Enabled is true if any lookups are configured
+//
+func (s *ResolverSettings) Enabled() bool {
+	return s.ReverseDNS || s.SysName
+}
+
+// setDefaults fills in the settings left out of the configuration file.
+// A cache_ttl of 0 also gets the default, but an explicit negative_ttl of
+// 0 turns off caching of failed lookups, and async can be turned off.
+//
+func (s *ResolverSettings) setDefaults() {
+	if s.Community == "" {
+		s.Community = "public"
+	}
+	if s.SnmpVersion == "" {
+		s.SnmpVersion = "2c"
+	}
+	if s.SnmpPort == 0 {
+		s.SnmpPort = 161
+	}
+	if s.Address == "" {
+		s.Address = "source_ip"
+	}
+	if s.CacheTTL == 0 {
+		s.CacheTTL = 3600
+	}
+	if s.CacheSize == 0 {
+		s.CacheSize = 10000
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 1
+	}
+	if s.NegativeTTL == nil {
+		negativeTTL := defaultNegativeTTL
+		s.NegativeTTL = &negativeTTL
+	}
+	if s.Async == nil {
+		async := true
+		s.Async = &async
+	}
+}
+
+type resolverCacheEntry struct {
+	name    string
+	expires time.Time
+}
+
+// DeviceResolver looks up device names, from the sysName of the agent
+// and/or reverse DNS, and caches the answers (including failures, for the
+// negative TTL).
+//
+type DeviceResolver struct {
+	settings    ResolverSettings
+	snmpVersion g.SnmpVersion
+	timeout     time.Duration
+
+	mutex    sync.Mutex
+	cache    map[string]resolverCacheEntry
+	inFlight map[string]chan struct{}
+
+	lookupAddr    func(ctx context.Context, address string) ([]string, error)
+	lookupSysName func(address string) (string, error)
+}
+
+// NewDeviceResolver checks the resolver settings and sets up the lookups
+//
+func NewDeviceResolver(settings ResolverSettings) (*DeviceResolver, error) {
+	settings.setDefaults()
+	r := DeviceResolver{
+		settings: settings,
+		timeout:  time.Duration(settings.Timeout) * time.Second,
+		cache:    make(map[string]resolverCacheEntry),
+		inFlight: make(map[string]chan struct{}),
+	}
+
+	switch settings.Address {
+	case "source_ip", "agent_address":
+	default:
+		return nil, fmt.Errorf("Unknown resolver address %s: should be source_ip or agent_address", settings.Address)
+	}
+	switch settings.SnmpVersion {
+	case "1":
+		r.snmpVersion = g.Version1
+	case "2c":
+		r.snmpVersion = g.Version2c
+	default:
+		return nil, fmt.Errorf("Unsupported resolver snmp_version %s: should be 1 or 2c", settings.SnmpVersion)
+	}
+	if settings.Timeout <= 0 || settings.CacheTTL < 0 || *settings.NegativeTTL < 0 || settings.CacheSize <= 0 {
+		return nil, fmt.Errorf("The resolver timeout and cache_size must be positive, and the TTLs can't be negative")
+	}
+
+	dns := net.DefaultResolver
+	if settings.DNSServer != "" {
+		server := settings.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		dns = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	r.lookupAddr = dns.LookupAddr
+	r.lookupSysName = r.getSysName
+	return &r, nil
+}
+
+// Resolve sets the device name of the trap.  With the async setting (the
+// default), the name of a device that isn't in the cache is looked up in
+// the background and the trap goes on without it, so that the listener
+// isn't held up by slow lookups.
+//
+func (r *DeviceResolver) Resolve(trap *Trap) {
+	address := trap.Data.AgentAddress
+	if r.settings.Address == "source_ip" || address == "" || address == "0.0.0.0" {
+		address = ""
+		if trap.SrcIP != nil {
+			address = trap.SrcIP.String()
+		}
+	}
+	if address != "" {
+		trap.DeviceName = r.Lookup(address)
+	}
+}
+
+// Lookup returns the name of the device at the address, or "" if it
+// doesn't have one
+//
+func (r *DeviceResolver) Lookup(address string) string {
+	r.mutex.Lock()
+	if entry, ok := r.cache[address]; ok && time.Now().Before(entry.expires) {
+		r.mutex.Unlock()
+		return entry.name
+	}
+	if wait, ok := r.inFlight[address]; ok {
+		r.mutex.Unlock()
+		if *r.settings.Async {
+			return ""
+		}
+		<-wait
+		return r.cached(address)
+	}
+	done := make(chan struct{})
+	r.inFlight[address] = done
+	r.mutex.Unlock()
+
+	if *r.settings.Async {
+		go r.fetch(address, done)
+		return ""
+	}
+	return r.fetch(address, done)
+}
+
+func (r *DeviceResolver) cached(address string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cache[address].name
+}
+
+// fetch looks up the name, preferring the sysName of the device, and adds
+// it to the cache
+//
+func (r *DeviceResolver) fetch(address string, done chan struct{}) string {
+	var name string
+	if r.settings.SysName {
+		name, _ = r.lookupSysName(address)
+	}
+	if name == "" && r.settings.ReverseDNS {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		names, err := r.lookupAddr(ctx, address)
+		cancel()
+		if err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+	}
+
+	ttl := r.settings.CacheTTL
+	if name == "" {
+		ttl = *r.settings.NegativeTTL
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.cache) >= r.settings.CacheSize {
+		r.evict()
+	}
+	r.cache[address] = resolverCacheEntry{name: name, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	delete(r.inFlight, address)
+	close(done)
+	return name
+}
+
+// evict makes room in the cache, removing the expired entries or, if
+// there aren't any, an arbitrary tenth of the cache
+//
+func (r *DeviceResolver) evict() {
+	now := time.Now()
+	for address, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, address)
+		}
+	}
+	remove := len(r.cache) - r.settings.CacheSize + r.settings.CacheSize/10 + 1
+	for address := range r.cache {
+		if remove <= 0 {
+			break
+		}
+		delete(r.cache, address)
+		remove--
+	}
+}
+
+// getSysName asks the agent for its sysName.0
+//
+func (r *DeviceResolver) getSysName(address string) (string, error) {
+	snmp := &g.GoSNMP{
+		Target:    address,
+		Port:      uint16(r.settings.SnmpPort),
+		Transport: "udp",
+		Community: r.settings.Community,
+		Version:   r.snmpVersion,
+		Timeout:   r.timeout,
+		Retries:   0,
+		MaxOids:   g.MaxOids,
+	}
+	if err := snmp.Connect(); err != nil {
+		return "", err
+	}
+	defer snmp.Conn.Close()
+
+	result, err := snmp.Get([]string{sysNameOID})
+	if err != nil {
+		return "", err
+	}
+	for _, v := range result.Variables {
+		if value, ok := v.Value.([]byte); ok && v.Type == g.OctetString {
+			return strings.TrimSpace(string(value)), nil
+		}
+	}
+	return "", fmt.Errorf("No sysName from %s", address)
+}
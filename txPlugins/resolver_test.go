@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func makeTestResolver(t *testing.T, settings ResolverSettings, names map[string]string) (*DeviceResolver, *int) {
+	r, err := NewDeviceResolver(settings)
+	if err != nil {
+		t.Fatalf("Unable to make resolver: %s", err)
+	}
+	var mutex sync.Mutex
+	lookups := 0
+	r.lookupAddr = func(ctx context.Context, address string) ([]string, error) {
+		mutex.Lock()
+		lookups++
+		mutex.Unlock()
+		if name, ok := names[address]; ok {
+			return []string{name}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	return r, &lookups
+}
+
+// defaultResolverSettings are the settings for the tests, which look up
+// names while they wait
+//
+func defaultResolverSettings() ResolverSettings {
+	negativeTTL, async := 300, false
+	return ResolverSettings{ReverseDNS: true, Community: "public", SnmpVersion: "2c", SnmpPort: 161,
+		Address: "source_ip", CacheTTL: 3600, NegativeTTL: &negativeTTL, CacheSize: 10, Timeout: 1, Async: &async}
+}
+
+func TestResolverCache(t *testing.T) {
+	r, lookups := makeTestResolver(t, defaultResolverSettings(), map[string]string{"192.0.2.1": "rtr1.example.com."})
+
+	trap := Trap{SrcIP: net.ParseIP("192.0.2.1")}
+	trap.Data.AgentAddress = "10.1.1.1"
+	r.Resolve(&trap)
+	if trap.DeviceName != "rtr1.example.com" {
+		t.Errorf("Unexpected device name %q", trap.DeviceName)
+	}
+	r.Resolve(&trap)
+	if r.Lookup("192.0.2.2") != "" || r.Lookup("192.0.2.2") != "" {
+		t.Errorf("Unknown address was given a name")
+	}
+	if *lookups != 2 {
+		t.Errorf("Expected 2 lookups with caching, found %d", *lookups)
+	}
+
+	// Expired entries are looked up again
+	r.cache["192.0.2.2"] = resolverCacheEntry{expires: time.Now().Add(-time.Second)}
+	r.Lookup("192.0.2.2")
+	if *lookups != 3 {
+		t.Errorf("Expired entry was not looked up again")
+	}
+
+	// The cache stays within its size
+	for i := 0; i < 25; i++ {
+		r.Lookup(fmt.Sprintf("198.51.100.%d", i))
+	}
+	if len(r.cache) > 10 {
+		t.Errorf("Cache grew to %d entries", len(r.cache))
+	}
+}
+
+func TestResolverAgentAddress(t *testing.T) {
+	settings := defaultResolverSettings()
+	settings.Address = "agent_address"
+	r, _ := makeTestResolver(t, settings, map[string]string{"192.0.2.1": "relay", "10.1.1.1": "rtr1"})
+
+	trap := Trap{SrcIP: net.ParseIP("192.0.2.1")}
+	trap.Data.AgentAddress = "10.1.1.1"
+	r.Resolve(&trap)
+	if trap.DeviceName != "rtr1" {
+		t.Errorf("Agent address was not used, found %q", trap.DeviceName)
+	}
+
+	// SNMPv2c traps have no agent address
+	trap.Data.AgentAddress = ""
+	r.Resolve(&trap)
+	if trap.DeviceName != "relay" {
+		t.Errorf("Source address was not used, found %q", trap.DeviceName)
+	}
+}
+
+func TestResolverAsync(t *testing.T) {
+	settings := defaultResolverSettings()
+	async := true
+	settings.Async = &async
+	r, _ := makeTestResolver(t, settings, map[string]string{"192.0.2.1": "rtr1"})
+	release := make(chan struct{})
+	lookupAddr := r.lookupAddr
+	r.lookupAddr = func(ctx context.Context, address string) ([]string, error) {
+		<-release
+		return lookupAddr(ctx, address)
+	}
+
+	if name := r.Lookup("192.0.2.1"); name != "" {
+		t.Errorf("Async lookup should not wait, found %q", name)
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for r.Lookup("192.0.2.1") != "rtr1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Background lookup did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveSysName answers one SNMP GET with the sysName
+//
+func serveSysName(t *testing.T, conn net.PacketConn, sysName string) {
+	buf := make([]byte, 1500)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	request, err := g.Default.SnmpDecodePacket(buf[:n])
+	if err != nil {
+		t.Errorf("Unable to decode request: %s", err)
+		return
+	}
+	response := g.SnmpPacket{
+		Version:   request.Version,
+		Community: request.Community,
+		PDUType:   g.GetResponse,
+		RequestID: request.RequestID,
+		Variables: []g.SnmpPDU{{Name: sysNameOID, Type: g.OctetString, Value: []byte(sysName)}},
+	}
+	data, err := response.MarshalMsg()
+	if err != nil {
+		t.Errorf("Unable to encode response: %s", err)
+		return
+	}
+	conn.WriteTo(data, addr)
+}
+
+func TestResolverSysName(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveSysName(t, conn, "core-rtr-1")
+
+	settings := defaultResolverSettings()
+	settings.SysName = true
+	settings.SnmpPort = conn.LocalAddr().(*net.UDPAddr).Port
+	r, lookups := makeTestResolver(t, settings, map[string]string{"127.0.0.1": "localhost"})
+
+	if name := r.Lookup("127.0.0.1"); name != "core-rtr-1" {
+		t.Errorf("Expected the sysName, found %q", name)
+	}
+	if *lookups != 0 {
+		t.Errorf("Reverse DNS was used with a sysName")
+	}
+}
+
+func TestResolverSettings(t *testing.T) {
+	invalid := []func(*ResolverSettings){
+		func(s *ResolverSettings) { s.Address = "hostname" },
+		func(s *ResolverSettings) { s.SnmpVersion = "3" },
+		func(s *ResolverSettings) { s.CacheSize = -1 },
+		func(s *ResolverSettings) { s.Timeout = -1 },
+	}
+	for _, change := range invalid {
+		settings := defaultResolverSettings()
+		change(&settings)
+		if _, err := NewDeviceResolver(settings); err == nil {
+			t.Errorf("Invalid settings were accepted: %+v", settings)
+		}
+	}
+
+	// The settings left out of the configuration get their defaults
+	r, err := NewDeviceResolver(ResolverSettings{ReverseDNS: true})
+	if err != nil {
+		t.Fatalf("Unable to make resolver with the default settings: %s", err)
+	}
+	expected := defaultResolverSettings()
+	expected.CacheSize = 10000
+	*expected.Async = true
+	if !reflect.DeepEqual(r.settings, expected) {
+		t.Errorf("Unexpected default settings: %+v", r.settings)
+	}
+
+	// negative_ttl defaults to 300, but can be 0, and async can be turned off
+	var settings ResolverSettings
+	if err = json.Unmarshal([]byte(`{"reverse_dns": true, "negative_ttl": 0, "async": false}`), &settings); err != nil {
+		t.Fatalf("Unable to decode settings: %s", err)
+	}
+	settings.setDefaults()
+	if *settings.NegativeTTL != 0 || *settings.Async {
+		t.Errorf("negative_ttl of 0 and async off were not kept: %d %v", *settings.NegativeTTL, *settings.Async)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Output templates are Go text/template templates that are run against a
+// TemplateData for each trap.  Actions take them from a 'template' argument
+// or from the file named by a 'template_file' argument, eg:
+//
+//   template: '{{ .Time | formatTime "2006-01-02T15:04:05Z07:00" }} {{ .SrcIP }} {{ .TrapName }}{{ range .Varbinds }} {{ .Name }}={{ .Display }}{{ end }}'
+//
+
+// TemplateData is what output templates see for each trap
+//
+type TemplateData struct {
+	Trap *Trap
+
+	TrapNumber   uint
+	Time         time.Time
+	Version      string
+	SrcIP        string
+	SrcPort      int
+	Listener     string
+	Community    string
+	SecurityName string
+	Hostname     string
+	DeviceName   string
+	AgentAddress string
+	Enterprise   string
+	GenericType  int
+	SpecificType int
+	Uptime       uint
+	TrapOID      string
+	TrapName     string
+	Varbinds     []TemplateVarbind
+	Metadata     map[string]string
+}
+
+// TemplateVarbind is a varbind as seen by output templates.  Name and
+// Display fall back to the numeric OID and the raw value when there is no
+// MIB for the varbind.
+//
+type TemplateVarbind struct {
+	Oid     string
+	Name    string
+	Type    string
+	Value   string
+	Display string
+}
+
+// NewTemplateData collects the trap fields used by output templates
+//
+func NewTemplateData(trap *Trap) TemplateData {
+	data := TemplateData{
+		Trap:         trap,
+		TrapNumber:   trap.TrapNumber,
+		Time:         trap.Time(),
+		Version:      trap.SnmpVersion.String(),
+		SrcIP:        trap.SrcIP.String(),
+		SrcPort:      trap.SrcPort,
+		Listener:     trap.Listener,
+		Community:    trap.Community,
+		SecurityName: trap.SecurityName,
+		Hostname:     trap.Hostname,
+		DeviceName:   trap.DeviceName,
+		AgentAddress: trap.Data.AgentAddress,
+		Enterprise:   strings.Trim(trap.Data.Enterprise, "."),
+		GenericType:  trap.Data.GenericTrap,
+		SpecificType: trap.Data.SpecificTrap,
+		Uptime:       trap.Data.Timestamp,
+		TrapOID:      trap.TrapOID(),
+		TrapName:     trap.TrapName(),
+		Metadata:     trap.Metadata,
+	}
+	for _, v := range trap.Data.Variables {
+		data.Varbinds = append(data.Varbinds, TemplateVarbind{
+			Oid:     strings.Trim(v.Name, "."),
+			Name:    VarbindName(v),
+			Type:    v.Type.String(),
+			Value:   VarbindString(v),
+			Display: VarbindDisplay(v),
+		})
+	}
+	return data
+}
+
+// Varbind returns the value of the first varbind whose OID starts with the
+// given prefix, so that table columns can be matched without the index.
+// The prefix may also be a MIB name, eg IF-MIB::ifOperStatus
+//
+func (d TemplateData) Varbind(prefix string) string {
+	if vb, ok := d.findVarbind(prefix); ok {
+		return vb.Value
+	}
+	return ""
+}
+
+// VarbindDisplay is like Varbind, but returns the value as described by
+// the MIB (eg "down(2)" rather than "2")
+//
+func (d TemplateData) VarbindDisplay(prefix string) string {
+	if vb, ok := d.findVarbind(prefix); ok {
+		return vb.Display
+	}
+	return ""
+}
+
+func (d TemplateData) findVarbind(prefix string) (TemplateVarbind, bool) {
+	if oid, ok := Mibs().Lookup(prefix); ok {
+		prefix = oid
+	}
+	prefix = strings.Trim(prefix, ".")
+	for _, vb := range d.Varbinds {
+		if vb.Oid == prefix || strings.HasPrefix(vb.Oid, prefix+".") {
+			return vb, true
+		}
+	}
+	return TemplateVarbind{}, false
+}
+
+// TemplateFuncs are the helper functions available to output templates
+//
+var TemplateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"quote":   strconv.Quote,
+	"hex":     templateHex,
+	"oidName": templateOidName,
+	"oidNum":  templateOidNum,
+	"json":    templateJSON,
+	// Pipeline friendly, eg {{ .Time | formatTime "15:04:05" }}
+	"formatTime": func(layout string, t time.Time) string { return t.Format(layout) },
+	"unixTime":   func(t time.Time) int64 { return t.Unix() },
+	"utc":        func(t time.Time) time.Time { return t.UTC() },
+}
+
+// templateHex shows a string or byte slice in hex
+//
+func templateHex(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return hex.EncodeToString(v)
+	case string:
+		return hex.EncodeToString([]byte(v))
+	}
+	return fmt.Sprintf("%x", value)
+}
+
+// templateOidName translates an OID to its MIB name, leaving it unchanged
+// if it isn't known
+//
+func templateOidName(oid string) string {
+	if name := Mibs().Translate(oid); name != "" {
+		return name
+	}
+	return oid
+}
+
+// templateOidNum translates a MIB name to the numeric OID, leaving it
+// unchanged if it isn't known
+//
+func templateOidNum(name string) string {
+	if oid, ok := Mibs().Lookup(name); ok {
+		return oid
+	}
+	return name
+}
+
+// templateJSON encodes a value as JSON.  Traps use the canonical form.
+//
+func templateJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// ParseTemplate compiles the text of an output template
+//
+func ParseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(TemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// GetTemplateArg compiles the 'template' or 'template_file' argument of an
+// action, returning nil if neither was given.
+//
+func GetTemplateArg(actionArgs map[string]string, pluginName string) (*template.Template, error) {
+	text, hasText := actionArgs["template"]
+	filename, hasFile := actionArgs["template_file"]
+	switch {
+	case hasText && hasFile:
+		return nil, fmt.Errorf("Only one of the template and template_file arguments can be given to the %s plugin", pluginName)
+	case hasFile:
+		data, err := ioutil.ReadFile(filepath.Clean(filename))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read template file for %s plugin: %s", pluginName, err)
+		}
+		text = string(data)
+	case !hasText:
+		return nil, nil
+	}
+
+	tmpl, err := ParseTemplate(pluginName, text)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template for %s plugin: %s", pluginName, err)
+	}
+	return tmpl, nil
+}
+
+// GetIntArg converts an optional numeric argument of an action, returning
+// defValue if the argument was not specified.
+//
+func GetIntArg(actionArgs map[string]string, key string, defValue int, pluginName string) (int, error) {
+	value, ok := actionArgs[key]
+	if !ok || value == "" {
+		return defValue, nil
+	}
+	converted, err := strconv.Atoi(value)
+	if err != nil || converted < 0 {
+		return 0, fmt.Errorf("Invalid value for %s argument to %s plugin: %s", key, pluginName, value)
+	}
+	return converted, nil
+}
+
+// ExecuteTemplate runs an output template for the trap
+//
+func ExecuteTemplate(tmpl *template.Template, trap *Trap) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, NewTemplateData(trap)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
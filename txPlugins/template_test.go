@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func makeTemplateTrap() *Trap {
+	trap := &Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version2c,
+		ReceivedAt: time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)}
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: SnmpTrapOID, Type: g.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: g.Integer, Value: 2},
+		{Name: ".1.3.6.1.2.1.2.2.1.6.3", Type: g.OctetString, Value: []byte{0, 0x1b, 0x21}},
+	}
+	return trap
+}
+
+func expandTestTemplate(t *testing.T, text string, trap *Trap) string {
+	tmpl, err := GetTemplateArg(map[string]string{"template": text}, "test")
+	if err != nil {
+		t.Fatalf("Unable to parse template %s: %s", text, err)
+	}
+	result, err := ExecuteTemplate(tmpl, trap)
+	if err != nil {
+		t.Fatalf("Unable to run template %s: %s", text, err)
+	}
+	return result
+}
+
+func TestTemplateFields(t *testing.T) {
+	trap := makeTemplateTrap()
+	tests := map[string]string{
+		`{{ .SrcIP }} {{ .Version }} {{ .TrapOID }}`:                          "192.0.2.1 2c 1.3.6.1.6.3.1.1.5.3",
+		`{{ .Time | formatTime "2006-01-02 15:04:05" }} {{ unixTime .Time }}`: "2022-03-04 05:06:07 1646370367",
+		`{{ .Varbind "1.3.6.1.2.1.2.2.1.8" }}`:                                "2",
+		`{{ range .Varbinds }}{{ .Type }} {{ end }}`:                          "ObjectIdentifier Integer OctetString ",
+		`{{ .Varbind "1.3.6.1.2.1.2.2.1.6" | hex }}`:                          "303031623231",
+		`{{ (index .Varbinds 2).Value | upper }}`:                             "001B21",
+		`{{ .Trap.SrcIP }}`:                                                   "192.0.2.1",
+	}
+	for text, expected := range tests {
+		if result := expandTestTemplate(t, text, trap); result != expected {
+			t.Errorf("Template %s gave %q, expected %q", text, result, expected)
+		}
+	}
+}
+
+func TestTemplateMibHelpers(t *testing.T) {
+	SetMibDatabase(loadTestMibs(t))
+	defer SetMibDatabase(nil)
+
+	trap := makeTemplateTrap()
+	tests := map[string]string{
+		`{{ .TrapName }}`: "IF-MIB::linkDown",
+		`{{ .VarbindDisplay "IF-MIB::ifOperStatus" }} {{ .Varbind "ifOperStatus" }}`: "down(2) 2",
+		`{{ range .Varbinds }}{{ .Name }}={{ .Display }};{{ end }}`:                  "SNMPv2-MIB::snmpTrapOID.0=IF-MIB::linkDown;IF-MIB::ifOperStatus.3=down(2);IF-MIB::ifPhysAddress.3=00:1b:21;",
+		`{{ oidName "1.3.6.1.2.1.2.2.1.8.1" }} {{ oidNum "IF-MIB::linkUp" }}`:        "IF-MIB::ifOperStatus.1 1.3.6.1.6.3.1.1.5.4",
+	}
+	for text, expected := range tests {
+		if result := expandTestTemplate(t, text, trap); result != expected {
+			t.Errorf("Template %s gave %q, expected %q", text, result, expected)
+		}
+	}
+}
+
+func TestTemplateArgs(t *testing.T) {
+	tmpl, err := GetTemplateArg(map[string]string{}, "test")
+	if tmpl != nil || err != nil {
+		t.Errorf("No template arguments should give no template")
+	}
+	if _, err = GetTemplateArg(map[string]string{"template": "{{ .SrcIP "}, "test"); err == nil {
+		t.Errorf("Invalid template was accepted")
+	}
+
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "trap.tmpl")
+	if err = ioutil.WriteFile(filename, []byte("{{ .SrcIP }}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if tmpl, err = GetTemplateArg(map[string]string{"template_file": filename}, "test"); err != nil {
+		t.Fatalf("Unable to load template file: %s", err)
+	}
+	if result, _ := ExecuteTemplate(tmpl, makeTemplateTrap()); result != "192.0.2.1\n" {
+		t.Errorf("Unexpected template file output: %q", result)
+	}
+	if _, err = GetTemplateArg(map[string]string{"template": "x", "template_file": filename}, "test"); err == nil {
+		t.Errorf("Both template and template_file were accepted")
+	}
+}
+
+func TestIntArgs(t *testing.T) {
+	args := map[string]string{"timeout": "10", "empty": "", "bad": "x", "negative": "-1"}
+	if value, err := GetIntArg(args, "timeout", 30, "test"); value != 10 || err != nil {
+		t.Errorf("Expected 10, got %d (%v)", value, err)
+	}
+	for _, key := range []string{"missing", "empty"} {
+		if value, err := GetIntArg(args, key, 30, "test"); value != 30 || err != nil {
+			t.Errorf("Expected the default for %s, got %d (%v)", key, value, err)
+		}
+	}
+	for _, key := range []string{"bad", "negative"} {
+		if _, err := GetIntArg(args, key, 30, "test"); err == nil {
+			t.Errorf("Invalid %s argument was accepted", key)
+		}
+	}
+}
@@ -13,13 +13,15 @@ import (
 	g "github.com/gosnmp/gosnmp"
 )
 
-// OID constants we will need for v2c to v1 conversion.
+// OIDs from SNMPv2-MIB and SNMP-COMMUNITY-MIB (RFC 3584), used to convert
+// between trap versions and by actions that rewrite traps
+//
 const (
-	snmpTraps          = ".1.3.6.1.6.3.1.1.5"
-	snmpTrapOID        = ".1.3.6.1.6.3.1.1.4.1.0"
-	snmpTrapEnterprise = ".1.3.6.1.6.3.1.1.4.3.0"
-	snmpTrapAddress    = ".1.3.6.1.6.3.18.1.3.0"
-	sysUpTime          = ".1.3.6.1.2.1.1.3.0"
+	SnmpTraps          = ".1.3.6.1.6.3.1.1.5"
+	SnmpTrapOID        = ".1.3.6.1.6.3.1.1.4.1.0"
+	SnmpTrapEnterprise = ".1.3.6.1.6.3.1.1.4.3.0"
+	SnmpTrapAddress    = ".1.3.6.1.6.3.18.1.3.0"
+	SysUpTime          = ".1.3.6.1.2.1.1.3.0"
 )
 
 // translateToV1 converts a trap from v2c/v3 to v1 per RFC-3584
@@ -40,11 +42,11 @@ func TranslateToV1(t *Trap) error {
 	// We expect varbind 0 to be sysUptime (type: TimeTicks). If it isn't,
 	// something is wrong and we bail.
 	//
-	if vb0.Name != sysUpTime || (vb0.Type != g.TimeTicks && vb0.Type != g.Integer) {
+	if vb0.Name != SysUpTime || (vb0.Type != g.TimeTicks && vb0.Type != g.Integer) {
 		return fmt.Errorf("Invalid sysUptime (varbind0) for v2c trap: %v", vb0)
 	}
 	// We also expect varbind 1 to the snmpTrapOID.
-	if vb1.Name != snmpTrapOID || vb1.Type != g.ObjectIdentifier {
+	if vb1.Name != SnmpTrapOID || vb1.Type != g.ObjectIdentifier {
 		return fmt.Errorf("Invalid snmpTrapOID (varbind1) for v2c trap: %v", vb0)
 	}
 
@@ -65,7 +67,7 @@ func TranslateToV1(t *Trap) error {
 
 	// Let's see if we are dealing with a standard trap
 	var isStd bool
-	if strings.HasPrefix(trapOID, snmpTraps) {
+	if strings.HasPrefix(trapOID, SnmpTraps) {
 		isStd = true
 		// Remove any trailing .0 from the trapOID value
 		if strings.HasSuffix(trapOID, ".0") {
@@ -120,10 +122,10 @@ func TranslateToV1(t *Trap) error {
 		}
 		// If this is a standard trap and the snmpTrapEnterprise OID, set
 		// the v1 Enterprise value accordingly
-		if isStd && v.Name == snmpTrapEnterprise {
+		if isStd && v.Name == SnmpTrapEnterprise {
 			enterprise = v.Value.(string)
 			// Or if we have an snmpTrapAddress OID set agentAddress to its value
-		} else if v.Name == snmpTrapAddress {
+		} else if v.Name == SnmpTrapAddress {
 			agentAddress = v.Value.(string)
 		}
 	}
@@ -133,7 +135,7 @@ func TranslateToV1(t *Trap) error {
 	if len(enterprise) > 0 {
 		trap.Enterprise = enterprise
 	} else if isStd {
-		trap.Enterprise = snmpTraps
+		trap.Enterprise = SnmpTraps
 	} else {
 		trap.Enterprise = trapOID[:dmarc]
 	}
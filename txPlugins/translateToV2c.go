@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"strings"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// TranslateToV2c converts a v1 trap to the v2c notification format per
+// RFC-3584 section 3.1: sysUpTime.0 and snmpTrapOID.0 are prepended, and
+// snmpTrapAddress.0 and snmpTrapEnterprise.0 are appended to the varbinds.
+//
+func TranslateToV2c(t *Trap) error {
+	// Only v1 traps need to be translated
+	if t.SnmpVersion != g.Version1 {
+		return nil
+	}
+
+	trap := &t.Data
+	variables := []g.SnmpPDU{
+		{Name: SysUpTime, Type: g.TimeTicks, Value: uint32(trap.Timestamp)},
+		{Name: SnmpTrapOID, Type: g.ObjectIdentifier, Value: "." + t.TrapOID()},
+	}
+	variables = append(variables, trap.Variables...)
+
+	agentAddress := trap.AgentAddress
+	if agentAddress == "" || agentAddress == "0.0.0.0" {
+		agentAddress = t.SrcIP.String()
+	}
+	if !hasVarbind(variables, SnmpTrapAddress) {
+		variables = append(variables, g.SnmpPDU{Name: SnmpTrapAddress, Type: g.IPAddress, Value: agentAddress})
+	}
+	if !hasVarbind(variables, SnmpTrapEnterprise) && trap.Enterprise != "" {
+		variables = append(variables, g.SnmpPDU{Name: SnmpTrapEnterprise, Type: g.ObjectIdentifier, Value: "." + strings.Trim(trap.Enterprise, ".")})
+	}
+
+	trap.Variables = variables
+	t.SnmpVersion = g.Version2c
+	t.Translated = true
+	return nil
+}
+
+// AddTrapAddress appends the snmpTrapAddress.0 varbind with the source IP of
+// the trap, so that receivers of a forwarded v2c/v3 trap can still identify
+// the originating agent.  Nothing is added if the varbind is already present.
+//
+func AddTrapAddress(t *Trap) {
+	if t.SrcIP == nil || hasVarbind(t.Data.Variables, SnmpTrapAddress) {
+		return
+	}
+	t.Data.Variables = append(t.Data.Variables, g.SnmpPDU{Name: SnmpTrapAddress, Type: g.IPAddress, Value: t.SrcIP.String()})
+}
+
+func hasVarbind(variables []g.SnmpPDU, oid string) bool {
+	for _, v := range variables {
+		if v.Name == oid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"net"
+	"testing"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func makeV1Trap() Trap {
+	trap := Trap{SrcIP: net.ParseIP("192.0.2.1"), SnmpVersion: g.Version1}
+	trap.Data.Enterprise = ".1.3.6.1.4.1.9"
+	trap.Data.AgentAddress = "10.1.1.1"
+	trap.Data.GenericTrap = 6
+	trap.Data.SpecificTrap = 17
+	trap.Data.Timestamp = 1234
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: 3},
+	}
+	return trap
+}
+
+func TestTranslateToV2c(t *testing.T) {
+	original := makeV1Trap()
+	trap := original.Copy()
+	if err := TranslateToV2c(&trap); err != nil {
+		t.Fatalf("Unable to translate trap: %s", err)
+	}
+
+	vbs := trap.Data.Variables
+	if len(vbs) != 5 {
+		t.Fatalf("Expected 5 varbinds after translation, got %d: %v", len(vbs), vbs)
+	}
+	if vbs[0].Name != SysUpTime || vbs[0].Value != uint32(1234) {
+		t.Errorf("Invalid sysUpTime varbind: %v", vbs[0])
+	}
+	if vbs[1].Name != SnmpTrapOID || vbs[1].Value != ".1.3.6.1.4.1.9.0.17" {
+		t.Errorf("Invalid snmpTrapOID varbind: %v", vbs[1])
+	}
+	if vbs[3].Name != SnmpTrapAddress || vbs[3].Value != "10.1.1.1" {
+		t.Errorf("Invalid snmpTrapAddress varbind: %v", vbs[3])
+	}
+	if trap.SnmpVersion != g.Version2c || trap.TrapOID() != "1.3.6.1.4.1.9.0.17" {
+		t.Errorf("Translated trap has version %v and OID %s", trap.SnmpVersion, trap.TrapOID())
+	}
+	if len(original.Data.Variables) != 1 || original.SnmpVersion != g.Version1 {
+		t.Errorf("Translation of a copy modified the original trap")
+	}
+
+	// And back again
+	if err := TranslateToV1(&trap); err != nil {
+		t.Fatalf("Unable to translate trap back to v1: %s", err)
+	}
+	if trap.Data.SpecificTrap != 17 || trap.Data.Enterprise != ".1.3.6.1.4.1.9" || trap.Data.AgentAddress != "10.1.1.1" {
+		t.Errorf("Round trip translation lost data: %+v", trap.Data)
+	}
+}
+
+func TestGenericTrapOID(t *testing.T) {
+	trap := makeV1Trap()
+	trap.Data.GenericTrap = 2
+	if trap.TrapOID() != "1.3.6.1.6.3.1.1.5.3" {
+		t.Errorf("Invalid OID for linkDown: %s", trap.TrapOID())
+	}
+	AddTrapAddress(&trap)
+	AddTrapAddress(&trap)
+	if len(trap.Data.Variables) != 2 || trap.Data.Variables[1].Value != "192.0.2.1" {
+		t.Errorf("snmpTrapAddress not added exactly once: %v", trap.Data.Variables)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+// trapJSON is the canonical JSON form of a trap.  Varbinds keep their order,
+// SNMP type and a typed value, so that a trap can be decoded back into the
+// same pluginMeta.Trap.
+//
+type trapJSON struct {
+	TrapNumber   uint              `json:"trap_number"`
+	SnmpVersion  string            `json:"snmp_version"`
+	ReceivedAt   *time.Time        `json:"received_at,omitempty"`
+	Listener     string            `json:"listener,omitempty"`
+	SrcIP        string            `json:"source_ip"`
+	SrcPort      int               `json:"source_port,omitempty"`
+	Community    string            `json:"community,omitempty"`
+	SecurityName string            `json:"security_name,omitempty"`
+	Hostname     string            `json:"hostname,omitempty"`
+	DeviceName   string            `json:"device_name,omitempty"`
+	AgentAddress string            `json:"agent_address,omitempty"`
+	Enterprise   string            `json:"enterprise,omitempty"`
+	GenericType  int               `json:"generic_type"`
+	SpecificType int               `json:"specific_type"`
+	Uptime       uint              `json:"uptime"`
+	TrapOID      string            `json:"trap_oid"`
+	TrapName     string            `json:"trap_name,omitempty"`
+	Inform       bool              `json:"inform,omitempty"`
+	Translated   bool              `json:"translated,omitempty"`
+	Varbinds     []varbindJSON     `json:"varbinds"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Raw          []byte            `json:"raw,omitempty"` // Only in captures
+}
+
+// varbindJSON holds one varbind.  Octet strings that aren't printable text
+// are given in hex, with Encoding set to "hex".  When MIBs are loaded the
+// symbolic name and displayed value are included, but only as output.
+//
+type varbindJSON struct {
+	Oid      string          `json:"oid"`
+	Name     string          `json:"name,omitempty"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value"`
+	Encoding string          `json:"encoding,omitempty"`
+	Display  string          `json:"display,omitempty"`
+}
+
+// The SNMP types that can appear in a varbind, by name
+var varbindTypes = map[string]g.Asn1BER{}
+
+func init() {
+	for _, t := range []g.Asn1BER{g.Boolean, g.Integer, g.BitString, g.OctetString, g.Null,
+		g.ObjectIdentifier, g.ObjectDescription, g.IPAddress, g.Counter32, g.Gauge32, g.TimeTicks,
+		g.Opaque, g.NsapAddress, g.Counter64, g.Uinteger32, g.OpaqueFloat, g.OpaqueDouble,
+		g.NoSuchObject, g.NoSuchInstance, g.EndOfMibView} {
+		varbindTypes[t.String()] = t
+	}
+}
+
+// MarshalJSON encodes the trap in the canonical JSON form.  The packet as
+// received is left out; use MarshalCaptureJSON to keep it.
+//
+func (trap Trap) MarshalJSON() ([]byte, error) {
+	return trap.encodeJSON(false)
+}
+
+// MarshalCaptureJSON encodes the trap in the canonical JSON form along with
+// the packet as received, so that a capture can be replayed byte for byte
+//
+func (trap Trap) MarshalCaptureJSON() ([]byte, error) {
+	return trap.encodeJSON(true)
+}
+
+func (trap Trap) encodeJSON(withRaw bool) ([]byte, error) {
+	doc := trapJSON{
+		TrapNumber:   trap.TrapNumber,
+		SnmpVersion:  trap.SnmpVersion.String(),
+		Listener:     trap.Listener,
+		SrcPort:      trap.SrcPort,
+		Community:    trap.Community,
+		SecurityName: trap.SecurityName,
+		Hostname:     trap.Hostname,
+		DeviceName:   trap.DeviceName,
+		AgentAddress: trap.Data.AgentAddress,
+		Enterprise:   strings.TrimPrefix(trap.Data.Enterprise, "."),
+		GenericType:  trap.Data.GenericTrap,
+		SpecificType: trap.Data.SpecificTrap,
+		Uptime:       trap.Data.Timestamp,
+		TrapOID:      trap.TrapOID(),
+		TrapName:     trap.TrapName(),
+		Inform:       trap.Data.IsInform,
+		Translated:   trap.Translated,
+		Varbinds:     make([]varbindJSON, 0, len(trap.Data.Variables)),
+		Metadata:     trap.Metadata,
+	}
+	if withRaw {
+		doc.Raw = trap.Raw
+	}
+	if trap.SrcIP != nil {
+		doc.SrcIP = trap.SrcIP.String()
+	}
+	if !trap.ReceivedAt.IsZero() {
+		doc.ReceivedAt = &trap.ReceivedAt
+	}
+	for _, v := range trap.Data.Variables {
+		vb, err := encodeVarbind(v)
+		if err != nil {
+			return nil, err
+		}
+		doc.Varbinds = append(doc.Varbinds, vb)
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a trap from the canonical JSON form
+//
+func (trap *Trap) UnmarshalJSON(data []byte) error {
+	var doc trapJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	var decoded Trap
+	switch doc.SnmpVersion {
+	case "1":
+		decoded.SnmpVersion = g.Version1
+	case "2c":
+		decoded.SnmpVersion = g.Version2c
+	case "3":
+		decoded.SnmpVersion = g.Version3
+	default:
+		return fmt.Errorf("Unknown SNMP version in trap: %s", doc.SnmpVersion)
+	}
+	decoded.TrapNumber = doc.TrapNumber
+	if doc.ReceivedAt != nil {
+		decoded.ReceivedAt = *doc.ReceivedAt
+	}
+	decoded.Listener = doc.Listener
+	if doc.SrcIP != "" {
+		if decoded.SrcIP = net.ParseIP(doc.SrcIP); decoded.SrcIP == nil {
+			return fmt.Errorf("Invalid source IP in trap: %s", doc.SrcIP)
+		}
+	}
+	decoded.SrcPort = doc.SrcPort
+	decoded.Community = doc.Community
+	decoded.SecurityName = doc.SecurityName
+	decoded.Hostname = doc.Hostname
+	decoded.DeviceName = doc.DeviceName
+	decoded.Translated = doc.Translated
+	decoded.Raw = doc.Raw
+	decoded.Metadata = doc.Metadata
+
+	decoded.Data.AgentAddress = doc.AgentAddress
+	if doc.Enterprise != "" {
+		decoded.Data.Enterprise = "." + doc.Enterprise
+	}
+	decoded.Data.GenericTrap = doc.GenericType
+	decoded.Data.SpecificTrap = doc.SpecificType
+	decoded.Data.Timestamp = doc.Uptime
+	decoded.Data.IsInform = doc.Inform
+	for _, vb := range doc.Varbinds {
+		v, err := decodeVarbind(vb)
+		if err != nil {
+			return err
+		}
+		decoded.Data.Variables = append(decoded.Data.Variables, v)
+	}
+
+	*trap = decoded
+	return nil
+}
+
+// isPrintable reports whether an octet string can be shown as text
+//
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeVarbind(v g.SnmpPDU) (varbindJSON, error) {
+	vb := varbindJSON{Oid: strings.TrimPrefix(v.Name, "."), Type: v.Type.String()}
+	vb.Name = Mibs().Translate(v.Name)
+	vb.Display, _ = Mibs().FormatValue(v)
+	var value interface{}
+
+	switch v.Type {
+	case g.OctetString, g.Opaque, g.BitString, g.NsapAddress, g.ObjectDescription:
+		var octets []byte
+		switch val := v.Value.(type) {
+		case []byte:
+			octets = val
+		case string:
+			octets = []byte(val)
+		}
+		if isPrintable(octets) {
+			value = string(octets)
+		} else {
+			value = hex.EncodeToString(octets)
+			vb.Encoding = "hex"
+		}
+	case g.ObjectIdentifier:
+		value = strings.TrimPrefix(fmt.Sprintf("%v", v.Value), ".")
+	case g.IPAddress:
+		value = fmt.Sprintf("%v", v.Value)
+	case g.Integer, g.Counter32, g.Gauge32, g.TimeTicks, g.Counter64, g.Uinteger32:
+		// json.Number keeps all of the digits of a Counter64
+		value = json.Number(g.ToBigInt(v.Value).String())
+	case g.OpaqueFloat, g.OpaqueDouble, g.Boolean:
+		value = v.Value
+	default:
+		value = nil
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return vb, fmt.Errorf("Unable to encode varbind %s: %s", v.Name, err)
+	}
+	vb.Value = raw
+	return vb, nil
+}
+
+// decodeVarbind restores a varbind with the same Go value types that gosnmp
+// uses when it decodes a packet.
+//
+func decodeVarbind(vb varbindJSON) (g.SnmpPDU, error) {
+	t, ok := varbindTypes[vb.Type]
+	if !ok {
+		return g.SnmpPDU{}, fmt.Errorf("Unknown SNMP type for varbind %s: %s", vb.Oid, vb.Type)
+	}
+	v := g.SnmpPDU{Name: "." + vb.Oid, Type: t}
+	invalid := func(err error) (g.SnmpPDU, error) {
+		return v, fmt.Errorf("Invalid %s value for varbind %s: %s", vb.Type, vb.Oid, err)
+	}
+
+	switch t {
+	case g.OctetString, g.Opaque, g.BitString, g.NsapAddress, g.ObjectDescription:
+		var text string
+		if err := json.Unmarshal(vb.Value, &text); err != nil {
+			return invalid(err)
+		}
+		if vb.Encoding == "hex" {
+			octets, err := hex.DecodeString(text)
+			if err != nil {
+				return invalid(err)
+			}
+			v.Value = octets
+		} else {
+			v.Value = []byte(text)
+		}
+	case g.ObjectIdentifier, g.IPAddress:
+		var text string
+		if err := json.Unmarshal(vb.Value, &text); err != nil {
+			return invalid(err)
+		}
+		if t == g.ObjectIdentifier && text != "" {
+			text = "." + text
+		}
+		v.Value = text
+	case g.Integer:
+		n, err := strconv.ParseInt(string(vb.Value), 10, 64)
+		if err != nil {
+			return invalid(err)
+		}
+		v.Value = int(n)
+	case g.Counter32, g.Gauge32:
+		n, err := strconv.ParseUint(string(vb.Value), 10, 32)
+		if err != nil {
+			return invalid(err)
+		}
+		v.Value = uint(n)
+	case g.TimeTicks, g.Uinteger32:
+		n, err := strconv.ParseUint(string(vb.Value), 10, 32)
+		if err != nil {
+			return invalid(err)
+		}
+		v.Value = uint32(n)
+	case g.Counter64:
+		n, ok := new(big.Int).SetString(string(vb.Value), 10)
+		if !ok || !n.IsUint64() {
+			return invalid(fmt.Errorf("not a 64 bit counter: %s", vb.Value))
+		}
+		v.Value = n.Uint64()
+	case g.OpaqueFloat:
+		var f float32
+		if err := json.Unmarshal(vb.Value, &f); err != nil {
+			return invalid(err)
+		}
+		v.Value = f
+	case g.OpaqueDouble:
+		var f float64
+		if err := json.Unmarshal(vb.Value, &f); err != nil {
+			return invalid(err)
+		}
+		v.Value = f
+	case g.Boolean:
+		var b bool
+		if err := json.Unmarshal(vb.Value, &b); err != nil {
+			return invalid(err)
+		}
+		v.Value = b
+	}
+	return v, nil
+}
+
+// VarbindType returns the SNMP type with the given name, as in the JSON form
+//
+func VarbindType(name string) (g.Asn1BER, bool) {
+	t, ok := varbindTypes[name]
+	return t, ok
+}
+
+// ParseVarbind makes a varbind from its OID, SNMP type name (as in the JSON
+// form, eg OctetString or Counter32) and the value as text, for actions
+// that add or change varbinds
+//
+func ParseVarbind(oid string, typeName string, text string) (g.SnmpPDU, error) {
+	t, ok := varbindTypes[typeName]
+	if !ok {
+		return g.SnmpPDU{}, fmt.Errorf("Unknown SNMP type for varbind %s: %s", oid, typeName)
+	}
+	vb := varbindJSON{Oid: strings.Trim(oid, "."), Type: typeName, Value: json.RawMessage(strings.TrimSpace(text))}
+	switch t {
+	case g.OctetString, g.Opaque, g.BitString, g.NsapAddress, g.ObjectDescription, g.ObjectIdentifier, g.IPAddress:
+		if t == g.ObjectIdentifier {
+			text = strings.Trim(text, ".")
+		}
+		vb.Value, _ = json.Marshal(text)
+	case g.Null, g.NoSuchObject, g.NoSuchInstance, g.EndOfMibView:
+		return g.SnmpPDU{Name: "." + vb.Oid, Type: t}, nil
+	}
+	if t == g.IPAddress && net.ParseIP(text).To4() == nil {
+		return g.SnmpPDU{}, fmt.Errorf("Invalid IPAddress value for varbind %s: %s", oid, text)
+	}
+	return decodeVarbind(vb)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	trap := makeV1Trap()
+	trap.TrapNumber = 42
+	trap.ReceivedAt = time.Date(2022, 3, 4, 5, 6, 7, 8, time.UTC)
+	trap.SrcPort = 1162
+	trap.Listener = "0.0.0.0:162"
+	trap.Community = "public"
+	trap.Hostname = "trapmux1"
+	trap.DeviceName = "rtr1.example.com"
+	trap.Raw = []byte{0x30, 0x82, 0x00}
+	trap.SetMetadata("site", "lon1")
+	trap.Data.Variables = []g.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: g.Integer, Value: -3},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0 \"uplink\" 100%")},
+		{Name: ".1.3.6.1.2.1.2.2.1.6.3", Type: g.OctetString, Value: []byte{0x00, 0x1b, 0x21, 0xff}},
+		{Name: ".1.3.6.1.2.1.1.2.0", Type: g.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1"},
+		{Name: ".1.3.6.1.2.1.4.20.1.1.3", Type: g.IPAddress, Value: "10.1.1.1"},
+		{Name: ".1.3.6.1.2.1.2.2.1.10.3", Type: g.Counter32, Value: uint(4294967295)},
+		{Name: ".1.3.6.1.2.1.2.2.1.5.3", Type: g.Gauge32, Value: uint(1000000000)},
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: g.TimeTicks, Value: uint32(123456)},
+		{Name: ".1.3.6.1.2.1.31.1.1.1.6.3", Type: g.Counter64, Value: uint64(18446744073709551615)},
+		{Name: ".1.3.6.1.4.1.9.9.1.0", Type: g.OpaqueDouble, Value: float64(2.5)},
+		{Name: ".1.3.6.1.4.1.9.9.2.0", Type: g.Null, Value: nil},
+	}
+
+	data, err := json.Marshal(&trap)
+	if err != nil {
+		t.Fatalf("Unable to encode trap: %s", err)
+	}
+	if !strings.Contains(string(data), `"value":18446744073709551615`) || !strings.Contains(string(data), `"value":"001b21ff","encoding":"hex"`) {
+		t.Errorf("Unexpected varbind encoding: %s", data)
+	}
+
+	var decoded Trap
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unable to decode trap: %s", err)
+	}
+	if !reflect.DeepEqual(decoded.Data.Variables, trap.Data.Variables) {
+		t.Errorf("Varbinds changed in round trip:\n%#v\n%#v", decoded.Data.Variables, trap.Data.Variables)
+	}
+	decoded.Data.Variables, trap.Data.Variables = nil, nil
+	if !decoded.ReceivedAt.Equal(trap.ReceivedAt) {
+		t.Errorf("Receive time changed in round trip: %v", decoded.ReceivedAt)
+	}
+	decoded.ReceivedAt = trap.ReceivedAt
+	if decoded.Raw != nil {
+		t.Errorf("The packet as received was encoded: %s", data)
+	}
+	decoded.Raw = trap.Raw
+	if !reflect.DeepEqual(decoded, trap) {
+		t.Errorf("Trap changed in round trip:\n%+v\n%+v", decoded, trap)
+	}
+}
+
+func TestCaptureJSON(t *testing.T) {
+	trap := makeV1Trap()
+	trap.Raw = []byte{0x30, 0x82, 0x00}
+
+	data, err := trap.MarshalCaptureJSON()
+	if err != nil {
+		t.Fatalf("Unable to encode trap: %s", err)
+	}
+	var decoded Trap
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unable to decode trap: %s", err)
+	}
+	if !reflect.DeepEqual(decoded.Raw, trap.Raw) {
+		t.Errorf("Expected the packet as received in a capture, got %v", decoded.Raw)
+	}
+}
+
+func TestJSONDecodeErrors(t *testing.T) {
+	var trap Trap
+	bad := []string{
+		`{"snmp_version":"4","varbinds":[]}`,
+		`{"snmp_version":"2c","varbinds":[{"oid":"1.3.6","type":"Bogus","value":1}]}`,
+		`{"snmp_version":"2c","varbinds":[{"oid":"1.3.6","type":"Counter32","value":-1}]}`,
+		`{"snmp_version":"2c","varbinds":[{"oid":"1.3.6","type":"OctetString","value":"zz","encoding":"hex"}]}`,
+	}
+	for _, doc := range bad {
+		if err := json.Unmarshal([]byte(doc), &trap); err == nil {
+			t.Errorf("Invalid trap was decoded: %s", doc)
+		}
+	}
+}
+
+func TestParseVarbind(t *testing.T) {
+	tests := []struct {
+		typeName, text string
+		expected       interface{}
+	}{
+		{"OctetString", "eth0 up", []byte("eth0 up")},
+		{"Integer", " -3", -3},
+		{"Counter32", "42", uint(42)},
+		{"TimeTicks", "100", uint32(100)},
+		{"ObjectIdentifier", "1.3.6.1.4.1.9", ".1.3.6.1.4.1.9"},
+		{"IPAddress", "10.1.1.1", "10.1.1.1"},
+	}
+	for _, test := range tests {
+		v, err := ParseVarbind("1.3.6.1.4.1.9.9.1.0", test.typeName, test.text)
+		if err != nil {
+			t.Errorf("Unable to parse %s %q: %s", test.typeName, test.text, err)
+			continue
+		}
+		if v.Name != ".1.3.6.1.4.1.9.9.1.0" || !reflect.DeepEqual(v.Value, test.expected) {
+			t.Errorf("Parsing %s %q gave %#v", test.typeName, test.text, v)
+		}
+	}
+
+	invalid := [][2]string{{"Integer", "three"}, {"IPAddress", "10.1.1"}, {"Bogus", "1"}, {"Counter32", "-1"}}
+	for _, bad := range invalid {
+		if _, err := ParseVarbind("1.3.6.1.4.1.9.9.1.0", bad[0], bad[1]); err == nil {
+			t.Errorf("Invalid %s value was accepted: %s", bad[0], bad[1])
+		}
+	}
+}
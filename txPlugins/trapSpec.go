@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,6 +26,80 @@ type Trap struct {
 	Translated  bool
 	Dropped     bool
 	Hostname    string
+
+	// Raw is the packet as it was received (if known)
+	Raw []byte
+
+	// Receive metadata, captured by the listener
+	ReceivedAt   time.Time
+	Listener     string
+	SrcPort      int
+	Community    string
+	SecurityName string
+
+	// DeviceName is the name of the sending device, from the resolver
+	DeviceName string
+
+	// Metadata added by actions (eg enrich) for the filters and actions
+	// that follow
+	Metadata map[string]string
+}
+
+// SetMetadata adds a metadata value to the trap
+//
+func (trap *Trap) SetMetadata(key string, value string) {
+	if trap.Metadata == nil {
+		trap.Metadata = make(map[string]string)
+	}
+	trap.Metadata[key] = value
+}
+
+// Time returns when the trap was received, or the current time for traps
+// without receive metadata (eg generated traps).
+//
+func (trap *Trap) Time() time.Time {
+	if trap.ReceivedAt.IsZero() {
+		return time.Now()
+	}
+	return trap.ReceivedAt
+}
+
+// MetadataKeys returns the metadata keys in order, for outputs that list
+// the metadata
+//
+func (trap *Trap) MetadataKeys() []string {
+	keys := make([]string, 0, len(trap.Metadata))
+	for key := range trap.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Copy returns a copy of the trap that can be modified (eg translated to
+// another SNMP version) without affecting the original.  Octet string
+// values are copied too, as actions may change them in place.
+//
+func (trap *Trap) Copy() Trap {
+	dup := *trap
+	dup.Data.Variables = make([]g.SnmpPDU, len(trap.Data.Variables))
+	copy(dup.Data.Variables, trap.Data.Variables)
+	for i, v := range dup.Data.Variables {
+		if value, ok := v.Value.([]byte); ok {
+			dup.Data.Variables[i].Value = append([]byte(nil), value...)
+		}
+	}
+	dup.SrcIP = append(net.IP(nil), trap.SrcIP...)
+	if trap.Raw != nil {
+		dup.Raw = append([]byte(nil), trap.Raw...)
+	}
+	if trap.Metadata != nil {
+		dup.Metadata = make(map[string]string, len(trap.Metadata))
+		for key, value := range trap.Metadata {
+			dup.Metadata[key] = value
+		}
+	}
+	return dup
 }
 
 func (trap *Trap) Trap2Map() map[string]string {
@@ -32,7 +107,7 @@ func (trap *Trap) Trap2Map() map[string]string {
 	raw_trap := trap.Data
 
 	// FIXME: should include a check to validate that we work with only SNMP v1 traps?
-	var ts = time.Now().Format(time.RFC3339)
+	var ts = trap.Time().Format(time.RFC3339)
 	trapMap["TrapDate"] = fmt.Sprintf("%v", ts[:10])
 	trapMap["TrapTimestamp"] = fmt.Sprintf("%v %v", ts[:10], ts[11:19])
 
@@ -43,44 +118,68 @@ func (trap *Trap) Trap2Map() map[string]string {
 	trapMap["TrapNumber"] = fmt.Sprintf("%v", 1)
 
 	trapMap["TrapSourceIP"] = fmt.Sprintf("\"%v\"", trap.SrcIP)
+	trapMap["TrapSourcePort"] = fmt.Sprintf("%v", trap.SrcPort)
+	trapMap["TrapListener"] = fmt.Sprintf("\"%v\"", trap.Listener)
+	trapMap["TrapCommunity"] = fmt.Sprintf("\"%v\"", trap.Community)
+	trapMap["TrapSecurityName"] = fmt.Sprintf("\"%v\"", trap.SecurityName)
+	trapMap["TrapDeviceName"] = fmt.Sprintf("\"%v\"", trap.DeviceName)
 	trapMap["TrapAgentAddress"] = fmt.Sprintf("\"%v\"", raw_trap.AgentAddress)
 	trapMap["TrapGenericType"] = fmt.Sprintf("%v", raw_trap.GenericTrap)
-	trapMap["TrapEnterpriseOID"] = fmt.Sprintf("%v", raw_trap.SpecificTrap)
+	trapMap["TrapSpecificType"] = fmt.Sprintf("%v", raw_trap.SpecificTrap)
 	trapMap["TrapEnterpriseOID"] = fmt.Sprintf("\"%v\"", strings.Trim(raw_trap.Enterprise, "."))
+	if name := trap.TrapName(); name != "" {
+		trapMap["TrapName"] = fmt.Sprintf("\"%v\"", name)
+	}
+	for key, value := range trap.Metadata {
+		trapMap["TrapMetadata."+key] = fmt.Sprintf("\"%v\"", value)
+	}
 
 	// For escaping quotes and backslashes and replace newlines with a space
 	replacer := strings.NewReplacer("\"", "\"\"", "'", "''", "\\", "\\\\", "\n", " - ", "%", "%%")
 
 	// Process the Varbinds for this raw_trap.
-	var oidPath, oidValue string
 	for _, v := range raw_trap.Variables {
-		// Get the OID
-		oidPath = strings.Trim(v.Name, ".")
-		// Parse the value
-		switch v.Type {
-		case g.OctetString:
-			var nonASCII bool
-			val := v.Value.([]byte)
-			if len(val) > 0 {
-				for i := 0; i < len(val); i++ {
-					if (val[i] < 32 || val[i] > 127) && val[i] != 9 && val[i] != 10 {
-						nonASCII = true
-						break
-					}
-				}
-			}
-			// Strings with non-printable/non-ascii characters will be dumped
-			// as a hex string. Otherwise, just as a plain string.
-			if nonASCII {
-				oidValue = fmt.Sprintf("%v", replacer.Replace(hex.EncodeToString(val)))
-			} else {
-				oidValue = replacer.Replace(fmt.Sprintf("%v", string(val)))
+		trapMap[strings.Trim(v.Name, ".")] = replacer.Replace(VarbindString(v))
+	}
+
+	return trapMap
+}
+
+// VarbindString returns the printable form of a varbind value.  Strings with
+// non-printable/non-ascii characters will be dumped as a hex string.
+// Otherwise, just as a plain string.
+//
+func VarbindString(v g.SnmpPDU) string {
+	switch v.Type {
+	case g.OctetString:
+		val, _ := v.Value.([]byte)
+		for i := 0; i < len(val); i++ {
+			if (val[i] < 32 || val[i] > 127) && val[i] != 9 && val[i] != 10 {
+				return hex.EncodeToString(val)
 			}
-		default:
-			oidValue = replacer.Replace(fmt.Sprintf("%v", v.Value))
 		}
-		trapMap[oidPath] = oidValue
+		return string(val)
+	default:
+		return fmt.Sprintf("%v", v.Value)
 	}
+}
 
-	return trapMap
+// TrapOID returns the notification OID identifying the trap.  For v2c/v3
+// traps this is the snmpTrapOID.0 varbind; v1 traps are mapped to the
+// equivalent OID as described in RFC 3584 section 3.1.
+//
+func (trap *Trap) TrapOID() string {
+	raw_trap := trap.Data
+	if trap.SnmpVersion != g.Version1 && !trap.Translated {
+		for _, v := range raw_trap.Variables {
+			if v.Name == SnmpTrapOID {
+				oid, _ := v.Value.(string)
+				return strings.Trim(oid, ".")
+			}
+		}
+	}
+	if raw_trap.GenericTrap >= 0 && raw_trap.GenericTrap < 6 {
+		return fmt.Sprintf("%s.%d", strings.Trim(SnmpTraps, "."), raw_trap.GenericTrap+1)
+	}
+	return fmt.Sprintf("%s.0.%d", strings.Trim(raw_trap.Enterprise, "."), raw_trap.SpecificTrap)
 }
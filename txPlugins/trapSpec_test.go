@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Kells Kearney. All rights reserved.
+//
+// Use of this source code is governed by the MIT License that can be found
+// in the LICENSE file.
+//
+package pluginMeta
+
+import (
+	"testing"
+	"time"
+
+	g "github.com/gosnmp/gosnmp"
+)
+
+func TestReceiveMetadata(t *testing.T) {
+	trap := makeV1Trap()
+	received := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	trap.ReceivedAt = received
+	trap.SrcPort = 1162
+	trap.Listener = "0.0.0.0:162"
+	trap.Community = "public"
+	trap.Raw = []byte{0x30, 0x00}
+
+	trapMap := trap.Trap2Map()
+	if trapMap["TrapTimestamp"] != "2022-03-04 05:06:07" || trapMap["TrapDate"] != "2022-03-04" {
+		t.Errorf("Trap2Map did not use the receive time: %s", trapMap["TrapTimestamp"])
+	}
+	if trapMap["TrapSourcePort"] != "1162" || trapMap["TrapCommunity"] != `"public"` {
+		t.Errorf("Trap2Map is missing receive metadata: %v", trapMap)
+	}
+
+	trap.SetMetadata("site", "lon1")
+	if trap.Trap2Map()["TrapMetadata.site"] != `"lon1"` {
+		t.Errorf("Trap2Map is missing the trap metadata")
+	}
+
+	dup := trap.Copy()
+	dup.Raw[0] = 0
+	dup.SetMetadata("site", "nyc1")
+	if trap.Raw[0] != 0x30 || trap.Metadata["site"] != "lon1" || !dup.ReceivedAt.Equal(received) || dup.Listener != trap.Listener {
+		t.Errorf("Copy did not keep the receive metadata separately: %+v", dup)
+	}
+
+	trap.Data.Variables = []g.SnmpPDU{{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: g.OctetString, Value: []byte("eth0")}}
+	dup = trap.Copy()
+	dup.Data.Variables[0].Value.([]byte)[0] = 'x'
+	if string(trap.Data.Variables[0].Value.([]byte)) != "eth0" {
+		t.Errorf("Copy shares octet string values with the original: %s", trap.Data.Variables[0].Value)
+	}
+
+	var generated Trap
+	if time.Since(generated.Time()) > time.Minute {
+		t.Errorf("Traps without a receive time should use the current time")
+	}
+}